@@ -1,20 +1,52 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 
 	"github.com/leihog/discord-bot/internal/bot"
 	"github.com/leihog/discord-bot/internal/config"
+	"github.com/leihog/discord-bot/internal/scaffold"
 	"github.com/leihog/discord-bot/internal/utils"
 )
 
 func main() {
+	initScripts := flag.Bool("init", false, "write an example script into an empty scripts directory and exit")
+	repl := flag.Bool("repl", false, "run the scripts without connecting to Discord, reading messages and Lua from stdin")
+	flag.Parse()
+
 	// Load configuration
 	cfg := config.Load()
+
+	if *initScripts {
+		path, err := scaffold.WriteExampleScript(cfg.ScriptsDir)
+		if err != nil {
+			log.Fatal("Failed to write example script:", err)
+		}
+		if path == "" {
+			log.Printf("%s already contains scripts, nothing written", cfg.ScriptsDir)
+		} else {
+			log.Printf("Wrote %s", path)
+		}
+		return
+	}
+
+	if *repl {
+		log.SetOutput(utils.NewRedactingWriter(os.Stderr, cfg.SecretValues()))
+		if err := runREPL(cfg, os.Stdin, os.Stdout); err != nil {
+			log.Fatal("REPL error:", err)
+		}
+		return
+	}
+
 	if err := cfg.Validate(); err != nil {
 		log.Fatal("Configuration error:", err)
 	}
 
+	// Keep the token and script secrets out of the logs
+	log.SetOutput(utils.NewRedactingWriter(os.Stderr, cfg.SecretValues()))
+
 	// Set up graceful shutdown
 	ctx, cancel := utils.SetupGracefulShutdown()
 	defer cancel()
@@ -30,11 +62,18 @@ func main() {
 		log.Fatal("Failed to start bot:", err)
 	}
 
-	// Wait for shutdown signal
-	<-ctx.Done()
+	// Wait for shutdown signal, or for the Lua engine to fail for good
+	var failure error
+	select {
+	case <-ctx.Done():
+	case failure = <-b.Failed():
+	}
 
 	// Stop the bot gracefully
 	if err := b.Stop(); err != nil {
 		log.Fatal("Failed to stop bot:", err)
 	}
+	if failure != nil {
+		log.Fatal("Bot stopped: ", failure)
+	}
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/leihog/discord-bot/internal/config"
+	"github.com/leihog/discord-bot/internal/database"
+	"github.com/leihog/discord-bot/internal/devshell"
+	luaengine "github.com/leihog/discord-bot/internal/lua"
+	"github.com/leihog/discord-bot/internal/users"
+)
+
+// runREPL runs the engine without a Discord connection and reads lines from
+// in: plain lines are sent as messages from a simulated user, lines starting
+// with / are shell commands. Unlike the dev shell it needs no terminal, so a
+// session can be piped in from a file. Data lives in an in-memory database.
+func runREPL(cfg *config.Config, in io.Reader, out io.Writer) error {
+	db, err := database.New(":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Initialize(); err != nil {
+		return err
+	}
+
+	userStore := users.New(db)
+	sess := &devshell.Session{Output: func(line string) { fmt.Fprintln(out, line) }}
+	engine := luaengine.New(db, sess, userStore)
+	engine.SetConfig(cfg)
+	engine.Initialize()
+	defer engine.Close()
+
+	if err := userStore.Bootstrap(); err != nil {
+		log.Println("Warning: admin bootstrap failed:", err)
+	}
+	result := engine.LoadScripts(cfg.ScriptsDir)
+	fmt.Fprintf(out, "Loaded %d scripts from %s, %d failed. Type /help for help.\n",
+		result.Loaded, cfg.ScriptsDir, len(result.Failed))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+	luaengine.NewWatcher(engine, cfg.ScriptsDir).Start(ctx)
+
+	shell := devshell.New(engine, cfg.ScriptsDir)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, shell.State.Prompt())
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		reply := shell.Handle(scanner.Text())
+		if reply.Text != "" {
+			fmt.Fprintln(out, reply.Text)
+		}
+		if reply.Wait != nil {
+			output, err := reply.Wait()
+			if err != nil {
+				fmt.Fprintln(out, "Error:", err)
+			} else if output != "" {
+				fmt.Fprintln(out, strings.TrimRight(output, "\n"))
+			}
+		}
+		if reply.Quit {
+			return nil
+		}
+		// Wait for the dispatcher to handle the line, so replies are printed
+		// before the next prompt
+		engine.Exec("")
+	}
+}
@@ -5,30 +5,19 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"path/filepath"
 	"strings"
-	"sync"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/leihog/discord-bot/internal/config"
 	"github.com/leihog/discord-bot/internal/database"
+	"github.com/leihog/discord-bot/internal/devshell"
 	luaengine "github.com/leihog/discord-bot/internal/lua"
 	"github.com/leihog/discord-bot/internal/users"
+	"github.com/leihog/discord-bot/internal/utils"
 )
 
-// devSession implements luaengine.MessageSender; it sends bot messages into the TUI.
-type devSession struct {
-	mu sync.Mutex
-	p  *tea.Program
-}
-
-func (d *devSession) ChannelMessageSend(channelID, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
-	d.p.Send(botMsgEvent{channelID: channelID, content: content})
-	return nil, nil
-}
-
 // teaLogWriter redirects log output into the TUI viewport.
 type teaLogWriter struct{ p *tea.Program }
 
@@ -38,30 +27,18 @@ func (w *teaLogWriter) Write(b []byte) (int, error) {
 }
 
 // tea.Msg types
-type botMsgEvent struct{ channelID, content string }
 type logLineEvent struct{ line string }
 type execDoneEvent struct {
 	output string
 	err    error
 }
-type scriptNamesEvent struct{ names []string }
 type engineReadyMsg struct{}
 
-// shellState tracks the simulated user/channel context.
-type shellState struct {
-	author    string
-	authorID  string
-	channelID string
-	dmMode    bool
-}
-
 type model struct {
 	viewport    viewport.Model
 	input       textinput.Model
-	state       shellState
+	shell       *devshell.Shell
 	lines       []string
-	engine      *luaengine.Engine
-	scriptsDir  string
 	cancel      context.CancelFunc
 	ready       bool
 	engineReady bool
@@ -70,21 +47,15 @@ type model struct {
 	initFunc    func() tea.Msg // runs engine bootstrap + load + start
 }
 
-func newModel(engine *luaengine.Engine, scriptsDir string, cancel context.CancelFunc, initFunc func() tea.Msg) model {
+func newModel(shell *devshell.Shell, cancel context.CancelFunc, initFunc func() tea.Msg) model {
 	ti := textinput.New()
 	ti.Focus()
 
 	m := model{
-		input:      ti,
-		engine:     engine,
-		scriptsDir: scriptsDir,
-		cancel:     cancel,
-		initFunc:   initFunc,
-		state: shellState{
-			author:    "dev",
-			authorID:  "dev-user",
-			channelID: "dev-channel",
-		},
+		input:    ti,
+		shell:    shell,
+		cancel:   cancel,
+		initFunc: initFunc,
 	}
 	m.updatePrompt()
 	return m
@@ -131,15 +102,11 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			line := m.input.Value()
 			m.input.SetValue("")
 			if line != "" {
-				m.addLine(fmt.Sprintf("[#%s] %s> %s", m.state.channelID, m.state.author, line))
+				m.addLine(m.input.Prompt + line)
 				if !m.engineReady {
 					m.addLine("Engine is still starting up...")
-				} else if strings.HasPrefix(line, "/") {
-					if cmd := m.handleMeta(line); cmd != nil {
-						cmds = append(cmds, cmd)
-					}
-				} else {
-					m.engine.ProcessMessage(buildMessage(line, &m.state))
+				} else if cmd := m.handle(line); cmd != nil {
+					cmds = append(cmds, cmd)
 				}
 			}
 		case tea.KeyShiftUp:
@@ -152,9 +119,6 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			cmds = append(cmds, inputCmd)
 		}
 
-	case botMsgEvent:
-		m.addLine(fmt.Sprintf("[Bot → #%s]: %s", msg.channelID, msg.content))
-
 	case logLineEvent:
 		m.addLine(msg.line)
 
@@ -169,15 +133,6 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 
-	case scriptNamesEvent:
-		if len(msg.names) == 0 {
-			m.addLine("No scripts loaded.")
-		} else {
-			for _, name := range msg.names {
-				m.addLine("  " + name)
-			}
-		}
-
 	default:
 		var vpCmd, inputCmd tea.Cmd
 		m.viewport, vpCmd = m.viewport.Update(msg)
@@ -195,143 +150,32 @@ func (m *model) addLine(line string) {
 }
 
 func (m *model) updatePrompt() {
-	prefix := ""
-	if m.state.dmMode {
-		prefix = "(DM) "
-	}
-	m.input.Prompt = fmt.Sprintf("%s[#%s] %s> ", prefix, m.state.channelID, m.state.author)
+	m.input.Prompt = m.shell.State.Prompt()
 	if m.width > 0 {
 		m.input.Width = m.width - len(m.input.Prompt)
 	}
 }
 
-func (m *model) handleMeta(line string) tea.Cmd {
-	parts := strings.Fields(line)
-	cmd := parts[0]
-
-	switch cmd {
-	case "/help":
-		m.addLine(`Shell commands:
-  /channel <id>       Set active channel ID
-  /user <name> [id]   Set author name and optional ID
-  /dm                 Toggle DM mode (on_direct_message vs on_channel_message)
-  /scripts            List loaded scripts
-  /reload <name>      Reload a script by name (e.g. jokes.lua)
-  /commands           List registered commands
-  /hooks              List registered hooks
-  /lua <code>         Execute Lua code and print result
-  /quit, /exit        Exit the shell`)
-
-	case "/channel":
-		if len(parts) < 2 {
-			m.addLine("Usage: /channel <id>")
-			return nil
-		}
-		m.state.channelID = parts[1]
-		m.updatePrompt()
-		m.addLine(fmt.Sprintf("Channel set to #%s", m.state.channelID))
-
-	case "/user":
-		if len(parts) < 2 {
-			m.addLine("Usage: /user <name> [id]")
-			return nil
-		}
-		m.state.author = parts[1]
-		if len(parts) >= 3 {
-			m.state.authorID = parts[2]
-		} else {
-			m.state.authorID = parts[1]
-		}
-		m.updatePrompt()
-		m.addLine(fmt.Sprintf("User set to %s (id: %s)", m.state.author, m.state.authorID))
-
-	case "/dm":
-		m.state.dmMode = !m.state.dmMode
-		m.updatePrompt()
-		if m.state.dmMode {
-			m.addLine("DM mode: ON  (messages trigger on_direct_message)")
-		} else {
-			m.addLine("DM mode: OFF (messages trigger on_channel_message)")
-		}
-
-	case "/hooks":
-		hooks := m.engine.GetHookNames()
-		if len(hooks) == 0 {
-			m.addLine("No hooks registered.")
-		} else {
-			for hookName, scripts := range hooks {
-				m.addLine(fmt.Sprintf("  %s: %s", hookName, strings.Join(scripts, ", ")))
-			}
-		}
-
-	case "/reload":
-		if len(parts) < 2 {
-			m.addLine("Usage: /reload <name>")
-			return nil
-		}
-		scriptPath := filepath.Join(m.scriptsDir, parts[1])
-		m.engine.EnqueueScriptEvent(scriptPath, "reload")
-		m.addLine(fmt.Sprintf("Reloading %s...", parts[1]))
-
-	case "/scripts":
-		engine := m.engine
-		return func() tea.Msg {
-			return scriptNamesEvent{names: engine.GetScriptNames()}
-		}
-
-	case "/commands":
-		engine := m.engine
-		return func() tea.Msg {
-			out, err := engine.Exec(`
-local cmds = get_commands()
-local found = false
-for name, cmd in pairs(cmds) do
-    print(name .. " - " .. cmd.description .. " [" .. cmd.script .. "]")
-    found = true
-end
-if not found then print("No commands registered.") end
-`)
-			return execDoneEvent{output: out, err: err}
-		}
-
-	case "/lua":
-		if len(parts) < 2 {
-			m.addLine("Usage: /lua <code>")
-			return nil
-		}
-		code := strings.TrimPrefix(line, "/lua ")
-		engine := m.engine
-		return func() tea.Msg {
-			out, err := engine.Exec(code)
-			return execDoneEvent{output: out, err: err}
+// handle runs a line in the shell. Work that waits for the dispatcher runs as
+// a tea.Cmd, so the TUI keeps showing bot messages and logs meanwhile.
+func (m *model) handle(line string) tea.Cmd {
+	reply := m.shell.Handle(line)
+	m.updatePrompt()
+	if reply.Text != "" {
+		for l := range strings.SplitSeq(reply.Text, "\n") {
+			m.addLine(l)
 		}
-
-	case "/quit", "/exit":
+	}
+	if reply.Quit {
 		m.cancel()
 		return tea.Quit
-
-	default:
-		m.addLine(fmt.Sprintf("Unknown command: %s (type /help for help)", cmd))
 	}
-
-	return nil
-}
-
-func buildMessage(content string, state *shellState) *discordgo.MessageCreate {
-	guildID := "dev-guild"
-	if state.dmMode {
-		guildID = ""
+	if reply.Wait == nil {
+		return nil
 	}
-	return &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Content:   content,
-			ChannelID: state.channelID,
-			GuildID:   guildID,
-			Author: &discordgo.User{
-				Username: state.author,
-				ID:       state.authorID,
-			},
-		},
+	return func() tea.Msg {
+		out, err := reply.Wait()
+		return execDoneEvent{output: out, err: err}
 	}
 }
 
@@ -350,9 +194,16 @@ func main() {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
+	// The dev shell honours the same environment variables as the bot, except
+	// for the paths which come from flags.
+	cfg := config.Load()
+	cfg.ScriptsDir = *scriptsDir
+	cfg.DatabasePath = *dbPath
+
 	userStore := users.New(db)
-	sess := &devSession{}
+	sess := &devshell.Session{}
 	engine := luaengine.New(db, sess, userStore)
+	engine.SetConfig(cfg)
 	engine.Initialize()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -370,11 +221,11 @@ func main() {
 		return engineReadyMsg{}
 	}
 
-	m := newModel(engine, *scriptsDir, cancel, initFunc)
+	m := newModel(devshell.New(engine, *scriptsDir), cancel, initFunc)
 	p := tea.NewProgram(&m, tea.WithAltScreen(), tea.WithMouseCellMotion())
 
-	sess.p = p
-	log.SetOutput(&teaLogWriter{p: p})
+	sess.Output = func(line string) { p.Send(logLineEvent{line: line}) }
+	log.SetOutput(utils.NewRedactingWriter(&teaLogWriter{p: p}, cfg.SecretValues()))
 
 	if _, err := p.Run(); err != nil {
 		log.Fatal("TUI error:", err)
@@ -2,7 +2,9 @@ package bot
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sync/atomic"
 
 	"github.com/bwmarrin/discordgo"
 
@@ -20,6 +22,11 @@ type Bot struct {
 	watcher   *lua.Watcher
 	config    *config.Config
 	userStore *users.Store
+
+	// Flapping connection alerts, see reconnect.go
+	stopping atomic.Bool
+	flaps    *flapDetector
+	failed   chan error
 }
 
 // New creates a new bot instance
@@ -29,6 +36,17 @@ func New(cfg *config.Config) (*Bot, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Recent messages feed the register_command history option and the old
+	// content of on_message_edit and on_message_delete events
+	session.State.MaxMessageCount = cfg.MessageCacheSize
+	// Run as one shard of several; the defaults (0 of 1) are a single shard
+	session.ShardID = cfg.ShardID
+	session.ShardCount = cfg.ShardCount
+
+	log.Println("Effective configuration:")
+	for _, setting := range cfg.Settings() {
+		log.Printf("  %s=%s", setting.Name, setting.Value)
+	}
 
 	// Initialize database
 	db, err := database.New(cfg.DatabasePath)
@@ -44,6 +62,7 @@ func New(cfg *config.Config) (*Bot, error) {
 
 	// Create Lua engine
 	engine := lua.New(db, session, userStore)
+	engine.SetConfig(cfg)
 	engine.Initialize()
 
 	// Create file watcher
@@ -56,17 +75,43 @@ func New(cfg *config.Config) (*Bot, error) {
 		watcher:   watcher,
 		config:    cfg,
 		userStore: userStore,
+		flaps: &flapDetector{
+			window:    cfg.ReconnectAlertWindow,
+			threshold: cfg.ReconnectAlertThreshold,
+		},
+		failed: make(chan error, 1),
 	}, nil
 }
 
 // Start starts the bot
 func (b *Bot) Start(ctx context.Context) error {
 	// Set up Discord intents
-	b.session.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsGuilds | discordgo.IntentsDirectMessages
+	b.session.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsGuilds | discordgo.IntentsDirectMessages |
+		discordgo.IntentsGuildMessageReactions
 
 	// Add message handler
 	b.session.AddHandler(b.onMessageCreate) // todo this should be done after LuaEngine is started
 
+	// Select menu choices
+	b.session.AddHandler(b.onInteractionCreate)
+
+	// Reaction hooks and on_reaction_threshold
+	b.session.AddHandler(b.onMessageReactionAdd)
+	b.session.AddHandler(b.onMessageReactionRemove)
+
+	// Edit and delete hooks
+	b.session.AddHandler(b.onMessageUpdate)
+	b.session.AddHandler(b.onMessageDelete)
+
+	// Count dropped gateway connections to detect flapping
+	b.session.AddHandler(b.onDisconnect)
+	b.session.AddHandler(b.onResumed)
+
+	// Keep the channel name cache in sync
+	b.session.AddHandler(b.onChannelCreate)
+	b.session.AddHandler(b.onChannelUpdate)
+	b.session.AddHandler(b.onChannelDelete)
+
 	// Open Discord connection
 	if err := b.session.Open(); err != nil {
 		return err
@@ -78,21 +123,63 @@ func (b *Bot) Start(ctx context.Context) error {
 	}
 
 	// Load initial scripts
-	b.engine.LoadScripts(b.config.ScriptsDir) // todo: this could be done in Initialize or Start
+	result := b.engine.LoadScripts(b.config.ScriptsDir) // todo: this could be done in Initialize or Start
+	if err := b.reportScripts(result); err != nil {
+		b.session.Close()
+		return err
+	}
 
 	// Start Lua engine dispatcher
 	b.engine.Start(ctx)
+	go b.watchEngine(ctx)
 
 	// Start file watcher
-	b.watcher.Start(ctx)
+	if b.config.WatchScripts {
+		b.watcher.Start(ctx)
+	} else {
+		log.Println("Script watching disabled (WATCH_SCRIPTS=false); scripts will not hot-reload")
+	}
 
 	log.Println("Bot is now running. Press CTRL+C to exit.")
 	return nil
 }
 
+// reportScripts logs how many scripts loaded and which failed, and fails once
+// SCRIPT_FAILURE_LIMIT scripts have failed.
+func (b *Bot) reportScripts(result lua.LoadResult) error {
+	if len(result.Failed) == 0 {
+		log.Printf("Loaded %d scripts", result.Loaded)
+		return nil
+	}
+	log.Printf("WARNING: %d scripts failed to load (%d loaded):", len(result.Failed), result.Loaded)
+	for _, f := range result.Failed {
+		log.Printf("  %s: %v", f.Name, f.Err)
+	}
+	if limit := b.config.ScriptFailureLimit; limit > 0 && len(result.Failed) >= limit {
+		return fmt.Errorf("%d scripts failed to load, SCRIPT_FAILURE_LIMIT is %d", len(result.Failed), limit)
+	}
+	return nil
+}
+
+// watchEngine alerts about and passes on a failure of the Lua engine, such
+// as a stuck event dispatcher: the bot would otherwise stay connected while
+// handling nothing.
+func (b *Bot) watchEngine(ctx context.Context) {
+	select {
+	case err := <-b.engine.Failed():
+		b.alert(fmt.Sprintf("Lua engine failed: %v", err))
+		select {
+		case b.failed <- fmt.Errorf("lua engine failed: %w", err):
+		default:
+		}
+	case <-ctx.Done():
+	}
+}
+
 // Stop gracefully shuts down the bot
 func (b *Bot) Stop() error {
 	log.Println("Received shutdown signal. Gracefully shutting down...")
+	b.stopping.Store(true)
 
 	// Close Lua engine
 	b.engine.Close()
@@ -102,7 +189,7 @@ func (b *Bot) Stop() error {
 		log.Println("Error closing Discord session:", err)
 	}
 
-	// Close database
+	// Close database; this checkpoints the WAL so recent writes are in the main file
 	if err := b.db.Close(); err != nil {
 		log.Println("Error closing database:", err)
 	}
@@ -115,3 +202,42 @@ func (b *Bot) Stop() error {
 func (b *Bot) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 	b.engine.ProcessMessage(m)
 }
+
+// onInteractionCreate handles component interactions such as select menus
+func (b *Bot) onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	b.engine.ProcessInteraction(i)
+}
+
+// onMessageReactionAdd and onMessageReactionRemove pass reactions to the engine
+func (b *Bot) onMessageReactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	b.engine.ProcessReaction(r.MessageReaction, true)
+}
+
+func (b *Bot) onMessageReactionRemove(s *discordgo.Session, r *discordgo.MessageReactionRemove) {
+	b.engine.ProcessReaction(r.MessageReaction, false)
+}
+
+// onMessageUpdate and onMessageDelete pass edited and deleted messages to the
+// engine. The state has already replaced or dropped the cached message and
+// set BeforeUpdate or BeforeDelete to the old one.
+func (b *Bot) onMessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	b.engine.ProcessMessageEdit(m)
+}
+
+func (b *Bot) onMessageDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	b.engine.ProcessMessageDelete(m)
+}
+
+// onChannelCreate, onChannelUpdate and onChannelDelete invalidate the engine's
+// channel name cache for the affected guild
+func (b *Bot) onChannelCreate(s *discordgo.Session, c *discordgo.ChannelCreate) {
+	b.engine.InvalidateChannelCache(c.GuildID)
+}
+
+func (b *Bot) onChannelUpdate(s *discordgo.Session, c *discordgo.ChannelUpdate) {
+	b.engine.InvalidateChannelCache(c.GuildID)
+}
+
+func (b *Bot) onChannelDelete(s *discordgo.Session, c *discordgo.ChannelDelete) {
+	b.engine.InvalidateChannelCache(c.GuildID)
+}
@@ -0,0 +1,86 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// flapDetector counts reconnects in a sliding window and reports when they
+// reach the threshold. It reports once per episode: the alert re-arms when
+// the window has emptied below the threshold again.
+type flapDetector struct {
+	mu        sync.Mutex
+	window    time.Duration
+	threshold int
+	events    []time.Time
+	alerted   bool
+}
+
+// record notes a reconnect at now and returns the number of reconnects in the
+// window and whether that just reached the threshold.
+func (f *flapDetector) record(now time.Time) (count int, flapping bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kept := f.events[:0]
+	for _, t := range f.events {
+		if now.Sub(t) < f.window {
+			kept = append(kept, t)
+		}
+	}
+	f.events = append(kept, now)
+	count = len(f.events)
+
+	if f.threshold <= 0 || count < f.threshold {
+		f.alerted = false
+		return count, false
+	}
+	if f.alerted {
+		return count, false
+	}
+	f.alerted = true
+	return count, true
+}
+
+// onDisconnect counts a dropped gateway connection and alerts when they come
+// too often. discordgo reconnects by itself, and resumes the session when it
+// can; events sent while the connection was down may still be lost.
+func (b *Bot) onDisconnect(s *discordgo.Session, d *discordgo.Disconnect) {
+	if b.stopping.Load() {
+		return
+	}
+	count, flapping := b.flaps.record(time.Now())
+	log.Printf("Disconnected from Discord (%d time(s) in the last %s), reconnecting", count, b.config.ReconnectAlertWindow)
+	if flapping {
+		b.alert(fmt.Sprintf("Discord connection is flapping: %d reconnects in the last %s. Events may have been missed.",
+			count, b.config.ReconnectAlertWindow))
+	}
+}
+
+// onResumed logs a session resumed after a dropped connection.
+func (b *Bot) onResumed(s *discordgo.Session, r *discordgo.Resumed) {
+	log.Println("Resumed Discord session")
+}
+
+// alert logs a problem prominently and posts it to ERROR_CHANNEL_ID if set.
+// The REST API works without the gateway, so the post can get through while
+// the connection is down.
+func (b *Bot) alert(message string) {
+	log.Printf("!!! ALERT: %s", message)
+	if b.config.ErrorChannelID == "" {
+		return
+	}
+	if _, err := b.session.ChannelMessageSend(b.config.ErrorChannelID, "⚠️ "+message); err != nil {
+		log.Printf("Failed to post alert to channel %s: %v", b.config.ErrorChannelID, err)
+	}
+}
+
+// Failed reports a failure the bot could not recover from, such as a failed
+// Lua engine.
+func (b *Bot) Failed() <-chan error {
+	return b.failed
+}
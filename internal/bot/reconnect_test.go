@@ -0,0 +1,34 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlapDetector(t *testing.T) {
+	f := &flapDetector{window: time.Minute, threshold: 3}
+	start := time.Now()
+
+	for i, want := range []bool{false, false, true, false} {
+		if _, flapping := f.record(start.Add(time.Duration(i) * time.Second)); flapping != want {
+			t.Errorf("Reconnect %d: expected flapping=%v", i+1, want)
+		}
+	}
+
+	// Once the window has emptied the alert re-arms
+	count, flapping := f.record(start.Add(5 * time.Minute))
+	if count != 1 || flapping {
+		t.Errorf("Expected old reconnects to expire, got count %d flapping %v", count, flapping)
+	}
+	f.record(start.Add(5*time.Minute + time.Second))
+	if _, flapping := f.record(start.Add(5*time.Minute + 2*time.Second)); !flapping {
+		t.Error("Expected a second flapping episode to be reported")
+	}
+
+	disabled := &flapDetector{window: time.Minute}
+	for i := 0; i < 10; i++ {
+		if _, flapping := disabled.record(start); flapping {
+			t.Fatal("Expected a zero threshold to disable the alert")
+		}
+	}
+}
@@ -1,37 +1,429 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
+// SecretEnvPrefix marks environment variables that hold secrets for scripts.
+// BOT_SECRET_WEATHER_KEY is available to scripts as get_secret("weather_key").
+const SecretEnvPrefix = "BOT_SECRET_"
+
 // Config holds all configuration for the bot
 type Config struct {
 	BotToken     string
 	ScriptsDir   string
 	DatabasePath string
+
+	// WatchScripts enables hot-reloading scripts when files in ScriptsDir
+	// change. Turn it off where scripts are deployed as immutable bundles.
+	WatchScripts bool
+
+	// ScriptFailureLimit makes startup fail when at least this many scripts
+	// fail to load. Zero only logs the failures.
+	ScriptFailureLimit int
+
+	// ShutdownHookTimeout bounds how long each on_shutdown hook may run
+	// unless the hook registers its own timeout.
+	ShutdownHookTimeout time.Duration
+
+	// AllowedMentions is the default allowed_mentions preset for outgoing
+	// messages ("none", "users", "roles", "everyone" or "all").
+	AllowedMentions string
+
+	// EmbedColor, EmbedFooterText and EmbedFooterIcon brand the embeds
+	// scripts send: each applies to embeds that don't set their own color or
+	// footer. A zero color and empty footer text leave embeds as they are.
+	EmbedColor      int
+	EmbedFooterText string
+	EmbedFooterIcon string
+
+	// MaintenanceInterval is how often expired kv_store values are deleted
+	// and the database is vacuumed. Zero disables scheduled maintenance.
+	MaintenanceInterval time.Duration
+
+	// TickInterval is how often the on_tick hook fires.
+	TickInterval time.Duration
+
+	// HTTPBreakerThreshold is the number of consecutive failures after which
+	// requests to a host are fast-failed for HTTPBreakerCooldown. Zero
+	// disables the circuit breaker.
+	HTTPBreakerThreshold int
+	HTTPBreakerCooldown  time.Duration
+
+	// HTTPDefaultTimeout bounds HTTP requests from scripts that don't set
+	// their own timeout. HTTPMaxTimeout caps the timeout a script may set, so
+	// a synchronous request can't block the dispatcher for long. Zero means
+	// no limit.
+	HTTPDefaultTimeout time.Duration
+	HTTPMaxTimeout     time.Duration
+
+	// HTTPMaxBodySize caps the size in bytes of HTTP responses and downloaded
+	// attachments scripts can read. Zero means no limit.
+	HTTPMaxBodySize int64
+
+	// ScriptTimeout bounds every hook, command and timer callback that
+	// doesn't set its own timeout. Zero means no limit.
+	ScriptTimeout time.Duration
+
+	// ScriptLoadTimeout bounds the top-level code of a script, including
+	// the scripts it requires, so a script that hangs while loading is
+	// skipped instead of blocking startup. Zero means no limit.
+	ScriptLoadTimeout time.Duration
+
+	// OutboundFilterFailure decides what happens to a message when an
+	// outbound filter raises an error: "open" sends it as if the filter
+	// weren't there, "closed" doesn't send it.
+	OutboundFilterFailure string
+
+	// CommandPrefix starts every command, "!" unless the bot shares a
+	// server with another bot using it. It can't contain whitespace.
+	CommandPrefix string
+
+	// UnknownCommand is what the bot answers to an unknown !command:
+	// "silent" (nothing, the default), "suggest" (only when a registered
+	// command is a close match) or "reply" (always). on_unknown_command hooks
+	// run either way.
+	UnknownCommand string
+
+	// ReconnectAlertThreshold dropped gateway connections within
+	// ReconnectAlertWindow are reported as a flapping connection. Zero
+	// disables the alert. Reconnecting itself is left to discordgo.
+	ReconnectAlertThreshold int
+	ReconnectAlertWindow    time.Duration
+
+	// ErrorChannelID is a channel the bot posts operational alerts to, such
+	// as a flapping connection. Empty means alerts are only logged.
+	ErrorChannelID string
+
+	// LoopGuardWindow is how long messages the bot sent are remembered to
+	// detect relay loops; incoming messages repeating one are dropped after
+	// LoopGuardMaxEchoes. A zero window disables the guard.
+	LoopGuardWindow    time.Duration
+	LoopGuardMaxEchoes int
+
+	// MaxEventDepth caps chains of events queued by handlers of other
+	// events, e.g. a store change running a command that changes the store
+	// again. Events past it are dropped. Zero disables the cap.
+	MaxEventDepth int
+
+	// DispatcherStallTimeout is how long the event dispatcher may spend on
+	// one event before the bot reports it stuck and stops. Zero disables the
+	// check.
+	DispatcherStallTimeout time.Duration
+
+	// ShardID and ShardCount make the bot one shard of several: Discord
+	// sends it only the events of the guilds assigned to ShardID, and DMs
+	// only to shard 0. Each shard runs as its own process.
+	ShardID    int
+	ShardCount int
+
+	// MessageCacheSize is how many recent messages per channel the Discord
+	// state keeps, which bounds the register_command history option and
+	// decides whether edit and delete events know the old content. Memory
+	// grows with the size times the number of active channels.
+	MessageCacheSize int
+
+	// CommandNamespaces maps script file names to the namespace of their
+	// commands' qualified names ("!ns:command"), which otherwise is the file
+	// name without .lua.
+	CommandNamespaces map[string]string
+
+	// CommandUsageLog enables recording who used which command, for
+	// !topcommands. Off by default; records older than CommandUsageRetention
+	// are pruned (zero keeps them forever).
+	CommandUsageLog       bool
+	CommandUsageRetention time.Duration
+
+	// JournalNamespaces lists the kv_store namespaces whose changes are
+	// recorded in kv_journal so they can be audited and rolled back. An
+	// entry ending in * matches namespaces by prefix, e.g. "economy:*".
+	JournalNamespaces []string
+
+	// ExportDir is the directory export_data writes to and import_data reads
+	// from. Scripts pass file names, which must stay inside it.
+	ExportDir string
+
+	// Secrets maps lower-cased secret names to their values. Never log these.
+	Secrets map[string]string
 }
 
 // Load loads configuration from environment variables
 func Load() *Config {
+	cfg := load(os.Getenv)
+	cfg.Secrets = parseSecrets(os.Environ())
+	return cfg
+}
+
+// Default returns the configuration used when no environment variables are set.
+func Default() *Config {
+	return load(func(string) string { return "" })
+}
+
+func load(getenv func(string) string) *Config {
+	env := envReader(getenv)
 	return &Config{
-		BotToken:     os.Getenv("DISCORD_BOT_TOKEN"),
-		ScriptsDir:   getenvOrDefault("SCRIPTS_DIR", "scripts"),
-		DatabasePath: getenvOrDefault("DATABASE_PATH", "data/bot.db"),
+		BotToken:            getenv("DISCORD_BOT_TOKEN"),
+		ScriptsDir:          env.string("SCRIPTS_DIR", "scripts"),
+		DatabasePath:        env.string("DATABASE_PATH", "data/bot.db"),
+		WatchScripts:        env.bool("WATCH_SCRIPTS", true),
+		ScriptFailureLimit:  env.int("SCRIPT_FAILURE_LIMIT", 0),
+		ShutdownHookTimeout: env.duration("SHUTDOWN_HOOK_TIMEOUT", 5*time.Second),
+		AllowedMentions:     env.string("ALLOWED_MENTIONS", "none"),
+		EmbedColor:          env.color("EMBED_COLOR"),
+		EmbedFooterText:     getenv("EMBED_FOOTER_TEXT"),
+		EmbedFooterIcon:     getenv("EMBED_FOOTER_ICON"),
+		MaintenanceInterval: env.duration("DB_MAINTENANCE_INTERVAL", 0),
+		TickInterval:        env.duration("TICK_INTERVAL", time.Second),
+		ScriptTimeout:       env.duration("SCRIPT_TIMEOUT", 0),
+		ScriptLoadTimeout:   env.duration("SCRIPT_LOAD_TIMEOUT", 10*time.Second),
+		CommandPrefix:       env.string("COMMAND_PREFIX", "!"),
+		UnknownCommand:      env.string("UNKNOWN_COMMAND", "silent"),
+
+		OutboundFilterFailure: env.string("OUTBOUND_FILTER_FAILURE", "open"),
+
+		HTTPBreakerThreshold: env.int("HTTP_BREAKER_THRESHOLD", 5),
+		HTTPBreakerCooldown:  env.duration("HTTP_BREAKER_COOLDOWN", time.Minute),
+		HTTPMaxBodySize:      int64(env.int("HTTP_MAX_BODY_SIZE", 10<<20)),
+		HTTPDefaultTimeout:   env.duration("HTTP_DEFAULT_TIMEOUT", 30*time.Second),
+		HTTPMaxTimeout:       env.duration("HTTP_MAX_TIMEOUT", 2*time.Minute),
+
+		MessageCacheSize: env.int("MESSAGE_CACHE_SIZE", 50),
+
+		ShardID:    env.int("SHARD_ID", 0),
+		ShardCount: env.int("SHARD_COUNT", 1),
+
+		LoopGuardWindow:    env.duration("LOOP_GUARD_WINDOW", 10*time.Second),
+		LoopGuardMaxEchoes: env.int("LOOP_GUARD_MAX_ECHOES", 2),
+		MaxEventDepth:      env.int("MAX_EVENT_DEPTH", 20),
+
+		DispatcherStallTimeout: env.duration("DISPATCHER_STALL_TIMEOUT", 5*time.Minute),
+
+		ReconnectAlertThreshold: env.int("RECONNECT_ALERT_THRESHOLD", 5),
+		ReconnectAlertWindow:    env.duration("RECONNECT_ALERT_WINDOW", 10*time.Minute),
+		ErrorChannelID:          getenv("ERROR_CHANNEL_ID"),
+
+		CommandNamespaces:     env.pairs("COMMAND_NAMESPACES"),
+		CommandUsageLog:       env.bool("COMMAND_USAGE_LOG", false),
+		CommandUsageRetention: env.duration("COMMAND_USAGE_RETENTION", 30*24*time.Hour),
+
+		JournalNamespaces: env.list("JOURNAL_NAMESPACES"),
+		ExportDir:         env.string("EXPORT_DIR", "data/exports"),
+	}
+}
+
+// parseSecrets collects the BOT_SECRET_* variables from an environment list.
+func parseSecrets(environ []string) map[string]string {
+	secrets := make(map[string]string)
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, SecretEnvPrefix) || value == "" {
+			continue
+		}
+		secrets[strings.ToLower(strings.TrimPrefix(name, SecretEnvPrefix))] = value
+	}
+	return secrets
+}
+
+// Secret returns the named secret. Names are case-insensitive.
+func (c *Config) Secret(name string) (string, bool) {
+	value, ok := c.Secrets[strings.ToLower(name)]
+	return value, ok
+}
+
+// SecretValues returns every secret value, for redacting logs.
+func (c *Config) SecretValues() []string {
+	values := make([]string, 0, len(c.Secrets))
+	for _, value := range c.Secrets {
+		values = append(values, value)
+	}
+	if c.BotToken != "" {
+		values = append(values, c.BotToken)
 	}
+	return values
 }
 
-func getenvOrDefault(key, fallback string) string {
-	if value := os.Getenv(key); value != "" {
+// envReader reads typed values from an environment lookup function, falling
+// back to a default when the variable is unset or malformed.
+type envReader func(string) string
+
+func (env envReader) string(key, fallback string) string {
+	if value := env(key); value != "" {
 		return value
 	}
 	return fallback
 }
 
+func (env envReader) int(key string, fallback int) int {
+	if value := env(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func (env envReader) bool(key string, fallback bool) bool {
+	if value := env(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+func (env envReader) duration(key string, fallback time.Duration) time.Duration {
+	if value := env(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+// pairs reads a comma-separated list of key=value pairs, e.g.
+// "games.lua=fun,admin.lua=mod". Malformed entries are skipped.
+func (env envReader) pairs(key string) map[string]string {
+	result := make(map[string]string)
+	for _, entry := range strings.Split(env(key), ",") {
+		k, v, ok := strings.Cut(entry, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if ok && k != "" && v != "" {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// list reads a comma-separated list, e.g. "economy,inventory". Empty entries
+// are skipped.
+func (env envReader) list(key string) []string {
+	var result []string
+	for _, entry := range strings.Split(env(key), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// formatPairs writes pairs back in the form pairs reads, sorted by key.
+func formatPairs(pairs map[string]string) string {
+	entries := make([]string, 0, len(pairs))
+	for k, v := range pairs {
+		entries = append(entries, k+"="+v)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// color reads an RGB color written as "#5865F2", "0x5865F2" or a decimal
+// number. It returns 0, meaning no color, when unset or malformed.
+func (env envReader) color(key string) int {
+	value := strings.TrimSpace(env(key))
+	base := 10
+	if hex, ok := strings.CutPrefix(value, "#"); ok {
+		value, base = hex, 16
+	} else if hex, ok := strings.CutPrefix(strings.ToLower(value), "0x"); ok {
+		value, base = hex, 16
+	}
+	n, err := strconv.ParseInt(value, base, 32)
+	if err != nil || n < 0 || n > 0xFFFFFF {
+		return 0
+	}
+	return int(n)
+}
+
+// Setting is one configuration value as shown to operators.
+type Setting struct {
+	Name  string // environment variable
+	Value string
+}
+
+// Settings returns the effective configuration with secrets masked, for
+// logging and the !config command.
+func (c *Config) Settings() []Setting {
+	token := "<unset>"
+	if c.BotToken != "" {
+		token = "<set>"
+	}
+	return []Setting{
+		{"DISCORD_BOT_TOKEN", token},
+		{"SCRIPTS_DIR", c.ScriptsDir},
+		{"DATABASE_PATH", c.DatabasePath},
+		{"WATCH_SCRIPTS", strconv.FormatBool(c.WatchScripts)},
+		{"SCRIPT_FAILURE_LIMIT", strconv.Itoa(c.ScriptFailureLimit)},
+		{"SHUTDOWN_HOOK_TIMEOUT", c.ShutdownHookTimeout.String()},
+		{"ALLOWED_MENTIONS", c.AllowedMentions},
+		{"EMBED_COLOR", formatColor(c.EmbedColor)},
+		{"EMBED_FOOTER_TEXT", c.EmbedFooterText},
+		{"EMBED_FOOTER_ICON", c.EmbedFooterIcon},
+		{"DB_MAINTENANCE_INTERVAL", c.MaintenanceInterval.String()},
+		{"TICK_INTERVAL", c.TickInterval.String()},
+		{"SCRIPT_TIMEOUT", c.ScriptTimeout.String()},
+		{"SCRIPT_LOAD_TIMEOUT", c.ScriptLoadTimeout.String()},
+		{"COMMAND_PREFIX", c.CommandPrefix},
+		{"UNKNOWN_COMMAND", c.UnknownCommand},
+		{"OUTBOUND_FILTER_FAILURE", c.OutboundFilterFailure},
+		{"HTTP_BREAKER_THRESHOLD", strconv.Itoa(c.HTTPBreakerThreshold)},
+		{"HTTP_BREAKER_COOLDOWN", c.HTTPBreakerCooldown.String()},
+		{"HTTP_MAX_BODY_SIZE", strconv.FormatInt(c.HTTPMaxBodySize, 10)},
+		{"HTTP_DEFAULT_TIMEOUT", c.HTTPDefaultTimeout.String()},
+		{"HTTP_MAX_TIMEOUT", c.HTTPMaxTimeout.String()},
+		{"MESSAGE_CACHE_SIZE", strconv.Itoa(c.MessageCacheSize)},
+		{"SHARD_ID", strconv.Itoa(c.ShardID)},
+		{"SHARD_COUNT", strconv.Itoa(c.ShardCount)},
+		{"LOOP_GUARD_WINDOW", c.LoopGuardWindow.String()},
+		{"LOOP_GUARD_MAX_ECHOES", strconv.Itoa(c.LoopGuardMaxEchoes)},
+		{"MAX_EVENT_DEPTH", strconv.Itoa(c.MaxEventDepth)},
+		{"DISPATCHER_STALL_TIMEOUT", c.DispatcherStallTimeout.String()},
+		{"RECONNECT_ALERT_THRESHOLD", strconv.Itoa(c.ReconnectAlertThreshold)},
+		{"RECONNECT_ALERT_WINDOW", c.ReconnectAlertWindow.String()},
+		{"ERROR_CHANNEL_ID", c.ErrorChannelID},
+		{"COMMAND_NAMESPACES", formatPairs(c.CommandNamespaces)},
+		{"COMMAND_USAGE_LOG", strconv.FormatBool(c.CommandUsageLog)},
+		{"COMMAND_USAGE_RETENTION", c.CommandUsageRetention.String()},
+		{"JOURNAL_NAMESPACES", strings.Join(c.JournalNamespaces, ",")},
+		{"EXPORT_DIR", c.ExportDir},
+		{SecretEnvPrefix + "*", strconv.Itoa(len(c.Secrets)) + " set"},
+	}
+}
+
+// formatColor writes an RGB color as "#RRGGBB", or "" for no color.
+func formatColor(color int) string {
+	if color == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#%06X", color)
+}
+
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
 	if c.BotToken == "" {
 		return &ConfigError{Field: "DISCORD_BOT_TOKEN", Message: "Bot token is required"}
 	}
+	if strings.ContainsFunc(c.CommandPrefix, unicode.IsSpace) {
+		return &ConfigError{Field: "COMMAND_PREFIX", Message: fmt.Sprintf("COMMAND_PREFIX can't contain whitespace, got %q", c.CommandPrefix)}
+	}
+	if c.ShardCount < 1 {
+		return &ConfigError{Field: "SHARD_COUNT", Message: fmt.Sprintf("SHARD_COUNT must be at least 1, got %d", c.ShardCount)}
+	}
+	if c.ShardID < 0 || c.ShardID >= c.ShardCount {
+		return &ConfigError{Field: "SHARD_ID", Message: fmt.Sprintf("SHARD_ID must be between 0 and %d (SHARD_COUNT - 1), got %d", c.ShardCount-1, c.ShardID)}
+	}
+	switch c.UnknownCommand {
+	case "silent", "suggest", "reply":
+	default:
+		return &ConfigError{Field: "UNKNOWN_COMMAND", Message: fmt.Sprintf("UNKNOWN_COMMAND must be silent, suggest or reply, got %q", c.UnknownCommand)}
+	}
+	if c.OutboundFilterFailure != "open" && c.OutboundFilterFailure != "closed" {
+		return &ConfigError{Field: "OUTBOUND_FILTER_FAILURE", Message: fmt.Sprintf("OUTBOUND_FILTER_FAILURE must be open or closed, got %q", c.OutboundFilterFailure)}
+	}
 	return nil
 }
 
@@ -0,0 +1,48 @@
+package database
+
+import "time"
+
+// CommandCount is how often a command was used in a period.
+type CommandCount struct {
+	Command string
+	Uses    int
+	Users   int // distinct users
+}
+
+// RecordCommandUsage logs one use of a command.
+func (db *DB) RecordCommandUsage(command, userID, guildID string, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO command_usage(command, user_id, guild_id, used_at) VALUES (?, ?, ?, ?)`,
+		command, userID, guildID, at.Unix())
+	return err
+}
+
+// PruneCommandUsage deletes usage older than before and returns the number of
+// rows removed.
+func (db *DB) PruneCommandUsage(before time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM command_usage WHERE used_at < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// TopCommands returns the most used commands since the given time, most used
+// first.
+func (db *DB) TopCommands(since time.Time, limit int) ([]CommandCount, error) {
+	rows, err := db.Query(`SELECT command, COUNT(*), COUNT(DISTINCT user_id) FROM command_usage
+		WHERE used_at >= ? GROUP BY command ORDER BY COUNT(*) DESC, command LIMIT ?`, since.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []CommandCount
+	for rows.Next() {
+		var c CommandCount
+		if err := rows.Scan(&c.Command, &c.Uses, &c.Users); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// CronJob is a cron schedule registered by a script.
+type CronJob struct {
+	Script string
+	Name   string
+	Spec   string
+	// CheckedAt is the time up to which the job's runs are accounted for:
+	// when it was last run, or when it was scheduled if it hasn't run since.
+	CheckedAt time.Time
+}
+
+// GetCronJob returns a script's cron job, or nil if there is none.
+func (db *DB) GetCronJob(script, name string) (*CronJob, error) {
+	job := CronJob{Script: script, Name: name}
+	var checkedAt int64
+	err := db.QueryRow(`SELECT spec, checked_at FROM cron_jobs WHERE script = ? AND name = ?`, script, name).
+		Scan(&job.Spec, &checkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	job.CheckedAt = time.Unix(checkedAt, 0)
+	return &job, nil
+}
+
+// SaveCronJob stores a cron job, replacing the one of the same script and
+// name.
+func (db *DB) SaveCronJob(job CronJob) error {
+	_, err := db.Exec(`INSERT INTO cron_jobs(script, name, spec, checked_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(script, name) DO UPDATE SET spec=excluded.spec, checked_at=excluded.checked_at`,
+		job.Script, job.Name, job.Spec, job.CheckedAt.Unix())
+	return err
+}
+
+// DeleteCronJob removes a script's cron job.
+func (db *DB) DeleteCronJob(script, name string) error {
+	_, err := db.Exec(`DELETE FROM cron_jobs WHERE script = ? AND name = ?`, script, name)
+	return err
+}
+
+// CronJobs returns the stored cron jobs, ordered by script and name.
+func (db *DB) CronJobs() ([]CronJob, error) {
+	rows, err := db.Query(`SELECT script, name, spec, checked_at FROM cron_jobs ORDER BY script, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []CronJob
+	for rows.Next() {
+		var job CronJob
+		var checkedAt int64
+		if err := rows.Scan(&job.Script, &job.Name, &job.Spec, &checkedAt); err != nil {
+			return nil, err
+		}
+		job.CheckedAt = time.Unix(checkedAt, 0)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
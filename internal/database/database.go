@@ -1,8 +1,13 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 
 	_ "modernc.org/sqlite"
 )
@@ -12,8 +17,13 @@ type DB struct {
 	*sql.DB
 }
 
-// New creates a new database connection
+// New creates a new database connection. The directory the database file is
+// in is created if it doesn't exist yet.
 func New(dbPath string) (*DB, error) {
+	if err := prepareDatabaseFile(dbPath); err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, err
@@ -27,6 +37,29 @@ func New(dbPath string) (*DB, error) {
 	return &DB{db}, nil
 }
 
+// prepareDatabaseFile creates the parent directory of a database file and
+// checks the file can be opened for writing, so a bad DATABASE_PATH fails
+// with a clear error instead of on the first query. In-memory databases and
+// file: URIs are left to SQLite.
+func prepareDatabaseFile(dbPath string) error {
+	if dbPath == "" || dbPath == ":memory:" || strings.HasPrefix(dbPath, "file:") {
+		return nil
+	}
+	if info, err := os.Stat(dbPath); err == nil && info.IsDir() {
+		return fmt.Errorf("database path %s is a directory, expected a file such as %s", dbPath, filepath.Join(dbPath, "bot.db"))
+	}
+	if dir := filepath.Dir(dbPath); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("cannot create database directory: %w", err)
+		}
+	}
+	f, err := os.OpenFile(dbPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("database path %s is not writable: %w", dbPath, err)
+	}
+	return f.Close()
+}
+
 // Initialize sets up the database schema
 func (db *DB) Initialize() error {
 	log.Println("Initializing database")
@@ -40,12 +73,25 @@ func (db *DB) Initialize() error {
 		namespace TEXT NOT NULL,
 		key TEXT NOT NULL,
 		value TEXT,
+		type TEXT,
+		expires_at INTEGER,
 		PRIMARY KEY (namespace, key)
 	)`)
 	if err != nil {
 		return err
 	}
 
+	// Rows written before the type column existed keep a NULL type.
+	if err := db.addColumnIfMissing("kv_store", "type", "TEXT"); err != nil {
+		return err
+	}
+
+	// When a value set with an expiry stops being returned, in Unix
+	// milliseconds. NULL for values that don't expire.
+	if err := db.addColumnIfMissing("kv_store", "expires_at", "INTEGER"); err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
 		id TEXT PRIMARY KEY,
 		display_name TEXT NOT NULL,
@@ -82,11 +128,162 @@ func (db *DB) Initialize() error {
 		return err
 	}
 
+	// Only written when COMMAND_USAGE_LOG is enabled.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS command_usage (
+		command TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		used_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS command_usage_used_at ON command_usage(used_at)`)
+	if err != nil {
+		return err
+	}
+
+	// Cron jobs scheduled by scripts, so missed runs can be detected after
+	// a restart. checked_at is the time up to which runs are accounted for.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cron_jobs (
+		script TEXT NOT NULL,
+		name TEXT NOT NULL,
+		spec TEXT NOT NULL,
+		checked_at INTEGER NOT NULL,
+		PRIMARY KEY (script, name)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Keys claimed with once(), scoped by script. Rows stay until they
+	// expire, then are replaced by the next claim or pruned. expires_at is
+	// in Unix milliseconds, since TTLs may be shorter than a second.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS once_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (scope, key)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Changes to the kv_store namespaces listed in JOURNAL_NAMESPACES, oldest
+	// first. A NULL old or new value means the key was unset before or after.
+	// changed_at is in Unix milliseconds.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv_journal (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		namespace TEXT NOT NULL,
+		key TEXT NOT NULL,
+		old_value TEXT,
+		old_type TEXT,
+		new_value TEXT,
+		new_type TEXT,
+		script TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL DEFAULT '',
+		changed_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS kv_journal_namespace_key ON kv_journal(namespace, key, id)`)
+	if err != nil {
+		return err
+	}
+
+	// The expiry of the value before and after the change, like
+	// kv_store.expires_at. Entries written before these columns existed
+	// have NULL, as if the values didn't expire.
+	if err := db.addColumnIfMissing("kv_journal", "old_expires_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("kv_journal", "new_expires_at", "INTEGER"); err != nil {
+		return err
+	}
+
 	log.Println("Database initialized successfully")
 	return nil
 }
 
-// Close closes the database connection
+// addColumnIfMissing adds a column to an existing table. CREATE TABLE IF NOT
+// EXISTS leaves older databases untouched, so new columns are added here.
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Adding column %s.%s", table, column)
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+// Vacuum rebuilds the database file to reclaim the space left behind by
+// deleted rows, then truncates the WAL. It returns the database size in bytes
+// before and after. VACUUM fails inside a transaction, so it runs on its own
+// connection; callers must make sure no other writes are in flight.
+func (db *DB) Vacuum() (before, after int64, err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	if before, err = databaseSize(ctx, conn); err != nil {
+		return 0, 0, err
+	}
+	if _, err = conn.ExecContext(ctx, `VACUUM`); err != nil {
+		return before, 0, err
+	}
+	if _, err = conn.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return before, 0, err
+	}
+	if after, err = databaseSize(ctx, conn); err != nil {
+		return before, 0, err
+	}
+	return before, after, nil
+}
+
+func databaseSize(ctx context.Context, conn *sql.Conn) (int64, error) {
+	var pageCount, pageSize int64
+	if err := conn.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pageCount); err != nil {
+		return 0, err
+	}
+	if err := conn.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pageCount * pageSize, nil
+}
+
+// Checkpoint copies everything in the WAL into the main database file and
+// truncates the WAL, so committed writes don't depend on the WAL surviving.
+func (db *DB) Checkpoint() error {
+	_, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// Close checkpoints the WAL and closes the database connection
 func (db *DB) Close() error {
+	if err := db.Checkpoint(); err != nil {
+		log.Println("Warning: WAL checkpoint on close failed:", err)
+	}
 	return db.DB.Close()
 }
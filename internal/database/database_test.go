@@ -0,0 +1,41 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewCreatesParentDirectory(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "data", "nested", "bot.db")
+	db, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer db.Close()
+	if err := db.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		t.Errorf("Expected the database file to exist: %v", err)
+	}
+}
+
+func TestNewRejectsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := New(dir); err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Errorf("Expected a directory path to be refused, got %v", err)
+	}
+}
+
+func TestNewRejectsUnwritablePath(t *testing.T) {
+	// A file where the parent directory should be
+	parent := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(parent, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(filepath.Join(parent, "bot.db")); err == nil || !strings.Contains(err.Error(), "cannot create database directory") {
+		t.Errorf("Expected an unusable directory to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package database
+
+import "time"
+
+// ClaimOnceKey records key in scope until expiresAt and reports whether this
+// call claimed it: false means the key was already claimed and hasn't
+// expired yet. A claim that has expired is replaced. The check and the claim
+// are one transaction, so a key is never claimed twice.
+func (db *DB) ClaimOnceKey(scope, key string, now, expiresAt time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM once_keys WHERE scope = ? AND key = ? AND expires_at <= ?`, scope, key, now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`INSERT OR IGNORE INTO once_keys(scope, key, expires_at) VALUES (?, ?, ?)`, scope, key, expiresAt.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, tx.Commit()
+}
+
+// PruneOnceKeys deletes the claims that have expired by now and returns the
+// number of rows removed.
+func (db *DB) PruneOnceKeys(now time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM once_keys WHERE expires_at <= ?`, now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
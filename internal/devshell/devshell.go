@@ -0,0 +1,235 @@
+// Package devshell runs the scripts without a Discord connection: a fake
+// session shows the bot's messages and a Shell turns typed lines into
+// messages from a simulated user and shell commands. It is shared by the
+// dev shell TUI and the bot's --repl mode, which only differ in how they
+// read input and show output.
+package devshell
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	luaengine "github.com/leihog/discord-bot/internal/lua"
+)
+
+// Help lists the shell commands.
+const Help = `Shell commands:
+  /channel <id>       Set active channel ID
+  /user <name> [id]   Set author name and optional ID
+  /dm                 Toggle DM mode (on_direct_message vs on_channel_message)
+  /scripts            List loaded scripts
+  /load <name>        Load a script from the scripts directory
+  /reload <name>      Reload a script by name (e.g. jokes.lua)
+  /commands           List registered commands
+  /hooks              List registered hooks
+  /lua <code>         Execute Lua code and print the result
+  /lua @<name> <code> Execute Lua code in a script's globals
+  /quit, /exit        Exit the shell
+Any other line is sent as a message from the simulated user.`
+
+// Session implements luaengine.MessageSender by passing the bot's messages
+// to Output as lines of text.
+type Session struct {
+	luaengine.UnsupportedSession
+
+	// Output receives a line for every message the bot sends or edits.
+	Output func(line string)
+
+	mu     sync.Mutex
+	nextID int // IDs of sent messages, so they can be edited; guarded by mu
+}
+
+func (s *Session) ChannelMessageSend(channelID, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Output(fmt.Sprintf("[Bot → #%s]: %s", channelID, content))
+	return s.message(channelID, content), nil
+}
+
+func (s *Session) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return s.ChannelMessageSend(channelID, data.Content, options...)
+}
+
+func (s *Session) ChannelMessageEdit(channelID, messageID, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Output(fmt.Sprintf("[Bot → #%s] (edited): %s", channelID, content))
+	return &discordgo.Message{ID: messageID, ChannelID: channelID, Content: content}, nil
+}
+
+// message returns a sent message with a new ID.
+func (s *Session) message(channelID, content string) *discordgo.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	return &discordgo.Message{ID: fmt.Sprintf("dev-%d", s.nextID), ChannelID: channelID, Content: content}
+}
+
+// State is the simulated author and channel of typed messages.
+type State struct {
+	Author    string
+	AuthorID  string
+	ChannelID string
+	DMMode    bool
+}
+
+// Prompt returns the prompt showing the state, e.g. "[#dev-channel] dev> ".
+func (s *State) Prompt() string {
+	prefix := ""
+	if s.DMMode {
+		prefix = "(DM) "
+	}
+	return fmt.Sprintf("%s[#%s] %s> ", prefix, s.ChannelID, s.Author)
+}
+
+// Message returns content as a message from the simulated author. Outside DM
+// mode it comes from a guild, so it reaches on_channel_message.
+func (s *State) Message(content string) *discordgo.MessageCreate {
+	guildID := "dev-guild"
+	if s.DMMode {
+		guildID = ""
+	}
+	return &discordgo.MessageCreate{
+		Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: s.ChannelID,
+			GuildID:   guildID,
+			Author:    &discordgo.User{Username: s.Author, ID: s.AuthorID},
+		},
+	}
+}
+
+// Reply is the outcome of a shell line.
+type Reply struct {
+	// Text is shown right away. It may be empty.
+	Text string
+	// Wait, if set, does the rest of the work, which waits for the engine's
+	// dispatcher. Its output is shown when it returns. Front ends that must
+	// stay responsive, like the TUI, run it on another goroutine.
+	Wait func() (string, error)
+	// Quit asks the front end to exit.
+	Quit bool
+}
+
+// Shell handles typed lines for an engine whose scripts are in ScriptsDir.
+type Shell struct {
+	Engine     *luaengine.Engine
+	ScriptsDir string
+	State      State
+}
+
+// New returns a shell for engine with the default simulated user and channel.
+func New(engine *luaengine.Engine, scriptsDir string) *Shell {
+	return &Shell{
+		Engine:     engine,
+		ScriptsDir: scriptsDir,
+		State:      State{Author: "dev", AuthorID: "dev-user", ChannelID: "dev-channel"},
+	}
+}
+
+// Handle runs a line: lines starting with / are shell commands, anything
+// else is sent to the engine as a message from the simulated user.
+func (s *Shell) Handle(line string) Reply {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return Reply{}
+	}
+	if !strings.HasPrefix(line, "/") {
+		s.Engine.ProcessMessage(s.State.Message(line))
+		return Reply{}
+	}
+
+	parts := strings.Fields(line)
+	switch parts[0] {
+	case "/help":
+		return Reply{Text: Help}
+
+	case "/channel":
+		if len(parts) < 2 {
+			return Reply{Text: "Usage: /channel <id>"}
+		}
+		s.State.ChannelID = parts[1]
+		return Reply{Text: fmt.Sprintf("Channel set to #%s", s.State.ChannelID)}
+
+	case "/user":
+		if len(parts) < 2 {
+			return Reply{Text: "Usage: /user <name> [id]"}
+		}
+		s.State.Author, s.State.AuthorID = parts[1], parts[1]
+		if len(parts) >= 3 {
+			s.State.AuthorID = parts[2]
+		}
+		return Reply{Text: fmt.Sprintf("User set to %s (id: %s)", s.State.Author, s.State.AuthorID)}
+
+	case "/dm":
+		s.State.DMMode = !s.State.DMMode
+		if s.State.DMMode {
+			return Reply{Text: "DM mode: ON  (messages trigger on_direct_message)"}
+		}
+		return Reply{Text: "DM mode: OFF (messages trigger on_channel_message)"}
+
+	case "/scripts":
+		engine := s.Engine
+		return Reply{Wait: func() (string, error) {
+			names := engine.GetScriptNames()
+			if len(names) == 0 {
+				return "No scripts loaded.", nil
+			}
+			return "  " + strings.Join(names, "\n  "), nil
+		}}
+
+	case "/load", "/reload":
+		if len(parts) < 2 {
+			return Reply{Text: fmt.Sprintf("Usage: %s <name>", parts[0])}
+		}
+		action, verb := "load", "Loading"
+		if parts[0] == "/reload" {
+			action, verb = "reload", "Reloading"
+		}
+		s.Engine.EnqueueScriptEvent(filepath.Join(s.ScriptsDir, parts[1]), action)
+		return Reply{Text: fmt.Sprintf("%s %s...", verb, parts[1])}
+
+	case "/commands":
+		engine := s.Engine
+		return Reply{Wait: func() (string, error) {
+			return engine.Exec(`
+local found = false
+for name, cmd in pairs(get_commands()) do
+    print(name .. " - " .. cmd.description .. " [" .. cmd.script .. "]")
+    found = true
+end
+if not found then print("No commands registered.") end
+`)
+		}}
+
+	case "/hooks":
+		hooks := s.Engine.GetHookNames()
+		if len(hooks) == 0 {
+			return Reply{Text: "No hooks registered."}
+		}
+		lines := make([]string, 0, len(hooks))
+		for name, scripts := range hooks {
+			lines = append(lines, fmt.Sprintf("  %s: %s", name, strings.Join(scripts, ", ")))
+		}
+		sort.Strings(lines)
+		return Reply{Text: strings.Join(lines, "\n")}
+
+	case "/lua":
+		code := strings.TrimSpace(strings.TrimPrefix(line, "/lua"))
+		var script string
+		if strings.HasPrefix(code, "@") {
+			script, code, _ = strings.Cut(code[1:], " ")
+		}
+		if code == "" {
+			return Reply{Text: "Usage: /lua [@<name>] <code>"}
+		}
+		engine := s.Engine
+		return Reply{Wait: func() (string, error) {
+			return engine.ExecIn(script, code)
+		}}
+
+	case "/quit", "/exit":
+		return Reply{Quit: true}
+	}
+	return Reply{Text: fmt.Sprintf("Unknown command: %s (type /help for help)", parts[0])}
+}
@@ -0,0 +1,58 @@
+package devshell
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSessionOutput(t *testing.T) {
+	var lines []string
+	sess := &Session{Output: func(line string) { lines = append(lines, line) }}
+
+	first, _ := sess.ChannelMessageSend("c1", "hello")
+	second, _ := sess.ChannelMessageSendComplex("c1", &discordgo.MessageSend{Content: "embed"})
+	sess.ChannelMessageEdit("c1", first.ID, "bye")
+
+	if first.ID == second.ID {
+		t.Errorf("Expected sent messages to get distinct IDs, both got %s", first.ID)
+	}
+	want := []string{"[Bot → #c1]: hello", "[Bot → #c1]: embed", "[Bot → #c1] (edited): bye"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected output %q, got %q", want, lines)
+	}
+}
+
+func TestShellState(t *testing.T) {
+	shell := New(nil, "scripts")
+
+	if got := shell.State.Prompt(); got != "[#dev-channel] dev> " {
+		t.Errorf("Expected the default prompt, got %q", got)
+	}
+	for _, line := range []string{"/channel general", "/user bob 42", "/dm"} {
+		if reply := shell.Handle(line); reply.Text == "" || reply.Wait != nil || reply.Quit {
+			t.Errorf("%s: unexpected reply %+v", line, reply)
+		}
+	}
+	if got := shell.State.Prompt(); got != "(DM) [#general] bob> " {
+		t.Errorf("Expected the prompt to show the new state, got %q", got)
+	}
+	msg := shell.State.Message("hi")
+	if msg.ChannelID != "general" || msg.GuildID != "" || msg.Author.ID != "42" || msg.Author.Username != "bob" {
+		t.Errorf("Expected a DM from bob (42) in #general, got %+v", msg.Message)
+	}
+
+	if reply := shell.Handle("/user"); reply.Text != "Usage: /user <name> [id]" {
+		t.Errorf("Expected usage for /user without a name, got %q", reply.Text)
+	}
+	if reply := shell.Handle("/lua @ping.lua"); reply.Text != "Usage: /lua [@<name>] <code>" || reply.Wait != nil {
+		t.Errorf("Expected usage for /lua without code, got %+v", reply)
+	}
+	if reply := shell.Handle("/nope"); !strings.Contains(reply.Text, "Unknown command: /nope") {
+		t.Errorf("Expected an unknown command to be reported, got %q", reply.Text)
+	}
+	if reply := shell.Handle("/exit"); !reply.Quit {
+		t.Error("Expected /exit to quit")
+	}
+}
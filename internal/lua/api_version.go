@@ -0,0 +1,76 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// APIVersion is the version of the host API, the functions and hooks scripts
+// can use. Bump it when a function is removed or changes in a way that breaks
+// existing scripts, and describe the change in apiChanges.
+const APIVersion = 1
+
+// minAPIVersion is the oldest API version scripts may target. Raise it once
+// the changes since are too large for old scripts to run at all.
+const minAPIVersion = 1
+
+// apiChanges describes the breaking changes of each API version, for the
+// warning shown when loading a script written for an older one.
+var apiChanges = map[int]string{}
+
+// apiHeaderPattern matches the "-- api: 2" header declaring the API version
+// a script was written for.
+var apiHeaderPattern = regexp.MustCompile(`^--\s*api:\s*(.*)$`)
+
+// scriptAPIVersion reads the API version a script declares in the comments
+// at its top, before the first line of code. It returns 0 if there is none.
+func scriptAPIVersion(code []byte) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(code))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		if m := apiHeaderPattern.FindStringSubmatch(line); m != nil {
+			version, err := strconv.Atoi(strings.TrimSpace(m[1]))
+			if err != nil || version < 1 {
+				return 0, fmt.Errorf("invalid API version header '%s'", line)
+			}
+			return version, nil
+		}
+	}
+	return 0, nil
+}
+
+// checkAPIVersion refuses scripts written for a newer API than this bot
+// provides, or for one older than minAPIVersion. For scripts written for an
+// older but supported version it returns a warning listing what changed
+// since. Scripts that declare no version are assumed to be current.
+func checkAPIVersion(version int) (warning string, err error) {
+	switch {
+	case version == 0 || version == APIVersion:
+		return "", nil
+	case version > APIVersion:
+		return "", fmt.Errorf("script targets API version %d, but this bot provides version %d; update the bot", version, APIVersion)
+	case version < minAPIVersion:
+		return "", fmt.Errorf("script targets API version %d, which is no longer supported (oldest is %d); update the script", version, minAPIVersion)
+	}
+	var changes []string
+	for v := version + 1; v <= APIVersion; v++ {
+		if change, ok := apiChanges[v]; ok {
+			changes = append(changes, fmt.Sprintf("version %d: %s", v, change))
+		}
+	}
+	warning = fmt.Sprintf("Script targets API version %d, the current version is %d", version, APIVersion)
+	if len(changes) > 0 {
+		warning += ". Changes since: " + strings.Join(changes, "; ")
+	}
+	return warning, nil
+}
@@ -0,0 +1,56 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScriptAPIVersion(t *testing.T) {
+	tests := []struct {
+		code    string
+		want    int
+		wantErr bool
+	}{
+		{"-- api: 1\nlog('hi')", 1, false},
+		{"\n-- Greeter script\n--api:3\nlog('hi')", 3, false},
+		{"log('hi')\n-- api: 2", 0, false}, // only the header counts
+		{"-- no version here\nlog('hi')", 0, false},
+		{"-- api: two", 0, true},
+		{"-- api: 0", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := scriptAPIVersion([]byte(tt.code))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("scriptAPIVersion(%q) = %d, %v; want %d, error %v", tt.code, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadScriptChecksAPIVersion(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	script := loadTestScript(t, engine, "current.lua", "-- api: 1\ncurrent = api_version()")
+	if script.APIVersion != 1 {
+		t.Errorf("Expected the declared API version to be recorded, got %d", script.APIVersion)
+	}
+	if got := scriptGlobal(engine, "current").String(); got != "1" {
+		t.Errorf("Expected api_version() to return 1, got %s", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "future.lua")
+	if err := os.WriteFile(path, []byte("-- api: 99\nfuture_loaded = true"), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	err := engine.loadScript(path)
+	if err == nil || !strings.Contains(err.Error(), "targets API version 99") {
+		t.Errorf("Expected a script for a newer API to be refused, got %v", err)
+	}
+	if _, ok := engine.scripts["future.lua"]; ok {
+		t.Error("Expected future.lua not to be loaded")
+	}
+}
@@ -0,0 +1,75 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// attachmentHosts are the hosts Discord serves message attachments from.
+// download_attachment refuses anything else so it can't be used as a general
+// purpose HTTP client.
+var attachmentHosts = map[string]bool{
+	"cdn.discordapp.com":   true,
+	"media.discordapp.net": true,
+}
+
+// attachmentClient downloads attachments. It only follows redirects to
+// attachmentHosts, so the CDN can't send download_attachment elsewhere.
+var attachmentClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return checkAttachmentURL(req.URL.String())
+	},
+}
+
+// attachmentsToLua converts message attachments into an array of
+// {id, filename, url, size, content_type} tables.
+func attachmentsToLua(L *lua.LState, attachments []*discordgo.MessageAttachment) *lua.LTable {
+	result := L.NewTable()
+	for _, a := range attachments {
+		entry := L.NewTable()
+		entry.RawSetString("id", lua.LString(a.ID))
+		entry.RawSetString("filename", lua.LString(a.Filename))
+		entry.RawSetString("url", lua.LString(a.URL))
+		entry.RawSetString("size", lua.LNumber(a.Size))
+		entry.RawSetString("content_type", lua.LString(a.ContentType))
+		result.Append(entry)
+	}
+	return result
+}
+
+// checkAttachmentURL verifies that rawURL points at Discord's CDN over HTTPS.
+func checkAttachmentURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid attachment URL: %w", err)
+	}
+	if u.Scheme != "https" || !attachmentHosts[u.Hostname()] {
+		return fmt.Errorf("not a Discord attachment URL: %s", rawURL)
+	}
+	return nil
+}
+
+// downloadAttachment fetches an attachment and returns its bytes. Attachments
+// larger than HTTP_MAX_BODY_SIZE are refused. The URL must already have
+// passed checkAttachmentURL. Safe to call from any goroutine.
+func downloadAttachment(ctx context.Context, breaker *circuitBreaker, rawURL string, opts httpOptions) (string, error) {
+	opts.Client = attachmentClient
+	result := breaker.do(rawURL, func() HTTPResult {
+		return doHTTPRequest(ctx, "GET", rawURL, "", opts)
+	})
+	if result.Err != nil {
+		return "", result.Err
+	}
+	if result.StatusCode != 200 {
+		return "", fmt.Errorf("downloading attachment: HTTP %d", result.StatusCode)
+	}
+	return result.Body, nil
+}
@@ -0,0 +1,143 @@
+package lua
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxAwaitTimeout caps await_message so a forgotten prompt doesn't swallow a
+// user's messages indefinitely.
+const maxAwaitTimeout = time.Hour
+
+// pendingReply is a one-shot handler for the next message of a user in a
+// channel. Exactly one of the reply and the timeout resolves it.
+type pendingReply struct {
+	ChannelID string
+	UserID    string
+	Callback  HookInfo
+	timer     *time.Timer
+}
+
+// awaitList holds the pending replies, oldest first. ProcessMessage checks it
+// on the Discord event goroutine while scripts add to it on the dispatcher.
+type awaitList struct {
+	mu      sync.Mutex
+	pending []*pendingReply
+}
+
+// remove takes p off the list and reports whether it was still there, which
+// decides whether a reply or the timeout gets to resolve it.
+func (a *awaitList) remove(p *pendingReply) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, q := range a.pending {
+		if q == p {
+			a.pending = append(a.pending[:i], a.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// awaitMessage registers callback for the next message userID sends in
+// channelID. If none arrives within timeout the callback gets nil instead.
+func (e *Engine) awaitMessage(channelID, userID string, timeout time.Duration, callback *lua.LFunction) error {
+	if e.currentScript == nil {
+		return fmt.Errorf("await_message can only be called by a loaded script")
+	}
+	if timeout <= 0 || timeout > maxAwaitTimeout {
+		return fmt.Errorf("timeout must be between 0 and %s", maxAwaitTimeout)
+	}
+
+	p := &pendingReply{
+		ChannelID: channelID,
+		UserID:    userID,
+		Callback: HookInfo{
+			Function: callback,
+			Script:   e.currentScript,
+			Name:     "await_message callback",
+		},
+	}
+	e.awaits.mu.Lock()
+	e.awaits.pending = append(e.awaits.pending, p)
+	p.timer = time.AfterFunc(timeout, func() {
+		if e.awaits.remove(p) {
+			e.enqueueEvent(AwaitReplyEvent{Reply: p}, "await_message timeout")
+		}
+	})
+	e.awaits.mu.Unlock()
+	return nil
+}
+
+// resolveAwait hands m to the oldest reply waiting for its author in its
+// channel. It returns false if nothing was waiting, in which case the message
+// is dispatched as usual.
+func (e *Engine) resolveAwait(m *discordgo.MessageCreate) bool {
+	e.awaits.mu.Lock()
+	var match *pendingReply
+	for i, p := range e.awaits.pending {
+		if p.ChannelID == m.ChannelID && p.UserID == m.Author.ID {
+			match = p
+			e.awaits.pending = append(e.awaits.pending[:i], e.awaits.pending[i+1:]...)
+			break
+		}
+	}
+	e.awaits.mu.Unlock()
+	if match == nil {
+		return false
+	}
+
+	match.timer.Stop()
+	e.enqueueEvent(AwaitReplyEvent{Reply: match, Message: m.Message}, m.Author.Username)
+	return true
+}
+
+// cancelAwaits drops the pending replies of a script that is unloading.
+func (e *Engine) cancelAwaits(script *LuaScript) {
+	e.awaits.mu.Lock()
+	defer e.awaits.mu.Unlock()
+	kept := e.awaits.pending[:0]
+	for _, p := range e.awaits.pending {
+		if p.Callback.Script == script {
+			p.timer.Stop()
+			scriptLogf(script, "Cancelled await_message in channel %s", p.ChannelID)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	e.awaits.pending = kept
+}
+
+// AwaitReplyEvent resolves an await_message with the reply, or with nil when
+// Message is nil because the wait timed out.
+type AwaitReplyEvent struct {
+	Reply   *pendingReply
+	Message *discordgo.Message
+}
+
+func (ae AwaitReplyEvent) Dispatch(e *Engine) {
+	if script := ae.Reply.Callback.Script; e.scripts[script.Name] != script {
+		return // the script was unloaded after the event was queued
+	}
+	var data lua.LValue = lua.LNil
+	if m := ae.Message; m != nil {
+		tbl := e.state.NewTable()
+		tbl.RawSetString("content", lua.LString(m.Content))
+		tbl.RawSetString("message_id", lua.LString(m.ID))
+		tbl.RawSetString("channel_id", lua.LString(m.ChannelID))
+		tbl.RawSetString("guild_id", lua.LString(m.GuildID))
+		tbl.RawSetString("author", lua.LString(m.Author.Username))
+		tbl.RawSetString("author_id", lua.LString(m.Author.ID))
+		tbl.RawSetString("attachments", attachmentsToLua(e.state, m.Attachments))
+		data = tbl
+	}
+	e.callLuaFunction(ae.Reply.Callback, data)
+}
+
+func (ae AwaitReplyEvent) Type() string {
+	return "await_message"
+}
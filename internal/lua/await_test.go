@@ -0,0 +1,79 @@
+package lua
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestAwaitMessage(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "wizard.lua", `
+		heard = 0
+		register_hook("on_channel_message", function() heard = heard + 1 end)
+		register_command("setup", "Starts the wizard", function(event)
+			await_message(event.channel_id, event.author_id, 5, function(reply)
+				answer = reply.content
+			end)
+		end)
+		register_command("quick", "Gives up quickly", function(event)
+			await_message(event.channel_id, event.author_id, 0.02, function(reply)
+				timed_out = reply == nil
+			end)
+		end)
+	`)
+
+	send := func(userID, content string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			GuildID:   "g1",
+			Author:    &discordgo.User{ID: userID, Username: userID},
+		}})
+		drainEvents(engine)
+	}
+
+	send("alice", "!setup")
+	send("bob", "not for the wizard")
+	send("alice", "!quick") // consumed as the answer, not run as a command
+	send("alice", "after")
+
+	if answer := scriptGlobal(engine, "answer").String(); answer != "!quick" {
+		t.Errorf("Expected alice's next message as the answer, got %q", answer)
+	}
+	if heard := scriptGlobal(engine, "heard").String(); heard != "2" {
+		t.Errorf("Expected the hooks to see only bob's and the later message, got %s", heard)
+	}
+
+	send("alice", "!quick")
+	time.Sleep(50 * time.Millisecond)
+	drainEvents(engine)
+	if scriptGlobal(engine, "timed_out") != lua.LTrue {
+		t.Error("Expected the callback to get nil after the timeout")
+	}
+	send("alice", "too late")
+	if heard := scriptGlobal(engine, "heard").String(); heard != "3" {
+		t.Errorf("Expected a message after the timeout to be dispatched normally, got %s", heard)
+	}
+
+	// Unloading the script drops its pending waits
+	send("alice", "!setup")
+	engine.unloadScript("wizard.lua")
+	if n := len(engine.awaits.pending); n != 0 {
+		t.Errorf("Expected unloading to cancel pending waits, %d left", n)
+	}
+
+	err := engine.state.DoString(`ok, err = await_message("c1", "alice", 5, function() end)`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if scriptGlobal(engine, "ok") != lua.LNil || scriptGlobal(engine, "err") == lua.LNil {
+		t.Error("Expected await_message outside a script to fail")
+	}
+}
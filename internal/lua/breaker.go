@@ -0,0 +1,129 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned instead of performing a request while the
+// circuit for a host is open.
+type CircuitOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.RetryAfter <= 0 {
+		return fmt.Sprintf("circuit open for %s after repeated failures, waiting on a trial request", e.Host)
+	}
+	return fmt.Sprintf("circuit open for %s after repeated failures, retry in %s", e.Host, e.RetryAfter.Round(time.Second))
+}
+
+// circuitBreaker fast-fails requests to hosts that keep failing. After
+// threshold consecutive failures (transport errors or 5xx responses) the host
+// is blocked for cooldown. Once the cooldown passes a single request is let
+// through, and the others still fail fast until it completes: success closes
+// the circuit, failure opens it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int // zero disables the breaker
+	cooldown  time.Duration
+	hosts     map[string]*hostCircuit
+	now       func() time.Time
+}
+
+type hostCircuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool // the trial request after the cooldown is in flight
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*hostCircuit),
+		now:       time.Now,
+	}
+}
+
+// do runs request unless the circuit for rawURL's host is open, and records
+// the outcome.
+func (cb *circuitBreaker) do(rawURL string, request func() HTTPResult) HTTPResult {
+	if cb == nil || cb.threshold <= 0 {
+		return request()
+	}
+
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	if err := cb.allow(host); err != nil {
+		return HTTPResult{Err: err}
+	}
+	result := request()
+	if errors.Is(result.Err, context.Canceled) {
+		// Cancelled by shutdown, says nothing about the host
+		cb.cancelled(host)
+		return result
+	}
+	cb.record(host, result.Err != nil || result.StatusCode >= 500)
+	return result
+}
+
+func (cb *circuitBreaker) allow(host string) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	hc, ok := cb.hosts[host]
+	if !ok {
+		return nil
+	}
+	if wait := hc.openUntil.Sub(cb.now()); wait > 0 {
+		return &CircuitOpenError{Host: host, RetryAfter: wait}
+	}
+	if hc.failures >= cb.threshold {
+		if hc.probing {
+			return &CircuitOpenError{Host: host}
+		}
+		hc.probing = true
+	}
+	return nil
+}
+
+// cancelled lets another trial request through if the one that was cancelled
+// was the trial.
+func (cb *circuitBreaker) cancelled(host string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if hc, ok := cb.hosts[host]; ok {
+		hc.probing = false
+	}
+}
+
+func (cb *circuitBreaker) record(host string, failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if !failed {
+		delete(cb.hosts, host)
+		return
+	}
+
+	hc, ok := cb.hosts[host]
+	if !ok {
+		hc = &hostCircuit{}
+		cb.hosts[host] = hc
+	}
+	hc.failures++
+	hc.probing = false
+	if hc.failures >= cb.threshold {
+		hc.openUntil = cb.now().Add(cb.cooldown)
+	}
+}
@@ -0,0 +1,160 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// broadcastConfigKey is the guild config key naming the channel (by ID or
+// name) that broadcasts go to. Guilds without it get their system channel.
+const broadcastConfigKey = "broadcast_channel"
+
+// broadcastInterval spaces out broadcast messages. discordgo waits out rate
+// limits on its own; this keeps a large broadcast from running into them.
+var broadcastInterval = 250 * time.Millisecond
+
+// broadcastTarget is where a broadcast goes in one guild. Channel is a channel
+// ID or name, or empty if the guild has nowhere to send it.
+type broadcastTarget struct {
+	GuildID string
+	Channel string
+}
+
+// BroadcastResult reports the outcome of a broadcast per guild.
+type BroadcastResult struct {
+	Sent   []string          // guild IDs
+	Failed map[string]string // guild ID -> error
+}
+
+// guilds returns the guilds the bot is in, from the state cache.
+func (e *Engine) guilds() ([]*discordgo.Guild, error) {
+	state := e.messageState()
+	if state == nil {
+		return nil, fmt.Errorf("the guild list is not available in this session")
+	}
+	state.RLock()
+	defer state.RUnlock()
+	return append([]*discordgo.Guild(nil), state.Guilds...), nil
+}
+
+// broadcastTargets picks the channel for each guild: the broadcast_channel
+// guild config if set, else the guild's system channel. Must be called on the
+// dispatcher goroutine.
+func (e *Engine) broadcastTargets(guilds []*discordgo.Guild) []broadcastTarget {
+	targets := make([]broadcastTarget, 0, len(guilds))
+	for _, guild := range guilds {
+		target := broadcastTarget{GuildID: guild.ID, Channel: guild.SystemChannelID}
+		value, err := e.GuildConfigGet(guild.ID, broadcastConfigKey, lua.LNil)
+		if err != nil {
+			log.Printf("broadcast: reading %s for guild %s: %v", broadcastConfigKey, guild.ID, err)
+		} else if channel := lua.LVAsString(value); channel != "" {
+			target.Channel = channel
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// sendBroadcast sends content to every target, one message per interval, and
+// logs the outcome for each guild. It doesn't touch the Lua state, so it can
+// run on its own goroutine. Targets not reached before ctx is done fail.
+func (e *Engine) sendBroadcast(ctx context.Context, targets []broadcastTarget, content string) BroadcastResult {
+	result := BroadcastResult{Failed: make(map[string]string)}
+	mentions := e.defaultAllowedMentions()
+
+	for i, target := range targets {
+		if i > 0 {
+			select {
+			case <-time.After(broadcastInterval):
+			case <-ctx.Done():
+			}
+		}
+		err := ctx.Err()
+		if err == nil {
+			err = e.sendBroadcastTo(target, content, mentions)
+		}
+		if err != nil {
+			log.Printf("broadcast: guild %s failed: %v", target.GuildID, err)
+			result.Failed[target.GuildID] = err.Error()
+			continue
+		}
+		log.Printf("broadcast: sent to guild %s", target.GuildID)
+		result.Sent = append(result.Sent, target.GuildID)
+	}
+	return result
+}
+
+func (e *Engine) sendBroadcastTo(target broadcastTarget, content string, mentions *discordgo.MessageAllowedMentions) error {
+	if target.Channel == "" {
+		return fmt.Errorf("no %s configured and no system channel", broadcastConfigKey)
+	}
+	channelID := target.Channel
+	if !isSnowflake(channelID) {
+		var err error
+		if channelID, err = e.resolveChannel(target.GuildID, channelID); err != nil {
+			return err
+		}
+	}
+	_, err := e.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: mentions,
+	})
+	return err
+}
+
+// isSnowflake reports whether s looks like a Discord ID.
+func isSnowflake(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// broadcastResultToLua converts a result into a {sent = {guild_id, ...},
+// failed = {[guild_id] = error}} table.
+func broadcastResultToLua(L *lua.LState, result BroadcastResult) *lua.LTable {
+	sent := L.NewTable()
+	for _, guildID := range result.Sent {
+		sent.Append(lua.LString(guildID))
+	}
+	failed := L.NewTable()
+	for guildID, err := range result.Failed {
+		failed.RawSetString(guildID, lua.LString(err))
+	}
+	tbl := L.NewTable()
+	tbl.RawSetString("sent", sent)
+	tbl.RawSetString("failed", failed)
+	return tbl
+}
+
+// requireOwner returns an error for the owner-only function fn unless the
+// command being dispatched was run by an owner.
+func (e *Engine) requireOwner(fn string) error {
+	if !e.callerIsOwner() {
+		return fmt.Errorf("%s requires a command run by an owner", fn)
+	}
+	return nil
+}
+
+// callerIsOwner reports whether the command being dispatched was run by a
+// user with the owner role.
+func (e *Engine) callerIsOwner() bool {
+	if e.currentCaller == "" || e.users == nil {
+		return false
+	}
+	ok, err := e.users.HasRole(e.currentCaller, "owner")
+	if err != nil {
+		log.Printf("Permission check error for user %s: %v", e.currentCaller, err)
+	}
+	return ok
+}
@@ -0,0 +1,88 @@
+package lua
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/leihog/discord-bot/internal/users"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestBroadcastTargetsAndSend(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{channels: []*discordgo.Channel{
+		{ID: "200", Name: "announcements", Type: discordgo.ChannelTypeGuildText},
+	}}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	oldInterval := broadcastInterval
+	broadcastInterval = 0
+	t.Cleanup(func() { broadcastInterval = oldInterval })
+
+	if err := engine.GuildConfigSet("g2", broadcastConfigKey, lua.LString("#announcements")); err != nil {
+		t.Fatalf("GuildConfigSet failed: %v", err)
+	}
+	targets := engine.broadcastTargets([]*discordgo.Guild{
+		{ID: "g1", SystemChannelID: "100"},
+		{ID: "g2", SystemChannelID: "101"},
+		{ID: "g3"},
+	})
+
+	result := engine.sendBroadcast(engine.context(), targets, "Maintenance at noon")
+	if len(result.Sent) != 2 || result.Sent[0] != "g1" || result.Sent[1] != "g2" {
+		t.Errorf("Expected g1 and g2 to be sent to, got %v", result.Sent)
+	}
+	if _, failed := result.Failed["g3"]; !failed || len(result.Failed) != 1 {
+		t.Errorf("Expected only g3 to fail, got %v", result.Failed)
+	}
+	if len(session.sentTo) != 2 || session.sentTo[0] != "100" || session.sentTo[1] != "200" {
+		t.Errorf("Expected the system channel and the configured channel, got %v", session.sentTo)
+	}
+}
+
+func TestBroadcastRequiresOwner(t *testing.T) {
+	db := setupTestDB(t)
+	store := users.New(db)
+	engine := New(db, &fakeSession{}, store)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	if err := store.EnsureUser("owner1", "boss"); err != nil {
+		t.Fatalf("EnsureUser failed: %v", err)
+	}
+	if err := store.AddRole("owner1", "owner"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+
+	loadTestScript(t, engine, "announce.lua", `
+		register_command("announce", "Broadcast", function(event)
+			results[event.author_id] = select(2, broadcast("hello"))
+		end)
+		results = {}
+		_, outside_err = broadcast("hello")
+	`)
+
+	for _, id := range []string{"user1", "owner1"} {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   "!announce",
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: id, Username: id},
+		}})
+	}
+	drainEvents(engine)
+
+	denied := "broadcast requires a command run by an owner"
+	if got := scriptGlobal(engine, "outside_err").String(); got != denied {
+		t.Errorf("Expected broadcast outside a command to be refused, got %q", got)
+	}
+	results := scriptGlobal(engine, "results").(*lua.LTable)
+	if got := results.RawGetString("user1").String(); got != denied {
+		t.Errorf("Expected a non-owner to be refused, got %q", got)
+	}
+	// The owner passes the permission check; the fake session has no guild list
+	if got := results.RawGetString("owner1").String(); got == denied {
+		t.Error("Expected the owner to pass the permission check")
+	}
+}
@@ -0,0 +1,94 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelCache maps guild ID → lower-cased channel name → channel ID. Entries
+// are filled lazily from the API and dropped when Discord reports a channel
+// change in that guild, so recreated channels resolve to their new ID.
+type channelCache struct {
+	mu     sync.Mutex
+	guilds map[string]map[string]string
+}
+
+func newChannelCache() *channelCache {
+	return &channelCache{guilds: make(map[string]map[string]string)}
+}
+
+func (c *channelCache) invalidate(guildID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.guilds, guildID)
+}
+
+// resolveChannel returns the ID of the text channel called name in the guild.
+// A leading '#' is ignored and names are matched case-insensitively.
+func (e *Engine) resolveChannel(guildID, name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+
+	e.channels.mu.Lock()
+	names, cached := e.channels.guilds[guildID]
+	e.channels.mu.Unlock()
+
+	if !cached {
+		channels, err := e.session.GuildChannels(guildID)
+		if err != nil {
+			return "", err
+		}
+		names = make(map[string]string, len(channels))
+		for _, ch := range channels {
+			if ch.Type == discordgo.ChannelTypeGuildText || ch.Type == discordgo.ChannelTypeGuildNews {
+				names[strings.ToLower(ch.Name)] = ch.ID
+			}
+		}
+		e.channels.mu.Lock()
+		e.channels.guilds[guildID] = names
+		e.channels.mu.Unlock()
+	}
+
+	id, ok := names[name]
+	if !ok {
+		return "", fmt.Errorf("no text channel named '%s' in guild %s", name, guildID)
+	}
+	return id, nil
+}
+
+// InvalidateChannelCache forgets the cached channel names of a guild. Call it
+// whenever a channel in the guild is created, renamed or deleted.
+func (e *Engine) InvalidateChannelCache(guildID string) {
+	e.channels.invalidate(guildID)
+}
+
+// botHasPermissions reports whether the bot has all of perms in a channel,
+// computed from the state cache; administrators and the guild owner have them
+// all. In a thread the parent channel's overwrites apply and sending needs
+// SendMessagesInThreads rather than SendMessages. DMs allow everything.
+func (e *Engine) botHasPermissions(channelID string, perms int64) (bool, error) {
+	state := e.messageState()
+	if state == nil || state.User == nil {
+		return false, fmt.Errorf("permissions are not available in this session")
+	}
+	channel, err := state.Channel(channelID)
+	if err != nil {
+		return false, fmt.Errorf("channel %s is not in the cache", channelID)
+	}
+	if channel.GuildID == "" {
+		return true, nil
+	}
+	if channel.IsThread() {
+		if perms&discordgo.PermissionSendMessages != 0 {
+			perms = perms&^discordgo.PermissionSendMessages | discordgo.PermissionSendMessagesInThreads
+		}
+		channelID = channel.ParentID
+	}
+	actual, err := state.UserChannelPermissions(state.User.ID, channelID)
+	if err != nil {
+		return false, fmt.Errorf("permissions in channel %s: %w", channelID, err)
+	}
+	return actual&perms == perms, nil
+}
@@ -0,0 +1,156 @@
+package lua
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Argument types for the args option of register_command. "text" takes the
+// rest of the message and must come last.
+var argTypes = map[string]bool{
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"user":    true,
+	"channel": true,
+	"role":    true,
+	"text":    true,
+}
+
+// Mentions accepted by the user, channel and role argument types. A bare ID
+// is accepted too.
+var (
+	userMentionPattern    = regexp.MustCompile(`^<@!?(\d+)>$`)
+	channelMentionPattern = regexp.MustCompile(`^<#(\d+)>$`)
+	roleMentionPattern    = regexp.MustCompile(`^<@&(\d+)>$`)
+)
+
+// argSpec describes one declared command argument.
+type argSpec struct {
+	Name     string
+	Type     string
+	Required bool
+}
+
+// parseArgSpecs reads the args option: an array of {name, type, required}
+// tables. type defaults to "string" and required to true. Optional arguments
+// must follow the required ones.
+func parseArgSpecs(tbl *lua.LTable) ([]argSpec, error) {
+	var specs []argSpec
+	seen := make(map[string]bool)
+	for i := 1; i <= tbl.Len(); i++ {
+		t, ok := tbl.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("argument %d must be a table", i)
+		}
+		spec := argSpec{
+			Name:     lua.LVAsString(t.RawGetString("name")),
+			Type:     lua.LVAsString(t.RawGetString("type")),
+			Required: t.RawGetString("required") != lua.LFalse,
+		}
+		if spec.Type == "" {
+			spec.Type = "string"
+		}
+		switch {
+		case spec.Name == "":
+			return nil, fmt.Errorf("argument %d has no name", i)
+		case seen[spec.Name]:
+			return nil, fmt.Errorf("argument '%s' is declared twice", spec.Name)
+		case !argTypes[spec.Type]:
+			return nil, fmt.Errorf("argument '%s' has unknown type '%s'", spec.Name, spec.Type)
+		case i > 1 && specs[i-2].Type == "text":
+			return nil, fmt.Errorf("argument '%s' follows the text argument '%s', which takes the rest of the message", spec.Name, specs[i-2].Name)
+		case spec.Required && i > 1 && !specs[i-2].Required:
+			return nil, fmt.Errorf("required argument '%s' follows an optional one", spec.Name)
+		}
+		seen[spec.Name] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// commandUsage formats the usage line of a command with declared arguments,
+// e.g. "!give <user> [amount]".
+func commandUsage(prefix, name string, specs []argSpec) string {
+	var b strings.Builder
+	b.WriteString(prefix + name)
+	for _, spec := range specs {
+		argName := spec.Name
+		if spec.Type == "text" {
+			argName += "..."
+		}
+		if spec.Required {
+			fmt.Fprintf(&b, " <%s>", argName)
+		} else {
+			fmt.Fprintf(&b, " [%s]", argName)
+		}
+	}
+	return b.String()
+}
+
+// parseArgs validates the words following a command against specs and
+// returns them by name, converted to their declared types. Missing optional
+// arguments are left out.
+func parseArgs(L *lua.LState, specs []argSpec, words []string) (*lua.LTable, error) {
+	params := L.NewTable()
+	for i, spec := range specs {
+		if i >= len(words) {
+			if spec.Required {
+				return nil, fmt.Errorf("missing %s", spec.Name)
+			}
+			continue
+		}
+		if spec.Type == "text" {
+			params.RawSetString(spec.Name, lua.LString(strings.Join(words[i:], " ")))
+			return params, nil
+		}
+		value, err := parseArg(spec, words[i])
+		if err != nil {
+			return nil, err
+		}
+		params.RawSetString(spec.Name, value)
+	}
+	if len(words) > len(specs) {
+		return nil, fmt.Errorf("too many arguments")
+	}
+	return params, nil
+}
+
+// parseArg converts one word to the type of spec.
+func parseArg(spec argSpec, word string) (lua.LValue, error) {
+	switch spec.Type {
+	case "number":
+		if n, err := strconv.ParseFloat(word, 64); err == nil {
+			return lua.LNumber(n), nil
+		}
+		return nil, fmt.Errorf("%s must be a number, got '%s'", spec.Name, word)
+	case "integer":
+		if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+			return lua.LNumber(n), nil
+		}
+		return nil, fmt.Errorf("%s must be a whole number, got '%s'", spec.Name, word)
+	case "user":
+		return parseMentionArg(spec, word, userMentionPattern, "a user mention")
+	case "channel":
+		return parseMentionArg(spec, word, channelMentionPattern, "a channel mention")
+	case "role":
+		return parseMentionArg(spec, word, roleMentionPattern, "a role mention")
+	}
+	return lua.LString(word), nil
+}
+
+// parseMentionArg returns the ID of a mention matching pattern, or of a bare
+// ID.
+func parseMentionArg(spec argSpec, word string, pattern *regexp.Regexp, what string) (lua.LValue, error) {
+	if m := pattern.FindStringSubmatch(word); m != nil {
+		return lua.LString(m[1]), nil
+	}
+	if isSnowflake(word) {
+		return lua.LString(word), nil
+	}
+	return nil, fmt.Errorf("%s must be %s or an ID, got '%s'", spec.Name, what, word)
+}
@@ -0,0 +1,109 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestCommandArgs(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "coins.lua", `
+		calls = 0
+		register_command("give", "Give coins", function(event)
+			calls = calls + 1
+			user, amount, note = event.params.user, event.params.amount, event.params.note
+		end, { cooldown = 60, args = {
+			{ name = "user", type = "user" },
+			{ name = "amount", type = "integer", required = false },
+			{ name = "note", type = "text", required = false },
+		} })
+		register_command("bad", "Required after optional", function() end, { args = {
+			{ name = "a", required = false },
+			{ name = "b" },
+		} })
+	`)
+
+	send := func(content string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		drainEvents(engine)
+	}
+
+	send("!give")
+	send("!give <@123> lots")
+	if calls := scriptGlobal(engine, "calls"); calls != lua.LNumber(0) {
+		t.Fatalf("Expected invalid input not to reach the callback, got %v calls", calls)
+	}
+	if len(session.sent) != 2 {
+		t.Fatalf("Expected 2 usage replies, got %d", len(session.sent))
+	}
+	if want := "Invalid arguments: missing user. Usage: `!give <user> [amount] [note...]`"; session.sent[0].Content != want {
+		t.Errorf("Expected %q, got %q", want, session.sent[0].Content)
+	}
+	if !strings.Contains(session.sent[1].Content, "amount must be a whole number, got 'lots'") {
+		t.Errorf("Expected a type error, got %q", session.sent[1].Content)
+	}
+	send("!give @everyone")
+	if reply := session.sent[len(session.sent)-1]; reply.AllowedMentions == nil || len(reply.AllowedMentions.Parse) != 0 {
+		t.Errorf("Expected the usage reply to allow no mentions, got %+v", reply.AllowedMentions)
+	}
+
+	// Rejected input doesn't start the cooldown
+	send("!give <@!123> 5 for the   help")
+	if calls := scriptGlobal(engine, "calls"); calls != lua.LNumber(1) {
+		t.Fatalf("Expected the callback to run once, got %v", calls)
+	}
+	if user := scriptGlobal(engine, "user").String(); user != "123" {
+		t.Errorf("Expected the mention to be passed as an ID, got %q", user)
+	}
+	if amount := scriptGlobal(engine, "amount"); amount != lua.LNumber(5) {
+		t.Errorf("Expected amount 5, got %v", amount)
+	}
+	if note := scriptGlobal(engine, "note").String(); note != "for the help" {
+		t.Errorf("Expected the rest of the message as note, got %q", note)
+	}
+
+	if _, exists := engine.commands["bad"]; exists {
+		t.Error("Expected a required argument after an optional one to be rejected")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	specs := []argSpec{
+		{Name: "channel", Type: "channel", Required: true},
+		{Name: "role", Type: "role", Required: true},
+		{Name: "ratio", Type: "number", Required: false},
+	}
+
+	params, err := parseArgs(L, specs, []string{"<#42>", "7", "0.5"})
+	if err != nil {
+		t.Fatalf("parseArgs failed: %v", err)
+	}
+	if params.RawGetString("channel").String() != "42" || params.RawGetString("role").String() != "7" || params.RawGetString("ratio") != lua.LNumber(0.5) {
+		t.Errorf("Unexpected params: channel %v, role %v, ratio %v",
+			params.RawGetString("channel"), params.RawGetString("role"), params.RawGetString("ratio"))
+	}
+
+	for _, words := range [][]string{
+		{"general", "7"},           // not a mention
+		{"<#42>", "<@7>"},          // a user where a role is expected
+		{"<#42>", "7", "0.5", "x"}, // too many
+	} {
+		if _, err := parseArgs(L, specs, words); err == nil {
+			t.Errorf("parseArgs(%q): expected an error", words)
+		}
+	}
+}
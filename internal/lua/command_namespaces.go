@@ -0,0 +1,141 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Every command is also registered under a qualified name, "namespace:name",
+// so two scripts can register the same command: the first keeps the plain
+// name and the other stays reachable as e.g. !pack_b:ping. The namespace is
+// the script's file name without .lua unless COMMAND_NAMESPACES sets one.
+
+// commandNamespace returns the namespace of the commands script registers.
+func (e *Engine) commandNamespace(script *LuaScript) string {
+	if ns, ok := e.cfg.CommandNamespaces[script.Name]; ok {
+		return ns
+	}
+	return strings.TrimSuffix(script.Name, ".lua")
+}
+
+// QualifiedName is the name the command is always reachable under.
+func (c *Command) QualifiedName() string {
+	return c.Namespace + ":" + c.Name
+}
+
+// findCommand looks a typed command name up: plain names first, then
+// qualified ones, then patterns. It also returns the name to report to the
+// callback, which for a qualified name is the plain one so scripts checking
+// event.command keep working. The caller must hold cmdMutex.
+func (e *Engine) findCommand(name string) (*Command, string) {
+	if cmd, ok := e.commands[name]; ok {
+		return cmd, name
+	}
+	if cmd, ok := e.qualifiedCommands[name]; ok {
+		return cmd, cmd.Name
+	}
+	return e.matchCommandPattern(name), name
+}
+
+// removeCommand unregisters cmd. If it held the plain name, a command of the
+// same name from another script takes over, so unloading one of two
+// conflicting scripts leaves the other reachable as !name. The caller must
+// hold cmdMutex.
+func (e *Engine) removeCommand(cmd *Command) {
+	delete(e.qualifiedCommands, cmd.QualifiedName())
+	if e.commands[cmd.Name] != cmd {
+		return
+	}
+	delete(e.commands, cmd.Name)
+	script := cmd.Callback.Script
+	for i, name := range script.Commands {
+		if name == cmd.Name {
+			script.Commands = append(script.Commands[:i], script.Commands[i+1:]...)
+			break
+		}
+	}
+
+	// Promote the earliest other registration
+	var other *Command
+	for _, candidate := range e.qualifiedCommands {
+		if candidate.Name == cmd.Name && (other == nil || candidate.seq < other.seq) {
+			other = candidate
+		}
+	}
+	if other == nil {
+		return
+	}
+	e.commands[other.Name] = other
+	other.Callback.Script.Commands = append(other.Callback.Script.Commands, other.Name)
+	scriptLogf(other.Callback.Script, "Command '%s' is now handled by this script", other.Name)
+}
+
+// removeScriptCommands unregisters every command of script.
+func (e *Engine) removeScriptCommands(script *LuaScript) {
+	e.cmdMutex.Lock()
+	defer e.cmdMutex.Unlock()
+
+	for _, cmd := range e.qualifiedCommands {
+		if cmd.Callback.Script == script {
+			e.removeCommand(cmd)
+		}
+	}
+}
+
+// unregisterCommand removes the command or command pattern name for
+// unregister_command and reports whether there was one. The calling script's
+// own registration comes first, even when another script holds the plain
+// name. Another script's command must be named by its qualified name, and
+// removing it, or another script's pattern, requires a command run by an
+// owner. Go code calling it outside any script is not restricted.
+func (e *Engine) unregisterCommand(name string) (bool, error) {
+	e.cmdMutex.Lock()
+	defer e.cmdMutex.Unlock()
+
+	script := e.currentScript
+	if script != nil {
+		own, ok := e.qualifiedCommands[e.commandNamespace(script)+":"+name]
+		if ok && own.Callback.Script == script {
+			e.removeCommand(own)
+			return true, nil
+		}
+	}
+	if cmd, ok := e.qualifiedCommands[name]; ok {
+		if script != nil && cmd.Callback.Script != script {
+			if err := e.requireOwner("removing another script's command"); err != nil {
+				return false, err
+			}
+		}
+		e.removeCommand(cmd)
+		return true, nil
+	}
+	if cmd, ok := e.commands[name]; ok {
+		if script != nil {
+			return false, fmt.Errorf("command '%s' is registered by %s, use its qualified name '%s'",
+				name, cmd.Callback.Script.Name, cmd.QualifiedName())
+		}
+		e.removeCommand(cmd)
+		return true, nil
+	}
+
+	// Patterns have no qualified name, so prefer the script's own
+	index := -1
+	for i, pattern := range e.commandPatterns {
+		if pattern.Name != name {
+			continue
+		}
+		if index < 0 || pattern.Callback.Script == script {
+			index = i
+		}
+	}
+	if index < 0 {
+		return false, nil
+	}
+	if script != nil && e.commandPatterns[index].Callback.Script != script {
+		if err := e.requireOwner("removing another script's command pattern"); err != nil {
+			return false, err
+		}
+	}
+	e.commandPatterns = append(e.commandPatterns[:index], e.commandPatterns[index+1:]...)
+	return true, nil
+}
@@ -0,0 +1,153 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/leihog/discord-bot/internal/users"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestCommandNamespaces(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, &fakeSession{}, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.CommandNamespaces = map[string]string{"pack_c.lua": "c"}
+	engine.Initialize()
+
+	engine.state.SetGlobal("calls", engine.state.NewTable())
+	for _, name := range []string{"pack_a.lua", "pack_b.lua", "pack_c.lua"} {
+		loadTestScript(t, engine, name, `
+			register_command("ping", "Pong", function(event)
+				table.insert(calls, "`+name+` " .. event.command)
+			end)
+		`)
+	}
+
+	send := func(content string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		drainEvents(engine)
+	}
+	calls := func() string {
+		tbl := scriptGlobal(engine, "calls").(*lua.LTable)
+		var got []string
+		for i := 1; i <= tbl.Len(); i++ {
+			got = append(got, tbl.RawGetInt(i).String())
+		}
+		engine.state.SetGlobal("calls", engine.state.NewTable())
+		return strings.Join(got, ",")
+	}
+
+	send("!ping")
+	send("!pack_b:ping")
+	send("!c:ping")
+	send("!pack_c:ping") // renamed by COMMAND_NAMESPACES
+	if got, want := calls(), "pack_a.lua ping,pack_b.lua ping,pack_c.lua ping"; got != want {
+		t.Errorf("Expected calls %q, got %q", want, got)
+	}
+
+	if err := engine.state.DoString(`
+		local names = {}
+		for name in pairs(get_commands()) do table.insert(names, name) end
+		table.sort(names)
+		listed = table.concat(names, ",")
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if got := scriptGlobal(engine, "listed").String(); got != "c:ping,pack_b:ping,ping" {
+		t.Errorf("Expected shadowed commands to be listed by qualified name, got %q", got)
+	}
+
+	// Unloading the owner of !ping hands it to the next script
+	engine.unloadScript("pack_a.lua")
+	send("!ping")
+	send("!pack_a:ping")
+	if got, want := calls(), "pack_b.lua ping"; got != want {
+		t.Errorf("Expected calls %q after unloading pack_a.lua, got %q", want, got)
+	}
+	engine.unloadScript("pack_b.lua")
+	send("!ping")
+	if got, want := calls(), "pack_c.lua ping"; got != want {
+		t.Errorf("Expected calls %q after unloading pack_b.lua, got %q", want, got)
+	}
+}
+
+func TestUnregisterCommandScopedToScript(t *testing.T) {
+	db := setupTestDB(t)
+	store := users.New(db)
+	engine := New(db, &fakeSession{}, store)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	if err := store.EnsureUser("u1", "alice"); err != nil {
+		t.Fatalf("EnsureUser failed: %v", err)
+	}
+	if err := store.AddRole("u1", "owner"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+
+	loadTestScript(t, engine, "pack_a.lua", `
+		register_command("ping", "Pong", function() end)
+		register_command_pattern("^tag_", "Tags", function() end)
+	`)
+	loadTestScript(t, engine, "pack_b.lua", `
+		register_command("ping", "Pong", function() end)
+		register_command("drop", "Unregisters a command", function(event)
+			local ok, err = unregister_command(event.args[2])
+			result = tostring(ok) .. " " .. tostring(err)
+		end)
+	`)
+
+	drop := func(userID, name string) string {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   "!drop " + name,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: userID, Username: userID},
+		}})
+		drainEvents(engine)
+		return scriptGlobal(engine, "result").String()
+	}
+	registered := func(name string) bool {
+		_, ok := engine.qualifiedCommands[name]
+		return ok
+	}
+
+	// The plain name is held by pack_a, but pack_b removes its own command
+	if got := drop("u2", "ping"); got != "true nil" {
+		t.Errorf("Expected pack_b to remove its own ping, got %q", got)
+	}
+	if registered("pack_b:ping") || !registered("pack_a:ping") {
+		t.Error("Expected only pack_b:ping to be removed")
+	}
+
+	if got := drop("u2", "ping"); !strings.Contains(got, "use its qualified name 'pack_a:ping'") {
+		t.Errorf("Expected another script's command to need its qualified name, got %q", got)
+	}
+	if got := drop("u2", "pack_a:ping"); !strings.Contains(got, "requires a command run by an owner") {
+		t.Errorf("Expected removing another script's command to be owner only, got %q", got)
+	}
+	if got := drop("u2", "^tag_"); !strings.Contains(got, "requires a command run by an owner") {
+		t.Errorf("Expected removing another script's pattern to be owner only, got %q", got)
+	}
+	if !registered("pack_a:ping") || len(engine.commandPatterns) != 1 {
+		t.Error("Expected pack_a's registrations to be kept")
+	}
+
+	if got := drop("u1", "pack_a:ping"); got != "true nil" {
+		t.Errorf("Expected an owner to remove another script's command, got %q", got)
+	}
+	if got := drop("u1", "^tag_"); got != "true nil" {
+		t.Errorf("Expected an owner to remove another script's pattern, got %q", got)
+	}
+	if registered("pack_a:ping") || len(engine.commandPatterns) != 0 {
+		t.Error("Expected pack_a's registrations to be removed")
+	}
+	if got := drop("u1", "nope"); got != "false nil" {
+		t.Errorf("Expected false for an unknown command, got %q", got)
+	}
+}
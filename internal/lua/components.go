@@ -0,0 +1,170 @@
+package lua
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Discord's component limits.
+const (
+	maxActionRows     = 5
+	maxSelectOptions  = 25
+	maxCustomIDLength = 100
+)
+
+// selectMenuTypes maps the select component's menu field to discordgo types.
+// "string" menus list their own options; the others are populated by Discord.
+var selectMenuTypes = map[string]discordgo.SelectMenuType{
+	"string":      discordgo.StringSelectMenu,
+	"user":        discordgo.UserSelectMenu,
+	"role":        discordgo.RoleSelectMenu,
+	"channel":     discordgo.ChannelSelectMenu,
+	"mentionable": discordgo.MentionableSelectMenu,
+}
+
+// parseComponents converts the components send option into action rows. Each
+// entry is a component table and gets its own row, as select menus fill a row.
+func parseComponents(tbl *lua.LTable) ([]discordgo.MessageComponent, error) {
+	n := tbl.Len()
+	if n > maxActionRows {
+		return nil, fmt.Errorf("a message can hold at most %d components, got %d", maxActionRows, n)
+	}
+	rows := make([]discordgo.MessageComponent, 0, n)
+	for i := 1; i <= n; i++ {
+		t, ok := tbl.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("component %d must be a table", i)
+		}
+		var component discordgo.MessageComponent
+		var err error
+		switch kind := lua.LVAsString(t.RawGetString("type")); kind {
+		case "select":
+			component, err = parseSelectMenu(t)
+		default:
+			err = fmt.Errorf("unsupported component type '%s'", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("component %d: %w", i, err)
+		}
+		rows = append(rows, discordgo.ActionsRow{Components: []discordgo.MessageComponent{component}})
+	}
+	return rows, nil
+}
+
+// parseSelectMenu reads {custom_id, menu, placeholder, min_values, max_values,
+// disabled, options = {{label, value, description, default}, ...}}.
+func parseSelectMenu(tbl *lua.LTable) (discordgo.SelectMenu, error) {
+	menu := discordgo.SelectMenu{
+		CustomID:    lua.LVAsString(tbl.RawGetString("custom_id")),
+		Placeholder: lua.LVAsString(tbl.RawGetString("placeholder")),
+		MaxValues:   int(lua.LVAsNumber(tbl.RawGetString("max_values"))),
+		Disabled:    lua.LVAsBool(tbl.RawGetString("disabled")),
+	}
+	if menu.CustomID == "" || len(menu.CustomID) > maxCustomIDLength {
+		return menu, fmt.Errorf("custom_id must be 1-%d characters", maxCustomIDLength)
+	}
+
+	menuName := lua.LVAsString(tbl.RawGetString("menu"))
+	if menuName == "" {
+		menuName = "string"
+	}
+	menuType, ok := selectMenuTypes[menuName]
+	if !ok {
+		return menu, fmt.Errorf("unknown select menu type '%s'", menuName)
+	}
+	menu.MenuType = menuType
+
+	if minValues, ok := tbl.RawGetString("min_values").(lua.LNumber); ok {
+		n := int(minValues)
+		menu.MinValues = &n
+	}
+
+	if options, ok := tbl.RawGetString("options").(*lua.LTable); ok {
+		for i := 1; i <= options.Len(); i++ {
+			opt, ok := options.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return menu, fmt.Errorf("option %d must be a table", i)
+			}
+			option := discordgo.SelectMenuOption{
+				Label:       lua.LVAsString(opt.RawGetString("label")),
+				Value:       lua.LVAsString(opt.RawGetString("value")),
+				Description: lua.LVAsString(opt.RawGetString("description")),
+				Default:     lua.LVAsBool(opt.RawGetString("default")),
+			}
+			if option.Value == "" {
+				option.Value = option.Label
+			}
+			if option.Label == "" {
+				return menu, fmt.Errorf("option %d needs a label", i)
+			}
+			menu.Options = append(menu.Options, option)
+		}
+	}
+	if menuType == discordgo.StringSelectMenu && (len(menu.Options) == 0 || len(menu.Options) > maxSelectOptions) {
+		return menu, fmt.Errorf("a select menu needs 1-%d options, got %d", maxSelectOptions, len(menu.Options))
+	}
+	return menu, nil
+}
+
+// ProcessInteraction handles component interactions. Select menu choices are
+// acknowledged straight away, since Discord expects an answer within three
+// seconds, and then passed to the on_select hooks.
+func (e *Engine) ProcessInteraction(i *discordgo.InteractionCreate) {
+	if e.IsShuttingDown() || i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	componentData := i.MessageComponentData()
+	menuName := selectMenuName(componentData.ComponentType)
+	if menuName == "" {
+		return
+	}
+
+	err := e.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		log.Printf("Failed to acknowledge interaction %s: %v", i.ID, err)
+	}
+
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+
+	values := e.state.NewTable()
+	for _, value := range componentData.Values {
+		values.Append(lua.LString(value))
+	}
+
+	data := e.state.NewTable()
+	data.RawSetString("custom_id", lua.LString(componentData.CustomID))
+	data.RawSetString("values", values)
+	data.RawSetString("menu", lua.LString(menuName))
+	data.RawSetString("channel_id", lua.LString(i.ChannelID))
+	data.RawSetString("guild_id", lua.LString(i.GuildID))
+	if i.Message != nil {
+		data.RawSetString("message_id", lua.LString(i.Message.ID))
+	}
+	source := "interaction"
+	if user != nil {
+		data.RawSetString("user", lua.LString(user.Username))
+		data.RawSetString("user_id", lua.LString(user.ID))
+		source = user.Username
+	}
+
+	e.enqueueEvent(BotEvent{Data: data, EventType: "on_select"}, source)
+}
+
+// selectMenuName returns the menu name for a select component type, or "" for
+// other components.
+func selectMenuName(componentType discordgo.ComponentType) string {
+	for name, menuType := range selectMenuTypes {
+		if discordgo.ComponentType(menuType) == componentType {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSendSelectMenu(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		send_message("c1", "Pick one", { components = {
+			{ type = "select", custom_id = "team", placeholder = "Team", max_values = 2,
+			  options = { { label = "Red" }, { label = "Blue", value = "b", default = true } } },
+			{ type = "select", custom_id = "roles", menu = "role" },
+		} })
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if len(session.sent) != 1 || len(session.sent[0].Components) != 2 {
+		t.Fatalf("Expected one message with two rows, got %#v", session.sent)
+	}
+
+	menu := session.sent[0].Components[0].(discordgo.ActionsRow).Components[0].(discordgo.SelectMenu)
+	if menu.CustomID != "team" || menu.MaxValues != 2 || len(menu.Options) != 2 {
+		t.Errorf("Unexpected menu: %+v", menu)
+	}
+	if menu.Options[0].Value != "Red" || menu.Options[1].Value != "b" || !menu.Options[1].Default {
+		t.Errorf("Unexpected options: %+v", menu.Options)
+	}
+	roles := session.sent[0].Components[1].(discordgo.ActionsRow).Components[0].(discordgo.SelectMenu)
+	if roles.MenuType != discordgo.RoleSelectMenu {
+		t.Errorf("Expected a role select menu, got %v", roles.MenuType)
+	}
+}
+
+func TestParseComponentsErrors(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	tests := []struct {
+		name   string
+		script string
+		errMsg string
+	}{
+		{"unknown type", `return { { type = "button", custom_id = "x" } }`, "unsupported component type"},
+		{"missing id", `return { { type = "select", options = { { label = "a" } } } }`, "custom_id"},
+		{"no options", `return { { type = "select", custom_id = "x" } }`, "needs 1-25 options"},
+		{"bad menu", `return { { type = "select", custom_id = "x", menu = "emoji" } }`, "unknown select menu type"},
+		{"too many rows", `local t = {} for i = 1, 6 do t[i] = { type = "select", custom_id = "x" .. i, menu = "user" } end return t`, "at most 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := engine.state.DoString(tt.script); err != nil {
+				t.Fatalf("DoString failed: %v", err)
+			}
+			tbl := engine.state.CheckTable(-1)
+			engine.state.Pop(1)
+			_, err := parseComponents(tbl)
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+// interactionSession records interaction responses.
+type interactionSession struct {
+	UnsupportedSession
+	responses []*discordgo.InteractionResponse
+}
+
+func (s *interactionSession) InteractionRespond(_ *discordgo.Interaction, resp *discordgo.InteractionResponse, _ ...discordgo.RequestOption) error {
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+func TestProcessInteractionSelect(t *testing.T) {
+	db := setupTestDB(t)
+	session := &interactionSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "menu.lua", `
+		register_hook("on_select", function(event)
+			picked = event.custom_id .. ":" .. table.concat(event.values, ",") .. ":" .. event.user_id .. ":" .. event.menu
+		end)
+	`)
+
+	engine.ProcessInteraction(&discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        "i1",
+		Type:      discordgo.InteractionMessageComponent,
+		ChannelID: "c1",
+		GuildID:   "g1",
+		Member:    &discordgo.Member{User: &discordgo.User{ID: "u1", Username: "alice"}},
+		Data: discordgo.MessageComponentInteractionData{
+			CustomID:      "team",
+			ComponentType: discordgo.SelectMenuComponent,
+			Values:        []string{"red", "blue"},
+		},
+	}})
+
+	if len(session.responses) != 1 || session.responses[0].Type != discordgo.InteractionResponseDeferredMessageUpdate {
+		t.Fatalf("Expected the interaction to be acknowledged, got %v", session.responses)
+	}
+	(<-engine.eventQueue).Dispatch(engine)
+	if got := scriptGlobal(engine, "picked").String(); got != "team:red,blue:u1:string" {
+		t.Errorf("Unexpected on_select data: %s", got)
+	}
+}
@@ -0,0 +1,273 @@
+package lua
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/leihog/discord-bot/internal/database"
+)
+
+// Cron jobs run a script callback at the times a cron expression matches,
+// such as "0 8 * * *" for 08:00 every day. Unlike timers their schedule is
+// absolute, so the spec is stored in the cron_jobs table: when the script
+// schedules the job again after a restart, runs missed while the bot was down
+// are detected and, if the job asks for it, made up with a single catch-up
+// run.
+
+// cronJob is a cron job of a loaded script.
+type cronJob struct {
+	name     string
+	spec     string
+	schedule *cronSchedule
+	callback HookInfo
+	timer    *time.Timer
+	next     time.Time
+}
+
+// cronList holds the scheduled cron jobs by script and name. Their timers
+// fire on their own goroutines while scripts change the list on the
+// dispatcher.
+type cronList struct {
+	mu     sync.Mutex
+	jobs   map[string]*cronJob
+	closed bool
+}
+
+func cronKey(script *LuaScript, name string) string {
+	return script.Name + "/" + name
+}
+
+// current reports whether job is still scheduled, i.e. it hasn't been
+// cancelled or replaced.
+func (c *cronList) current(job *cronJob) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.jobs[cronKey(job.callback.Script, job.name)] == job
+}
+
+// remove stops and removes the job of script called name, and reports whether
+// there was one.
+func (c *cronList) remove(script *LuaScript, name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cronKey(script, name)
+	job, ok := c.jobs[key]
+	if ok {
+		job.timer.Stop()
+		delete(c.jobs, key)
+	}
+	return ok
+}
+
+// removeScript stops the jobs of script. Their stored specs are kept, so the
+// script picks them up again when it is loaded next.
+func (c *cronList) removeScript(script *LuaScript) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, job := range c.jobs {
+		if job.callback.Script == script {
+			job.timer.Stop()
+			delete(c.jobs, key)
+		}
+	}
+}
+
+// stopAll stops every job and refuses new ones, for shutdown.
+func (c *cronList) stopAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for key, job := range c.jobs {
+		job.timer.Stop()
+		delete(c.jobs, key)
+	}
+}
+
+// scheduleCron schedules callback to run whenever spec matches, replacing the
+// calling script's job of the same name. If the job was stored with the same
+// spec before, runs missed since are logged, or with catchUp made up by one
+// run that is queued right away.
+func (e *Engine) scheduleCron(name, spec string, catchUp bool, callback *lua.LFunction) error {
+	script := e.currentScript
+	if script == nil || script.unloaded {
+		return errors.New("cron jobs can only be scheduled by a loaded script")
+	}
+	schedule, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	checkedAt := now
+	stored, err := e.db.GetCronJob(script.Name, name)
+	if err != nil {
+		return err
+	}
+	if stored != nil && stored.Spec == spec {
+		checkedAt = stored.CheckedAt
+	}
+
+	job := &cronJob{
+		name:     name,
+		spec:     spec,
+		schedule: schedule,
+		callback: HookInfo{Function: callback, Script: script, Name: "cron " + name},
+	}
+
+	missed, lastMissed := schedule.missedRuns(checkedAt, now)
+	if missed > 0 && !catchUp {
+		scriptLogf(script, "Cron job '%s' missed %d runs, the last at %s", name, missed, lastMissed.Format(time.DateTime))
+		checkedAt = now
+	}
+	if err := e.db.SaveCronJob(database.CronJob{Script: script.Name, Name: name, Spec: spec, CheckedAt: checkedAt}); err != nil {
+		return err
+	}
+
+	e.crons.mu.Lock()
+	if e.crons.closed {
+		e.crons.mu.Unlock()
+		return errors.New("cannot schedule cron jobs during shutdown")
+	}
+	if e.crons.jobs == nil {
+		e.crons.jobs = make(map[string]*cronJob)
+	}
+	if old, ok := e.crons.jobs[cronKey(script, name)]; ok {
+		old.timer.Stop()
+	}
+	e.crons.jobs[cronKey(script, name)] = job
+	e.armCron(job, now)
+	e.crons.mu.Unlock()
+
+	scriptLogf(script, "Scheduled cron job '%s' (%s), next run at %s", name, spec, job.next.Format(time.DateTime))
+	if missed > 0 && catchUp {
+		scriptLogf(script, "Cron job '%s' missed %d runs, catching up", name, missed)
+		e.enqueueFollowUp(CronEvent{job: job, ScheduledAt: lastMissed, CatchUp: true, Missed: missed}, "cron")
+	}
+	return nil
+}
+
+// armCron sets job's timer for its first run after t. The caller must hold
+// crons.mu.
+func (e *Engine) armCron(job *cronJob, t time.Time) {
+	job.next = job.schedule.next(t)
+	job.timer = time.AfterFunc(time.Until(job.next), func() {
+		e.fireCron(job)
+	})
+}
+
+// fireCron queues a run of job and sets the timer for the next one.
+func (e *Engine) fireCron(job *cronJob) {
+	e.crons.mu.Lock()
+	if e.crons.closed || e.crons.jobs[cronKey(job.callback.Script, job.name)] != job {
+		e.crons.mu.Unlock()
+		return
+	}
+	scheduledAt := job.next
+	// Schedule from now rather than scheduledAt if the timer fired late, e.g.
+	// after the machine was suspended: runs missed meanwhile would otherwise
+	// fire all at once
+	from := scheduledAt
+	if now := time.Now(); now.After(from) {
+		from = now
+	}
+	e.armCron(job, from)
+	e.crons.mu.Unlock()
+
+	if err := e.tryEnqueue(CronEvent{job: job, ScheduledAt: scheduledAt}); err != nil {
+		scriptLogf(job.callback.Script, "Warning: Could not enqueue cron job '%s' - %v", job.name, err)
+	}
+}
+
+// cancelCron cancels the calling script's job called name and forgets its
+// stored spec. It reports whether there was such a job.
+func (e *Engine) cancelCron(name string) (bool, error) {
+	script := e.currentScript
+	if script == nil {
+		return false, errors.New("cron jobs can only be cancelled by a loaded script")
+	}
+	scheduled := e.crons.remove(script, name)
+	stored, err := e.db.GetCronJob(script.Name, name)
+	if err != nil {
+		return scheduled, err
+	}
+	if stored != nil {
+		if err := e.db.DeleteCronJob(script.Name, name); err != nil {
+			return scheduled, err
+		}
+	}
+	return scheduled || stored != nil, nil
+}
+
+// reportUnscheduledCronJobs logs stored cron jobs that no loaded script has
+// scheduled again, since they won't run until it does.
+func (e *Engine) reportUnscheduledCronJobs() {
+	jobs, err := e.db.CronJobs()
+	if err != nil {
+		log.Println("Failed to read cron jobs:", err)
+		return
+	}
+	e.crons.mu.Lock()
+	defer e.crons.mu.Unlock()
+	for _, job := range jobs {
+		if _, ok := e.crons.jobs[job.Script+"/"+job.Name]; ok {
+			continue
+		}
+		if _, loaded := e.scripts[job.Script]; !loaded {
+			log.Printf("Warning: cron job '%s' (%s) won't run, its script %s isn't loaded", job.Name, job.Spec, job.Script)
+			continue
+		}
+		log.Printf("Warning: cron job '%s' of %s (%s) is stored but the script didn't schedule it, so it won't run; cancel_cron removes it", job.Name, job.Script, job.Spec)
+	}
+}
+
+// missedRuns counts the runs due after checkedAt up to now and returns the
+// last of them.
+func (s *cronSchedule) missedRuns(checkedAt, now time.Time) (int, time.Time) {
+	var count int
+	var last time.Time
+	for t := s.next(checkedAt); !t.IsZero() && !t.After(now); t = s.next(t) {
+		count++
+		last = t
+	}
+	return count, last
+}
+
+// CronEvent runs a cron job's callback.
+type CronEvent struct {
+	job         *cronJob
+	ScheduledAt time.Time
+	CatchUp     bool // making up for runs missed while the bot was down
+	Missed      int  // runs missed, for catch-up runs
+}
+
+func (ce CronEvent) Dispatch(e *Engine) {
+	script := ce.job.callback.Script
+	if script.unloaded || !e.crons.current(ce.job) {
+		scriptLogf(script, "Dropping run of cron job '%s', it was cancelled", ce.job.name)
+		return
+	}
+
+	data := e.state.NewTable()
+	data.RawSetString("name", lua.LString(ce.job.name))
+	data.RawSetString("spec", lua.LString(ce.job.spec))
+	data.RawSetString("scheduled_at", lua.LNumber(ce.ScheduledAt.Unix()))
+	data.RawSetString("catch_up", lua.LBool(ce.CatchUp))
+	data.RawSetString("missed", lua.LNumber(ce.Missed))
+	e.callLuaFunction(ce.job.callback, data)
+	if !e.crons.current(ce.job) {
+		return // cancelled by the callback
+	}
+
+	err := e.db.SaveCronJob(database.CronJob{Script: script.Name, Name: ce.job.name, Spec: ce.job.spec, CheckedAt: ce.ScheduledAt})
+	if err != nil {
+		scriptLogf(script, "Failed to record run of cron job '%s': %v", ce.job.name, err)
+	}
+}
+
+func (ce CronEvent) Type() string {
+	return "cron(" + ce.job.name + ")"
+}
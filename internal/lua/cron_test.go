@@ -0,0 +1,139 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/leihog/discord-bot/internal/database"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{"* * * * *", "0 8 * * 1-5", "*/15 9-17 * * *", "0 0 1,15 * *", "5/20 * * * 7", "@daily", " @hourly "} {
+		if _, err := parseCron(spec); err != nil {
+			t.Errorf("parseCron(%q) failed: %v", spec, err)
+		}
+	}
+
+	for spec, wantErr := range map[string]string{
+		"* * * *":      "expected 5 fields",
+		"60 * * * *":   "minute: '60' is out of range 0-59",
+		"* * 0 * *":    "day of month: '0' is out of range 1-31",
+		"* 5-2 * * *":  "hour: invalid range '5-2'",
+		"*/0 * * * *":  "minute: invalid step '0'",
+		"x * * * *":    "minute: invalid value 'x'",
+		"0 0 30 2 *":   "never matches",
+		"@fortnightly": "expected 5 fields",
+	} {
+		if _, err := parseCron(spec); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("parseCron(%q) error = %v, want it to contain %q", spec, err, wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-03-15 is a Friday
+	from := time.Date(2024, 3, 15, 10, 30, 20, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 15, 10, 31, 0, 0, time.UTC)},
+		{"0 8 * * *", time.Date(2024, 3, 16, 8, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, 3, 16, 10, 30, 0, 0, time.UTC)}, // strictly after
+		{"*/20 * * * *", time.Date(2024, 3, 15, 10, 40, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matches
+		{"0 0 1 * 6", time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q) failed: %v", tt.spec, err)
+		}
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next = %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestCronJobs(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	// Jobs stored by the previous run of the bot, three minutes ago
+	now := time.Now()
+	checkedAt := now.Truncate(time.Minute).Add(-3 * time.Minute)
+	for _, job := range []database.CronJob{
+		{Script: "digest.lua", Name: "catch_up", Spec: "* * * * *", CheckedAt: checkedAt},
+		{Script: "digest.lua", Name: "no_catch_up", Spec: "* * * * *", CheckedAt: checkedAt},
+		{Script: "digest.lua", Name: "changed", Spec: "0 8 * * *", CheckedAt: checkedAt},
+		{Script: "digest.lua", Name: "stale", Spec: "* * * * *", CheckedAt: checkedAt},
+	} {
+		if err := db.SaveCronJob(job); err != nil {
+			t.Fatalf("SaveCronJob failed: %v", err)
+		}
+	}
+
+	script := loadTestScript(t, engine, "digest.lua", `
+		caught_up = {}
+		local function record(event)
+			if event.catch_up then caught_up[event.name] = event.missed end
+		end
+		schedule_cron("catch_up", "* * * * *", record, {catch_up = true})
+		schedule_cron("no_catch_up", "* * * * *", record)
+		schedule_cron("changed", "* * * * *", record, {catch_up = true})
+		ok, err = schedule_cron("broken", "99 * * * *", record)
+	`)
+	drainEvents(engine)
+
+	caughtUp := scriptGlobal(engine, "caught_up").(*lua.LTable)
+	if got := caughtUp.RawGetString("catch_up").String(); got != "3" {
+		t.Errorf("Expected one catch-up run for the 3 missed runs, got missed = %s", got)
+	}
+	for _, name := range []string{"no_catch_up", "changed"} {
+		if caughtUp.RawGetString(name) != lua.LNil {
+			t.Errorf("Expected no catch-up run for %s", name)
+		}
+	}
+	if got := scriptGlobal(engine, "err").String(); !strings.Contains(got, "out of range") {
+		t.Errorf("Expected an invalid spec to be refused, got %s", got)
+	}
+
+	job, err := db.GetCronJob("digest.lua", "catch_up")
+	if err != nil || job == nil {
+		t.Fatalf("GetCronJob failed: %v, %v", job, err)
+	}
+	if job.CheckedAt.Before(now.Truncate(time.Minute)) {
+		t.Errorf("Expected the catch-up run to be recorded, checked at %s", job.CheckedAt)
+	}
+
+	// Unloading stops the jobs but keeps them stored for the next load
+	engine.unloadScript("digest.lua")
+	if len(engine.crons.jobs) != 0 {
+		t.Errorf("Expected the script's cron jobs to stop on unload, %d left", len(engine.crons.jobs))
+	}
+	if job, _ := db.GetCronJob("digest.lua", "no_catch_up"); job == nil {
+		t.Error("Expected cron jobs to stay stored across unloads")
+	}
+
+	engine.currentScript = script
+	for name, want := range map[string]bool{"stale": true, "missing": false} {
+		found, err := engine.cancelCron(name)
+		if err != nil || found != want {
+			t.Errorf("cancelCron(%s) = %v, %v; want %v", name, found, err, want)
+		}
+	}
+	engine.currentScript = nil
+	if job, _ := db.GetCronJob("digest.lua", "stale"); job != nil {
+		t.Error("Expected cancel_cron to remove the stored job")
+	}
+}
@@ -0,0 +1,80 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultDeferText is the placeholder posted by defer_reply when the script
+// doesn't give one.
+const defaultDeferText = "Working..."
+
+// editMessage replaces the content of a message the bot sent.
+func (e *Engine) editMessage(channelID, messageID, content string) error {
+	if err := e.filterOutboundMessage(channelID, "edit", &content, nil); err != nil {
+		return err
+	}
+	if content == "" {
+		return errors.New("message content is empty")
+	}
+	if n := messageLength(content); n > maxMessageLength {
+		return fmt.Errorf("message is %d characters, Discord allows %d", n, maxMessageLength)
+	}
+	if _, err := e.session.ChannelMessageEdit(channelID, messageID, content); err != nil {
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) && restErr.Message != nil {
+			switch restErr.Message.Code {
+			case discordgo.ErrCodeCannotEditFromAnotherUser:
+				return fmt.Errorf("message %s was not sent by the bot", messageID)
+			case discordgo.ErrCodeUnknownMessage:
+				return fmt.Errorf("unknown message %s", messageID)
+			}
+		}
+		return err
+	}
+	e.recordSent(content)
+	return nil
+}
+
+// deferReply posts a placeholder for a reply that is still being worked on
+// and returns a handle to edit it into the real reply, e.g. from the
+// callback of http_get_async. The handle is {channel_id, message_id} with an
+// edit method, so a slow command can return and free the dispatcher right
+// away instead of blocking it until the reply is ready.
+func (e *Engine) deferReply(L *lua.LState, channelID, placeholder string) (*lua.LTable, error) {
+	send := &discordgo.MessageSend{Content: placeholder}
+	if err := e.filterOutboundMessage(channelID, "message", &send.Content, nil); err != nil {
+		return nil, err
+	}
+	if err := e.applySendOptions(send, nil); err != nil {
+		return nil, err
+	}
+	msg, err := e.session.ChannelMessageSendComplex(channelID, send)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.ID == "" {
+		return nil, errors.New("the placeholder was sent, but its message ID is unknown")
+	}
+	e.recordSent(send.Content)
+
+	handle := L.NewTable()
+	handle.RawSetString("channel_id", lua.LString(msg.ChannelID))
+	handle.RawSetString("message_id", lua.LString(msg.ID))
+	// handle:edit(content) → true, or false, error
+	handle.RawSetString("edit", L.NewFunction(func(L *lua.LState) int {
+		content := L.CheckString(2)
+		if err := e.editMessage(msg.ChannelID, msg.ID, content); err != nil {
+			e.logf("defer_reply edit error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+	return handle, nil
+}
@@ -0,0 +1,57 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestDeferReply(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "slow.lua", `
+		handle = defer_reply("c1")
+		default_ok = handle:edit("Here is the forecast")
+
+		custom = defer_reply("c2", "Fetching...")
+		too_long_ok, too_long_err = custom:edit(string.rep("x", 2001))
+		edit_ok = edit_message(custom.channel_id, custom.message_id, "Done")
+	`)
+
+	if len(session.sent) != 2 || session.sent[0].Content != "Working..." || session.sent[1].Content != "Fetching..." {
+		t.Fatalf("Expected the default and the custom placeholder to be sent, got %v", session.sent)
+	}
+	if mentions := session.sent[1].AllowedMentions; mentions == nil || len(mentions.Parse) != 0 {
+		t.Errorf("Expected the placeholder to allow no mentions, got %+v", mentions)
+	}
+	if got := scriptGlobal(engine, "handle").(*lua.LTable).RawGetString("message_id").String(); got != "mc1" {
+		t.Errorf("Expected the handle to carry the placeholder's message ID, got %s", got)
+	}
+	want := []string{"c1/mc1: Here is the forecast", "c2/mc2: Done"}
+	if strings.Join(session.messageEdits, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected edits %v, got %v", want, session.messageEdits)
+	}
+	if scriptGlobal(engine, "default_ok") != lua.LTrue || scriptGlobal(engine, "edit_ok") != lua.LTrue {
+		t.Error("Expected the edits to succeed")
+	}
+	if err := scriptGlobal(engine, "too_long_err").String(); !strings.Contains(err, "Discord allows 2000") {
+		t.Errorf("Expected an overlong edit to be refused, got %s", err)
+	}
+}
+
+func TestDeferReplySendFailure(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, UnsupportedSession{}, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "slow.lua", `handle, err = defer_reply("c1")`)
+	if scriptGlobal(engine, "handle") != lua.LNil || scriptGlobal(engine, "err") == lua.LNil {
+		t.Error("Expected defer_reply to fail when the placeholder can't be sent")
+	}
+}
@@ -0,0 +1,197 @@
+package lua
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Discord's embed limits. Character counts are in runes and the total applies
+// to all embeds of a message combined.
+const (
+	maxEmbedsPerMessage = 10
+	maxEmbedFields      = 25
+	maxEmbedTitle       = 256
+	maxEmbedDescription = 4096
+	maxEmbedFieldName   = 256
+	maxEmbedFieldValue  = 1024
+	maxEmbedFooter      = 2048
+	maxEmbedAuthor      = 256
+	maxEmbedTotal       = 6000
+)
+
+// parseEmbeds accepts either a single embed table or an array of them.
+func parseEmbeds(tbl *lua.LTable) ([]*discordgo.MessageEmbed, error) {
+	if _, isArray := tbl.RawGetInt(1).(*lua.LTable); !isArray {
+		embed, err := parseEmbed(tbl)
+		if err != nil {
+			return nil, err
+		}
+		return []*discordgo.MessageEmbed{embed}, nil
+	}
+
+	n := tbl.Len()
+	if n > maxEmbedsPerMessage {
+		return nil, fmt.Errorf("a message can hold at most %d embeds, got %d", maxEmbedsPerMessage, n)
+	}
+	embeds := make([]*discordgo.MessageEmbed, 0, n)
+	total := 0
+	for i := 1; i <= n; i++ {
+		t, ok := tbl.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("embed %d must be a table", i)
+		}
+		embed, err := parseEmbed(t)
+		if err != nil {
+			return nil, fmt.Errorf("embed %d: %w", i, err)
+		}
+		total += embedLength(embed)
+		embeds = append(embeds, embed)
+	}
+	if total > maxEmbedTotal {
+		return nil, fmt.Errorf("embeds total %d characters, limit is %d", total, maxEmbedTotal)
+	}
+	return embeds, nil
+}
+
+// parseEmbed converts an embed table into its discordgo form. Supported fields
+// are title, description, url, color, timestamp (unix seconds), image,
+// thumbnail (urls), footer {text, icon_url}, author {name, url, icon_url} and
+// fields {{name, value, inline}, ...}.
+func parseEmbed(tbl *lua.LTable) (*discordgo.MessageEmbed, error) {
+	embed := &discordgo.MessageEmbed{
+		Title:       lua.LVAsString(tbl.RawGetString("title")),
+		Description: lua.LVAsString(tbl.RawGetString("description")),
+		URL:         lua.LVAsString(tbl.RawGetString("url")),
+		Color:       int(lua.LVAsNumber(tbl.RawGetString("color"))),
+	}
+	if ts, ok := tbl.RawGetString("timestamp").(lua.LNumber); ok {
+		embed.Timestamp = time.Unix(int64(ts), 0).UTC().Format(time.RFC3339)
+	}
+	if image := lua.LVAsString(tbl.RawGetString("image")); image != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: image}
+	}
+	if thumbnail := lua.LVAsString(tbl.RawGetString("thumbnail")); thumbnail != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: thumbnail}
+	}
+	if footer, ok := tbl.RawGetString("footer").(*lua.LTable); ok {
+		embed.Footer = &discordgo.MessageEmbedFooter{
+			Text:    lua.LVAsString(footer.RawGetString("text")),
+			IconURL: lua.LVAsString(footer.RawGetString("icon_url")),
+		}
+	}
+	if author, ok := tbl.RawGetString("author").(*lua.LTable); ok {
+		embed.Author = &discordgo.MessageEmbedAuthor{
+			Name:    lua.LVAsString(author.RawGetString("name")),
+			URL:     lua.LVAsString(author.RawGetString("url")),
+			IconURL: lua.LVAsString(author.RawGetString("icon_url")),
+		}
+	}
+	if fields, ok := tbl.RawGetString("fields").(*lua.LTable); ok {
+		for i := 1; i <= fields.Len(); i++ {
+			field, ok := fields.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return nil, fmt.Errorf("field %d must be a table", i)
+			}
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:   lua.LVAsString(field.RawGetString("name")),
+				Value:  lua.LVAsString(field.RawGetString("value")),
+				Inline: lua.LVAsBool(field.RawGetString("inline")),
+			})
+		}
+	}
+
+	if err := validateEmbed(embed); err != nil {
+		return nil, err
+	}
+	return embed, nil
+}
+
+// applyEmbedTheme gives embeds the configured EMBED_COLOR and footer where
+// they don't set their own, so all scripts share the deployment's look.
+func (e *Engine) applyEmbedTheme(embeds []*discordgo.MessageEmbed) error {
+	total := 0
+	for _, embed := range embeds {
+		if embed.Color == 0 {
+			embed.Color = e.cfg.EmbedColor
+		}
+		if embed.Footer == nil && e.cfg.EmbedFooterText != "" {
+			embed.Footer = &discordgo.MessageEmbedFooter{
+				Text:    e.cfg.EmbedFooterText,
+				IconURL: e.cfg.EmbedFooterIcon,
+			}
+			if err := checkLength("footer text", embed.Footer.Text, maxEmbedFooter); err != nil {
+				return err
+			}
+		}
+		total += embedLength(embed)
+	}
+	if total > maxEmbedTotal {
+		return fmt.Errorf("embeds total %d characters with the theme footer, limit is %d", total, maxEmbedTotal)
+	}
+	return nil
+}
+
+func validateEmbed(embed *discordgo.MessageEmbed) error {
+	if err := checkLength("title", embed.Title, maxEmbedTitle); err != nil {
+		return err
+	}
+	if err := checkLength("description", embed.Description, maxEmbedDescription); err != nil {
+		return err
+	}
+	if embed.Footer != nil {
+		if err := checkLength("footer text", embed.Footer.Text, maxEmbedFooter); err != nil {
+			return err
+		}
+	}
+	if embed.Author != nil {
+		if err := checkLength("author name", embed.Author.Name, maxEmbedAuthor); err != nil {
+			return err
+		}
+	}
+
+	if len(embed.Fields) > maxEmbedFields {
+		return fmt.Errorf("an embed can hold at most %d fields, got %d", maxEmbedFields, len(embed.Fields))
+	}
+	for i, field := range embed.Fields {
+		if field.Name == "" || field.Value == "" {
+			return fmt.Errorf("field %d needs both a name and a value", i+1)
+		}
+		if err := checkLength(fmt.Sprintf("field %d name", i+1), field.Name, maxEmbedFieldName); err != nil {
+			return err
+		}
+		if err := checkLength(fmt.Sprintf("field %d value", i+1), field.Value, maxEmbedFieldValue); err != nil {
+			return err
+		}
+	}
+
+	if n := embedLength(embed); n > maxEmbedTotal {
+		return fmt.Errorf("embed is %d characters, limit is %d", n, maxEmbedTotal)
+	}
+	return nil
+}
+
+func checkLength(name, value string, limit int) error {
+	if n := utf8.RuneCountInString(value); n > limit {
+		return fmt.Errorf("%s is %d characters, limit is %d", name, n, limit)
+	}
+	return nil
+}
+
+// embedLength counts the characters Discord includes in its total limit.
+func embedLength(embed *discordgo.MessageEmbed) int {
+	n := utf8.RuneCountInString(embed.Title) + utf8.RuneCountInString(embed.Description)
+	if embed.Footer != nil {
+		n += utf8.RuneCountInString(embed.Footer.Text)
+	}
+	if embed.Author != nil {
+		n += utf8.RuneCountInString(embed.Author.Name)
+	}
+	for _, field := range embed.Fields {
+		n += utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+	}
+	return n
+}
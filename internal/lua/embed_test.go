@@ -0,0 +1,113 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSendEmbedMultiple(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		ok, err = send_embed("c1", {
+			{ title = "one", fields = { { name = "a", value = "b", inline = true } } },
+			{ title = "two", timestamp = 0 },
+		}, { content = "digest" })
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if scriptGlobal(engine, "ok").String() != "true" {
+		t.Fatalf("send_embed failed: %s", scriptGlobal(engine, "err"))
+	}
+	if len(session.sent) != 1 {
+		t.Fatalf("Expected embeds to go out as one message, got %d", len(session.sent))
+	}
+	msg := session.sent[0]
+	if msg.Content != "digest" || len(msg.Embeds) != 2 {
+		t.Fatalf("Unexpected message: content %q with %d embeds", msg.Content, len(msg.Embeds))
+	}
+	if msg.Embeds[1].Timestamp != "1970-01-01T00:00:00Z" {
+		t.Errorf("Expected RFC3339 timestamp, got %q", msg.Embeds[1].Timestamp)
+	}
+	if !msg.Embeds[0].Fields[0].Inline {
+		t.Error("Expected field to be inline")
+	}
+}
+
+func TestSendEmbedLimits(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	tests := []struct {
+		name   string
+		script string
+		errMsg string
+	}{
+		{"too many embeds", `local e = {} for i = 1, 11 do e[i] = { title = "x" } end ok, err = send_embed("c1", e)`, "at most 10 embeds"},
+		{"long title", `ok, err = send_embed("c1", { title = string.rep("x", 257) })`, "title is 257 characters"},
+		{"aggregate", `local e = {} for i = 1, 2 do e[i] = { description = string.rep("x", 3001) } end ok, err = send_embed("c1", e)`, "total 6002 characters"},
+		{"empty field", `ok, err = send_embed("c1", { fields = { { name = "a" } } })`, "needs both a name and a value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := engine.state.DoString(tt.script); err != nil {
+				t.Fatalf("DoString failed: %v", err)
+			}
+			if scriptGlobal(engine, "ok").String() != "false" {
+				t.Fatal("Expected send_embed to fail")
+			}
+			if msg := scriptGlobal(engine, "err").String(); !strings.Contains(msg, tt.errMsg) {
+				t.Errorf("Expected error containing %q, got %q", tt.errMsg, msg)
+			}
+		})
+	}
+	if len(session.sent) != 0 {
+		t.Errorf("Expected nothing to be sent, got %d messages", len(session.sent))
+	}
+}
+
+func TestSendEmbedTheme(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+	engine.cfg.EmbedColor = 0x5865F2
+	engine.cfg.EmbedFooterText = "Acme Bot"
+	engine.cfg.EmbedFooterIcon = "https://example.com/icon.png"
+
+	err := engine.state.DoString(`
+		send_embed("c1", {
+			{ title = "themed" },
+			{ title = "own", color = 255, footer = { text = "custom" } },
+		})
+		send_embed("c1", { title = "plain" }, { theme = false })
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if len(session.sent) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(session.sent))
+	}
+
+	themed := session.sent[0].Embeds[0]
+	if themed.Color != 0x5865F2 || themed.Footer == nil || themed.Footer.Text != "Acme Bot" || themed.Footer.IconURL != "https://example.com/icon.png" {
+		t.Errorf("Expected the theme to be applied, got color %x and footer %+v", themed.Color, themed.Footer)
+	}
+	own := session.sent[0].Embeds[1]
+	if own.Color != 255 || own.Footer.Text != "custom" {
+		t.Errorf("Expected the embed's own color and footer to win, got color %x and footer %+v", own.Color, own.Footer)
+	}
+	plain := session.sent[1].Embeds[0]
+	if plain.Color != 0 || plain.Footer != nil {
+		t.Errorf("Expected theme = false to skip the theme, got color %x and footer %+v", plain.Color, plain.Footer)
+	}
+}
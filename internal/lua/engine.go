@@ -4,44 +4,68 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	lua "github.com/yuin/gopher-lua"
 
+	"github.com/leihog/discord-bot/internal/config"
 	"github.com/leihog/discord-bot/internal/database"
 	"github.com/leihog/discord-bot/internal/users"
 )
 
 // todo optimize the way we handle hooks. I'm not entirely happy with the current implementation.
 
-// MessageSender is satisfied by *discordgo.Session and by the dev shell mock.
-type MessageSender interface {
-	ChannelMessageSend(channelID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
-}
-
 // HookInfo contains information about a registered hook
 type HookInfo struct {
-	Function lua.LValue
-	Script   *LuaScript
+	Function  lua.LValue
+	Script    *LuaScript
+	Name      string        // what the function handles, e.g. "on_tick" or "!ping"; used in logs
+	Priority  int           // higher runs first (only used for on_shutdown)
+	Timeout   time.Duration // zero falls back to the configured SCRIPT_TIMEOUT
+	Namespace string        // kv namespace watched by an on_store_change hook
+	Emoji     string        // reaction counted by an on_reaction_threshold callback
+	Threshold int           // reaction count at which it fires
+	OnDrop    lua.LValue    // called when the count falls below Threshold again, or nil
+}
+
+// describe names the hook for log messages.
+func (h HookInfo) describe() string {
+	if h.Name == "" {
+		return "Lua function"
+	}
+	return h.Name
 }
 
 // Command represents a scripted Bot command
 type Command struct {
-	Name          string
-	Description   string
-	Callback      HookInfo
-	Cooldown      time.Duration
-	LastUsed      time.Time // Global cooldown for the command
-	lastUsedMutex sync.RWMutex
-	RequiredRole  string // if non-empty, caller must have this role
+	Name            string
+	Description     string
+	Callback        HookInfo
+	Cooldown        time.Duration
+	CooldownPerUser bool                 // the cooldown applies to each user on their own rather than to everyone
+	LastUsed        time.Time            // Global cooldown for the command
+	userLastUsed    map[string]time.Time // per-user cooldowns, guarded by lastUsedMutex
+	lastUsedMutex   sync.RWMutex
+	CooldownMessage string         // reply while on cooldown, see sendCooldownNotice; empty for none
+	noticeSentAt    time.Time      // when the last cooldown notice went out, guarded by lastUsedMutex
+	RequiredRole    string         // if non-empty, caller must have this role
+	History         int            // number of recent channel messages passed as event.recent
+	Pattern         *regexp.Regexp // set for commands registered with register_command_pattern
+	Args            []argSpec      // declared arguments, validated before the callback runs
+	Namespace       string         // prefix of the qualified name, see commandNamespace
+	seq             uint64         // registration order, see removeCommand
 }
 
 // Engine manages the Lua scripting environment
 type Engine struct {
 	state     *lua.LState
+	cfg       *config.Config
 	db        *database.DB
 	session   MessageSender
 	users     *users.Store
@@ -50,90 +74,347 @@ type Engine struct {
 
 	scripts       map[string]*LuaScript
 	currentScript *LuaScript
-
-	// Event queue system
-	eventQueue   chan Event
-	ctx          context.Context
-	cancel       context.CancelFunc
-	dispatcherWg sync.WaitGroup
+	loading       []string // scripts being loaded, innermost last; used to detect circular requires
+
+	// compiled holds each script's compiled chunk by script name, so
+	// loading it again with unchanged source skips the compiler. Dispatcher
+	// only.
+	compiled map[string]compiledScript
+
+	// scriptDirs are the directories scripts were loaded from, as absolute
+	// paths, in the order they were added.
+	scriptDirs []string
+
+	// watcher is the running script watcher, so AddScriptDir can watch the
+	// directories it adds. Nil when scripts aren't watched.
+	watcher atomic.Pointer[Watcher]
+
+	// Event queue system. queueMutex guards sends against close: senders
+	// hold it for reading and drop events once queueClosed is set.
+	eventQueue        chan Event
+	queueMutex        sync.RWMutex
+	queueClosed       bool
+	ctx               context.Context
+	cancel            context.CancelFunc
+	dispatcherWg      sync.WaitGroup
+	dispatcherRunning atomic.Bool // the dispatcher owns the Lua state, see checkLuaAccess
+
+	// Dispatcher supervision, see supervisor.go
+	dispatching        atomic.Pointer[activeDispatch] // nil while idle
+	dispatcherRestarts atomic.Int32
+	stalled            atomic.Bool
+	failed             chan error
 
 	// Timer system
 	timer *Timer
 
 	// Command system
 	commands map[string]*Command
-	cmdMutex sync.Mutex
+	// qualifiedCommands holds every command by its qualified name,
+	// "namespace:name", including those whose plain name is taken by
+	// another script. Guarded by cmdMutex.
+	qualifiedCommands map[string]*Command
+	commandSeq        uint64 // guarded by cmdMutex
+	// commandPatterns are tried in registration order when no command
+	// matches exactly. Guarded by cmdMutex.
+	commandPatterns []*Command
+	cmdMutex        sync.Mutex
+
+	// Channel name lookups for send_to_channel
+	channels *channelCache
+
+	// Discord users for get_user
+	userCache *userCache
+
+	// DM channel IDs opened by send_dm, by user ID. Dispatcher only.
+	dmChannels map[string]string
+
+	// Replies awaited with await_message
+	awaits awaitList
+
+	// Jobs scheduled with schedule_cron
+	crons cronList
+
+	// Recently sent messages, to drop relay loops
+	loops loopGuard
 
 	// In-flight async operations (e.g. HTTP requests)
 	inflightWg sync.WaitGroup
 
+	// Fast-fails HTTP requests to hosts that keep failing
+	breaker *circuitBreaker
+
+	// Set while an on_tick event is queued so a slow dispatcher doesn't
+	// accumulate a backlog of ticks
+	tickPending atomic.Bool
+
 	// Shutdown state
 	shutdownMutex  sync.RWMutex
 	isShuttingDown bool
+	started        bool
+	closeOnce      sync.Once
+
+	startedAt time.Time
+
+	// rng backs the Lua rand table. Replaced by SeedRandom in tests.
+	rng *rand.Rand
+
+	// storeChangeDepth is the chain depth of the StoreChangeEvent being
+	// dispatched, used to stop handlers from triggering each other forever.
+	// Only touched on the dispatcher goroutine.
+	storeChangeDepth int
+
+	// commandDepth is the run_command chain depth of the CommandEvent being
+	// dispatched, 0 for commands typed by users. Only touched on the
+	// dispatcher goroutine.
+	commandDepth int
+
+	// traceID identifies the event being dispatched in log lines, see
+	// tracef. Only touched on the dispatcher goroutine.
+	traceID string
+
+	// outboundFilters are the functions registered with
+	// register_outbound_filter, in order. filteringOutbound is set while
+	// they run, so messages they send themselves aren't filtered. Only
+	// touched on the dispatcher goroutine.
+	outboundFilters   []outboundFilter
+	filteringOutbound bool
+
+	// eventDepth is how many events led to the one being dispatched, 0 for
+	// events from Discord, timers and the like. Only touched on the
+	// dispatcher goroutine.
+	eventDepth int
+
+	// currentCaller is the ID of the user whose command is being dispatched,
+	// empty outside commands. Only touched on the dispatcher goroutine.
+	currentCaller string
+
+	// usagePrunedAt is when old command usage was last pruned. Only touched
+	// on the dispatcher goroutine.
+	usagePrunedAt time.Time
+
+	// oncePrunedAt is when expired once() keys were last pruned. Only
+	// touched on the dispatcher goroutine.
+	oncePrunedAt time.Time
 }
 
 // New creates a new Lua engine
 func New(db *database.DB, session MessageSender, userStore *users.Store) *Engine {
 	engine := &Engine{
-		state:      lua.NewState(),
-		db:         db,
-		session:    session,
-		users:      userStore,
-		eventQueue: make(chan Event, 200), // Buffer for 200 events
-		hooks:      make(map[string][]HookInfo),
-		commands:   make(map[string]*Command),
-		scripts:    make(map[string]*LuaScript),
+		state:             lua.NewState(),
+		cfg:               config.Default(),
+		db:                db,
+		session:           session,
+		users:             userStore,
+		eventQueue:        make(chan Event, 200), // Buffer for 200 events
+		hooks:             make(map[string][]HookInfo),
+		commands:          make(map[string]*Command),
+		qualifiedCommands: make(map[string]*Command),
+		scripts:           make(map[string]*LuaScript),
+		compiled:          make(map[string]compiledScript),
+		channels:          newChannelCache(),
+		userCache:         newUserCache(userCacheSize),
+		dmChannels:        make(map[string]string),
+		loops:             loopGuard{now: time.Now},
+		failed:            make(chan error, 1),
 	}
+	engine.breaker = newCircuitBreaker(engine.cfg.HTTPBreakerThreshold, engine.cfg.HTTPBreakerCooldown)
 	//engine.scriptManager = NewScriptManager(engine)
 	engine.timer = NewTimer(engine)
 	return engine
 }
 
+// SetConfig replaces the engine configuration. Must be called before Start.
+func (e *Engine) SetConfig(cfg *config.Config) {
+	e.cfg = cfg
+	e.breaker = newCircuitBreaker(cfg.HTTPBreakerThreshold, cfg.HTTPBreakerCooldown)
+}
+
 // Initialize sets up the Lua engine with all functions
 func (e *Engine) Initialize() {
 	e.registerFunctions()
+	e.registerRandom()
+	e.registerQueues()
+	e.registerRequires()
+	e.protectHostFunctions()
 }
 
 // Start starts the Lua event dispatcher
 func (e *Engine) Start(ctx context.Context) {
+	e.started = true
+	e.startedAt = time.Now()
 	e.ctx, e.cancel = context.WithCancel(ctx)
-	e.dispatcherWg.Add(1)
-	go e.dispatcher()
+	e.startDispatcher()
+	if e.cfg.DispatcherStallTimeout > 0 {
+		go e.watchDispatcher(e.cfg.DispatcherStallTimeout)
+	}
+
+	if e.cfg.MaintenanceInterval > 0 {
+		go e.maintenanceLoop(e.cfg.MaintenanceInterval)
+	}
+	if e.cfg.TickInterval > 0 {
+		go e.tickLoop(e.cfg.TickInterval)
+	}
+}
+
+// tickLoop drives the on_tick hook. A tick is only enqueued when a script has
+// subscribed and the previous tick has been dispatched.
+func (e *Engine) tickLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if e.IsShuttingDown() {
+				return
+			}
+			e.enqueueTick(now)
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// enqueueTick queues a tick for the on_tick hooks unless one is still
+// waiting in the queue. A tick that can't be queued is dropped without
+// leaving the pending flag set, so the next one is tried again.
+func (e *Engine) enqueueTick(now time.Time) {
+	e.hookMutex.Lock()
+	subscribed := len(e.hooks["on_tick"]) > 0
+	e.hookMutex.Unlock()
+	if !subscribed || !e.tickPending.CompareAndSwap(false, true) {
+		return
+	}
+	if err := e.tryEnqueue(TickEvent{Time: now}); err != nil {
+		e.tickPending.Store(false)
+		log.Printf("Warning: %v, dropping tick event", err)
+	}
 }
 
-// callLuaFunction calls a Lua function with the given data
-func (e *Engine) callLuaFunction(fn HookInfo, data lua.LValue) {
+// callLuaFunction calls a Lua function with the given data. The call is
+// bounded by the hook's own timeout, or SCRIPT_TIMEOUT if it has none. Lua code
+// is aborted once the limit passes; a watchdog also logs the overrun, so a
+// handler stuck in a blocking call is attributed to its script. Errors are
+// logged here; the error is returned for callers that need to know the call
+// failed.
+func (e *Engine) callLuaFunction(fn HookInfo, data lua.LValue) error {
+	if err := e.checkLuaAccess(fn.describe()); err != nil {
+		return err
+	}
 	e.currentScript = fn.Script
 	defer func() { e.currentScript = nil }()
 
+	timeout := fn.Timeout
+	if timeout == 0 {
+		timeout = e.cfg.ScriptTimeout
+	}
+	var ctx context.Context
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		e.state.SetContext(ctx)
+		defer e.state.RemoveContext()
+
+		trace := e.traceID // the watchdog logs from its own goroutine
+		watchdog := time.AfterFunc(timeout, func() {
+			scriptLogf(fn.Script, "%sWatchdog: %s exceeded its %s timeout, aborting", traceLogPrefix(trace), fn.describe(), timeout)
+		})
+		defer watchdog.Stop()
+	}
+
+	start := time.Now()
 	if err := e.state.CallByParam(lua.P{
 		Fn:      fn.Function,
 		NRet:    0,
 		Protect: true,
 	}, data); err != nil {
-		log.Printf("Lua error in script '%s': %v", fn.Script.Name, err)
+		if ctx != nil && ctx.Err() == context.DeadlineExceeded {
+			e.tracef(fn.Script, "%s aborted after %s", fn.describe(), time.Since(start).Round(time.Millisecond))
+			return err
+		}
+		e.tracef(fn.Script, "Lua error in %s: %v", fn.describe(), err)
+		return err
 	}
+	return nil
 }
 
 // dispatcher runs the main Lua event processing loop
 func (e *Engine) dispatcher() {
 	defer e.dispatcherWg.Done()
+	drained := false
+	defer func() {
+		if !drained {
+			e.dispatcherExited(recover())
+		}
+	}()
+	defer e.dispatcherRunning.Store(false) // the state is free again once the queue is drained
 
 	for event := range e.eventQueue {
-		event.Dispatch(e)
+		active := &activeDispatch{event: event.Type(), since: time.Now()}
+		if te, ok := event.(tracedEvent); ok {
+			active.trace = te.trace
+		}
+		e.dispatching.Store(active)
+		e.dispatch(event)
+		e.dispatching.Store(nil)
 	}
+	drained = true
 
 	log.Println("Event queue closed and drained")
 }
 
 func (e *Engine) enqueueEvent(event Event, source string) {
+	if err := e.tryEnqueue(event); err != nil {
+		log.Printf("Warning: %v, dropping %s event from '%s'", err, event.Type(), source)
+	}
+}
+
+// enqueueFollowUp is enqueueEvent for events queued by the event being
+// dispatched. Must be called on the dispatcher goroutine.
+func (e *Engine) enqueueFollowUp(event Event, source string) {
+	if err := e.tryEnqueueFollowUp(event); err != nil {
+		log.Printf("Warning: %v, dropping %s event from '%s'", err, event.Type(), source)
+	}
+}
+
+// tryEnqueue queues event without blocking, with a new trace ID. It fails if
+// the queue is full or has been closed by Close, so it is safe to call from
+// any goroutine at any time, including timers firing during shutdown.
+func (e *Engine) tryEnqueue(event Event) error {
+	return e.queueTraced(tracedEvent{Event: event, trace: newTraceID()})
+}
+
+// tryEnqueueFollowUp queues an event set off by the event being dispatched:
+// it keeps that event's trace ID and is one level deeper, and fails beyond
+// MAX_EVENT_DEPTH. Outside of an event, e.g. while scripts load at startup,
+// it is tryEnqueue. Must be called on the dispatcher goroutine.
+func (e *Engine) tryEnqueueFollowUp(event Event) error {
+	if e.traceID == "" {
+		return e.tryEnqueue(event)
+	}
+	depth := e.eventDepth + 1
+	if max := e.cfg.MaxEventDepth; max > 0 && depth > max {
+		return fmt.Errorf("%sevent chain more than %d events deep (MAX_EVENT_DEPTH)", traceLogPrefix(e.traceID), max)
+	}
+	return e.queueTraced(tracedEvent{Event: event, trace: e.traceID, depth: depth})
+}
+
+// queueTraced puts event on the queue unless it is full or closed.
+func (e *Engine) queueTraced(event tracedEvent) error {
+	e.queueMutex.RLock()
+	defer e.queueMutex.RUnlock()
+	if e.queueClosed {
+		return fmt.Errorf("lua event queue closed")
+	}
 	select {
 	case e.eventQueue <- event:
-		// Event queued successfully
+		return nil
 	// todo test using timeout
 	// case <-time.After(100 * time.Millisecond): // we could use this to drop events if the queue is still full after 100ms
 	default:
-		log.Printf("Warning: Lua event queue full, dropping %s event from '%s'", event.Type(), source)
+		return fmt.Errorf("lua event queue full")
 	}
 }
 
@@ -141,8 +422,10 @@ func (e *Engine) enqueueMessageHooks(m *discordgo.MessageCreate) {
 	data := e.state.NewTable()
 	data.RawSetString("content", lua.LString(m.Content))
 	data.RawSetString("channel_id", lua.LString(m.ChannelID))
+	data.RawSetString("message_id", lua.LString(m.ID))
 	data.RawSetString("author", lua.LString(m.Author.Username))
 	data.RawSetString("author_id", lua.LString(m.Author.ID))
+	data.RawSetString("attachments", attachmentsToLua(e.state, m.Attachments))
 
 	var eventType string
 	if m.GuildID == "" {
@@ -159,23 +442,100 @@ func (e *Engine) enqueueMessageHooks(m *discordgo.MessageCreate) {
 	e.enqueueEvent(event, m.Author.Username)
 }
 
+// cooldownSweepSize is how many users a per-user cooldown tracks before the
+// ones whose cooldown has passed are forgotten.
+const cooldownSweepSize = 1024
+
+// cooldownRemaining returns how long cmd is still on cooldown for userID, or
+// for everyone unless the command has a per-user cooldown.
+func (c *Command) cooldownRemaining(userID string) time.Duration {
+	c.lastUsedMutex.RLock()
+	defer c.lastUsedMutex.RUnlock()
+	lastUsed := c.LastUsed
+	if c.CooldownPerUser {
+		lastUsed = c.userLastUsed[userID]
+	}
+	return c.Cooldown - time.Since(lastUsed)
+}
+
+// markUsed starts the cooldown of cmd, for userID only if the command has a
+// per-user cooldown.
+func (c *Command) markUsed(userID string) {
+	c.lastUsedMutex.Lock()
+	defer c.lastUsedMutex.Unlock()
+	now := time.Now()
+	if !c.CooldownPerUser {
+		c.LastUsed = now
+		return
+	}
+	if c.Cooldown <= 0 {
+		return
+	}
+	if c.userLastUsed == nil {
+		c.userLastUsed = make(map[string]time.Time)
+	}
+	if len(c.userLastUsed) >= cooldownSweepSize {
+		for id, lastUsed := range c.userLastUsed {
+			if now.Sub(lastUsed) >= c.Cooldown {
+				delete(c.userLastUsed, id)
+			}
+		}
+	}
+	c.userLastUsed[userID] = now
+}
+
+// cooldownNoticeTTL is how long a cooldown notice stays up before the bot
+// deletes it. Only one notice per command is up at a time, so spamming a
+// command on cooldown doesn't make the bot spam as well.
+var cooldownNoticeTTL = 5 * time.Second
+
+// defaultCooldownMessage is the notice sent for cooldown_message = true.
+const defaultCooldownMessage = "`{prefix}{command}` is on cooldown, try again in {remaining}."
+
+// sendCooldownNotice tells the channel how long cmd is still on cooldown, if
+// the command has a CooldownMessage, and deletes the notice again after
+// cooldownNoticeTTL.
+func (e *Engine) sendCooldownNotice(cmd *Command, commandName, channelID string, remaining time.Duration) {
+	if cmd.CooldownMessage == "" {
+		return
+	}
+	cmd.lastUsedMutex.Lock()
+	if time.Since(cmd.noticeSentAt) < cooldownNoticeTTL {
+		cmd.lastUsedMutex.Unlock()
+		return
+	}
+	cmd.noticeSentAt = time.Now()
+	cmd.lastUsedMutex.Unlock()
+
+	// Round up, so the last second reads "1s" rather than "0s"
+	remaining = (remaining + time.Second - 1).Truncate(time.Second)
+	notice := strings.NewReplacer("{prefix}", e.cfg.CommandPrefix, "{command}", commandName, "{remaining}", formatDuration(remaining)).Replace(cmd.CooldownMessage)
+	msg, err := e.sendNotice(channelID, notice)
+	if err != nil {
+		log.Printf("Cooldown notice for command '%s' failed: %v", commandName, err)
+		return
+	}
+	time.AfterFunc(cooldownNoticeTTL, func() {
+		if err := e.session.ChannelMessageDelete(msg.ChannelID, msg.ID); err != nil {
+			log.Printf("Deleting cooldown notice for command '%s' failed: %v", commandName, err)
+		}
+	})
+}
+
 func (e *Engine) tryHandleCommand(content string, m *discordgo.MessageCreate) bool {
 	parts := strings.Fields(content)
-	commandName := strings.TrimPrefix(parts[0], "!")
+	commandName := strings.TrimPrefix(parts[0], e.cfg.CommandPrefix)
 
 	e.cmdMutex.Lock()
-	cmd, exists := e.commands[commandName]
+	cmd, commandName := e.findCommand(commandName)
 	e.cmdMutex.Unlock()
-	if !exists {
+	if cmd == nil {
 		return false
 	}
 
-	cmd.lastUsedMutex.RLock()
-	lastUsed := cmd.LastUsed
-	cmd.lastUsedMutex.RUnlock()
-
-	if time.Since(lastUsed) < cmd.Cooldown {
+	if remaining := cmd.cooldownRemaining(m.Author.ID); remaining > 0 {
 		log.Printf("Command '%s' on cooldown", commandName)
+		e.sendCooldownNotice(cmd, commandName, m.ChannelID, remaining)
 		return true
 	}
 
@@ -186,14 +546,22 @@ func (e *Engine) tryHandleCommand(content string, m *discordgo.MessageCreate) bo
 			ok = false
 		}
 		if !ok {
-			_, _ = e.session.ChannelMessageSend(m.ChannelID, "Permission denied.")
+			_, _ = e.sendNotice(m.ChannelID, "Permission denied.")
 			return true
 		}
 	}
 
-	cmd.lastUsedMutex.Lock()
-	cmd.LastUsed = time.Now()
-	cmd.lastUsedMutex.Unlock()
+	var params *lua.LTable
+	if cmd.Args != nil {
+		var err error
+		if params, err = parseArgs(e.state, cmd.Args, parts[1:]); err != nil {
+			reply := fmt.Sprintf("Invalid arguments: %v. Usage: `%s`", err, commandUsage(e.cfg.CommandPrefix, commandName, cmd.Args))
+			_, _ = e.sendNotice(m.ChannelID, reply)
+			return true
+		}
+	}
+
+	cmd.markUsed(m.Author.ID)
 
 	args := e.state.NewTable()
 	for i, arg := range parts {
@@ -202,21 +570,44 @@ func (e *Engine) tryHandleCommand(content string, m *discordgo.MessageCreate) bo
 
 	data := e.state.NewTable()
 	data.RawSetString("args", args)
+	data.RawSetString("command", lua.LString(commandName))
 	data.RawSetString("channel_id", lua.LString(m.ChannelID))
 	data.RawSetString("guild_id", lua.LString(m.GuildID))
+	data.RawSetString("message_id", lua.LString(m.ID))
 	data.RawSetString("author", lua.LString(m.Author.Username))
 	data.RawSetString("author_id", lua.LString(m.Author.ID))
+	data.RawSetString("attachments", attachmentsToLua(e.state, m.Attachments))
+	if params != nil {
+		data.RawSetString("params", params)
+	}
+	if cmd.History > 0 {
+		recent := recentMessages(e.messageState(), m.ChannelID, m.ID, cmd.History)
+		data.RawSetString("recent", messagesToLua(e.state, recent))
+	}
 
 	event := CommandEvent{
 		CommandName: commandName,
 		CommandData: data,
 		Callback:    cmd.Callback,
+		AuthorID:    m.Author.ID,
+		GuildID:     m.GuildID,
 	}
 
 	e.enqueueEvent(event, m.Author.Username)
 	return true
 }
 
+// matchCommandPattern returns the first pattern command matching name, or nil.
+// The caller must hold cmdMutex.
+func (e *Engine) matchCommandPattern(name string) *Command {
+	for _, cmd := range e.commandPatterns {
+		if cmd.Pattern.MatchString(name) {
+			return cmd
+		}
+	}
+	return nil
+}
+
 // ProcessMessage processes a Discord message through all registered hooks
 func (e *Engine) ProcessMessage(m *discordgo.MessageCreate) {
 	// Check if we're shutting down
@@ -224,7 +615,12 @@ func (e *Engine) ProcessMessage(m *discordgo.MessageCreate) {
 		return
 	}
 
-	if m.Author.Bot {
+	e.userCache.put(m.Author)
+
+	// Bots, the bot itself included, are ignored so scripts can't trigger
+	// each other or themselves; isEcho catches loops through webhooks and
+	// bridges that post as users
+	if m.Author.Bot || e.isEcho(m.Content) {
 		return
 	}
 
@@ -234,19 +630,32 @@ func (e *Engine) ProcessMessage(m *discordgo.MessageCreate) {
 		}
 	}
 
+	// A reply a script is waiting for is not dispatched any further
+	if e.resolveAwait(m) {
+		return
+	}
+
 	// Check for commands
 	content := strings.TrimSpace(m.Content)
-	if strings.HasPrefix(content, "!") {
+	if strings.HasPrefix(content, e.cfg.CommandPrefix) {
 		if e.tryHandleCommand(content, m) {
 			return
 		}
+		e.handleUnknownCommand(content, m)
 	}
 
 	e.enqueueMessageHooks(m)
 }
 
-// Close closes the Lua engine
+// Close shuts the Lua engine down: timers are stopped, on_shutdown hooks run,
+// queued events are drained and all scripts are unloaded. It is safe to call
+// more than once and on an engine that was never started, so tests can simply
+// register t.Cleanup(engine.Close).
 func (e *Engine) Close() {
+	e.closeOnce.Do(e.close)
+}
+
+func (e *Engine) close() {
 	e.shutdownMutex.Lock()
 	e.isShuttingDown = true
 	e.shutdownMutex.Unlock()
@@ -255,6 +664,7 @@ func (e *Engine) Close() {
 	if e.timer != nil {
 		e.timer.StopAll()
 	}
+	e.crons.stopAll()
 
 	// Wait for any in-flight async operations (e.g. HTTP requests) to finish.
 	// e.ctx is already cancelled at this point, so they should return quickly.
@@ -267,27 +677,53 @@ func (e *Engine) Close() {
 	data.RawSetString("reason", lua.LString("graceful_shutdown"))
 
 	// Enqueue shutdown event
-	event := BotEvent{
-		Data:      data,
-		EventType: "on_shutdown",
-	}
-	e.enqueueEvent(event, "shutdown")
+	e.enqueueEvent(ShutdownEvent{Data: data}, "shutdown")
 
 	log.Println("Waiting for event queue to drain...")
 
-	close(e.eventQueue) // stop accepting new events and drain the queue
-	e.dispatcherWg.Wait()
+	// Stop accepting new events and drain the queue. Holding queueMutex
+	// waits out any send in progress, so nothing sends on the closed channel.
+	e.queueMutex.Lock()
+	e.queueClosed = true
+	close(e.eventQueue)
+	e.queueMutex.Unlock()
+	if !e.started {
+		// No dispatcher is running, so drain the queue on this goroutine
+		e.dispatcherWg.Add(1)
+		e.dispatcher()
+	}
+	if e.stalled.Load() {
+		// The stuck dispatcher still owns the Lua state, so neither the
+		// queue nor the scripts can be wound down
+		log.Println("Event dispatcher is stuck; not waiting for the event queue to drain")
+	} else {
+		e.dispatcherWg.Wait()
+
+		// unload all scripts
+		for name := range e.scripts {
+			e.unloadScript(name)
+		}
+	}
 
-	// unload all scripts
-	for name := range e.scripts {
-		e.unloadScript(name)
+	// Stop the background loops started by Start
+	if e.cancel != nil {
+		e.cancel()
 	}
 
-	if e.state != nil {
+	if e.state != nil && !e.stalled.Load() {
 		e.state.Close()
 	}
 }
 
+// Uptime returns how long the engine has been running, or zero if it hasn't
+// been started.
+func (e *Engine) Uptime() time.Duration {
+	if e.startedAt.IsZero() {
+		return 0
+	}
+	return time.Since(e.startedAt)
+}
+
 // IsShuttingDown returns true if the engine is in shutdown mode
 func (e *Engine) IsShuttingDown() bool {
 	e.shutdownMutex.RLock()
@@ -298,8 +734,16 @@ func (e *Engine) IsShuttingDown() bool {
 // Exec runs Lua code on the dispatcher goroutine and returns its output.
 // print() calls and return values are captured and returned as a string.
 func (e *Engine) Exec(code string) (string, error) {
+	return e.ExecIn("", code)
+}
+
+// ExecIn is Exec in the globals of the named script, so the code sees the
+// variables the script set. An empty script name runs in the shared globals.
+func (e *Engine) ExecIn(script, code string) (string, error) {
 	result := make(chan ExecResult, 1)
-	e.enqueueEvent(ExecEvent{Code: code, Result: result}, "dev-shell")
+	if err := e.tryEnqueue(ExecEvent{Code: code, Script: script, Result: result}); err != nil {
+		return "", err
+	}
 	select {
 	case r := <-result:
 		return r.Output, r.Err
@@ -338,6 +782,7 @@ func (e *Engine) GetScriptNames() []string {
 }
 
 // EnqueueScriptEvent enqueues a script management event (e.g. "reload").
+// Reloads asked for this way happen even if the script is unchanged.
 func (e *Engine) EnqueueScriptEvent(scriptPath, action string) {
-	e.enqueueEvent(ScriptEvent{ScriptName: scriptPath, Action: action}, "dev-shell")
+	e.enqueueEvent(ScriptEvent{ScriptName: scriptPath, Action: action, Force: true}, "dev-shell")
 }
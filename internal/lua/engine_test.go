@@ -0,0 +1,592 @@
+package lua
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// loadTestScript writes code to a temporary file and loads it into the engine.
+func loadTestScript(t *testing.T, engine *Engine, name, code string) *LuaScript {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(code), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	if err := engine.loadScript(path); err != nil {
+		t.Fatalf("Failed to load script: %v", err)
+	}
+	return engine.scripts[name]
+}
+
+// scriptGlobal returns the global name as set by one of the loaded scripts,
+// each of which has its own globals, or failing that by code run with
+// DoString.
+func scriptGlobal(engine *Engine, name string) lua.LValue {
+	for _, script := range engine.scripts {
+		if value := script.Env.RawGetString(name); value != lua.LNil {
+			return value
+		}
+	}
+	return engine.state.GetGlobal(name)
+}
+
+// execIn runs code in the globals of the named script, as ExecIn does, for
+// tests that haven't started the dispatcher.
+func execIn(engine *Engine, script, code string) (string, error) {
+	result := make(chan ExecResult, 1)
+	ExecEvent{Code: code, Script: script, Result: result}.Dispatch(engine)
+	r := <-result
+	return r.Output, r.Err
+}
+
+func TestShutdownHookPriorityOrder(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	engine.state.SetGlobal("order", engine.state.NewTable())
+	loadTestScript(t, engine, "a.lua", `
+		register_hook("on_shutdown", function() table.insert(order, "low") end, { priority = -5 })
+		register_hook("on_shutdown", function() table.insert(order, "default") end)
+	`)
+	loadTestScript(t, engine, "b.lua", `
+		register_hook("on_shutdown", function() table.insert(order, "high") end, { priority = 10 })
+		register_hook("on_shutdown", function() table.insert(order, "default2") end)
+	`)
+
+	ShutdownEvent{Data: lua.LNil}.Dispatch(engine)
+
+	order := scriptGlobal(engine, "order").(*lua.LTable)
+	expected := []string{"high", "default", "default2", "low"}
+	if order.Len() != len(expected) {
+		t.Fatalf("Expected %d hooks to run, got %d", len(expected), order.Len())
+	}
+	for i, want := range expected {
+		if got := order.RawGetInt(i + 1).String(); got != want {
+			t.Errorf("Hook %d: expected %s, got %s", i+1, want, got)
+		}
+	}
+}
+
+func TestShutdownHookTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.ShutdownHookTimeout = time.Second
+	engine.Initialize()
+
+	loadTestScript(t, engine, "slow.lua", `
+		register_hook("on_shutdown", function() while true do end end, { timeout = 0.05, priority = 1 })
+		register_hook("on_shutdown", function() done = true end)
+	`)
+
+	start := time.Now()
+	ShutdownEvent{Data: lua.LNil}.Dispatch(engine)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected slow hook to be aborted, shutdown took %s", elapsed)
+	}
+	if scriptGlobal(engine, "done") != lua.LTrue {
+		t.Error("Expected hook after the aborted one to run")
+	}
+}
+
+func TestCommandAndHookTimeouts(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.ScriptTimeout = 50 * time.Millisecond
+	engine.Initialize()
+
+	loadTestScript(t, engine, "slow.lua", `
+		register_command("spin", "Runs forever", function() while true do end end, { timeout = 0.1 })
+		register_hook("on_channel_message", function() while true do end end)
+		register_hook("on_channel_message", function()
+			local deadline = os.clock() + 0.1
+			while os.clock() < deadline do end
+			patient = true
+		end, { timeout = 5 })
+	`)
+
+	engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+		Content:   "!spin",
+		ChannelID: "c1",
+		Author:    &discordgo.User{ID: "u1", Username: "alice"},
+	}})
+	start := time.Now()
+	drainEvents(engine)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the command to run for its own 100ms timeout, took %s", elapsed)
+	}
+
+	start = time.Now()
+	BotEvent{Data: lua.LNil, EventType: "on_channel_message"}.Dispatch(engine)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected SCRIPT_TIMEOUT to abort the looping hook, took %s", elapsed)
+	}
+	if scriptGlobal(engine, "patient") != lua.LTrue {
+		t.Error("Expected a hook with a longer timeout to outlive SCRIPT_TIMEOUT")
+	}
+}
+
+func TestHooksGetTheirOwnData(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "rewriter.lua", `
+		register_hook("on_channel_message", function(event)
+			event.content = "rewritten"
+			event.attachments[1].filename = "renamed.png"
+			event.attachments[2] = nil
+		end)
+	`)
+	loadTestScript(t, engine, "logger.lua", `
+		register_hook("on_channel_message", function(event)
+			seen = event.content .. " " .. event.attachments[1].filename .. " " .. #event.attachments
+		end)
+	`)
+
+	engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+		Content:   "original",
+		ChannelID: "c1",
+		GuildID:   "g1",
+		Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		Attachments: []*discordgo.MessageAttachment{
+			{ID: "a1", Filename: "photo.png"},
+			{ID: "a2", Filename: "notes.txt"},
+		},
+	}})
+	drainEvents(engine)
+
+	if got := scriptGlobal(engine, "seen").String(); got != "original photo.png 2" {
+		t.Errorf("Expected the second hook to see the unmodified event, got %q", got)
+	}
+}
+
+func TestCopyLuaValue(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`
+		shared = {1, 2}
+		original = {a = shared, b = shared}
+		original.self = original
+	`); err != nil {
+		t.Fatal(err)
+	}
+	original := L.GetGlobal("original").(*lua.LTable)
+	c := copyLuaValue(L, original, make(map[*lua.LTable]*lua.LTable)).(*lua.LTable)
+
+	if c == original || c.RawGetString("a") == original.RawGetString("a") {
+		t.Error("Expected tables to be copied")
+	}
+	if c.RawGetString("a") != c.RawGetString("b") {
+		t.Error("Expected a table referenced twice to be copied once")
+	}
+	if c.RawGetString("self") != c {
+		t.Error("Expected cycles to point at the copy")
+	}
+}
+
+func TestOnTickHook(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.TickInterval = 10 * time.Millisecond
+	engine.Initialize()
+
+	loadTestScript(t, engine, "ticker.lua", `
+		ticks = 0
+		last = 0
+		register_hook("on_tick", function(event)
+			ticks = ticks + 1
+			last = event.timestamp
+		end)
+	`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+
+	time.Sleep(100 * time.Millisecond)
+
+	out, err := engine.ExecIn("ticker.lua", "ticks > 0 and last > 0")
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	if out != "true" {
+		t.Error("Expected on_tick to fire with a timestamp")
+	}
+}
+
+func TestDroppedTickIsRetried(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+	loadTestScript(t, engine, "ticker.lua", `register_hook("on_tick", function() end)`)
+
+	for engine.tryEnqueue(TickEvent{}) == nil {
+	}
+	engine.enqueueTick(time.Now())
+	if engine.tickPending.Load() {
+		t.Error("Expected a tick dropped on a full queue not to stay pending")
+	}
+
+	drainEvents(engine)
+	engine.enqueueTick(time.Now())
+	if !engine.tickPending.Load() || len(engine.eventQueue) != 1 {
+		t.Error("Expected the next tick to be queued")
+	}
+}
+
+func TestExampleScriptLoads(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+	defer engine.timer.StopAll()
+
+	if err := engine.loadScript(filepath.Join("..", "scaffold", "example.lua")); err != nil {
+		t.Fatalf("Example script failed to load: %v", err)
+	}
+	if _, exists := engine.commands["ping"]; !exists {
+		t.Error("Expected example script to register !ping")
+	}
+}
+
+func TestCloseWithoutStart(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "bye.lua", `
+		register_hook("on_shutdown", function() store_set("test", "shutdown", true) end)
+	`)
+
+	done := make(chan struct{})
+	go func() {
+		engine.Close()
+		engine.Close() // a second call is a no-op
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close deadlocked on an engine that was never started")
+	}
+
+	// The shutdown hook ran on the closing goroutine
+	var value string
+	if err := db.QueryRow(`SELECT value FROM kv_store WHERE namespace = 'test' AND key = 'shutdown'`).Scan(&value); err != nil || value != "true" {
+		t.Errorf("Expected on_shutdown to run, got %q (%v)", value, err)
+	}
+	if len(engine.scripts) != 0 {
+		t.Errorf("Expected scripts to be unloaded, got %d", len(engine.scripts))
+	}
+}
+
+func TestLuaAccessIsConfinedToDispatcher(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "late.lua"), []byte(`
+		late_loaded = true
+		register_hook("on_unload", function() store_set("test", "unloaded", true) end)
+	`), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+
+	// Direct access from another goroutine is refused
+	if err := engine.loadScript(filepath.Join(dir, "late.lua")); err == nil {
+		t.Error("Expected loadScript off the dispatcher to be refused")
+	}
+
+	// LoadScripts after Start goes through the queue
+	engine.LoadScripts(dir)
+	out, err := engine.ExecIn("late.lua", "late_loaded")
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	if out != "true" {
+		t.Errorf("Expected the script to be loaded by the dispatcher, got %q", out)
+	}
+
+	// Once the dispatcher has stopped, Close may run on_unload itself
+	engine.Close()
+	var value string
+	if err := db.QueryRow(`SELECT value FROM kv_store WHERE namespace = 'test' AND key = 'unloaded'`).Scan(&value); err != nil || value != "true" {
+		t.Errorf("Expected on_unload to run during Close, got %q (%v)", value, err)
+	}
+}
+
+func TestOnLoadHook(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	engine.state.SetGlobal("loads", engine.state.NewTable())
+	a := loadTestScript(t, engine, "a.lua", `
+		local restored = "a"
+		register_hook("on_load", function(event)
+			table.insert(loads, restored .. ":" .. type(event))
+		end)
+	`)
+	loadTestScript(t, engine, "b.lua", `register_hook("on_tick", function() end)`)
+	loadTestScript(t, engine, "c.lua", `register_hook("on_load", function() table.insert(loads, "c") end)`)
+	d := loadTestScript(t, engine, "d.lua", `register_hook("on_load", function() table.insert(loads, "d") end)`)
+
+	loads := func() string {
+		tbl := scriptGlobal(engine, "loads").(*lua.LTable)
+		var got []string
+		for i := 1; i <= tbl.Len(); i++ {
+			got = append(got, tbl.RawGetInt(i).String())
+		}
+		return strings.Join(got, ",")
+	}
+	if got := loads(); got != "" {
+		t.Fatalf("on_load should run through the event queue, ran %q while loading", got)
+	}
+
+	// d is unloaded before its on_load is dispatched
+	engine.unloadScript(d.Name)
+	drainEvents(engine)
+	if got := loads(); got != "a:table,c" {
+		t.Errorf("Expected each script's own on_load to run once, got %q", got)
+	}
+
+	if err := engine.reloadScript(a.Path, true); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	drainEvents(engine)
+	if got := loads(); got != "a:table,c,a:table" {
+		t.Errorf("Expected on_load to run again after a reload, got %q", got)
+	}
+}
+
+func TestScriptGlobalsAreIsolated(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "a.lua", `
+		count = 1
+		_G.secret = "a"
+		function describe() return "a" .. count end
+	`)
+	loadTestScript(t, engine, "b.lua", `
+		count = (count or 0) + 10
+		saw_secret = secret
+		function describe() return "b" .. count end
+		upper = string.upper("ok")
+	`)
+
+	for _, tc := range []struct{ script, code, want string }{
+		{"a.lua", "describe(), secret", "a1\ta"},
+		{"b.lua", "describe(), saw_secret, upper", "b10\tnil\tOK"},
+	} {
+		if got, err := execIn(engine, tc.script, tc.code); err != nil || got != tc.want {
+			t.Errorf("In %s, %s = %q (%v), want %q", tc.script, tc.code, got, err, tc.want)
+		}
+	}
+	if engine.state.GetGlobal("count") != lua.LNil || engine.state.GetGlobal("describe") != lua.LNil {
+		t.Error("Expected script globals to stay out of the shared globals")
+	}
+
+	// Library tables are per script too
+	loadTestScript(t, engine, "clobber.lua", `
+		string.format = nil
+		rand.secure.int = nil
+		function table.first(t) return t[1] end
+	`)
+	if got, err := execIn(engine, "a.lua", `string.format("%d", 7), rand.secure.int(1, 1), table.first`); err != nil || got != "7\t1\tnil" {
+		t.Errorf("Expected another script's changes to libraries not to leak, got %q (%v)", got, err)
+	}
+	if got, err := execIn(engine, "clobber.lua", `string.format, table.first({3})`); err != nil || got != "nil\t3" {
+		t.Errorf("Expected a script to keep its own changes to libraries, got %q (%v)", got, err)
+	}
+
+	// A reload starts afresh, and an unloaded script's globals are gone
+	engine.unloadScript("b.lua")
+	loadTestScript(t, engine, "b.lua", `count = (count or 0) + 10`)
+	if got, _ := execIn(engine, "b.lua", "count"); got != "10" {
+		t.Errorf("Expected the reloaded script to start with empty globals, count = %s", got)
+	}
+	engine.unloadScript("a.lua")
+	if _, err := execIn(engine, "a.lua", "count"); err == nil || !strings.Contains(err.Error(), "not loaded") {
+		t.Errorf("Expected running code in an unloaded script to fail, got %v", err)
+	}
+}
+
+func TestScriptEventLoad(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	path := filepath.Join(t.TempDir(), "new.lua")
+	if err := os.WriteFile(path, []byte(`register_command("new", "New command", function() end)`), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	ScriptEvent{Action: "load", ScriptName: path}.Dispatch(engine)
+
+	if _, ok := engine.scripts["new.lua"]; !ok {
+		t.Error("Expected a created script to be loaded")
+	}
+}
+
+func TestLoadEventSkipsLoadedScript(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loads := engine.state.NewTable()
+	loads.RawSetString("n", lua.LNumber(0))
+	engine.state.SetGlobal("loads", loads)
+	script := loadTestScript(t, engine, "dep.lua", `
+		loads.n = loads.n + 1
+		register_hook("on_tick", function() end)
+	`)
+
+	// As when the watcher sees a script that requires() already loaded
+	ScriptEvent{Action: "load", ScriptName: script.Path}.Dispatch(engine)
+
+	if engine.scripts["dep.lua"] != script || loads.RawGetString("n") != lua.LNumber(1) {
+		t.Error("Expected an already loaded script not to be loaded again")
+	}
+	if n := len(engine.hooks["on_tick"]); n != 1 {
+		t.Errorf("Expected one on_tick hook, got %d", n)
+	}
+}
+
+func TestReloadSkipsUnchangedScript(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	// Each load runs in a new environment, so count in a shared table
+	loads := engine.state.NewTable()
+	loads.RawSetString("n", lua.LNumber(0))
+	engine.state.SetGlobal("loads", loads)
+	script := loadTestScript(t, engine, "counter.lua", `loads.n = loads.n + 1`)
+
+	if err := engine.reloadScript(script.Path, false); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if engine.scripts["counter.lua"] != script || loads.RawGetString("n") != lua.LNumber(1) {
+		t.Error("Expected an unchanged script not to be reloaded")
+	}
+
+	if err := engine.reloadScript(script.Path, true); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if loads.RawGetString("n") != lua.LNumber(2) {
+		t.Error("Expected a forced reload to run the script again")
+	}
+
+	if err := os.WriteFile(script.Path, []byte(`loads.n = loads.n + 10`), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	if err := engine.reloadScript(script.Path, false); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if loads.RawGetString("n") != lua.LNumber(12) {
+		t.Errorf("Expected a changed script to be reloaded, got loads = %v", loads.RawGetString("n"))
+	}
+}
+
+func TestReloadReusesCompiledScript(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	script := loadTestScript(t, engine, "compiled.lua", `value = 1`)
+	proto := engine.compiled["compiled.lua"].proto
+
+	if err := engine.reloadScript(script.Path, true); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if engine.compiled["compiled.lua"].proto != proto {
+		t.Error("Expected a forced reload to reuse the compiled chunk")
+	}
+	if v := scriptGlobal(engine, "value"); v != lua.LNumber(1) {
+		t.Errorf("Expected the reloaded script to run, got value = %v", v)
+	}
+
+	if err := os.WriteFile(script.Path, []byte(`value = 2`), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	if err := engine.reloadScript(script.Path, false); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if engine.compiled["compiled.lua"].proto == proto {
+		t.Error("Expected a changed script to be compiled again")
+	}
+	if v := scriptGlobal(engine, "value"); v != lua.LNumber(2) {
+		t.Errorf("Expected the changed script to run, got value = %v", v)
+	}
+}
+
+func TestEventChainIsCappedAtMaxDepth(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.MaxEventDepth = 5
+	engine.Initialize()
+
+	// Neither chain limit of its own stops this: each store change runs a
+	// new command, and each command starts a new store change chain
+	loadTestScript(t, engine, "pingpong.lua", `
+		bumps = 0
+		register_command("bump", "Bumps the counter", function(event)
+			bumps = bumps + 1
+			store_set("pingpong", "n", bumps)
+		end)
+		register_hook("on_store_change", function(event)
+			local ok, err = run_command("bump")
+			if not ok then chain_error = err end
+		end, { namespace = "pingpong" })
+	`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+	if _, err := engine.Exec(`store_set("pingpong", "n", 0)`); err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	for range 10 {
+		if _, err := engine.Exec("true"); err != nil {
+			t.Fatalf("Exec failed: %v", err)
+		}
+	}
+
+	out, err := engine.ExecIn("pingpong.lua", "bumps, chain_error")
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	// Store changes at depths 1, 3 and 5 run commands at 2, 4 and 6, and
+	// the last of those is refused
+	if !strings.HasPrefix(out, "2\t") || !strings.Contains(out, "MAX_EVENT_DEPTH") {
+		t.Errorf("bumps, chain_error = %q, want 2 bumps and a MAX_EVENT_DEPTH error", out)
+	}
+}
@@ -1,8 +1,12 @@
 package lua
 
 import (
+	"fmt"
 	"log"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -14,6 +18,7 @@ type HTTPResult struct {
 	StatusCode int
 	Body       string
 	Headers    map[string][]string
+	JSON       any // the decoded body, for requests with decode_json
 	Err        error
 }
 
@@ -30,17 +35,127 @@ type BotEvent struct {
 }
 
 func (be BotEvent) Dispatch(e *Engine) {
-	for _, hook := range e.hooks[be.EventType] {
+	hooks := e.hooks[be.EventType]
+	for i, hook := range hooks {
 		// make this a debug log later so it's not spammy
-		log.Printf("Dispatching %s for script %s", be.EventType, hook.Script.Name)
-		e.callLuaFunction(hook, be.Data)
+		e.tracef(hook.Script, "Dispatching %s", be.EventType)
+		e.callLuaFunction(hook, hookData(e.state, be.Data, i, len(hooks)))
 	}
 }
 
+// hookData returns the data to pass to the i-th of n hooks handling an
+// event: a copy of data for all but the last, which gets the original. Hooks
+// may modify the table they are given, e.g. rewrite data.content, and that
+// must not change what the hooks after them see.
+func hookData(L *lua.LState, data lua.LValue, i, n int) lua.LValue {
+	if i == n-1 {
+		return data
+	}
+	return copyLuaValue(L, data, make(map[*lua.LTable]*lua.LTable))
+}
+
+// copyLuaValue returns a deep copy of tables in v; other values are returned
+// as they are. seen maps tables already copied to their copies, so shared and
+// cyclic references are kept.
+func copyLuaValue(L *lua.LState, v lua.LValue, seen map[*lua.LTable]*lua.LTable) lua.LValue {
+	tbl, ok := v.(*lua.LTable)
+	if !ok {
+		return v
+	}
+	if c, ok := seen[tbl]; ok {
+		return c
+	}
+	c := L.NewTable()
+	seen[tbl] = c
+	tbl.ForEach(func(key, value lua.LValue) {
+		c.RawSet(copyLuaValue(L, key, seen), copyLuaValue(L, value, seen))
+	})
+	if mt := L.GetMetatable(tbl); mt != lua.LNil {
+		L.SetMetatable(c, mt)
+	}
+	return c
+}
+
 func (be BotEvent) Type() string {
 	return be.EventType
 }
 
+// ShutdownEvent runs the on_shutdown hooks in priority order (highest first,
+// registration order for ties). Each hook is bounded by its own timeout or the
+// configured default so one slow script can't stall the rest of the shutdown.
+type ShutdownEvent struct {
+	Data lua.LValue
+}
+
+func (se ShutdownEvent) Dispatch(e *Engine) {
+	hooks := append([]HookInfo(nil), e.hooks["on_shutdown"]...)
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].Priority > hooks[j].Priority
+	})
+
+	for i, hook := range hooks {
+		if hook.Timeout == 0 {
+			hook.Timeout = e.cfg.ShutdownHookTimeout
+		}
+		e.tracef(hook.Script, "Dispatching on_shutdown (priority %d)", hook.Priority)
+		e.callLuaFunction(hook, hookData(e.state, se.Data, i, len(hooks)))
+	}
+}
+
+func (se ShutdownEvent) Type() string {
+	return "on_shutdown"
+}
+
+// TickEvent is the engine heartbeat delivered to on_tick hooks.
+type TickEvent struct {
+	Time time.Time
+}
+
+func (te TickEvent) Dispatch(e *Engine) {
+	e.tickPending.Store(false)
+
+	data := e.state.NewTable()
+	data.RawSetString("timestamp", lua.LNumber(te.Time.Unix()))
+	hooks := e.hooks["on_tick"]
+	for i, hook := range hooks {
+		e.callLuaFunction(hook, hookData(e.state, data, i, len(hooks)))
+	}
+}
+
+func (te TickEvent) Type() string {
+	return "on_tick"
+}
+
+// StoreChangeEvent delivers a kv_store write to the on_store_change hooks
+// watching its namespace. Depth counts how many store changes led to this one.
+type StoreChangeEvent struct {
+	Namespace string
+	Key       string
+	Value     lua.LValue // nil when the key was deleted
+	Depth     int
+}
+
+func (sc StoreChangeEvent) Dispatch(e *Engine) {
+	data := e.state.NewTable()
+	data.RawSetString("namespace", lua.LString(sc.Namespace))
+	data.RawSetString("key", lua.LString(sc.Key))
+	data.RawSetString("value", sc.Value)
+	data.RawSetString("deleted", lua.LBool(sc.Value == lua.LNil))
+
+	e.storeChangeDepth = sc.Depth
+	defer func() { e.storeChangeDepth = 0 }()
+	hooks := e.hooks["on_store_change"]
+	for i, hook := range hooks {
+		if hook.Namespace == sc.Namespace {
+			e.callLuaFunction(hook, hookData(e.state, data, i, len(hooks)))
+		}
+	}
+}
+
+func (sc StoreChangeEvent) Type() string {
+	return "on_store_change(" + sc.Namespace + ")"
+}
+
 type TimerEvent struct {
 	TimerID   string
 	TimerData lua.LValue
@@ -48,7 +163,14 @@ type TimerEvent struct {
 }
 
 func (te TimerEvent) Dispatch(e *Engine) {
-	log.Printf("Dispatching timer %s for script %s", te.TimerID, te.Callback.Script.Name)
+	// A timer can fire and be queued just before its script is unloaded; by
+	// the time it's dispatched the script may have been reloaded, and the
+	// callback belongs to the old instance.
+	if script := te.Callback.Script; script != nil && script.unloaded {
+		e.tracef(script, "Dropping timer %s fired before the script was unloaded", te.TimerID)
+		return
+	}
+	e.tracef(te.Callback.Script, "Dispatching timer %s", te.TimerID)
 	e.callLuaFunction(te.Callback, te.TimerData)
 }
 
@@ -60,10 +182,22 @@ type CommandEvent struct {
 	CommandName string
 	CommandData lua.LValue
 	Callback    HookInfo
+	AuthorID    string
+	GuildID     string
+	Depth       int // run_command nesting, 0 for commands typed by users
 }
 
 func (ce CommandEvent) Dispatch(e *Engine) {
-	e.callLuaFunction(ce.Callback, ce.CommandData)
+	e.currentCaller = ce.AuthorID
+	e.commandDepth = ce.Depth
+	defer func() {
+		e.currentCaller = ""
+		e.commandDepth = 0
+	}()
+	// Only commands that ran to completion count as used
+	if e.callLuaFunction(ce.Callback, ce.CommandData) == nil {
+		e.recordCommandUsage(ce.CommandName, ce.AuthorID, ce.GuildID)
+	}
 }
 
 func (ce CommandEvent) Type() string {
@@ -79,20 +213,12 @@ type AsyncHTTPEvent struct {
 }
 
 func (ae AsyncHTTPEvent) Dispatch(e *Engine) {
-	result := e.state.NewTable()
+	var result *lua.LTable
 	if ae.Result.Err != nil {
+		result = e.state.NewTable()
 		result.RawSetString("error", lua.LString(ae.Result.Err.Error()))
 	} else {
-		result.RawSetString("status", lua.LNumber(ae.Result.StatusCode))
-		result.RawSetString("body", lua.LString(ae.Result.Body))
-
-		headersTable := e.state.NewTable()
-		for key, values := range ae.Result.Headers {
-			if len(values) > 0 {
-				headersTable.RawSetString(key, lua.LString(values[0]))
-			}
-		}
-		result.RawSetString("headers", headersTable)
+		result = buildHTTPResultTable(e, ae.Result)
 	}
 	e.callLuaFunction(ae.Callback, result)
 }
@@ -101,11 +227,48 @@ func (ae AsyncHTTPEvent) Type() string {
 	return "http_async"
 }
 
+// AttachmentEvent is enqueued once a download_attachment download finishes.
+type AttachmentEvent struct {
+	Callback HookInfo
+	Data     string
+	Err      error
+}
+
+func (ae AttachmentEvent) Dispatch(e *Engine) {
+	result := e.state.NewTable()
+	if ae.Err != nil {
+		result.RawSetString("error", lua.LString(ae.Err.Error()))
+	} else {
+		result.RawSetString("body", lua.LString(ae.Data))
+	}
+	e.callLuaFunction(ae.Callback, result)
+}
+
+func (ae AttachmentEvent) Type() string {
+	return "attachment"
+}
+
+// MaintenanceEvent runs scheduled database maintenance. It is skipped when
+// other events are waiting so it only runs while the bot is idle.
+type MaintenanceEvent struct{}
+
+func (me MaintenanceEvent) Dispatch(e *Engine) {
+	if pending := len(e.eventQueue); pending > 0 {
+		log.Printf("Postponing database maintenance, %d events pending", pending)
+		return
+	}
+	e.runMaintenance()
+}
+
+func (me MaintenanceEvent) Type() string {
+	return "maintenance"
+}
+
 // ScriptEvent represents an internal system event to manage Lua scripts
-// todo: Do I want to add an onLoad event?
 type ScriptEvent struct {
-	Action     string // "reload", "unload", etc.
+	Action     string // "load", "reload" or "unload"
 	ScriptName string
+	Force      bool // reload even if the source is unchanged
 }
 
 func (se ScriptEvent) Dispatch(e *Engine) {
@@ -113,8 +276,24 @@ func (se ScriptEvent) Dispatch(e *Engine) {
 	case "unload":
 		e.unloadScript(se.ScriptName)
 
+	case "load":
+		// The script may already be loaded, e.g. as a dependency named with
+		// requires() before the watcher saw its file. Loading it again would
+		// register its hooks and timers twice, so reload it if it changed.
+		if _, ok := e.scripts[filepath.Base(se.ScriptName)]; ok {
+			if err := e.reloadScript(se.ScriptName, false); err != nil {
+				log.Printf("Failed to reload script '%s': %v", se.ScriptName, err)
+			}
+			return
+		}
+		if err := e.loadScript(se.ScriptName); err != nil {
+			log.Printf("Failed to load script '%s': %v", se.ScriptName, err)
+		}
+
 	case "reload":
-		e.reloadScript(se.ScriptName)
+		if err := e.reloadScript(se.ScriptName, se.Force); err != nil {
+			log.Printf("Failed to reload script '%s': %v", se.ScriptName, err)
+		}
 
 	default:
 		log.Printf("Unknown ScriptEvent action: %s", se.Action)
@@ -125,22 +304,59 @@ func (se ScriptEvent) Type() string {
 	return "script_" + se.Action
 }
 
+// LoadEvent runs the on_load hook of a script that has just loaded, after
+// its top-level code, so the hook can use everything the script set up.
+type LoadEvent struct {
+	Script *LuaScript
+}
+
+func (le LoadEvent) Dispatch(e *Engine) {
+	// The script may have been unloaded or reloaded while the event was
+	// queued; a reload queues its own
+	if le.Script.unloaded {
+		e.tracef(le.Script, "Dropping on_load queued before the script was unloaded")
+		return
+	}
+	e.tracef(le.Script, "Dispatching on_load")
+	e.callLuaFunction(HookInfo{
+		Function: le.Script.OnLoad,
+		Script:   le.Script,
+		Name:     "on_load",
+	}, e.state.NewTable())
+}
+
+func (le LoadEvent) Type() string {
+	return "on_load(" + le.Script.Name + ")"
+}
+
 // ExecResult holds the output and error from an ExecEvent.
 type ExecResult struct {
 	Output string
 	Err    error
 }
 
-// ExecEvent runs arbitrary Lua code on the dispatcher goroutine.
+// ExecEvent runs arbitrary Lua code on the dispatcher goroutine, in the
+// shared globals or, if Script is set, in the globals of that script.
 // print() output and return values are captured into Result.
 type ExecEvent struct {
 	Code   string
+	Script string
 	Result chan<- ExecResult
 }
 
 func (ee ExecEvent) Dispatch(e *Engine) {
 	var buf strings.Builder
 
+	var env *lua.LTable
+	if ee.Script != "" {
+		script, ok := e.scripts[ee.Script]
+		if !ok {
+			ee.Result <- ExecResult{Err: fmt.Errorf("script %s is not loaded", ee.Script)}
+			return
+		}
+		env = script.Env
+	}
+
 	origPrint := e.state.GetGlobal("print")
 	e.state.SetGlobal("print", e.state.NewFunction(func(L *lua.LState) int {
 		n := L.GetTop()
@@ -164,6 +380,9 @@ func (ee ExecEvent) Dispatch(e *Engine) {
 			return
 		}
 	}
+	if env != nil {
+		fn.Env = env
+	}
 
 	baseTop := e.state.GetTop()
 	e.state.Push(fn)
@@ -209,3 +428,17 @@ func (se snapshotEvent) Dispatch(e *Engine) {
 }
 
 func (se snapshotEvent) Type() string { return "snapshot_" + se.kind }
+
+// BroadcastEvent is enqueued once a broadcast has been sent to every guild.
+type BroadcastEvent struct {
+	Callback HookInfo
+	Result   BroadcastResult
+}
+
+func (be BroadcastEvent) Dispatch(e *Engine) {
+	e.callLuaFunction(be.Callback, broadcastResultToLua(e.state, be.Result))
+}
+
+func (be BroadcastEvent) Type() string {
+	return "broadcast"
+}
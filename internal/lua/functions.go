@@ -1,13 +1,182 @@
 package lua
 
 import (
+	"fmt"
 	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	lua "github.com/yuin/gopher-lua"
 )
 
+// maxCommandCooldown caps command cooldowns so a typo can't lock a command for weeks.
+const maxCommandCooldown = 24 * time.Hour
+
+// secondsToDuration converts a number of seconds from a script into a
+// duration. NaN, infinities and negative numbers are refused; numbers too
+// large for a duration are capped to the largest one.
+func secondsToDuration(seconds float64) (time.Duration, error) {
+	switch {
+	case math.IsNaN(seconds) || math.IsInf(seconds, 0):
+		return 0, fmt.Errorf("must be a finite number of seconds, got %v", seconds)
+	case seconds < 0:
+		return 0, fmt.Errorf("must not be negative, got %v", seconds)
+	case seconds >= float64(math.MaxInt64)/float64(time.Second):
+		return time.Duration(math.MaxInt64), nil
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseCooldown converts a register_command cooldown argument into a duration.
+// It accepts a number of seconds, a numeric string, or a duration string such
+// as "30s" or "5m". nil means no cooldown; negative and non-finite values are
+// rejected.
+func parseCooldown(value lua.LValue) (time.Duration, error) {
+	var seconds float64
+	switch v := value.(type) {
+	case lua.LNumber:
+		seconds = float64(v)
+	case lua.LString:
+		if n, err := strconv.ParseFloat(string(v), 64); err == nil {
+			seconds = n
+		} else if parsed, err := time.ParseDuration(string(v)); err == nil {
+			if parsed < 0 {
+				return 0, fmt.Errorf("cooldown must not be negative, got %s", parsed)
+			}
+			return parsed, nil
+		} else {
+			return 0, fmt.Errorf("cannot parse %q as a duration", string(v))
+		}
+	default:
+		if value == lua.LNil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf(`expected seconds or a duration string like "30s", got %s`, value.Type())
+	}
+
+	d, err := secondsToDuration(seconds)
+	if err != nil {
+		return 0, fmt.Errorf("cooldown %w", err)
+	}
+	return d, nil
+}
+
+// commandSettings holds the optional register_command arguments.
+type commandSettings struct {
+	Cooldown        time.Duration
+	CooldownPerUser bool
+	CooldownMessage string
+	RequiredRole    string
+	History         int
+	Timeout         time.Duration
+	Args            []argSpec
+}
+
+// parseCommandSettings reads the arguments that follow a command's callback:
+// either cooldown[, required_role] or an options table with cooldown,
+// cooldown_scope, cooldown_message, required_role, history, timeout and args.
+// Problems are logged; ok is false if the command should be rejected.
+func (e *Engine) parseCommandSettings(L *lua.LState, commandName string) (settings commandSettings, ok bool) {
+	cooldownValue := L.Get(4) // default is no cooldown
+	if options, isTable := cooldownValue.(*lua.LTable); isTable {
+		cooldownValue = options.RawGetString("cooldown")
+		switch scope := lua.LVAsString(options.RawGetString("cooldown_scope")); scope {
+		case "", "global":
+		case "user":
+			settings.CooldownPerUser = true
+		default:
+			e.logf("Error: Command '%s' has an invalid cooldown_scope '%s' (use \"global\" or \"user\")", commandName, scope)
+			return settings, false
+		}
+		switch message := options.RawGetString("cooldown_message").(type) {
+		case lua.LBool:
+			if message {
+				settings.CooldownMessage = defaultCooldownMessage
+			}
+		case lua.LString:
+			settings.CooldownMessage = string(message)
+		}
+		settings.RequiredRole = lua.LVAsString(options.RawGetString("required_role"))
+		settings.History = int(lua.LVAsNumber(options.RawGetString("history")))
+		timeout := float64(lua.LVAsNumber(options.RawGetString("timeout")))
+		if timeout < 0 {
+			e.logf("Error: Command '%s' has a negative timeout", commandName)
+			return settings, false
+		}
+		settings.Timeout = time.Duration(timeout * float64(time.Second))
+		if args, isTable := options.RawGetString("args").(*lua.LTable); isTable {
+			specs, err := parseArgSpecs(args)
+			if err != nil {
+				e.logf("Error: Command '%s' has invalid args: %v", commandName, err)
+				return settings, false
+			}
+			settings.Args = specs
+		}
+	} else if L.GetTop() >= 5 {
+		settings.RequiredRole = L.CheckString(5)
+	}
+
+	cooldown, err := parseCooldown(cooldownValue)
+	if err != nil {
+		e.logf("Error: Command '%s' has an invalid cooldown: %v", commandName, err)
+		return settings, false
+	}
+	if cooldown > maxCommandCooldown {
+		e.logf("Warning: Command '%s' cooldown %s capped to %s", commandName, cooldown, maxCommandCooldown)
+		cooldown = maxCommandCooldown
+	}
+	settings.Cooldown = cooldown
+
+	if settings.History < 0 {
+		e.logf("Error: Command '%s' has a negative history", commandName)
+		return settings, false
+	}
+	if settings.History > maxCommandHistory {
+		e.logf("Warning: Command '%s' history %d capped to %d", commandName, settings.History, maxCommandHistory)
+		settings.History = maxCommandHistory
+	}
+	return settings, true
+}
+
+// messageLinkPattern matches a Discord message link, including the ptb and
+// canary hosts and the old discordapp.com domain. DMs use "@me" as the guild.
+var messageLinkPattern = regexp.MustCompile(`^https://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/channels/(\d+|@me)/(\d+)/(\d+)/?$`)
+
+// messageLink builds the jump URL of a message. An empty guild ID links to a
+// message in a DM.
+func messageLink(guildID, channelID, messageID string) (string, error) {
+	if guildID == "" {
+		guildID = "@me"
+	} else if !isSnowflake(guildID) {
+		return "", fmt.Errorf("invalid guild ID '%s'", guildID)
+	}
+	if !isSnowflake(channelID) {
+		return "", fmt.Errorf("invalid channel ID '%s'", channelID)
+	}
+	if !isSnowflake(messageID) {
+		return "", fmt.Errorf("invalid message ID '%s'", messageID)
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, channelID, messageID), nil
+}
+
+// parseMessageLink extracts the IDs from a message link. The guild ID is empty
+// for DM links.
+func parseMessageLink(url string) (guildID, channelID, messageID string, err error) {
+	m := messageLinkPattern.FindStringSubmatch(strings.TrimSpace(url))
+	if m == nil {
+		return "", "", "", fmt.Errorf("not a message link: '%s'", url)
+	}
+	if m[1] != "@me" {
+		guildID = m[1]
+	}
+	return guildID, m[2], m[3], nil
+}
+
 // registerFunctions registers all available functions with the Lua state
 func (e *Engine) registerFunctions() {
 	// get_calendar_week returns the year and week number of the current week
@@ -41,193 +210,1356 @@ func (e *Engine) registerFunctions() {
 			week = 2 + days/7
 		}
 
-		L.Push(lua.LNumber(year))
-		L.Push(lua.LNumber(week))
-		return 2
+		L.Push(lua.LNumber(year))
+		L.Push(lua.LNumber(week))
+		return 2
+	}))
+
+	// send_message function
+	// Options: allowed_mentions ("none", "users", "roles", "everyone", "all" or
+	// a table) controls who can be pinged; it defaults to ALLOWED_MENTIONS.
+	e.state.SetGlobal("send_message", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		message := L.CheckString(2)
+		options := L.OptTable(3, nil)
+
+		msg := &discordgo.MessageSend{Content: message}
+		err := e.filterOutboundMessage(channelID, "message", &msg.Content, nil)
+		if err == nil {
+			err = e.applySendOptions(msg, options)
+		}
+		if err == nil {
+			_, err = e.session.ChannelMessageSendComplex(channelID, msg)
+		}
+		if err != nil {
+			e.logf("send_message error: %v", err)
+			return 0
+		}
+		e.recordSent(msg.Content)
+		return 0
+	}))
+
+	// reply_message(channel_id, message_id, content[, options]) → message_id, or nil, error
+	// Sends content as a reply quoting the message, e.g. event.message_id.
+	e.state.SetGlobal("reply_message", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		messageID := L.CheckString(2)
+		content := L.CheckString(3)
+		options := L.OptTable(4, nil)
+
+		replyID, err := e.replyMessage(channelID, messageID, content, options)
+		if err != nil {
+			e.logf("reply_message error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(replyID))
+		return 1
+	}))
+
+	// edit_message(channel_id, message_id, content) → true, or false, error
+	e.state.SetGlobal("edit_message", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		messageID := L.CheckString(2)
+		content := L.CheckString(3)
+
+		if err := e.editMessage(channelID, messageID, content); err != nil {
+			e.logf("edit_message error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// delete_message(channel_id, message_id) → true, or false, error
+	e.state.SetGlobal("delete_message", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		messageID := L.CheckString(2)
+
+		if err := e.deleteMessage(channelID, messageID); err != nil {
+			e.logf("delete_message error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// defer_reply(channel_id[, placeholder]) → handle, or nil, error
+	// Posts a placeholder ("Working..." by default) and returns a handle whose
+	// edit method replaces it with the reply once slow work is done.
+	e.state.SetGlobal("defer_reply", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		placeholder := L.OptString(2, defaultDeferText)
+
+		handle, err := e.deferReply(L, channelID, placeholder)
+		if err != nil {
+			e.logf("defer_reply error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(handle)
+		return 1
+	}))
+
+	// can_send(channel_id) → bool, or nil, error if the channel isn't cached
+	e.state.SetGlobal("can_send", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+
+		ok, err := e.botHasPermissions(channelID, discordgo.PermissionViewChannel|discordgo.PermissionSendMessages)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LBool(ok))
+		return 1
+	}))
+
+	// can_react(channel_id) → bool, or nil, error if the channel isn't cached
+	e.state.SetGlobal("can_react", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+
+		ok, err := e.botHasPermissions(channelID,
+			discordgo.PermissionViewChannel|discordgo.PermissionAddReactions|discordgo.PermissionReadMessageHistory)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LBool(ok))
+		return 1
+	}))
+
+	// api_version() → the host API version
+	e.state.SetGlobal("api_version", e.state.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(APIVersion))
+		return 1
+	}))
+
+	// message_length(text) → length as Discord counts it (UTF-16 code units)
+	e.state.SetGlobal("message_length", e.state.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(messageLength(L.CheckString(1))))
+		return 1
+	}))
+
+	// split_message(text[, limit]) → array of chunks of at most limit
+	// (default and maximum 2000) characters, split at newlines or spaces
+	e.state.SetGlobal("split_message", e.state.NewFunction(func(L *lua.LState) int {
+		text := L.CheckString(1)
+		limit := L.OptInt(2, maxMessageLength)
+
+		result := L.NewTable()
+		for _, chunk := range splitMessage(text, limit) {
+			result.Append(lua.LString(chunk))
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	// await_message(channel_id, user_id, timeout, callback) → true, or nil, error
+	// Calls callback with the next message the user sends in the channel, or
+	// with nil after timeout seconds. That message skips commands and hooks.
+	e.state.SetGlobal("await_message", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		userID := L.CheckString(2)
+		timeout := time.Duration(float64(L.CheckNumber(3)) * float64(time.Second))
+		callback := L.CheckFunction(4)
+
+		if err := e.awaitMessage(channelID, userID, timeout, callback); err != nil {
+			e.logf("await_message error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// send_dm(user_id, message[, options]) → message_id, or nil, error
+	// Opens the DM channel with the user the first time; options are those of
+	// send_message.
+	e.state.SetGlobal("send_dm", e.state.NewFunction(func(L *lua.LState) int {
+		userID := L.CheckString(1)
+		message := L.CheckString(2)
+		options := L.OptTable(3, nil)
+
+		messageID, err := e.sendDM(userID, message, options)
+		if err != nil {
+			e.logf("send_dm error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(messageID))
+		return 1
+	}))
+
+	// send_to_channel(guild_id, channel_name, message[, options]) → true, or false, error
+	// Resolves the channel by name so scripts don't have to store raw IDs.
+	e.state.SetGlobal("send_to_channel", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+		channelName := L.CheckString(2)
+		message := L.CheckString(3)
+		options := L.OptTable(4, nil)
+
+		msg := &discordgo.MessageSend{Content: message}
+		channelID, err := e.resolveChannel(guildID, channelName)
+		if err == nil {
+			err = e.filterOutboundMessage(channelID, "message", &msg.Content, nil)
+		}
+		if err == nil {
+			if err = e.applySendOptions(msg, options); err == nil {
+				_, err = e.session.ChannelMessageSendComplex(channelID, msg)
+			}
+		}
+		if err != nil {
+			e.logf("send_to_channel error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		e.recordSent(msg.Content)
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// send_embed(channel_id, embed_or_embeds[, options]) → true, or false, error
+	// Accepts one embed table or an array of up to 10, sent as a single message.
+	// Options are those of send_message plus content, text shown above the
+	// embeds, and theme = false to send them without the EMBED_* defaults.
+	e.state.SetGlobal("send_embed", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		embedTable := L.CheckTable(2)
+		options := L.OptTable(3, nil)
+
+		embeds, err := parseEmbeds(embedTable)
+		if err == nil && (options == nil || options.RawGetString("theme") != lua.LFalse) {
+			err = e.applyEmbedTheme(embeds)
+		}
+		msg := &discordgo.MessageSend{Embeds: embeds}
+		if err == nil {
+			if options != nil {
+				msg.Content = lua.LVAsString(options.RawGetString("content"))
+			}
+			err = e.filterOutboundMessage(channelID, "embed", &msg.Content, msg.Embeds)
+			if err == nil {
+				err = e.applySendOptions(msg, options)
+			}
+			if err == nil {
+				_, err = e.session.ChannelMessageSendComplex(channelID, msg)
+			}
+		}
+		if err != nil {
+			e.logf("send_embed error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		e.recordSent(msg.Content)
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// webhook_send(webhook_url, message) → message ID, or nil, error
+	// Posts through a Discord webhook instead of as the bot, so each message
+	// may have its own username and avatar_url. message takes content, embeds,
+	// theme and allowed_mentions like send_embed.
+	e.state.SetGlobal("webhook_send", e.state.NewFunction(func(L *lua.LState) int {
+		rawURL := L.CheckString(1)
+		message := L.CheckTable(2)
+
+		payload, err := e.parseWebhookMessage(message)
+		if err == nil {
+			err = e.filterOutboundMessage("", "webhook", &payload.Content, payload.Embeds)
+		}
+		var id string
+		if err == nil {
+			id, err = e.webhookSend(rawURL, payload)
+		}
+		if err != nil {
+			e.logf("webhook_send error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		e.recordSent(payload.Content)
+		L.Push(lua.LString(id))
+		return 1
+	}))
+
+	// create_webhook(channel_id, name) → {id, channel_id, name, url}, or nil, error
+	e.state.SetGlobal("create_webhook", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		name := L.CheckString(2)
+
+		webhook, err := e.createWebhook(channelID, name)
+		if err != nil {
+			e.logf("create_webhook error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(webhook)
+		return 1
+	}))
+
+	// broadcast(content[, callback]) → number of guilds, or nil, error
+	// Owner only: may only be called from a command run by a user with the
+	// owner role. Sends content to every guild's broadcast_channel (guild
+	// config) or system channel in the background; callback receives
+	// {sent = {guild_id, ...}, failed = {[guild_id] = error}} when done.
+	e.state.SetGlobal("broadcast", e.state.NewFunction(func(L *lua.LState) int {
+		content := L.CheckString(1)
+		callback := L.OptFunction(2, nil)
+
+		var guilds []*discordgo.Guild
+		err := e.requireOwner("broadcast")
+		if err == nil {
+			guilds, err = e.guilds()
+		}
+		if err == nil {
+			err = e.filterOutboundMessage("", "broadcast", &content, nil)
+		}
+		if err != nil {
+			e.logf("broadcast error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+
+		targets := e.broadcastTargets(guilds)
+		e.logf("broadcast: sending to %d guild(s) for user %s", len(targets), e.currentCaller)
+		hook := HookInfo{Function: callback, Script: e.currentScript, Name: "broadcast callback"}
+		ctx := e.context()
+
+		e.inflightWg.Add(1)
+		go func() {
+			defer e.inflightWg.Done()
+			result := e.sendBroadcast(ctx, targets, content)
+			scriptLogf(hook.Script, "broadcast: done, %d sent, %d failed", len(result.Sent), len(result.Failed))
+			if callback != nil {
+				e.enqueueEvent(BroadcastEvent{Callback: hook, Result: result}, "broadcast")
+			}
+		}()
+
+		L.Push(lua.LNumber(len(targets)))
+		return 1
+	}))
+
+	// get_roles(guild_id) → array of role tables (highest position first), or nil, error
+	e.state.SetGlobal("get_roles", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+
+		roles, err := e.guildRoles(guildID)
+		if err != nil {
+			e.logf("get_roles error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		result := L.NewTable()
+		for _, role := range roles {
+			result.Append(roleToLua(L, role))
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	// get_members(guild_id[, options]) → array of member tables (in user ID
+	// order) and the after cursor of the next page, or nil, error. options:
+	// limit (default 100, at most 1000) and after (a user ID).
+	e.state.SetGlobal("get_members", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+		limit := defaultMembersPerPage
+		after := ""
+		if opts := L.OptTable(2, nil); opts != nil {
+			if n, ok := opts.RawGetString("limit").(lua.LNumber); ok {
+				limit = int(n)
+			}
+			after = lua.LVAsString(opts.RawGetString("after"))
+		}
+
+		members, err := e.guildMembers(guildID, after, limit)
+		if err != nil {
+			e.logf("get_members error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		result := L.NewTable()
+		for _, member := range members {
+			result.Append(memberToLua(L, member))
+		}
+		L.Push(result)
+		// A full page means there may be more
+		if len(members) > 0 && len(members) == min(limit, maxMembersPerPage) && members[len(members)-1].User != nil {
+			L.Push(lua.LString(members[len(members)-1].User.ID))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 2
+	}))
+
+	// find_user(guild_id, name) → user ID or nil, matches; or nil, error
+	// Resolves a name typed in place of a mention. The ID is nil unless
+	// exactly one member matches; matches holds every candidate as a
+	// get_members table. A mention or bare ID is returned as is, with no
+	// matches.
+	e.state.SetGlobal("find_user", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+		name := strings.TrimSpace(L.CheckString(2))
+
+		if m := userMentionPattern.FindStringSubmatch(name); m != nil {
+			name = m[1]
+		}
+		if isSnowflake(name) {
+			L.Push(lua.LString(name))
+			L.Push(L.NewTable())
+			return 2
+		}
+
+		members, err := e.findUser(guildID, name)
+		if err != nil {
+			e.logf("find_user error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		matches := L.NewTable()
+		for _, member := range members {
+			matches.Append(memberToLua(L, member))
+		}
+		if len(members) == 1 {
+			L.Push(lua.LString(members[0].User.ID))
+		} else {
+			L.Push(lua.LNil)
+		}
+		L.Push(matches)
+		return 2
+	}))
+
+	// get_guild_stickers(guild_id) → array of sticker tables, or nil, error
+	e.state.SetGlobal("get_guild_stickers", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+
+		stickers, err := e.guildStickers(guildID)
+		if err != nil {
+			e.logf("get_guild_stickers error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		result := L.NewTable()
+		for _, sticker := range stickers {
+			result.Append(stickerToLua(L, sticker))
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	// add_reaction(channel_id, message_id, emoji) → true, or false, error
+	// emoji is a unicode emoji or a custom one as "name:id", "<:name:id>" or
+	// "<a:name:id>".
+	e.state.SetGlobal("add_reaction", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		messageID := L.CheckString(2)
+		emoji := L.CheckString(3)
+
+		if err := e.addReaction(channelID, messageID, emoji); err != nil {
+			e.logf("add_reaction error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// get_reaction_count(channel_id, message_id, emoji) → count, or nil, error
+	// emoji is a unicode emoji or a custom one as "name:id" or "<:name:id>".
+	e.state.SetGlobal("get_reaction_count", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		messageID := L.CheckString(2)
+		emoji := L.CheckString(3)
+
+		count, err := e.reactionCount(channelID, messageID, emoji)
+		if err != nil {
+			e.logf("get_reaction_count error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(count))
+		return 1
+	}))
+
+	// sync_reactions(channel_id, message_id[, options]) → array of
+	// {emoji, count, me, users, truncated}, or nil, error
+	// Options: users (default true), false to skip listing who reacted.
+	e.state.SetGlobal("sync_reactions", e.state.NewFunction(func(L *lua.LState) int {
+		channelID := L.CheckString(1)
+		messageID := L.CheckString(2)
+		options := L.OptTable(3, nil)
+		withUsers := true
+		if options != nil {
+			if v := options.RawGetString("users"); v != lua.LNil {
+				withUsers = lua.LVAsBool(v)
+			}
+		}
+
+		reactions, err := e.syncReactions(channelID, messageID, withUsers)
+		if err != nil {
+			e.logf("sync_reactions error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(messageReactionsToLua(L, reactions))
+		return 1
+	}))
+
+	// on_reaction_threshold(emoji, count, callback[, on_drop])
+	// Calls callback once per message when its emoji reactions reach count,
+	// and on_drop when they fall below it again; see checkReactionThresholds.
+	// Both get the reaction event plus the current count.
+	e.state.SetGlobal("on_reaction_threshold", e.state.NewFunction(func(L *lua.LState) int {
+		emoji := normalizeEmoji(L.CheckString(1))
+		threshold := L.CheckInt(2)
+		callback := L.CheckFunction(3)
+		var onDrop lua.LValue
+		if fn := L.OptFunction(4, nil); fn != nil {
+			onDrop = fn
+		}
+		if emoji == "" {
+			L.ArgError(1, "emoji expected")
+		}
+		if threshold < 1 {
+			L.ArgError(2, "count must be at least 1")
+		}
+
+		e.hookMutex.Lock()
+		defer e.hookMutex.Unlock()
+		e.hooks["on_reaction_threshold"] = append(e.hooks["on_reaction_threshold"], HookInfo{
+			Function:  callback,
+			Script:    e.currentScript,
+			Name:      fmt.Sprintf("on_reaction_threshold(%s, %d)", emoji, threshold),
+			Emoji:     emoji,
+			Threshold: threshold,
+			OnDrop:    onDrop,
+		})
+		return 0
+	}))
+
+	// get_user(user_id[, avatar_size]) → user table, or nil, error
+	// Users are cached for an hour; avatar_size is a power of two from 16 to 4096.
+	e.state.SetGlobal("get_user", e.state.NewFunction(func(L *lua.LState) int {
+		userID := L.CheckString(1)
+		size := L.OptInt(2, 0)
+
+		var avatar string
+		user, err := e.lookupUser(userID)
+		if err == nil {
+			avatar, err = avatarURL(user, size)
+		}
+		if err != nil {
+			e.logf("get_user error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(userToLua(L, user, avatar))
+		return 1
+	}))
+
+	// find_role(guild_id, name_or_id) → role table, or nil, error
+	e.state.SetGlobal("find_role", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+		name := L.CheckString(2)
+
+		role, err := e.findRole(guildID, name)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(roleToLua(L, role))
+		return 1
+	}))
+
+	// create_scheduled_event(guild_id, options) → event table, or nil, error
+	// Options: name, start_time, end_time (unix seconds), description, type
+	// ("external", "voice" or "stage"), channel_id and location.
+	e.state.SetGlobal("create_scheduled_event", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+		options := L.CheckTable(2)
+
+		params, err := parseScheduledEvent(options)
+		var event *discordgo.GuildScheduledEvent
+		if err == nil {
+			event, err = e.session.GuildScheduledEventCreate(guildID, params)
+		}
+		if err != nil {
+			e.logf("create_scheduled_event error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(scheduledEventToLua(L, event))
+		return 1
+	}))
+
+	// get_scheduled_events(guild_id) → array of event tables (soonest first), or nil, error
+	e.state.SetGlobal("get_scheduled_events", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+
+		events, err := e.session.GuildScheduledEvents(guildID, true)
+		if err != nil {
+			e.logf("get_scheduled_events error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].ScheduledStartTime.Before(events[j].ScheduledStartTime)
+		})
+		result := L.NewTable()
+		for _, event := range events {
+			result.Append(scheduledEventToLua(L, event))
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	// archive_thread(thread_id[, archived]) → true, or false, error
+	// Pass archived = false to unarchive.
+	e.state.SetGlobal("archive_thread", e.state.NewFunction(func(L *lua.LState) int {
+		threadID := L.CheckString(1)
+		archived := L.OptBool(2, true)
+
+		if err := e.setThreadArchived(threadID, archived); err != nil {
+			e.logf("archive_thread error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// lock_thread(thread_id[, locked]) → true, or false, error
+	// Pass locked = false to unlock.
+	e.state.SetGlobal("lock_thread", e.state.NewFunction(func(L *lua.LState) int {
+		threadID := L.CheckString(1)
+		locked := L.OptBool(2, true)
+
+		if err := e.setThreadLocked(threadID, locked); err != nil {
+			e.logf("lock_thread error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// set_thread_auto_archive(thread_id, minutes) → true, or false, error
+	e.state.SetGlobal("set_thread_auto_archive", e.state.NewFunction(func(L *lua.LState) int {
+		threadID := L.CheckString(1)
+		minutes := L.CheckInt(2)
+
+		if err := e.setThreadAutoArchive(threadID, minutes); err != nil {
+			e.logf("set_thread_auto_archive error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// register_command(name, description, callback[, cooldown[, required_role]])
+	// register_command(name, description, callback, options)
+	// Options: cooldown, required_role, history, the number of recent channel
+	// messages to pass to the callback as event.recent, and timeout in seconds.
+	e.state.SetGlobal("register_command", e.state.NewFunction(func(L *lua.LState) int {
+		commandName := L.CheckString(1)
+		commandDescription := L.CheckString(2)
+		commandCallback := L.CheckFunction(3)
+
+		settings, ok := e.parseCommandSettings(L, commandName)
+		if !ok {
+			return 0
+		}
+
+		// Validate command name
+		if commandName == "" {
+			e.logf("Error: Command name cannot be empty")
+			return 0
+		}
+
+		// Check for invalid characters in command name; ':' separates the
+		// namespace in qualified names
+		if strings.ContainsAny(commandName, " \t\n\r:") {
+			e.logf("Error: Command name '%s' contains invalid characters", commandName)
+			return 0
+		}
+
+		e.cmdMutex.Lock()
+		defer e.cmdMutex.Unlock()
+
+		cmd := &Command{
+			Name:        commandName,
+			Description: commandDescription,
+			Callback: HookInfo{
+				Function: commandCallback,
+				Script:   e.currentScript,
+				Name:     e.cfg.CommandPrefix + commandName,
+				Timeout:  settings.Timeout,
+			},
+			Cooldown:        settings.Cooldown,
+			CooldownPerUser: settings.CooldownPerUser,
+			CooldownMessage: settings.CooldownMessage,
+			LastUsed:        time.Time{}, // Zero time for initial state
+			RequiredRole:    settings.RequiredRole,
+			History:         settings.History,
+			Args:            settings.Args,
+			Namespace:       e.commandNamespace(e.currentScript),
+		}
+		if existing, exists := e.qualifiedCommands[cmd.QualifiedName()]; exists {
+			e.logf("Command '%s' already registered by script '%s'", cmd.QualifiedName(), existing.Callback.Script.Name)
+			return 0
+		}
+		e.commandSeq++
+		cmd.seq = e.commandSeq
+		e.qualifiedCommands[cmd.QualifiedName()] = cmd
+
+		if existing, exists := e.commands[commandName]; exists {
+			e.logf("Command '%s' already registered by script '%s'; this one is available as !%s",
+				commandName, existing.Callback.Script.Name, cmd.QualifiedName())
+			return 0
+		}
+		e.commands[commandName] = cmd
+		e.currentScript.Commands = append(e.currentScript.Commands, commandName)
+
+		e.logf("Command '%s' registered", commandName)
+		return 0
+	}))
+
+	// register_command_pattern(pattern, description, callback[, cooldown[, required_role]])
+	// register_command_pattern(pattern, description, callback, options)
+	// Handles every command whose name matches the Go regular expression and
+	// has no exact registration; event.command holds the name that was used.
+	e.state.SetGlobal("register_command_pattern", e.state.NewFunction(func(L *lua.LState) int {
+		pattern := L.CheckString(1)
+		description := L.CheckString(2)
+		callback := L.CheckFunction(3)
+
+		settings, ok := e.parseCommandSettings(L, pattern)
+		if !ok {
+			return 0
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			e.logf("Error: Invalid command pattern '%s': %v", pattern, err)
+			return 0
+		}
+
+		e.cmdMutex.Lock()
+		defer e.cmdMutex.Unlock()
+
+		for _, existing := range e.commandPatterns {
+			if existing.Name == pattern {
+				e.logf("Command pattern '%s' already registered by script '%s'", pattern, existing.Callback.Script.Name)
+				return 0
+			}
+		}
+
+		e.commandPatterns = append(e.commandPatterns, &Command{
+			Name:        pattern,
+			Description: description,
+			Callback: HookInfo{
+				Function: callback,
+				Script:   e.currentScript,
+				Name:     "command pattern " + pattern,
+				Timeout:  settings.Timeout,
+			},
+			Cooldown:        settings.Cooldown,
+			CooldownPerUser: settings.CooldownPerUser,
+			CooldownMessage: settings.CooldownMessage,
+			RequiredRole:    settings.RequiredRole,
+			History:         settings.History,
+			Args:            settings.Args,
+			Pattern:         re,
+		})
+
+		e.logf("Command pattern '%s' registered", pattern)
+		return 0
+	}))
+
+	// unregister_command(name) → true if it was registered, or nil, error
+	// Also accepts a command pattern; see unregisterCommand.
+	e.state.SetGlobal("unregister_command", e.state.NewFunction(func(L *lua.LState) int {
+		commandName := L.CheckString(1)
+
+		removed, err := e.unregisterCommand(commandName)
+		if err != nil {
+			e.logf("unregister_command error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		if removed {
+			e.logf("Command '%s' unregistered", commandName)
+		}
+		L.Push(lua.LBool(removed))
+		return 1
+	}))
+
+	// run_command(name[, args[, context]]) → true, or nil, error
+	// Queues another command as if it had been typed; see runCommand.
+	e.state.SetGlobal("run_command", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		argsTable := L.OptTable(2, L.NewTable())
+		origin := L.OptTable(3, L.NewTable())
+
+		var args []string
+		for i := 1; i <= argsTable.Len(); i++ {
+			args = append(args, argsTable.RawGetInt(i).String())
+		}
+
+		if err := e.runCommand(name, args, origin); err != nil {
+			e.logf("run_command error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// get_commands function
+	e.state.SetGlobal("get_commands", e.state.NewFunction(func(L *lua.LState) int {
+		e.cmdMutex.Lock()
+		defer e.cmdMutex.Unlock()
+
+		// Commands whose plain name another script took are listed by
+		// their qualified name
+		commandsTable := L.NewTable()
+		for _, cmd := range e.qualifiedCommands {
+			name := cmd.Name
+			if e.commands[name] != cmd {
+				name = cmd.QualifiedName()
+			}
+			cmdTable := L.NewTable()
+			cmdTable.RawSetString("name", lua.LString(cmd.Name))
+			cmdTable.RawSetString("qualified_name", lua.LString(cmd.QualifiedName()))
+			cmdTable.RawSetString("description", lua.LString(cmd.Description))
+			cmdTable.RawSetString("script", lua.LString(cmd.Callback.Script.Name))
+			cmdTable.RawSetString("cooldown", lua.LNumber(cmd.Cooldown.Seconds()))
+			if cmd.CooldownPerUser {
+				cmdTable.RawSetString("cooldown_scope", lua.LString("user"))
+			} else {
+				cmdTable.RawSetString("cooldown_scope", lua.LString("global"))
+			}
+			cmdTable.RawSetString("usage", lua.LString(commandUsage(e.cfg.CommandPrefix, name, cmd.Args)))
+			commandsTable.RawSetString(name, cmdTable)
+		}
+
+		L.Push(commandsTable)
+		return 1
+	}))
+
+	// command_prefix() → the prefix commands start with, "!" unless
+	// COMMAND_PREFIX is set
+	e.state.SetGlobal("command_prefix", e.state.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(e.cfg.CommandPrefix))
+		return 1
+	}))
+
+	// who_registered(name) → array of {kind, name, script, active, namespace}
+	// Lists the commands, command patterns and hooks registered for a command
+	// name (with or without the prefix) or a hook name, to find which script
+	// handles it.
+	e.state.SetGlobal("who_registered", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+
+		result := L.NewTable()
+		for _, r := range e.whoRegistered(name) {
+			entry := L.NewTable()
+			entry.RawSetString("kind", lua.LString(r.Kind))
+			entry.RawSetString("name", lua.LString(r.Name))
+			entry.RawSetString("script", lua.LString(r.Script))
+			if r.Kind != "hook" {
+				entry.RawSetString("active", lua.LBool(r.Active))
+			}
+			if r.Namespace != "" {
+				entry.RawSetString("namespace", lua.LString(r.Namespace))
+			}
+			result.Append(entry)
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	// register_outbound_filter(fn) → true, or false, error
+	// fn(text, info) sees the text of every message scripts send and returns
+	// the text to send, nil to keep it or false to block the message.
+	e.state.SetGlobal("register_outbound_filter", e.state.NewFunction(func(L *lua.LState) int {
+		fn := L.CheckFunction(1)
+
+		if err := e.registerOutboundFilter(fn); err != nil {
+			e.logf("register_outbound_filter error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// register_hook function
+	// An optional options table accepts:
+	//   priority  - on_shutdown hooks run highest priority first (default 0)
+	//   timeout   - seconds the hook may run before it is aborted (default SCRIPT_TIMEOUT)
+	//   namespace - the kv namespace an on_store_change hook watches (required)
+	e.state.SetGlobal("register_hook", e.state.NewFunction(func(L *lua.LState) int {
+		hookName := L.CheckString(1)
+		hookFunc := L.CheckFunction(2)
+		hook := HookInfo{
+			Function: hookFunc,
+			Script:   e.currentScript,
+			Name:     hookName,
+		}
+		if opts := L.OptTable(3, nil); opts != nil {
+			if priority, ok := opts.RawGetString("priority").(lua.LNumber); ok {
+				hook.Priority = int(priority)
+			}
+			if timeout, ok := opts.RawGetString("timeout").(lua.LNumber); ok && timeout > 0 {
+				hook.Timeout = time.Duration(float64(timeout) * float64(time.Second))
+			}
+			hook.Namespace = lua.LVAsString(opts.RawGetString("namespace"))
+		}
+
+		e.hookMutex.Lock()
+		defer e.hookMutex.Unlock()
+
+		switch hookName {
+		case "on_channel_message", "on_direct_message", "on_select", "on_shutdown", "on_tick",
+			"on_reaction_add", "on_reaction_remove", "on_unknown_command",
+			"on_message_edit", "on_message_delete":
+			e.hooks[hookName] = append(e.hooks[hookName], hook)
+		case "on_store_change":
+			if hook.Namespace == "" || isReservedNamespace(hook.Namespace) {
+				e.logf("Error: on_store_change requires a namespace option naming a non-reserved namespace")
+				return 0
+			}
+			e.hooks[hookName] = append(e.hooks[hookName], hook)
+		case "on_load":
+			e.currentScript.OnLoad = hookFunc
+		case "on_unload":
+			e.currentScript.OnUnload = hookFunc
+		default:
+			e.logf("Unknown hook name: %s", hookName)
+		}
+		return 0
+	}))
+
+	// store_set(namespace, key, value[, expiry]) → true, or nil, error
+	// With expiry the value reads as unset once that many seconds have passed.
+	e.state.SetGlobal("store_set", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.CheckString(2)
+		value := L.CheckAny(3)
+
+		var ttl time.Duration
+		err := checkNamespace(namespace)
+		if err == nil && L.GetTop() >= 4 && L.Get(4) != lua.LNil {
+			if ttl, err = secondsToDuration(float64(L.CheckNumber(4))); err != nil {
+				err = fmt.Errorf("expiry %w", err)
+			} else if ttl == 0 {
+				err = fmt.Errorf("expiry must be positive")
+			}
+		}
+		if err == nil {
+			err = e.StoreSetWithExpiry(namespace, key, value, ttl)
+		}
+		if err != nil {
+			e.logf("store_set error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// store_get(namespace, key) → value (nil if unset), or nil, error
+	e.state.SetGlobal("store_get", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.CheckString(2)
+
+		var value lua.LValue
+		err := checkNamespace(namespace)
+		if err == nil {
+			value, err = e.StoreGet(namespace, key)
+		}
+		if err != nil {
+			e.logf("store_get error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(value)
+		return 1
+	}))
+
+	// store_delete(namespace, key) → true, or nil, error
+	e.state.SetGlobal("store_delete", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.CheckString(2)
+
+		err := checkNamespace(namespace)
+		if err == nil {
+			err = e.StoreDelete(namespace, key)
+		}
+		if err != nil {
+			e.logf("store_delete error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// store_clear(namespace) → number of keys deleted, or nil, error
+	e.state.SetGlobal("store_clear", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+
+		var n int
+		err := checkNamespace(namespace)
+		if err == nil {
+			n, err = e.StoreDeleteNamespace(namespace)
+		}
+		if err != nil {
+			e.logf("store_clear error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(n))
+		return 1
 	}))
 
-	// send_message function
-	e.state.SetGlobal("send_message", e.state.NewFunction(func(L *lua.LState) int {
-		channelID := L.CheckString(1)
-		message := L.CheckString(2)
-		_, err := e.session.ChannelMessageSend(channelID, message)
+	// once(key, ttl) → true the first time key is seen within ttl seconds,
+	// false after that, or nil, error
+	e.state.SetGlobal("once", e.state.NewFunction(func(L *lua.LState) int {
+		key := L.CheckString(1)
+		ttl := time.Duration(float64(L.CheckNumber(2)) * float64(time.Second))
+
+		first, err := e.once(key, ttl)
 		if err != nil {
-			log.Println("send_message error:", err)
+			e.logf("once error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
-		return 0
+		L.Push(lua.LBool(first))
+		return 1
 	}))
 
-	// register_command function
-	e.state.SetGlobal("register_command", e.state.NewFunction(func(L *lua.LState) int {
-		commandName := L.CheckString(1)
-		commandDescription := L.CheckString(2)
-		commandCallback := L.CheckFunction(3)
-		commandCooldown := time.Duration(0) // default is no cooldown
-		if L.GetTop() >= 4 {
-			commandCooldown = time.Duration(L.CheckNumber(4)) * time.Second
+	// store_append(namespace, key, value[, max]) → new length, or nil, error
+	// Appends to a list value in one transaction. With max, only the newest max
+	// items are kept.
+	e.state.SetGlobal("store_append", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.CheckString(2)
+		value := L.CheckAny(3)
+		max := L.OptInt(4, 0)
+
+		var length int
+		err := checkNamespace(namespace)
+		if err == nil {
+			length, err = e.StoreAppend(namespace, key, value, max)
 		}
-		var requiredRole string
-		if L.GetTop() >= 5 {
-			requiredRole = L.CheckString(5)
+		if err != nil {
+			e.logf("store_append error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
+		L.Push(lua.LNumber(length))
+		return 1
+	}))
 
-		// Validate command name
-		if commandName == "" {
-			log.Println("Error: Command name cannot be empty")
-			return 0
-		}
+	// store_increment(namespace, key[, delta]) → new value, or nil, error
+	// Adds delta (default 1) to an integer value in one statement. A key that
+	// is unset or doesn't hold a number starts from 0.
+	e.state.SetGlobal("store_increment", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.CheckString(2)
+		delta := L.OptInt64(3, 1)
 
-		// Check for invalid characters in command name
-		if strings.ContainsAny(commandName, " \t\n\r") {
-			log.Printf("Error: Command name '%s' contains invalid characters", commandName)
-			return 0
+		var value int64
+		err := checkNamespace(namespace)
+		if err == nil {
+			value, err = e.StoreIncrement(namespace, key, delta)
 		}
+		if err != nil {
+			e.logf("store_increment error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(value))
+		return 1
+	}))
 
-		e.cmdMutex.Lock()
-		defer e.cmdMutex.Unlock()
-
-		if existingCommand, exists := e.commands[commandName]; exists {
-			log.Printf("Command '%s' already registered by script '%s'", commandName, existingCommand.Callback.Script)
-			return 0
+	// store_pop(namespace, key[, end]) → item (nil if the list is empty), or nil, error
+	// end is "last" (the default) or "first", which makes the list a queue.
+	e.state.SetGlobal("store_pop", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.CheckString(2)
+		end := L.OptString(3, "last")
+		if end != "first" && end != "last" {
+			L.ArgError(3, `expected "first" or "last"`)
 		}
 
-		e.commands[commandName] = &Command{
-			Name:        commandName,
-			Description: commandDescription,
-			Callback: HookInfo{
-				Function: commandCallback,
-				Script:   e.currentScript,
-			},
-			Cooldown:     commandCooldown,
-			LastUsed:     time.Time{}, // Zero time for initial state
-			RequiredRole: requiredRole,
+		var item lua.LValue
+		err := checkNamespace(namespace)
+		if err == nil {
+			item, err = e.StorePop(namespace, key, end == "first")
+		}
+		if err != nil {
+			e.logf("store_pop error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
+		L.Push(item)
+		return 1
+	}))
 
-		e.currentScript.Commands = append(e.currentScript.Commands, commandName)
+	// store_list_trim(namespace, key, max) → new length, or nil, error
+	// Keeps only the newest max items of a list value.
+	e.state.SetGlobal("store_list_trim", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.CheckString(2)
+		max := L.CheckInt(3)
+		if max < 0 {
+			L.ArgError(3, "max must not be negative")
+		}
 
-		log.Printf("Command '%s' registered by script '%s'", commandName, e.currentScript.Name)
-		return 0
+		var length int
+		err := checkNamespace(namespace)
+		if err == nil {
+			length, err = e.StoreListTrim(namespace, key, max)
+		}
+		if err != nil {
+			e.logf("store_list_trim error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(length))
+		return 1
 	}))
 
-	// unregister_command function
-	e.state.SetGlobal("unregister_command", e.state.NewFunction(func(L *lua.LState) int {
-		commandName := L.CheckString(1)
-
-		e.cmdMutex.Lock()
-		defer e.cmdMutex.Unlock()
+	// store_get_all(namespace) → table of values, or nil, error
+	e.state.SetGlobal("store_get_all", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
 
-		cmd, exists := e.commands[commandName]
-		if !exists {
-			return 0
+		var values lua.LValue
+		err := checkNamespace(namespace)
+		if err == nil {
+			values, err = e.StoreGetAll(namespace)
 		}
+		if err != nil {
+			e.logf("store_get_all error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(values)
+		return 1
+	}))
 
-		delete(e.commands, commandName)
-
-		// Remove from the owning script's Commands slice so script unload
-		// doesn't attempt a redundant delete.
-		script := cmd.Callback.Script
-		for i, name := range script.Commands {
-			if name == commandName {
-				script.Commands = append(script.Commands[:i], script.Commands[i+1:]...)
-				break
+	// store_journal(namespace[, key[, options]]) → entries, or nil, error
+	// Entries of a namespace in JOURNAL_NAMESPACES, newest first. Options:
+	// limit (default and maximum 100) and before, an entry ID to page back from.
+	e.state.SetGlobal("store_journal", e.state.NewFunction(func(L *lua.LState) int {
+		namespace := L.CheckString(1)
+		key := L.OptString(2, "")
+		options := L.OptTable(3, nil)
+
+		var before int64
+		limit := maxJournalEntries
+		if options != nil {
+			if n, ok := options.RawGetString("before").(lua.LNumber); ok {
+				before = int64(n)
+			}
+			if n, ok := options.RawGetString("limit").(lua.LNumber); ok {
+				limit = int(n)
 			}
 		}
 
-		log.Printf("Command '%s' unregistered", commandName)
-		return 0
+		err := checkNamespace(namespace)
+		var entries *lua.LTable
+		if err == nil {
+			entries, err = e.StoreJournal(namespace, key, before, limit)
+		}
+		if err != nil {
+			e.logf("store_journal error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(entries)
+		return 1
 	}))
 
-	// get_commands function
-	e.state.SetGlobal("get_commands", e.state.NewFunction(func(L *lua.LState) int {
-		e.cmdMutex.Lock()
-		defer e.cmdMutex.Unlock()
+	// store_rollback(entry_id[, options]) → true, or false, error
+	// Restores the value from before a journal entry. Set force in options
+	// to roll back a key that has changed again since.
+	e.state.SetGlobal("store_rollback", e.state.NewFunction(func(L *lua.LState) int {
+		id := L.CheckInt64(1)
+		options := L.OptTable(2, nil)
+		force := options != nil && lua.LVAsBool(options.RawGetString("force"))
 
-		commandsTable := L.NewTable()
-		for name, cmd := range e.commands {
-			cmdTable := L.NewTable()
-			cmdTable.RawSetString("name", lua.LString(cmd.Name))
-			cmdTable.RawSetString("description", lua.LString(cmd.Description))
-			cmdTable.RawSetString("script", lua.LString(cmd.Callback.Script.Name))
-			cmdTable.RawSetString("cooldown", lua.LNumber(cmd.Cooldown.Seconds()))
-			commandsTable.RawSetString(name, cmdTable)
+		if err := e.StoreRollback(id, force); err != nil {
+			e.logf("store_rollback error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
-
-		L.Push(commandsTable)
+		L.Push(lua.LTrue)
 		return 1
 	}))
 
-	// register_hook function
-	e.state.SetGlobal("register_hook", e.state.NewFunction(func(L *lua.LState) int {
-		hookName := L.CheckString(1)
-		hookFunc := L.CheckFunction(2)
-
-		e.hookMutex.Lock()
-		defer e.hookMutex.Unlock()
+	// get_guild_config(guild_id, key[, default]) → value
+	e.state.SetGlobal("get_guild_config", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
+		key := L.CheckString(2)
+		fallback := L.Get(3)
 
-		switch hookName {
-		case "on_channel_message", "on_direct_message", "on_shutdown":
-			e.hooks[hookName] = append(e.hooks[hookName], HookInfo{
-				Function: hookFunc,
-				Script:   e.currentScript,
-			})
-		case "on_unload":
-			e.currentScript.OnUnload = hookFunc
-		default:
-			log.Println("Unknown hook name:", hookName)
+		value, err := e.GuildConfigGet(guildID, key, fallback)
+		if err != nil {
+			e.logf("get_guild_config error: %v", err)
 		}
-		return 0
+		L.Push(value)
+		return 1
 	}))
 
-	// store_set function
-	e.state.SetGlobal("store_set", e.state.NewFunction(func(L *lua.LState) int {
-		namespace := L.CheckString(1)
+	// set_guild_config(guild_id, key, value) → true, or false, error. nil removes the key.
+	e.state.SetGlobal("set_guild_config", e.state.NewFunction(func(L *lua.LState) int {
+		guildID := L.CheckString(1)
 		key := L.CheckString(2)
-		value := L.CheckAny(3)
+		value := L.Get(3)
 
-		if err := e.StoreSet(namespace, key, value); err != nil {
-			log.Println("store_set error:", err)
+		if err := e.GuildConfigSet(guildID, key, value); err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
-		return 0
+		L.Push(lua.LTrue)
+		return 1
 	}))
 
-	// store_get function
-	e.state.SetGlobal("store_get", e.state.NewFunction(func(L *lua.LState) int {
-		namespace := L.CheckString(1)
-		key := L.CheckString(2)
+	// db_vacuum() → size_before, size_after (bytes), or nil, error
+	// Owner only: VACUUM locks the database while it runs.
+	e.state.SetGlobal("db_vacuum", e.state.NewFunction(func(L *lua.LState) int {
+		if err := e.requireOwner("db_vacuum"); err != nil {
+			e.logf("db_vacuum error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		before, after, err := e.runMaintenance()
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(before))
+		L.Push(lua.LNumber(after))
+		return 2
+	}))
 
-		value, err := e.StoreGet(namespace, key)
+	// export_data(name) → number of entries written, or nil, error
+	// Only for commands run by an owner; name is a file in EXPORT_DIR.
+	e.state.SetGlobal("export_data", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+
+		err := e.requireOwner("export_data")
+		var count int
+		if err == nil {
+			count, err = e.ExportData(name)
+		}
 		if err != nil {
-			log.Println("store_get error:", err)
+			e.logf("export_data error: %v", err)
 			L.Push(lua.LNil)
-		} else {
-			L.Push(value)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
+		L.Push(lua.LNumber(count))
 		return 1
 	}))
 
-	// store_delete function
-	e.state.SetGlobal("store_delete", e.state.NewFunction(func(L *lua.LState) int {
-		namespace := L.CheckString(1)
-		key := L.CheckString(2)
-
-		if err := e.StoreDelete(namespace, key); err != nil {
-			log.Println("store_delete error:", err)
+	// import_data(name[, strategy]) → imported, skipped, or nil, error
+	// Only for commands run by an owner; name is a file in EXPORT_DIR and
+	// strategy is "skip" (default), "overwrite" or "replace".
+	e.state.SetGlobal("import_data", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		strategy := L.OptString(2, mergeSkip)
+
+		err := e.requireOwner("import_data")
+		var imported, skipped int
+		if err == nil {
+			imported, skipped, err = e.ImportData(name, strategy)
 		}
-		return 0
+		if err != nil {
+			e.logf("import_data error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(imported))
+		L.Push(lua.LNumber(skipped))
+		return 2
 	}))
 
-	// store_get_all function
-	e.state.SetGlobal("store_get_all", e.state.NewFunction(func(L *lua.LState) int {
-		namespace := L.CheckString(1)
+	// add_script_dir(path) → number of scripts loaded, array of {name, error}
+	// for those that failed, or nil, error. Only for commands run by an owner.
+	e.state.SetGlobal("add_script_dir", e.state.NewFunction(func(L *lua.LState) int {
+		path := L.CheckString(1)
 
-		value, err := e.StoreGetAll(namespace)
+		err := e.requireOwner("add_script_dir")
+		var result LoadResult
+		if err == nil {
+			result, err = e.AddScriptDir(path)
+		}
 		if err != nil {
-			log.Println("store_get_all error:", err)
+			e.logf("add_script_dir error: %v", err)
 			L.Push(lua.LNil)
-		} else {
-			L.Push(value)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
-		return 1
+		failed := L.NewTable()
+		for _, f := range result.Failed {
+			entry := L.NewTable()
+			entry.RawSetString("name", lua.LString(f.Name))
+			entry.RawSetString("error", lua.LString(f.Err.Error()))
+			failed.Append(entry)
+		}
+		L.Push(lua.LNumber(result.Loaded))
+		L.Push(failed)
+		return 2
 	}))
 
 	// http_get function
@@ -238,13 +1570,14 @@ func (e *Engine) registerFunctions() {
 			options = L.CheckTable(2)
 		}
 
-		result, err := e.httpGet(url, options)
+		result, err := e.httpRequest("GET", url, "", options)
 		if err != nil {
-			log.Println("http_get error:", err)
+			e.logf("http_get error: %v", err)
 			L.Push(lua.LNil)
-		} else {
-			L.Push(result)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
+		L.Push(result)
 		return 1
 	}))
 
@@ -260,14 +1593,17 @@ func (e *Engine) registerFunctions() {
 
 		// Parse options and capture callback on the dispatcher goroutine before
 		// spawning — after this point we must not touch LState.
-		opts := parseHTTPOptions(options)
+		opts := e.requestOptions(options)
 		hook := HookInfo{Function: callback, Script: e.currentScript}
-		ctx := e.ctx
+		ctx := e.context()
+		breaker := e.breaker
 
 		e.inflightWg.Add(1)
 		go func() {
 			defer e.inflightWg.Done()
-			result := doHTTPGet(ctx, url, opts)
+			result := breaker.do(url, func() HTTPResult {
+				return doHTTPRequest(ctx, "GET", url, "", opts)
+			})
 			e.enqueueEvent(AsyncHTTPEvent{Callback: hook, Result: result}, "http_get_async")
 		}()
 
@@ -283,13 +1619,14 @@ func (e *Engine) registerFunctions() {
 			options = L.CheckTable(3)
 		}
 
-		result, err := e.httpPost(url, body, options)
+		result, err := e.httpRequest("POST", url, body, options)
 		if err != nil {
-			log.Println("http_post error:", err)
+			e.logf("http_post error: %v", err)
 			L.Push(lua.LNil)
-		} else {
-			L.Push(result)
+			L.Push(lua.LString(err.Error()))
+			return 2
 		}
+		L.Push(result)
 		return 1
 	}))
 
@@ -304,27 +1641,92 @@ func (e *Engine) registerFunctions() {
 		}
 		callback := L.CheckFunction(L.GetTop())
 
-		opts := parseHTTPOptions(options)
+		opts := e.requestOptions(options)
 		hook := HookInfo{Function: callback, Script: e.currentScript}
-		ctx := e.ctx
+		ctx := e.context()
+		breaker := e.breaker
 
 		e.inflightWg.Add(1)
 		go func() {
 			defer e.inflightWg.Done()
-			result := doHTTPPost(ctx, url, body, opts)
+			result := breaker.do(url, func() HTTPResult {
+				return doHTTPRequest(ctx, "POST", url, body, opts)
+			})
 			e.enqueueEvent(AsyncHTTPEvent{Callback: hook, Result: result}, "http_post_async")
 		}()
 
 		return 0
 	}))
 
+	// http_put(url, body[, options]), http_patch(url, body[, options]) and
+	// http_delete(url[, body][, options]) → result, or nil, error
+	// Synchronous like http_post, with the same options and result.
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		name := "http_" + strings.ToLower(method)
+		e.state.SetGlobal(name, e.state.NewFunction(func(L *lua.LState) int {
+			url := L.CheckString(1)
+			var body string
+			var options *lua.LTable
+			switch arg := L.Get(2); {
+			case method == "DELETE" && arg.Type() == lua.LTTable:
+				// http_delete(url, options)
+				options = arg.(*lua.LTable)
+			case method == "DELETE" && arg == lua.LNil:
+				// http_delete(url[, nil, options])
+				options = L.OptTable(3, nil)
+			default:
+				body = L.CheckString(2)
+				options = L.OptTable(3, nil)
+			}
+
+			result, err := e.httpRequest(method, url, body, options)
+			if err != nil {
+				e.logf("%s error: %v", name, err)
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(result)
+			return 1
+		}))
+	}
+
+	// download_attachment(url, callback) → true, or nil, error
+	// Downloads in the background like http_get_async; callback receives
+	// {body = contents} or {error = message}. The URL must be on Discord's CDN.
+	e.state.SetGlobal("download_attachment", e.state.NewFunction(func(L *lua.LState) int {
+		url := L.CheckString(1)
+		callback := L.CheckFunction(2)
+
+		if err := checkAttachmentURL(url); err != nil {
+			e.logf("download_attachment error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		opts := e.requestOptions(nil)
+		hook := HookInfo{Function: callback, Script: e.currentScript, Name: "download_attachment callback"}
+		ctx := e.context()
+		breaker := e.breaker
+
+		e.inflightWg.Add(1)
+		go func() {
+			defer e.inflightWg.Done()
+			data, err := downloadAttachment(ctx, breaker, url, opts)
+			e.enqueueEvent(AttachmentEvent{Callback: hook, Data: data, Err: err}, "download_attachment")
+		}()
+
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
 	// json_encode function
 	e.state.SetGlobal("json_encode", e.state.NewFunction(func(L *lua.LState) int {
 		table := L.CheckTable(1)
 
 		result, err := e.jsonEncode(table)
 		if err != nil {
-			log.Println("json_encode error:", err)
+			e.logf("json_encode error: %v", err)
 			L.Push(lua.LNil)
 		} else {
 			L.Push(result)
@@ -338,7 +1740,7 @@ func (e *Engine) registerFunctions() {
 
 		result, err := e.jsonDecode(jsonStr)
 		if err != nil {
-			log.Println("json_decode error:", err)
+			e.logf("json_decode error: %v", err)
 			L.Push(lua.LNil)
 		} else {
 			L.Push(result)
@@ -346,10 +1748,140 @@ func (e *Engine) registerFunctions() {
 		return 1
 	}))
 
+	// message_link(guild_id, channel_id, message_id) → url, or nil, error
+	// guild_id may be nil or "" for a message in a DM.
+	e.state.SetGlobal("message_link", e.state.NewFunction(func(L *lua.LState) int {
+		link, err := messageLink(L.OptString(1, ""), L.CheckString(2), L.CheckString(3))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(link))
+		return 1
+	}))
+
+	// parse_message_link(url) → guild_id, channel_id, message_id, or nil, error
+	// guild_id is nil for links to DMs.
+	e.state.SetGlobal("parse_message_link", e.state.NewFunction(func(L *lua.LState) int {
+		guildID, channelID, messageID, err := parseMessageLink(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		if guildID == "" {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(guildID))
+		}
+		L.Push(lua.LString(channelID))
+		L.Push(lua.LString(messageID))
+		return 3
+	}))
+
+	// get_state() → the calling script's in-memory table, or nil, error
+	// Survives across hook calls, is private to the script and is cleared when
+	// the script unloads. For ephemeral data that doesn't belong in the store.
+	e.state.SetGlobal("get_state", e.state.NewFunction(func(L *lua.LState) int {
+		if e.currentScript == nil || e.currentScript.State == nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString("get_state can only be called by a loaded script"))
+			return 2
+		}
+		L.Push(e.currentScript.State)
+		return 1
+	}))
+
+	// config.<key> → the calling script's value for key from its .conf file
+	// Scripts share their globals, so config is a read-only proxy looking the
+	// key up in the config of whichever script is running.
+	e.state.SetGlobal("config", e.scriptConfigProxy())
+
+	// get_secret(name) → value, or nil if unset
+	// Reads BOT_SECRET_<NAME> so API keys stay out of script source.
+	e.state.SetGlobal("get_secret", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		if value, ok := e.cfg.Secret(name); ok {
+			L.Push(lua.LString(value))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}))
+
+	// get_config() → array of {name, value}, the effective configuration with
+	// the bot token masked
+	e.state.SetGlobal("get_config", e.state.NewFunction(func(L *lua.LState) int {
+		result := L.NewTable()
+		for _, setting := range e.cfg.Settings() {
+			entry := L.NewTable()
+			entry.RawSetString("name", lua.LString(setting.Name))
+			entry.RawSetString("value", lua.LString(setting.Value))
+			result.Append(entry)
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	// get_top_commands([limit[, days]]) → array of {command, uses, users}, or nil, error
+	// Most used commands over the last days (default 30), from the usage log
+	// kept when COMMAND_USAGE_LOG is enabled.
+	e.state.SetGlobal("get_top_commands", e.state.NewFunction(func(L *lua.LState) int {
+		limit := L.OptInt(1, 10)
+		days := L.OptNumber(2, 30)
+
+		if !e.cfg.CommandUsageLog {
+			L.Push(lua.LNil)
+			L.Push(lua.LString("command usage logging is disabled (set COMMAND_USAGE_LOG=true)"))
+			return 2
+		}
+		since := time.Now().Add(-time.Duration(float64(days) * 24 * float64(time.Hour)))
+		counts, err := e.db.TopCommands(since, limit)
+		if err != nil {
+			e.logf("get_top_commands error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+
+		result := L.NewTable()
+		for _, c := range counts {
+			tbl := L.NewTable()
+			tbl.RawSetString("command", lua.LString(c.Command))
+			tbl.RawSetString("uses", lua.LNumber(c.Uses))
+			tbl.RawSetString("users", lua.LNumber(c.Users))
+			result.Append(tbl)
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	// get_uptime() → seconds, formatted string (e.g. "3d 4h")
+	e.state.SetGlobal("get_uptime", e.state.NewFunction(func(L *lua.LState) int {
+		uptime := e.Uptime()
+		L.Push(lua.LNumber(int64(uptime.Seconds())))
+		L.Push(lua.LString(formatDuration(uptime)))
+		return 2
+	}))
+
+	// get_shard() → shard ID, shard count
+	// Every shard runs its own copy of the scripts; scripts use this to do
+	// bot-wide work such as a daily digest on one shard only.
+	e.state.SetGlobal("get_shard", e.state.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(e.cfg.ShardID))
+		L.Push(lua.LNumber(e.cfg.ShardCount))
+		return 2
+	}))
+
 	// log function
 	e.state.SetGlobal("log", e.state.NewFunction(func(L *lua.LState) int {
 		message := L.CheckString(1)
-		log.Printf("[Lua Script] %s", message)
+		if e.currentScript == nil {
+			log.Printf("[lua] %s%s", traceLogPrefix(e.traceID), message)
+		} else {
+			e.logf("%s", message)
+		}
 		return 0
 	}))
 
@@ -362,15 +1894,13 @@ func (e *Engine) registerFunctions() {
 			data = L.CheckAny(3)
 		}
 
-		// Get the current script name
-		scriptName := e.currentScript
-
-		timerID := e.timer.RegisterTimer(float64(seconds), callback, data, scriptName)
+		timerID := e.timer.RegisterTimer(float64(seconds), callback, data, e.currentScript)
 		L.Push(lua.LString(timerID))
 		return 1
 	}))
 
-	// register_repeating_timer function
+	// register_timer(seconds, callback[, data[, options]]) → timer id
+	// Options: jitter, a window in seconds by which each firing is randomly delayed.
 	e.state.SetGlobal("register_timer", e.state.NewFunction(func(L *lua.LState) int {
 		seconds := L.CheckNumber(1)
 		callback := L.CheckFunction(2)
@@ -378,8 +1908,12 @@ func (e *Engine) registerFunctions() {
 		if L.GetTop() > 2 {
 			data = L.CheckAny(3)
 		}
+		var jitter float64
+		if options := L.OptTable(4, nil); options != nil {
+			jitter = float64(lua.LVAsNumber(options.RawGetString("jitter")))
+		}
 
-		timerID := e.timer.RegisterRepeatingTimer(float64(seconds), callback, data, e.currentScript)
+		timerID := e.timer.RegisterJitteredTimer(float64(seconds), jitter, callback, data, e.currentScript)
 		L.Push(lua.LString(timerID))
 		return 1
 	}))
@@ -393,6 +1927,61 @@ func (e *Engine) registerFunctions() {
 		return 1
 	}))
 
+	// schedule_cron(name, spec, callback[, options]) → true, or nil, error
+	// Runs callback whenever the cron expression spec matches. Options:
+	// catch_up, to make up for runs missed while the bot was down with one run.
+	e.state.SetGlobal("schedule_cron", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		spec := L.CheckString(2)
+		callback := L.CheckFunction(3)
+		var catchUp bool
+		if options := L.OptTable(4, nil); options != nil {
+			catchUp = lua.LVAsBool(options.RawGetString("catch_up"))
+		}
+
+		if err := e.scheduleCron(name, spec, catchUp, callback); err != nil {
+			e.logf("schedule_cron error: %v", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// cancel_cron(name) → whether the calling script had such a job
+	e.state.SetGlobal("cancel_cron", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+
+		found, err := e.cancelCron(name)
+		if err != nil {
+			e.logf("cancel_cron error: %v", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LBool(found))
+		return 1
+	}))
+
+	// get_timers([script]) → array of {id, script, repeating, remaining}
+	// remaining is in seconds; timers are ordered soonest first.
+	e.state.SetGlobal("get_timers", e.state.NewFunction(func(L *lua.LState) int {
+		scriptName := L.OptString(1, "")
+
+		result := L.NewTable()
+		for _, info := range e.timer.ListTimers(scriptName) {
+			entry := L.NewTable()
+			entry.RawSetString("id", lua.LString(info.ID))
+			entry.RawSetString("script", lua.LString(info.Script))
+			entry.RawSetString("repeating", lua.LBool(info.Repeating))
+			entry.RawSetString("remaining", lua.LNumber(info.Remaining.Seconds()))
+			result.Append(entry)
+		}
+		L.Push(result)
+		return 1
+	}))
+
 	if e.users == nil {
 		return
 	}
@@ -402,7 +1991,7 @@ func (e *Engine) registerFunctions() {
 		id := L.CheckString(1)
 		displayName := L.CheckString(2)
 		if err := e.users.EnsureUser(id, displayName); err != nil {
-			log.Println("user_ensure error:", err)
+			e.logf("user_ensure error: %v", err)
 		}
 		return 0
 	}))
@@ -412,7 +2001,7 @@ func (e *Engine) registerFunctions() {
 		id := L.CheckString(1)
 		u, err := e.users.GetUser(id)
 		if err != nil {
-			log.Println("user_get error:", err)
+			e.logf("user_get error: %v", err)
 			L.Push(lua.LNil)
 			return 1
 		}
@@ -439,7 +2028,7 @@ func (e *Engine) registerFunctions() {
 		role := L.CheckString(2)
 		ok, err := e.users.HasRole(id, role)
 		if err != nil {
-			log.Println("user_has_role error:", err)
+			e.logf("user_has_role error: %v", err)
 			L.Push(lua.LFalse)
 			return 1
 		}
@@ -452,7 +2041,7 @@ func (e *Engine) registerFunctions() {
 		id := L.CheckString(1)
 		role := L.CheckString(2)
 		if err := e.users.AddRole(id, role); err != nil {
-			log.Println("user_add_role error:", err)
+			e.logf("user_add_role error: %v", err)
 		}
 		return 0
 	}))
@@ -462,7 +2051,7 @@ func (e *Engine) registerFunctions() {
 		id := L.CheckString(1)
 		role := L.CheckString(2)
 		if err := e.users.RemoveRole(id, role); err != nil {
-			log.Println("user_remove_role error:", err)
+			e.logf("user_remove_role error: %v", err)
 		}
 		return 0
 	}))
@@ -473,7 +2062,7 @@ func (e *Engine) registerFunctions() {
 		key := L.CheckString(2)
 		value := L.CheckString(3)
 		if err := e.users.SetMeta(id, key, value); err != nil {
-			log.Println("user_set_meta error:", err)
+			e.logf("user_set_meta error: %v", err)
 		}
 		return 0
 	}))
@@ -484,7 +2073,7 @@ func (e *Engine) registerFunctions() {
 		key := L.CheckString(2)
 		value, ok, err := e.users.GetMeta(id, key)
 		if err != nil {
-			log.Println("user_get_meta error:", err)
+			e.logf("user_get_meta error: %v", err)
 			L.Push(lua.LNil)
 			return 1
 		}
@@ -500,7 +2089,7 @@ func (e *Engine) registerFunctions() {
 	e.state.SetGlobal("get_owner", e.state.NewFunction(func(L *lua.LState) int {
 		u, err := e.users.GetOwner()
 		if err != nil {
-			log.Println("get_owner error:", err)
+			e.logf("get_owner error: %v", err)
 			L.Push(lua.LNil)
 			return 1
 		}
@@ -528,7 +2117,7 @@ func (e *Engine) registerFunctions() {
 		token := L.CheckString(3)
 		ok, err := e.users.ClaimAdmin(userID, displayName, token)
 		if err != nil {
-			log.Println("user_claim_admin error:", err)
+			e.logf("user_claim_admin error: %v", err)
 			L.Push(lua.LFalse)
 			return 1
 		}
@@ -541,7 +2130,7 @@ func (e *Engine) registerFunctions() {
 		id := L.CheckString(1)
 		meta, err := e.users.GetAllMeta(id)
 		if err != nil {
-			log.Println("user_get_all_meta error:", err)
+			e.logf("user_get_all_meta error: %v", err)
 			L.Push(lua.LNil)
 			return 1
 		}
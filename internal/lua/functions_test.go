@@ -0,0 +1,625 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestParseCooldown(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	tests := []struct {
+		name    string
+		value   lua.LValue
+		want    time.Duration
+		wantErr bool
+	}{
+		{"nil", lua.LNil, 0, false},
+		{"seconds", lua.LNumber(10), 10 * time.Second, false},
+		{"fractional seconds", lua.LNumber(1.5), 1500 * time.Millisecond, false},
+		{"numeric string", lua.LString("20"), 20 * time.Second, false},
+		{"duration string", lua.LString("2m"), 2 * time.Minute, false},
+		{"negative number", lua.LNumber(-5), 0, true},
+		{"negative duration", lua.LString("-1s"), 0, true},
+		{"garbage string", lua.LString("soon"), 0, true},
+		{"NaN", lua.LNumber(math.NaN()), 0, true},
+		{"infinity", lua.LNumber(math.Inf(1)), 0, true},
+		{"negative infinity", lua.LNumber(math.Inf(-1)), 0, true},
+		{"infinity string", lua.LString("inf"), 0, true},
+		{"huge", lua.LNumber(1e300), time.Duration(math.MaxInt64), false},
+		{"table", L.NewTable(), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCooldown(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCooldown(%v) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseCooldown(%v) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterCommandInvalidCooldown(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "cooldowns.lua", `
+		register_command("bad", "negative cooldown", function() end, -10)
+		register_command("typo", "string cooldown", function() end, "soon")
+		register_command("long", "capped cooldown", function() end, "1000h")
+		register_command("ok", "duration cooldown", function() end, "30s")
+	`)
+
+	if _, exists := engine.commands["bad"]; exists {
+		t.Error("Expected command with negative cooldown to be rejected")
+	}
+	if _, exists := engine.commands["typo"]; exists {
+		t.Error("Expected command with unparseable cooldown to be rejected")
+	}
+	if cmd := engine.commands["long"]; cmd == nil || cmd.Cooldown != maxCommandCooldown {
+		t.Errorf("Expected cooldown to be capped at %s", maxCommandCooldown)
+	}
+	if cmd := engine.commands["ok"]; cmd == nil || cmd.Cooldown != 30*time.Second {
+		t.Error("Expected duration string cooldown to be accepted")
+	}
+}
+
+func TestCooldownMessage(t *testing.T) {
+	defer func(ttl time.Duration) { cooldownNoticeTTL = ttl }(cooldownNoticeTTL)
+	cooldownNoticeTTL = 50 * time.Millisecond
+
+	db := setupTestDB(t)
+	session := &fakeSession{deleted: make(chan string, 10)}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "cooldowns.lua", `
+		register_command("daily", "Daily reward", function() end, { cooldown = "2h", cooldown_message = true })
+		register_command("roll", "Roll a die", function() end, { cooldown = 30, cooldown_message = "Easy, {remaining} to go" })
+		register_command("quiet", "No notice", function() end, 30)
+	`)
+
+	run := func(content string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		drainEvents(engine)
+	}
+	for _, content := range []string{"!daily", "!daily", "!daily", "!roll", "!roll", "!quiet", "!quiet"} {
+		run(content)
+	}
+
+	var sent []string
+	for _, msg := range session.sent {
+		sent = append(sent, msg.Content)
+	}
+	// The second !daily on cooldown gets no notice while the first is up
+	want := []string{"`!daily` is on cooldown, try again in 2h.", "Easy, 30s to go"}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("sent %q, want %q", sent, want)
+	}
+
+	for range want {
+		select {
+		case <-session.deleted:
+		case <-time.After(time.Second):
+			t.Fatal("cooldown notice was not deleted")
+		}
+	}
+	run("!daily")
+	if len(session.sent) != 3 {
+		t.Errorf("expected a new notice once the last one was deleted, sent %d messages", len(session.sent))
+	}
+}
+
+func TestPerUserCooldown(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, &fakeSession{}, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "cooldowns.lua", `
+		ran = {}
+		local function count(event) table.insert(ran, event.command .. ":" .. event.author) end
+		register_command("daily", "Per user", count, { cooldown = "1h", cooldown_scope = "user" })
+		register_command("shared", "Global", count, { cooldown = "1h" })
+		register_command("bad", "Bad scope", count, { cooldown = 1, cooldown_scope = "guild" })
+	`)
+
+	run := func(content, userID, username string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: userID, Username: username},
+		}})
+		drainEvents(engine)
+	}
+	run("!daily", "u1", "alice")
+	run("!daily", "u1", "alice")
+	run("!daily", "u2", "bob")
+	run("!shared", "u1", "alice")
+	run("!shared", "u2", "bob")
+	engine.currentCaller = "u3" // as if carol's command ran these
+	if err := engine.state.DoString(`
+		via_run_command, run_err = run_command("daily", {}, { author = "carol" })
+		again, again_err = run_command("daily", {}, { author = "carol" })
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	engine.currentCaller = ""
+	drainEvents(engine)
+
+	ran := scriptGlobal(engine, "ran").(*lua.LTable)
+	var got []string
+	for i := 1; i <= ran.Len(); i++ {
+		got = append(got, ran.RawGetInt(i).String())
+	}
+	want := "daily:alice,daily:bob,shared:alice,daily:carol"
+	if strings.Join(got, ",") != want {
+		t.Errorf("ran %q, want %q", strings.Join(got, ","), want)
+	}
+	if err := scriptGlobal(engine, "again_err").String(); !strings.Contains(err, "on cooldown") {
+		t.Errorf("run_command should respect the per-user cooldown, got err %q", err)
+	}
+	if _, ok := engine.commands["bad"]; ok {
+		t.Error("a command with an invalid cooldown_scope should be rejected")
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.CommandPrefix = "?"
+	engine.cfg.UnknownCommand = "suggest"
+	engine.Initialize()
+
+	loadTestScript(t, engine, "prefixed.lua", `
+		ran = {}
+		register_command("ping", "Ping", function(event) table.insert(ran, event.command) end)
+		register_command("give", "Give", function() end, { args = { { name = "user", type = "user", required = true } } })
+		prefix = command_prefix()
+	`)
+
+	for _, content := range []string{"!ping", "?ping", "?pong", "?give"} {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		drainEvents(engine)
+	}
+
+	if ran := scriptGlobal(engine, "ran").(*lua.LTable); ran.Len() != 1 || ran.RawGetInt(1).String() != "ping" {
+		t.Errorf("expected only ?ping to run the command, ran %d time(s)", ran.Len())
+	}
+	if prefix := scriptGlobal(engine, "prefix").String(); prefix != "?" {
+		t.Errorf("command_prefix() = %q, want ?", prefix)
+	}
+	var sent []string
+	for _, msg := range session.sent {
+		sent = append(sent, msg.Content)
+	}
+	if len(sent) != 2 || !strings.Contains(sent[0], "Did you mean `?ping`?") || !strings.Contains(sent[1], "Usage: `?give <user>`") {
+		t.Errorf("replies should use the configured prefix, sent %q", sent)
+	}
+}
+
+func TestRegisterCommandOptions(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "options.lua", `
+		register_command("summarize", "with options", function() end, { cooldown = "1m", required_role = "admin", history = 20 })
+		register_command("greedy", "capped history", function() end, { history = 1000 })
+		register_command("negative", "bad history", function() end, { history = -1 })
+	`)
+
+	cmd := engine.commands["summarize"]
+	if cmd == nil {
+		t.Fatal("Expected command with options to be registered")
+	}
+	if cmd.Cooldown != time.Minute || cmd.RequiredRole != "admin" || cmd.History != 20 {
+		t.Errorf("Unexpected options: cooldown %s, role %q, history %d", cmd.Cooldown, cmd.RequiredRole, cmd.History)
+	}
+	if cmd := engine.commands["greedy"]; cmd == nil || cmd.History != maxCommandHistory {
+		t.Errorf("Expected history to be capped at %d", maxCommandHistory)
+	}
+	if _, exists := engine.commands["negative"]; exists {
+		t.Error("Expected command with negative history to be rejected")
+	}
+}
+
+func TestRecentMessages(t *testing.T) {
+	state := discordgo.NewState()
+	state.MaxMessageCount = 10
+	if err := state.ChannelAdd(&discordgo.Channel{ID: "c1", Type: discordgo.ChannelTypeDM}); err != nil {
+		t.Fatalf("ChannelAdd failed: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if err := state.MessageAdd(&discordgo.Message{ID: id, ChannelID: "c1", Content: "msg " + id}); err != nil {
+			t.Fatalf("MessageAdd failed: %v", err)
+		}
+	}
+
+	recent := recentMessages(state, "c1", "4", 2)
+	if len(recent) != 2 || recent[0].ID != "2" || recent[1].ID != "3" {
+		t.Errorf("Expected messages 2 and 3 oldest first, got %v", recent)
+	}
+	if got := recentMessages(state, "unknown", "", 5); len(got) != 0 {
+		t.Errorf("Expected no messages for an uncached channel, got %d", len(got))
+	}
+	if got := recentMessages(nil, "c1", "", 5); got != nil {
+		t.Error("Expected nil without a state")
+	}
+}
+
+func TestGetConfigMasksToken(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.BotToken = "secret-token"
+	engine.cfg.ScriptsDir = "my-scripts"
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		values = {}
+		for _, s in ipairs(get_config()) do values[s.name] = s.value end
+		token = values.DISCORD_BOT_TOKEN
+		scripts = values.SCRIPTS_DIR
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if token := scriptGlobal(engine, "token").String(); token != "<set>" {
+		t.Errorf("Expected the token to be masked, got %q", token)
+	}
+	if scripts := scriptGlobal(engine, "scripts").String(); scripts != "my-scripts" {
+		t.Errorf("Expected SCRIPTS_DIR my-scripts, got %q", scripts)
+	}
+}
+
+func TestCommandPatterns(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	script := loadTestScript(t, engine, "tags.lua", `
+		calls = {}
+		register_command_pattern("^tag_", "Tag commands", function(event)
+			table.insert(calls, event.command .. ":" .. (event.args[2] or ""))
+		end)
+		register_command("tag_exact", "Exact match wins", function(event)
+			table.insert(calls, "exact")
+		end)
+		register_command_pattern("[", "Invalid", function() end)
+	`)
+
+	message := func(content string) *discordgo.MessageCreate {
+		return &discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}}
+	}
+	for _, content := range []string{"!tag_add foo", "!tag_get bar", "!tag_exact", "!other"} {
+		engine.ProcessMessage(message(content))
+	}
+	drainEvents(engine)
+
+	calls := scriptGlobal(engine, "calls").(*lua.LTable)
+	var got []string
+	for i := 1; i <= calls.Len(); i++ {
+		got = append(got, calls.RawGetInt(i).String())
+	}
+	if want := "tag_add:foo,tag_get:bar,exact"; strings.Join(got, ",") != want {
+		t.Errorf("Expected calls %q, got %q", want, strings.Join(got, ","))
+	}
+	if len(engine.commandPatterns) != 1 {
+		t.Errorf("Expected the invalid pattern to be rejected, got %d patterns", len(engine.commandPatterns))
+	}
+
+	engine.unloadScript(script.Name)
+	if len(engine.commandPatterns) != 0 {
+		t.Error("Expected patterns to be removed when the script unloads")
+	}
+}
+
+func TestGetSecret(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.Secrets = map[string]string{"weather_key": "abc123"}
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		key = get_secret("WEATHER_KEY")
+		missing = get_secret("nope")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if key := scriptGlobal(engine, "key").String(); key != "abc123" {
+		t.Errorf("Expected secret lookup to be case-insensitive, got %q", key)
+	}
+	if scriptGlobal(engine, "missing") != lua.LNil {
+		t.Error("Expected nil for an unset secret")
+	}
+}
+
+func TestGetState(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	counter := func(name string) string {
+		return `
+			get_state().count = 0
+			register_hook("on_channel_message", function()
+				local state = get_state()
+				state.count = state.count + 1
+				counts["` + name + `"] = state.count
+			end)
+		`
+	}
+	engine.state.SetGlobal("counts", engine.state.NewTable())
+	a := loadTestScript(t, engine, "a.lua", counter("a"))
+	loadTestScript(t, engine, "b.lua", counter("b")+`get_state().count = 10`)
+	for i := 0; i < 3; i++ {
+		BotEvent{Data: lua.LNil, EventType: "on_channel_message"}.Dispatch(engine)
+	}
+
+	counts := scriptGlobal(engine, "counts").(*lua.LTable)
+	if a, b := counts.RawGetString("a").String(), counts.RawGetString("b").String(); a != "3" || b != "13" {
+		t.Errorf("Expected separate states persisting across calls (3 and 13), got %s and %s", a, b)
+	}
+
+	engine.unloadScript("a.lua")
+	if a.State != nil {
+		t.Error("Expected the state to be dropped on unload")
+	}
+
+	err := engine.state.DoString(`outside, outside_err = get_state()`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if scriptGlobal(engine, "outside") != lua.LNil || scriptGlobal(engine, "outside_err") == lua.LNil {
+		t.Error("Expected get_state outside a script to return nil and an error")
+	}
+}
+
+func TestParseMessageLink(t *testing.T) {
+	tests := []struct {
+		url                           string
+		guildID, channelID, messageID string
+		wantErr                       bool
+	}{
+		{"https://discord.com/channels/1/22/333", "1", "22", "333", false},
+		{"https://ptb.discord.com/channels/1/22/333/", "1", "22", "333", false},
+		{"https://discordapp.com/channels/1/22/333", "1", "22", "333", false},
+		{"  https://canary.discord.com/channels/1/22/333\n", "1", "22", "333", false},
+		{"https://discord.com/channels/@me/22/333", "", "22", "333", false},
+		{"https://discord.com/channels/1/22", "", "", "", true},
+		{"https://discord.com/channels/1/22/abc", "", "", "", true},
+		{"https://example.com/channels/1/22/333", "", "", "", true},
+		{"see https://discord.com/channels/1/22/333", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		guildID, channelID, messageID, err := parseMessageLink(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMessageLink(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			continue
+		}
+		if guildID != tt.guildID || channelID != tt.channelID || messageID != tt.messageID {
+			t.Errorf("parseMessageLink(%q) = %q, %q, %q", tt.url, guildID, channelID, messageID)
+		}
+	}
+}
+
+func TestMessageLinkRoundTrip(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		link = message_link("1", "22", "333")
+		g, c, m = parse_message_link(link)
+		dm = message_link(nil, "22", "333")
+		dm_guild = parse_message_link(dm)
+		bad, bad_err = message_link("1", "general", "333")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	get := func(name string) string { return scriptGlobal(engine, name).String() }
+
+	if link := get("link"); link != "https://discord.com/channels/1/22/333" {
+		t.Errorf("Unexpected link %q", link)
+	}
+	if get("g") != "1" || get("c") != "22" || get("m") != "333" {
+		t.Errorf("Expected the IDs back, got %s %s %s", get("g"), get("c"), get("m"))
+	}
+	if dm := get("dm"); dm != "https://discord.com/channels/@me/22/333" {
+		t.Errorf("Expected a DM link, got %q", dm)
+	}
+	if scriptGlobal(engine, "dm_guild") != lua.LNil {
+		t.Error("Expected a nil guild for a DM link")
+	}
+	if scriptGlobal(engine, "bad") != lua.LNil || !strings.Contains(get("bad_err"), "channel") {
+		t.Errorf("Expected an error for a channel name, got %s", get("bad_err"))
+	}
+}
+
+func TestLogPrefixesScriptName(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	loadTestScript(t, engine, "greeter.lua", `
+		log("hello")
+		register_hook("on_bogus", function() end)
+		register_hook("on_channel_message", function() error("boom") end)
+	`)
+	BotEvent{Data: lua.LNil, EventType: "on_channel_message"}.Dispatch(engine)
+	if err := engine.state.DoString(`log("from the host")`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"[greeter.lua] hello",
+		"[greeter.lua] Unknown hook name: on_bogus",
+		"[greeter.lua] Script loaded",
+		"[greeter.lua] Dispatching on_channel_message",
+		"[greeter.lua] Lua error in on_channel_message",
+		"[lua] from the host",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected log output to contain %q", want)
+		}
+	}
+}
+
+func TestLogLinesCarryTraceID(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "traced.lua", `
+		register_hook("on_channel_message", function(event)
+			log("message " .. event.n)
+			store_set("traced", "last", event.n)
+		end)
+		register_hook("on_store_change", function(event)
+			log("stored " .. event.value)
+		end, { namespace = "traced" })
+	`)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+	for _, n := range []string{"1", "2"} {
+		data := engine.state.NewTable()
+		data.RawSetString("n", lua.LString(n))
+		engine.enqueueEvent(BotEvent{Data: data, EventType: "on_channel_message"}, "test")
+	}
+	// The store change hooks are queued while the messages are dispatched
+	for range 2 {
+		if _, err := engine.Exec("true"); err != nil {
+			t.Fatalf("Exec failed: %v", err)
+		}
+	}
+
+	traces := make(map[string]string) // log message -> trace ID
+	for _, line := range strings.Split(buf.String(), "\n") {
+		m := regexp.MustCompile(`\[traced\.lua\] trace=([0-9a-f]{6}) (message \d|stored \d)$`).FindStringSubmatch(line)
+		if m != nil {
+			traces[m[2]] = m[1]
+		}
+	}
+	if len(traces) != 4 {
+		t.Fatalf("Expected 4 traced log lines, got %v in:\n%s", traces, buf.String())
+	}
+	if traces["message 1"] != traces["stored 1"] || traces["message 2"] != traces["stored 2"] {
+		t.Errorf("Expected store change hooks to keep the trace of the message, got %v", traces)
+	}
+	if traces["message 1"] == traces["message 2"] {
+		t.Errorf("Expected each message to get its own trace, got %v", traces)
+	}
+}
+
+func TestCanSendAndReact(t *testing.T) {
+	state := discordgo.NewState()
+	state.User = &discordgo.User{ID: "bot"}
+	everyone := int64(discordgo.PermissionViewChannel | discordgo.PermissionSendMessages |
+		discordgo.PermissionSendMessagesInThreads | discordgo.PermissionReadMessageHistory)
+	if err := state.GuildAdd(&discordgo.Guild{
+		ID:      "g1",
+		OwnerID: "owner",
+		Roles:   []*discordgo.Role{{ID: "g1", Permissions: everyone}},
+		Channels: []*discordgo.Channel{
+			{ID: "open", GuildID: "g1", Type: discordgo.ChannelTypeGuildText},
+			{ID: "muted", GuildID: "g1", Type: discordgo.ChannelTypeGuildText, PermissionOverwrites: []*discordgo.PermissionOverwrite{
+				{ID: "g1", Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionSendMessages},
+			}},
+		},
+		Threads: []*discordgo.Channel{
+			{ID: "thread", GuildID: "g1", ParentID: "muted", Type: discordgo.ChannelTypeGuildPublicThread},
+		},
+	}); err != nil {
+		t.Fatalf("GuildAdd failed: %v", err)
+	}
+	if err := state.MemberAdd(&discordgo.Member{GuildID: "g1", User: state.User}); err != nil {
+		t.Fatalf("MemberAdd failed: %v", err)
+	}
+
+	db := setupTestDB(t)
+	engine := New(db, &discordgo.Session{State: state}, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		send_open = can_send("open")
+		send_muted = can_send("muted")
+		send_thread = can_send("thread")
+		react_open = can_react("open")
+		local ok, err = can_send("unknown")
+		unknown_ok, unknown_err = ok, err
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	expected := map[string]lua.LValue{
+		"send_open":   lua.LTrue,
+		"send_muted":  lua.LFalse,
+		"send_thread": lua.LTrue,
+		"react_open":  lua.LFalse,
+		"unknown_ok":  lua.LNil,
+	}
+	for name, want := range expected {
+		if got := scriptGlobal(engine, name); got != want {
+			t.Errorf("Expected %s to be %v, got %v", name, want, got)
+		}
+	}
+	if err := scriptGlobal(engine, "unknown_err").String(); !strings.Contains(err, "not in the cache") {
+		t.Errorf("Expected an uncached channel error, got %q", err)
+	}
+}
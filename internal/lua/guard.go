@@ -0,0 +1,35 @@
+package lua
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+)
+
+// The Lua state is not safe for concurrent use. Until Start it belongs to the
+// goroutine setting the engine up (Initialize, LoadScripts); from then on only
+// the dispatcher may run Lua. Other goroutines hand work over as an Event.
+//
+// Building tables with NewTable is fine anywhere: it only allocates, and the
+// table reaches the dispatcher through the event queue.
+
+// checkLuaAccess returns an error if the dispatcher is running but not
+// dispatching an event, which is the only time it runs Lua, so the caller
+// must be another goroutine. Entry points that run Lua call it and refuse to
+// go on, since concurrent use would corrupt the VM. Go has no cheap way to
+// tell goroutines apart, so a call made while the dispatcher is busy goes
+// unnoticed; the check still catches such a bug the first time the
+// dispatcher is idle, which is most of the time.
+func (e *Engine) checkLuaAccess(what string) error {
+	if !e.dispatcherRunning.Load() || e.dispatching.Load() != nil {
+		return nil
+	}
+	err := fmt.Errorf("%s called off the dispatcher goroutine; enqueue an event instead", what)
+	log.Printf("BUG: %v\n%s", err, stack())
+	return err
+}
+
+func stack() []byte {
+	buf := make([]byte, 4096)
+	return buf[:runtime.Stack(buf, false)]
+}
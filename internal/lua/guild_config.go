@@ -0,0 +1,72 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// guildConfigPrefix marks the kv_store namespaces that hold per-guild
+// configuration. Scripts reach them only through get/set_guild_config.
+const guildConfigPrefix = "guild_config:"
+
+func guildConfigNamespace(guildID string) string {
+	return guildConfigPrefix + guildID
+}
+
+// isReservedNamespace reports whether namespace is off limits to the store_*
+// functions.
+func isReservedNamespace(namespace string) bool {
+	return strings.HasPrefix(namespace, guildConfigPrefix) || strings.HasPrefix(namespace, reactionThresholdPrefix)
+}
+
+// checkNamespace returns an error if namespace is reserved.
+func checkNamespace(namespace string) error {
+	if isReservedNamespace(namespace) {
+		return fmt.Errorf("namespace '%s' is reserved", namespace)
+	}
+	return nil
+}
+
+// GuildConfigSet stores a configuration value for a guild. It is stored like
+// a store_set value, with its type, so strings, numbers, booleans and tables
+// keep their type on the way back, and in journaled namespaces the change is
+// journaled. Setting nil removes the key.
+func (e *Engine) GuildConfigSet(guildID, key string, value lua.LValue) error {
+	if guildID == "" {
+		return fmt.Errorf("guild id is required")
+	}
+	namespace := guildConfigNamespace(guildID)
+
+	switch value.Type() {
+	case lua.LTNil:
+		return e.StoreDelete(namespace, key)
+	case lua.LTString, lua.LTNumber, lua.LTBool, lua.LTTable:
+	default:
+		return fmt.Errorf("unsupported guild config value type %s", value.Type())
+	}
+	return e.StoreSet(namespace, key, value)
+}
+
+// GuildConfigGet returns a guild configuration value, or fallback if the key
+// is unset. When fallback is not nil the stored value must have the same Lua
+// type, otherwise fallback is returned along with an error describing the
+// mismatch. Values stored before types were recorded are JSON, which
+// decodeStoredValue decodes for rows without a type.
+func (e *Engine) GuildConfigGet(guildID, key string, fallback lua.LValue) (lua.LValue, error) {
+	namespace := guildConfigNamespace(guildID)
+	row, err := readStoredRow(e.db, namespace, key)
+	if err != nil {
+		return fallback, err
+	}
+	if !row.value.Valid {
+		return fallback, nil
+	}
+	value := e.decodeStoredValue(namespace, key, row.value.String, row.typ)
+
+	if fallback != lua.LNil && value.Type() != fallback.Type() {
+		return fallback, fmt.Errorf("guild config '%s' is a %s, expected %s", key, value.Type(), fallback.Type())
+	}
+	return value, nil
+}
@@ -0,0 +1,63 @@
+package lua
+
+import (
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxCommandHistory caps the history option of register_command. The state
+// cache (MESSAGE_CACHE_SIZE) bounds what is actually available.
+const maxCommandHistory = 100
+
+// messageState returns the discordgo state cache, or nil when the session
+// isn't a real Discord session (e.g. the dev shell).
+func (e *Engine) messageState() *discordgo.State {
+	if s, ok := e.session.(*discordgo.Session); ok {
+		return s.State
+	}
+	return nil
+}
+
+// recentMessages returns up to limit cached messages from a channel, oldest
+// first, skipping excludeID (the command message itself).
+func recentMessages(state *discordgo.State, channelID, excludeID string, limit int) []*discordgo.Message {
+	if state == nil || limit <= 0 {
+		return nil
+	}
+	channel, err := state.Channel(channelID)
+	if err != nil {
+		return nil
+	}
+
+	state.RLock()
+	defer state.RUnlock()
+
+	var messages []*discordgo.Message
+	for i := len(channel.Messages) - 1; i >= 0 && len(messages) < limit; i-- {
+		if m := channel.Messages[i]; m.ID != excludeID {
+			messages = append(messages, m)
+		}
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// messagesToLua converts messages into an array of
+// {id, author, author_id, content, timestamp} tables.
+func messagesToLua(L *lua.LState, messages []*discordgo.Message) *lua.LTable {
+	result := L.NewTable()
+	for _, m := range messages {
+		entry := L.NewTable()
+		entry.RawSetString("id", lua.LString(m.ID))
+		entry.RawSetString("content", lua.LString(m.Content))
+		entry.RawSetString("timestamp", lua.LNumber(m.Timestamp.Unix()))
+		if m.Author != nil {
+			entry.RawSetString("author", lua.LString(m.Author.Username))
+			entry.RawSetString("author_id", lua.LString(m.Author.ID))
+		}
+		result.Append(entry)
+	}
+	return result
+}
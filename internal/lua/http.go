@@ -2,7 +2,10 @@ package lua
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strings"
 	"time"
@@ -14,13 +17,58 @@ import (
 // be safely read on the dispatcher goroutine and then passed to a goroutine
 // without touching LState again.
 type httpOptions struct {
-	Timeout float64
+	Timeout time.Duration // zero means no timeout
 	Headers map[string]string
+
+	// MaxBodySize caps the response body in bytes. Zero means no limit.
+	MaxBodySize int64
+
+	// DecodeJSON decodes JSON responses into HTTPResult.JSON.
+	DecodeJSON bool
+
+	// Client sends the request; nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// requestOptions parses options and applies the configured limits: the
+// timeout defaults to HTTP_DEFAULT_TIMEOUT and is capped at HTTP_MAX_TIMEOUT,
+// and the body is capped at HTTP_MAX_BODY_SIZE.
+func (e *Engine) requestOptions(options *lua.LTable) httpOptions {
+	opts := parseHTTPOptions(options)
+	if opts.Timeout <= 0 {
+		opts.Timeout = e.cfg.HTTPDefaultTimeout
+	}
+	switch max := e.cfg.HTTPMaxTimeout; {
+	case max <= 0:
+	case opts.Timeout > max:
+		e.logf("Warning: HTTP timeout %s capped to %s", opts.Timeout, max)
+		opts.Timeout = max
+	case opts.Timeout <= 0:
+		opts.Timeout = max // without a default the cap still applies
+	}
+	opts.MaxBodySize = e.cfg.HTTPMaxBodySize
+	return opts
+}
+
+// readBody reads a response body, failing once it grows past limit bytes so a
+// huge or endless response can't exhaust memory. A limit of zero or less
+// means no limit.
+func readBody(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response body exceeds %d bytes", limit)
+	}
+	return body, nil
 }
 
 func parseHTTPOptions(options *lua.LTable) httpOptions {
 	opts := httpOptions{
-		Timeout: 30.0,
 		Headers: make(map[string]string),
 	}
 	if options == nil {
@@ -29,10 +77,12 @@ func parseHTTPOptions(options *lua.LTable) httpOptions {
 
 	if timeoutVal := options.RawGetString("timeout"); timeoutVal != lua.LNil {
 		if timeoutNum, ok := timeoutVal.(lua.LNumber); ok {
-			opts.Timeout = float64(timeoutNum)
+			opts.Timeout = time.Duration(float64(timeoutNum) * float64(time.Second))
 		}
 	}
 
+	opts.DecodeJSON = lua.LVAsBool(options.RawGetString("decode_json"))
+
 	if headersVal := options.RawGetString("headers"); headersVal != lua.LNil {
 		if headersTbl, ok := headersVal.(*lua.LTable); ok {
 			headersTbl.ForEach(func(key lua.LValue, value lua.LValue) {
@@ -44,13 +94,25 @@ func parseHTTPOptions(options *lua.LTable) httpOptions {
 	return opts
 }
 
-// doHTTPGet performs a GET request using only plain Go types. Safe to call
-// from any goroutine.
-func doHTTPGet(ctx context.Context, url string, opts httpOptions) HTTPResult {
-	reqCtx, cancel := context.WithTimeout(ctx, time.Duration(opts.Timeout*float64(time.Second)))
+// withTimeout is context.WithTimeout, except that a zero timeout means none.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// doHTTPRequest performs a request using only plain Go types. An empty body
+// sends none. Safe to call from any goroutine.
+func doHTTPRequest(ctx context.Context, method, url, body string, opts httpOptions) HTTPResult {
+	reqCtx, cancel := withTimeout(ctx, opts.Timeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(reqCtx, method, url, reqBody)
 	if err != nil {
 		return HTTPResult{Err: err}
 	}
@@ -58,77 +120,84 @@ func doHTTPGet(ctx context.Context, url string, opts httpOptions) HTTPResult {
 		req.Header.Set(key, value)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return HTTPResult{Err: err}
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := readBody(resp.Body, opts.MaxBodySize)
 	if err != nil {
 		return HTTPResult{Err: err}
 	}
 
-	return HTTPResult{
+	result := HTTPResult{
 		StatusCode: resp.StatusCode,
-		Body:       string(body),
+		Body:       string(respBody),
 		Headers:    resp.Header,
 	}
-}
-
-// doHTTPPost performs a POST request using only plain Go types. Safe to call
-// from any goroutine.
-func doHTTPPost(ctx context.Context, url string, body string, opts httpOptions) HTTPResult {
-	reqCtx, cancel := context.WithTimeout(ctx, time.Duration(opts.Timeout*float64(time.Second)))
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(reqCtx, "POST", url, strings.NewReader(body))
-	if err != nil {
-		return HTTPResult{Err: err}
-	}
-	for key, value := range opts.Headers {
-		req.Header.Set(key, value)
+	if opts.DecodeJSON && isJSONContentType(resp.Header.Get("Content-Type")) {
+		// A body that doesn't decode leaves JSON nil; the body is still there
+		_ = json.Unmarshal(respBody, &result.JSON)
 	}
+	return result
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return HTTPResult{Err: err}
-	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
+// isJSONContentType reports whether a Content-Type header announces JSON:
+// application/json or a type with a +json suffix, such as
+// application/problem+json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return HTTPResult{Err: err}
+		return false
 	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
 
-	return HTTPResult{
-		StatusCode: resp.StatusCode,
-		Body:       string(respBody),
-		Headers:    resp.Header,
+// context returns the engine's lifetime context, which is cancelled on
+// shutdown so outstanding requests return promptly. Before Start it is
+// context.Background().
+func (e *Engine) context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
 	}
+	return e.ctx
 }
 
-// httpGet is the synchronous Lua binding — kept for simple use cases.
-func (e *Engine) httpGet(url string, options *lua.LTable) (lua.LValue, error) {
-	result := doHTTPGet(context.Background(), url, parseHTTPOptions(options))
-	if result.Err != nil {
-		return lua.LNil, result.Err
+// requestContext bounds a synchronous request by the engine's lifetime and by
+// the deadline of the running hook, so a hook blocked on a slow server is
+// released when its timeout passes.
+func (e *Engine) requestContext() (context.Context, context.CancelFunc) {
+	if hookCtx := e.state.Context(); hookCtx != nil {
+		if deadline, ok := hookCtx.Deadline(); ok {
+			return context.WithDeadline(e.context(), deadline)
+		}
 	}
-	return buildHTTPResultTable(e, result), nil
+	return context.WithCancel(e.context())
 }
 
-// httpPost is the synchronous Lua binding — kept for simple use cases.
-func (e *Engine) httpPost(url string, body string, options *lua.LTable) (lua.LValue, error) {
-	result := doHTTPPost(context.Background(), url, body, parseHTTPOptions(options))
+// httpRequest is the synchronous Lua binding behind http_get, http_post and
+// the other http_* functions.
+func (e *Engine) httpRequest(method, url, body string, options *lua.LTable) (lua.LValue, error) {
+	opts := e.requestOptions(options)
+	result := e.breaker.do(url, func() HTTPResult {
+		ctx, cancel := e.requestContext()
+		defer cancel()
+		return doHTTPRequest(ctx, method, url, body, opts)
+	})
 	if result.Err != nil {
 		return lua.LNil, result.Err
 	}
 	return buildHTTPResultTable(e, result), nil
 }
 
-// buildHTTPResultTable converts an HTTPResult to a Lua table.
+// buildHTTPResultTable converts a successful HTTPResult to a Lua table.
 // Must be called on the dispatcher goroutine.
-func buildHTTPResultTable(e *Engine, result HTTPResult) lua.LValue {
+func buildHTTPResultTable(e *Engine, result HTTPResult) *lua.LTable {
 	tbl := e.state.NewTable()
 	tbl.RawSetString("status", lua.LNumber(result.StatusCode))
 	tbl.RawSetString("body", lua.LString(result.Body))
@@ -140,5 +209,8 @@ func buildHTTPResultTable(e *Engine, result HTTPResult) lua.LValue {
 		}
 	}
 	tbl.RawSetString("headers", headersTable)
+	if result.JSON != nil {
+		tbl.RawSetString("json", goValueToLua(e.state, result.JSON))
+	}
 	return tbl
 }
@@ -1,7 +1,14 @@
 package lua
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -9,11 +16,12 @@ import (
 func TestHttpGetBasic(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Test basic HTTP GET
-	result, err := engine.httpGet("https://httpbin.org/get", nil)
+	result, err := engine.httpRequest("GET", "https://httpbin.org/get", "", nil)
 	if err != nil {
-		t.Fatalf("httpGet failed: %v", err)
+		t.Fatalf("httpRequest failed: %v", err)
 	}
 
 	if result == lua.LNil {
@@ -47,6 +55,7 @@ func TestHttpGetBasic(t *testing.T) {
 func TestHttpGetWithOptions(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create options table
 	L := lua.NewState()
@@ -60,9 +69,9 @@ func TestHttpGetWithOptions(t *testing.T) {
 	options.RawSetString("headers", headersTable)
 
 	// Test HTTP GET with options
-	result, err := engine.httpGet("https://httpbin.org/get", options)
+	result, err := engine.httpRequest("GET", "https://httpbin.org/get", "", options)
 	if err != nil {
-		t.Fatalf("httpGet failed: %v", err)
+		t.Fatalf("httpRequest failed: %v", err)
 	}
 
 	if result == lua.LNil {
@@ -86,12 +95,13 @@ func TestHttpGetWithOptions(t *testing.T) {
 func TestHttpPostBasic(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Test basic HTTP POST
 	body := `{"test": "data"}`
-	result, err := engine.httpPost("https://httpbin.org/post", body, nil)
+	result, err := engine.httpRequest("POST", "https://httpbin.org/post", body, nil)
 	if err != nil {
-		t.Fatalf("httpPost failed: %v", err)
+		t.Fatalf("httpRequest failed: %v", err)
 	}
 
 	if result == lua.LNil {
@@ -120,6 +130,7 @@ func TestHttpPostBasic(t *testing.T) {
 func TestHttpPostWithOptions(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create options table
 	L := lua.NewState()
@@ -134,9 +145,9 @@ func TestHttpPostWithOptions(t *testing.T) {
 
 	// Test HTTP POST with options
 	body := `{"message": "test"}`
-	result, err := engine.httpPost("https://httpbin.org/post", body, options)
+	result, err := engine.httpRequest("POST", "https://httpbin.org/post", body, options)
 	if err != nil {
-		t.Fatalf("httpPost failed: %v", err)
+		t.Fatalf("httpRequest failed: %v", err)
 	}
 
 	if result == lua.LNil {
@@ -160,6 +171,7 @@ func TestHttpPostWithOptions(t *testing.T) {
 func TestHttpGetTimeout(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create options table with very short timeout
 	L := lua.NewState()
@@ -168,7 +180,7 @@ func TestHttpGetTimeout(t *testing.T) {
 	options.RawSetString("timeout", lua.LNumber(0.001)) // 1ms timeout
 
 	// Test HTTP GET with timeout (should fail)
-	result, err := engine.httpGet("https://httpbin.org/delay/1", options)
+	result, err := engine.httpRequest("GET", "https://httpbin.org/delay/1", "", options)
 	if err == nil {
 		t.Error("Expected timeout error, got nil")
 	}
@@ -177,3 +189,331 @@ func TestHttpGetTimeout(t *testing.T) {
 		t.Error("Expected nil result on timeout")
 	}
 }
+
+func TestHttpCircuitBreaker(t *testing.T) {
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	now := time.Now()
+	engine.breaker = newCircuitBreaker(3, time.Minute)
+	engine.breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := engine.httpRequest("GET", server.URL, "", nil); err != nil {
+			t.Fatalf("Request %d: unexpected error %v", i+1, err)
+		}
+	}
+
+	// The circuit is now open: requests fail fast without reaching the server
+	_, err := engine.httpRequest("GET", server.URL, "", nil)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("Expected CircuitOpenError, got %v", err)
+	}
+	if hits != 3 {
+		t.Errorf("Expected 3 requests to reach the server, got %d", hits)
+	}
+
+	// After the cooldown a trial request is let through
+	now = now.Add(time.Minute + time.Second)
+	if _, err := engine.httpRequest("GET", server.URL, "", nil); err != nil {
+		t.Fatalf("Expected trial request after cooldown, got %v", err)
+	}
+	if hits != 4 {
+		t.Errorf("Expected trial request to reach the server, got %d hits", hits)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	now := time.Now()
+	cb := newCircuitBreaker(2, time.Minute)
+	cb.now = func() time.Time { return now }
+	cb.record("example.com", true)
+	cb.record("example.com", true)
+
+	now = now.Add(time.Minute + time.Second)
+	if err := cb.allow("example.com"); err != nil {
+		t.Fatalf("Expected a trial request after the cooldown, got %v", err)
+	}
+	var openErr *CircuitOpenError
+	if err := cb.allow("example.com"); !errors.As(err, &openErr) {
+		t.Fatalf("Expected requests to fail fast while the trial is in flight, got %v", err)
+	}
+
+	// A failed trial opens the circuit for another cooldown
+	cb.record("example.com", true)
+	if err := cb.allow("example.com"); !errors.As(err, &openErr) || openErr.RetryAfter != time.Minute {
+		t.Fatalf("Expected the circuit to open again, got %v", err)
+	}
+
+	// A cancelled trial lets the next request try
+	now = now.Add(time.Minute + time.Second)
+	if err := cb.allow("example.com"); err != nil {
+		t.Fatalf("Expected a trial request, got %v", err)
+	}
+	cb.cancelled("example.com")
+	if err := cb.allow("example.com"); err != nil {
+		t.Fatalf("Expected a new trial after a cancelled one, got %v", err)
+	}
+	cb.record("example.com", false)
+	if err := cb.allow("example.com"); err != nil {
+		t.Errorf("Expected a successful trial to close the circuit, got %v", err)
+	}
+}
+
+func TestHttpGetCancelledOnShutdown(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	engine.Start(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := engine.httpRequest("GET", server.URL, "", nil)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the request to be cancelled with the engine context")
+	}
+
+	// A cancelled request doesn't count against the host
+	if len(engine.breaker.hosts) != 0 {
+		t.Errorf("Expected no breaker failures to be recorded, got %d hosts", len(engine.breaker.hosts))
+	}
+}
+
+func TestHttpGetMaxBodySize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	engine.cfg.HTTPMaxBodySize = 100
+	if _, err := engine.httpRequest("GET", server.URL, "", nil); err != nil {
+		t.Fatalf("Expected a body at the limit to be read, got %v", err)
+	}
+
+	engine.cfg.HTTPMaxBodySize = 99
+	if _, err := engine.httpRequest("GET", server.URL, "", nil); err == nil || !strings.Contains(err.Error(), "exceeds 99 bytes") {
+		t.Errorf("Expected body size error, got %v", err)
+	}
+}
+
+func TestCheckAttachmentURL(t *testing.T) {
+	valid := []string{
+		"https://cdn.discordapp.com/attachments/1/2/config.json",
+		"https://media.discordapp.net/attachments/1/2/image.png?width=100",
+	}
+	for _, url := range valid {
+		if err := checkAttachmentURL(url); err != nil {
+			t.Errorf("checkAttachmentURL(%q): unexpected error %v", url, err)
+		}
+	}
+
+	invalid := []string{
+		"http://cdn.discordapp.com/attachments/1/2/config.json",
+		"https://example.com/attachments/1/2/config.json",
+		"https://cdn.discordapp.com.example.com/file",
+		"file:///etc/passwd",
+		"not a url",
+	}
+	for _, url := range invalid {
+		if err := checkAttachmentURL(url); err == nil {
+			t.Errorf("checkAttachmentURL(%q): expected an error", url)
+		}
+	}
+}
+
+func TestAttachmentClientChecksRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer target.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	_, err := attachmentClient.Get(redirect.URL)
+	if err == nil || !strings.Contains(err.Error(), "not a Discord attachment URL") {
+		t.Errorf("Expected a redirect off the CDN to be refused, got %v", err)
+	}
+}
+
+func TestDownloadAttachmentRefusesOtherHosts(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	if err := engine.state.DoString(`ok, err = download_attachment("https://example.com/file", function() end)`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if scriptGlobal(engine, "ok") != lua.LNil || !strings.Contains(scriptGlobal(engine, "err").String(), "not a Discord attachment URL") {
+		t.Errorf("Expected download_attachment to refuse other hosts, got %v", scriptGlobal(engine, "err"))
+	}
+}
+
+func TestHttpRequestTimeoutLimits(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.HTTPDefaultTimeout = 5 * time.Second
+	engine.cfg.HTTPMaxTimeout = time.Minute
+
+	options := func(timeout float64) *lua.LTable {
+		tbl := engine.state.NewTable()
+		tbl.RawSetString("timeout", lua.LNumber(timeout))
+		return tbl
+	}
+	tests := []struct {
+		name    string
+		options *lua.LTable
+		want    time.Duration
+	}{
+		{"default", nil, 5 * time.Second},
+		{"override", options(0.5), 500 * time.Millisecond},
+		{"capped", options(600), time.Minute},
+	}
+	for _, tt := range tests {
+		if got := engine.requestOptions(tt.options).Timeout; got != tt.want {
+			t.Errorf("%s: expected timeout %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	// Without a default the cap still applies
+	engine.cfg.HTTPDefaultTimeout = 0
+	if got := engine.requestOptions(nil).Timeout; got != time.Minute {
+		t.Errorf("Expected the cap as timeout without a default, got %s", got)
+	}
+}
+
+func TestHttpPutPatchDelete(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+string(body)+" "+r.Header.Get("X-Token"))
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	engine.state.SetGlobal("url", lua.LString(server.URL))
+	err := engine.state.DoString(`
+		put = http_put(url, "a", { headers = { ["X-Token"] = "t1" } })
+		http_patch(url, "b")
+		http_delete(url)
+		http_delete(url, "c")
+		http_delete(url, { headers = { ["X-Token"] = "t2" } })
+		http_delete(url, nil, { headers = { ["X-Token"] = "t3" } })
+		missing, missing_err = http_put(url)
+	`)
+	if err == nil || !strings.Contains(err.Error(), "bad argument #2 to http_put") {
+		t.Fatalf("http_put without a body: err = %v", err)
+	}
+
+	want := []string{"PUT a t1", "PATCH b ", "DELETE  ", "DELETE c ", "DELETE  t2", "DELETE  t3"}
+	if strings.Join(requests, "|") != strings.Join(want, "|") {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+	put := scriptGlobal(engine, "put").(*lua.LTable)
+	if put.RawGetString("status") != lua.LNumber(http.StatusAccepted) || put.RawGetString("headers").(*lua.LTable).RawGetString("X-Method").String() != "PUT" {
+		t.Errorf("http_put result: status %v", put.RawGetString("status"))
+	}
+}
+
+func TestHttpDecodeJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"name": "bot", "tags": ["a", "b"]}`))
+		case "/broken":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name": `))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(`{"name": "bot"}`))
+		}
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	engine.state.SetGlobal("url", lua.LString(server.URL))
+	err := engine.state.DoString(`
+		local opts = { decode_json = true }
+		decoded = http_get(url .. "/json", opts)
+		plain = http_get(url .. "/json")
+		broken = http_get(url .. "/broken", opts)
+		text = http_get(url .. "/text", opts)
+		http_get_async(url .. "/json", opts, function(result) async = result end)
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	engine.inflightWg.Wait()
+	drainEvents(engine)
+
+	for _, name := range []string{"decoded", "async"} {
+		result, ok := scriptGlobal(engine, name).(*lua.LTable)
+		if !ok {
+			t.Fatalf("%s: no result", name)
+		}
+		decoded, ok := result.RawGetString("json").(*lua.LTable)
+		if !ok || decoded.RawGetString("name").String() != "bot" || decoded.RawGetString("tags").(*lua.LTable).Len() != 2 {
+			t.Errorf("%s: json = %v", name, result.RawGetString("json"))
+		}
+		if !strings.Contains(result.RawGetString("body").String(), `"bot"`) {
+			t.Errorf("%s: the raw body should be kept", name)
+		}
+	}
+	for _, name := range []string{"plain", "broken", "text"} {
+		result := scriptGlobal(engine, name).(*lua.LTable)
+		if result.RawGetString("json") != lua.LNil {
+			t.Errorf("%s: json = %v, want nil", name, result.RawGetString("json"))
+		}
+		if result.RawGetString("body").String() == "" {
+			t.Errorf("%s: body is empty", name)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package lua
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// kvExportVersion is the version of the export file format.
+const kvExportVersion = 1
+
+// Import merge strategies, deciding what happens to keys that exist both in
+// the store and in the file.
+const (
+	mergeSkip      = "skip"      // keep the stored value
+	mergeOverwrite = "overwrite" // take the value from the file
+	mergeReplace   = "replace"   // empty the store first
+)
+
+// kvExport is the JSON document written by ExportData.
+type kvExport struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Entries    []kvExportEntry `json:"entries"`
+}
+
+// kvExportEntry is one kv_store row. Value holds the value as JSON of its
+// recorded type: a string, number, boolean or the table itself, so the file
+// can be read and edited by hand. Rows written before types were recorded
+// have no type and their raw text as a string. ExpiresAt is set for values
+// stored with an expiry.
+type kvExportEntry struct {
+	Namespace string          `json:"namespace"`
+	Key       string          `json:"key"`
+	Type      string          `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+// exportValue converts a stored value to its JSON form in an export.
+func exportValue(valStr string, valType sql.NullString) json.RawMessage {
+	switch valType.String {
+	case storeTypeNumber, storeTypeBoolean, storeTypeTable:
+		// Numbers like "inf" and corrupt tables aren't valid JSON and are
+		// kept as strings; importValue turns them back into the raw text.
+		if json.Valid([]byte(valStr)) {
+			return json.RawMessage(valStr)
+		}
+	}
+	quoted, _ := json.Marshal(valStr)
+	return quoted
+}
+
+// importValue converts a value from an export back into the text stored in
+// kv_store for its type.
+func importValue(entry kvExportEntry) (string, error) {
+	var text string
+	if json.Unmarshal(entry.Value, &text) == nil {
+		return text, nil
+	}
+	switch entry.Type {
+	case storeTypeNumber:
+		var n float64
+		if err := json.Unmarshal(entry.Value, &n); err != nil {
+			return "", fmt.Errorf("%s/%s: not a number", entry.Namespace, entry.Key)
+		}
+		return string(bytes.TrimSpace(entry.Value)), nil
+	case storeTypeBoolean:
+		var b bool
+		if err := json.Unmarshal(entry.Value, &b); err != nil {
+			return "", fmt.Errorf("%s/%s: not a boolean", entry.Namespace, entry.Key)
+		}
+		return strconv.FormatBool(b), nil
+	case storeTypeTable:
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, entry.Value); err != nil {
+			return "", fmt.Errorf("%s/%s: %w", entry.Namespace, entry.Key, err)
+		}
+		return compact.String(), nil
+	}
+	return "", fmt.Errorf("%s/%s: value must be a JSON string", entry.Namespace, entry.Key)
+}
+
+// openExportDir opens the configured export directory, creating it if needed.
+// Files are opened through the returned root, so a name can't reach outside
+// the directory, not even through a symlink.
+func (e *Engine) openExportDir() (*os.Root, error) {
+	if e.cfg.ExportDir == "" {
+		return nil, fmt.Errorf("no export directory configured (EXPORT_DIR)")
+	}
+	if err := os.MkdirAll(e.cfg.ExportDir, 0o700); err != nil {
+		return nil, err
+	}
+	return os.OpenRoot(e.cfg.ExportDir)
+}
+
+// ExportData writes every kv_store entry, of all namespaces including the
+// reserved ones such as guild configuration, to a JSON file called name in
+// the export directory and returns the number of entries written. Expired
+// values are left out. The export_data binding is owner only, since the file
+// holds every script's data.
+func (e *Engine) ExportData(name string) (int, error) {
+	now := time.Now()
+	rows, err := e.db.Query(`SELECT namespace, key, value, type, expires_at FROM kv_store
+		WHERE expires_at IS NULL OR expires_at > ? ORDER BY namespace, key`, now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	export := kvExport{Version: kvExportVersion, ExportedAt: now.UTC(), Entries: []kvExportEntry{}}
+	for rows.Next() {
+		var namespace, key string
+		var valStr, valType sql.NullString
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&namespace, &key, &valStr, &valType, &expiresAt); err != nil {
+			return 0, err
+		}
+		entry := kvExportEntry{
+			Namespace: namespace,
+			Key:       key,
+			Type:      valType.String,
+			Value:     exportValue(valStr.String, valType),
+		}
+		if expiresAt.Valid {
+			t := time.UnixMilli(expiresAt.Int64).UTC()
+			entry.ExpiresAt = &t
+		}
+		export.Entries = append(export.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	root, err := e.openExportDir()
+	if err != nil {
+		return 0, err
+	}
+	defer root.Close()
+	if err := writeRootFile(root, name, append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(export.Entries), nil
+}
+
+// writeRootFile writes data to the file called name inside root.
+func writeRootFile(root *os.Root, name string, data []byte) error {
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readRootFile reads the file called name inside root.
+func readRootFile(root *os.Root, name string) ([]byte, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// ImportData restores the entries of a file called name in the export
+// directory, written by ExportData. Keys that already exist are handled
+// according to strategy: "skip" keeps the stored value, "overwrite" takes the
+// one from the file and "replace" deletes the stored data first. Reserved
+// namespaces, such as a guild's configuration, are imported like the others,
+// which is why the import_data binding is owner only; replace only deletes
+// the reserved namespaces the file has entries for, so a file without guild
+// configuration doesn't wipe it. The import is a single transaction, so a bad
+// entry leaves the store untouched. on_store_change hooks are not run.
+func (e *Engine) ImportData(name, strategy string) (imported, skipped int, err error) {
+	if strategy == "" {
+		strategy = mergeSkip
+	}
+	if strategy != mergeSkip && strategy != mergeOverwrite && strategy != mergeReplace {
+		return 0, 0, fmt.Errorf("unknown merge strategy '%s' (use skip, overwrite or replace)", strategy)
+	}
+
+	root, err := e.openExportDir()
+	if err != nil {
+		return 0, 0, err
+	}
+	data, err := readRootFile(root, name)
+	root.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	var export kvExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return 0, 0, fmt.Errorf("invalid export file: %w", err)
+	}
+	if export.Version != kvExportVersion {
+		return 0, 0, fmt.Errorf("unsupported export version %d", export.Version)
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if strategy == mergeReplace {
+		if err := deleteForReplace(tx, export.Entries); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	query := `INSERT INTO kv_store(namespace, key, value, type, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(namespace, key) DO UPDATE SET value=excluded.value, type=excluded.type, expires_at=excluded.expires_at`
+	if strategy == mergeSkip {
+		query = `INSERT INTO kv_store(namespace, key, value, type, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(namespace, key) DO NOTHING`
+	}
+
+	for _, entry := range export.Entries {
+		switch entry.Type {
+		case "", storeTypeString, storeTypeNumber, storeTypeBoolean, storeTypeTable:
+		default:
+			return 0, 0, fmt.Errorf("%s/%s: unknown type '%s'", entry.Namespace, entry.Key, entry.Type)
+		}
+		valStr, err := importValue(entry)
+		if err != nil {
+			return 0, 0, err
+		}
+		valType := sql.NullString{String: entry.Type, Valid: entry.Type != ""}
+		var expiresAt sql.NullInt64
+		if entry.ExpiresAt != nil {
+			expiresAt = sql.NullInt64{Int64: entry.ExpiresAt.UnixMilli(), Valid: true}
+		}
+		res, err := tx.Exec(query, entry.Namespace, entry.Key, valStr, valType, expiresAt)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return imported, skipped, nil
+}
+
+// deleteForReplace empties the kv_store namespaces an import with the replace
+// strategy replaces: every namespace that isn't reserved, and the reserved
+// ones that entries has values for.
+func deleteForReplace(tx *sql.Tx, entries []kvExportEntry) error {
+	imported := make(map[string]bool)
+	for _, entry := range entries {
+		imported[entry.Namespace] = true
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT namespace FROM kv_store`)
+	if err != nil {
+		return err
+	}
+	var namespaces []string
+	for rows.Next() {
+		var namespace string
+		if err := rows.Scan(&namespace); err != nil {
+			rows.Close()
+			return err
+		}
+		if !isReservedNamespace(namespace) || imported[namespace] {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		if _, err := tx.Exec(`DELETE FROM kv_store WHERE namespace = ?`, namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/leihog/discord-bot/internal/users"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestExportImportData(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	tbl := engine.state.NewTable()
+	tbl.RawSetString("name", lua.LString("alice"))
+	tbl.RawSetString("scores", engine.state.NewTable())
+	tbl.RawGetString("scores").(*lua.LTable).Append(lua.LNumber(3))
+
+	values := map[string]lua.LValue{
+		"text":      lua.LString("hello"),
+		"numeric":   lua.LString("42"), // a string that looks like a number
+		"number":    lua.LNumber(3.5),
+		"big":       lua.LNumber(1e20),
+		"flag":      lua.LTrue,
+		"profile":   tbl,
+		"looks_obj": lua.LString(`{"a":1}`),
+	}
+	for key, value := range values {
+		if err := engine.StoreSet("data", key, value); err != nil {
+			t.Fatalf("StoreSet(%s) failed: %v", key, err)
+		}
+	}
+	if err := engine.GuildConfigSet("g1", "prefix", lua.LString("?")); err != nil {
+		t.Fatalf("GuildConfigSet failed: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO kv_store(namespace, key, value, type) VALUES ('data', 'legacy', '17', NULL)`); err != nil {
+		t.Fatalf("Failed to insert legacy row: %v", err)
+	}
+
+	engine.cfg.ExportDir = filepath.Join(t.TempDir(), "exports")
+	path := "export.json"
+	count, err := engine.ExportData(path)
+	if err != nil {
+		t.Fatalf("ExportData failed: %v", err)
+	}
+	if count != len(values)+2 {
+		t.Errorf("Expected %d entries exported, got %d", len(values)+2, count)
+	}
+	data, _ := os.ReadFile(filepath.Join(engine.cfg.ExportDir, path))
+	if !strings.Contains(string(data), `"value": 3.5`) || !strings.Contains(string(data), `"value": "42"`) {
+		t.Errorf("Expected values as typed JSON, got:\n%s", data)
+	}
+	if !strings.Contains(string(data), guildConfigPrefix+"g1") {
+		t.Errorf("Expected guild config to be exported, got:\n%s", data)
+	}
+
+	// Change a value and add one that isn't in the export
+	engine.StoreSet("data", "text", lua.LString("changed"))
+	engine.StoreSet("data", "extra", lua.LString("new"))
+	engine.GuildConfigSet("g1", "prefix", lua.LString("$"))
+	engine.GuildConfigSet("g2", "prefix", lua.LString("%"))
+
+	imported, skipped, err := engine.ImportData(path, "skip")
+	if err != nil {
+		t.Fatalf("ImportData(skip) failed: %v", err)
+	}
+	if imported != 0 || skipped != count {
+		t.Errorf("Expected all entries skipped, got %d imported, %d skipped", imported, skipped)
+	}
+	if v, _ := engine.StoreGet("data", "text"); v.String() != "changed" {
+		t.Errorf("Expected skip to keep the stored value, got %s", v)
+	}
+
+	if imported, _, err = engine.ImportData(path, "overwrite"); err != nil || imported != count {
+		t.Fatalf("ImportData(overwrite): %d imported, err %v", imported, err)
+	}
+	if v, _ := engine.StoreGet("data", "text"); v.String() != "hello" {
+		t.Errorf("Expected overwrite to restore the exported value, got %s", v)
+	}
+	if v, _ := engine.StoreGet("data", "extra"); v == lua.LNil {
+		t.Error("Expected overwrite to keep keys missing from the file")
+	}
+
+	if _, _, err = engine.ImportData(path, "replace"); err != nil {
+		t.Fatalf("ImportData(replace) failed: %v", err)
+	}
+	if v, _ := engine.StoreGet("data", "extra"); v != lua.LNil {
+		t.Errorf("Expected replace to delete keys missing from the file, got %s", v)
+	}
+
+	// Every value comes back with its type
+	for key, want := range values {
+		got, err := engine.StoreGet("data", key)
+		if err != nil {
+			t.Fatalf("StoreGet(%s) failed: %v", key, err)
+		}
+		if got.Type() != want.Type() {
+			t.Errorf("%s: expected a %s, got %s %v", key, want.Type(), got.Type(), got)
+		} else if _, ok := want.(*lua.LTable); !ok && got.String() != want.String() {
+			t.Errorf("%s: expected %v, got %v", key, want, got)
+		}
+	}
+	profile, _ := engine.StoreGet("data", "profile")
+	scores := profile.(*lua.LTable).RawGetString("scores").(*lua.LTable)
+	if scores.RawGetInt(1) != lua.LNumber(3) {
+		t.Errorf("Expected nested table to survive, got %v", scores.RawGetInt(1))
+	}
+	if v, _ := engine.GuildConfigGet("g1", "prefix", lua.LNil); v.String() != "?" {
+		t.Errorf("Expected guild config to be restored, got %s", v)
+	}
+	if v, _ := engine.GuildConfigGet("g2", "prefix", lua.LNil); v.String() != "%" {
+		t.Errorf("Expected replace to keep the config of a guild missing from the file, got %s", v)
+	}
+	var legacyType any
+	db.QueryRow(`SELECT type FROM kv_store WHERE namespace = 'data' AND key = 'legacy'`).Scan(&legacyType)
+	if legacyType != nil {
+		t.Errorf("Expected the legacy row to stay untyped, got %v", legacyType)
+	}
+	if v, _ := engine.StoreGet("data", "legacy"); v != lua.LNumber(17) {
+		t.Errorf("Expected the legacy row to read back as before, got %v", v)
+	}
+}
+
+func TestImportDataRejectsBadFiles(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.StoreSet("data", "keep", lua.LString("me"))
+
+	dir := t.TempDir()
+	engine.cfg.ExportDir = dir
+	files := map[string]string{
+		"strategy": `{"version": 1, "entries": []}`,
+		"version":  `{"version": 2, "entries": []}`,
+		"type":     `{"version": 1, "entries": [{"namespace": "data", "key": "a", "type": "blob", "value": "x"}]}`,
+		"value":    `{"version": 1, "entries": [{"namespace": "data", "key": "a", "type": "number", "value": true}]}`,
+		"partial": `{"version": 1, "entries": [
+			{"namespace": "data", "key": "a", "type": "string", "value": "ok"},
+			{"namespace": "data", "key": "b", "type": "string", "value": 5}]}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name+".json")
+		os.WriteFile(path, []byte(content), 0o600)
+		strategy := "replace"
+		if name == "strategy" {
+			strategy = "merge"
+		}
+		if _, _, err := engine.ImportData(name+".json", strategy); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Failed imports leave the store untouched, even with replace
+	if v, _ := engine.StoreGet("data", "keep"); v.String() != "me" {
+		t.Errorf("Expected the stored value to survive failed imports, got %v", v)
+	}
+	if v, _ := engine.StoreGet("data", "a"); v != lua.LNil {
+		t.Errorf("Expected no partial import, got %v", v)
+	}
+}
+
+func TestExportDataStaysInExportDir(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	dir := t.TempDir()
+	engine.cfg.ExportDir = filepath.Join(dir, "exports")
+	outside := filepath.Join(dir, "outside.json")
+	for _, name := range []string{"../outside.json", outside} {
+		if _, err := engine.ExportData(name); err == nil {
+			t.Errorf("Expected export to %s to be refused", name)
+		}
+		if _, _, err := engine.ImportData(name, "skip"); err == nil {
+			t.Errorf("Expected import from %s to be refused", name)
+		}
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Error("Expected no file outside the export directory")
+	}
+}
+
+func TestExportImportRequireOwner(t *testing.T) {
+	db := setupTestDB(t)
+	store := users.New(db)
+	engine := New(db, &fakeSession{}, store)
+	t.Cleanup(engine.Close)
+	engine.cfg.ExportDir = t.TempDir()
+	engine.Initialize()
+
+	if err := store.EnsureUser("owner1", "boss"); err != nil {
+		t.Fatalf("EnsureUser failed: %v", err)
+	}
+	if err := store.AddRole("owner1", "owner"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+
+	loadTestScript(t, engine, "backup.lua", `
+		results = {}
+		register_command("backup", "Backup", function(event)
+			local count, err = export_data("backup.json")
+			if not count then
+				results[event.author_id] = err
+				return
+			end
+			local imported, err = import_data("backup.json")
+			results[event.author_id] = imported and "ok" or err
+		end)
+		_, export_err = export_data("backup.json")
+		_, import_err = import_data("backup.json")
+	`)
+	for _, id := range []string{"user1", "owner1"} {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   "!backup",
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: id, Username: id},
+		}})
+	}
+	drainEvents(engine)
+
+	if got := scriptGlobal(engine, "export_err").String(); got != "export_data requires a command run by an owner" {
+		t.Errorf("Expected export_data outside a command to be refused, got %q", got)
+	}
+	if got := scriptGlobal(engine, "import_err").String(); got != "import_data requires a command run by an owner" {
+		t.Errorf("Expected import_data outside a command to be refused, got %q", got)
+	}
+	results := scriptGlobal(engine, "results").(*lua.LTable)
+	if got := results.RawGetString("user1").String(); got != "export_data requires a command run by an owner" {
+		t.Errorf("Expected a non-owner to be refused, got %q", got)
+	}
+	if got := results.RawGetString("owner1").String(); got != "ok" {
+		t.Errorf("Expected the owner to export and import, got %q", got)
+	}
+}
@@ -0,0 +1,238 @@
+package lua
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Changes to the namespaces listed in JOURNAL_NAMESPACES are journaled: each
+// write made through the store_* functions also adds a kv_journal row with the
+// value before and after, the script that made it and the user whose command
+// was running. The write and its journal row are one transaction, so the
+// journal can't miss a change that happened. store_journal reads it back and
+// store_rollback restores the value from before an entry.
+
+// maxJournalEntries caps how many entries one store_journal call returns.
+const maxJournalEntries = 100
+
+// journaled reports whether writes to namespace are journaled.
+func (e *Engine) journaled(namespace string) bool {
+	for _, pattern := range e.cfg.JournalNamespaces {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(namespace, prefix) {
+				return true
+			}
+		} else if namespace == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// storedRow is a value as kv_store holds it. value is NULL for an unset key,
+// and expiresAt NULL for a value that doesn't expire.
+type storedRow struct {
+	value, typ sql.NullString
+	expiresAt  sql.NullInt64
+}
+
+// expiredBy reports whether the row holds a value that has expired by now.
+// Such a row reads as unset.
+func (row storedRow) expiredBy(now time.Time) bool {
+	return row.value.Valid && expired(row.expiresAt, now)
+}
+
+// rowQuerier is satisfied by both the database and a transaction.
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// readStoredRow reads namespace/key without decoding it. An expired value is
+// returned as unset.
+func readStoredRow(q rowQuerier, namespace, key string) (storedRow, error) {
+	var row storedRow
+	err := q.QueryRow(`SELECT value, type, expires_at FROM kv_store WHERE namespace = ? AND key = ?`, namespace, key).
+		Scan(&row.value, &row.typ, &row.expiresAt)
+	if err == sql.ErrNoRows || (err == nil && row.expiredBy(time.Now())) {
+		return storedRow{}, nil
+	}
+	return row, err
+}
+
+// storeWrite runs query, which writes namespace/key in kv_store, and reports
+// whether it changed a row. In a journaled namespace the change is recorded
+// in the same transaction.
+func (e *Engine) storeWrite(namespace, key, query string, args ...any) (bool, error) {
+	if !e.journaled(namespace) {
+		res, err := e.db.Exec(query, args...)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n > 0, nil
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	old, err := readStoredRow(tx, namespace, key)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := e.journalChange(tx, namespace, key, old); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// journalChange records in tx that namespace/key changed from old to the
+// value it now has in tx. Must be called on the dispatcher goroutine, which
+// knows the script and user behind the change.
+func (e *Engine) journalChange(tx *sql.Tx, namespace, key string, old storedRow) error {
+	current, err := readStoredRow(tx, namespace, key)
+	if err != nil {
+		return err
+	}
+	if current == old {
+		return nil // e.g. store_pop on an empty list
+	}
+	var script string
+	if e.currentScript != nil {
+		script = e.currentScript.Name
+	}
+	_, err = tx.Exec(`INSERT INTO kv_journal(namespace, key, old_value, old_type, old_expires_at, new_value, new_type, new_expires_at, script, user_id, changed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		namespace, key, old.value, old.typ, old.expiresAt, current.value, current.typ, current.expiresAt, script, e.currentCaller, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("journaling %s/%s: %w", namespace, key, err)
+	}
+	return nil
+}
+
+// decodeStoredRow decodes a stored value, or returns nil for an unset key.
+func (e *Engine) decodeStoredRow(namespace, key string, row storedRow) lua.LValue {
+	if !row.value.Valid {
+		return lua.LNil
+	}
+	return e.decodeStoredValue(namespace, key, row.value.String, row.typ)
+}
+
+// StoreJournal returns the newest journal entries of namespace, newest first,
+// as a Lua array of {id, namespace, key, old, new, script, user_id, time}.
+// An empty key means every key of the namespace, and a before of zero or less
+// starts from the newest entry rather than the one before that ID.
+func (e *Engine) StoreJournal(namespace, key string, before int64, limit int) (*lua.LTable, error) {
+	if limit <= 0 || limit > maxJournalEntries {
+		limit = maxJournalEntries
+	}
+	query := `SELECT id, key, old_value, old_type, new_value, new_type, script, user_id, changed_at
+		FROM kv_journal WHERE namespace = ?`
+	args := []any{namespace}
+	if key != "" {
+		query += ` AND key = ?`
+		args = append(args, key)
+	}
+	if before > 0 {
+		query += ` AND id < ?`
+		args = append(args, before)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := e.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := e.state.NewTable()
+	for rows.Next() {
+		var (
+			id, changedAt    int64
+			entryKey         string
+			oldRow, newRow   storedRow
+			script, callerID string
+		)
+		if err := rows.Scan(&id, &entryKey, &oldRow.value, &oldRow.typ, &newRow.value, &newRow.typ, &script, &callerID, &changedAt); err != nil {
+			return nil, err
+		}
+		entry := e.state.NewTable()
+		entry.RawSetString("id", lua.LNumber(id))
+		entry.RawSetString("namespace", lua.LString(namespace))
+		entry.RawSetString("key", lua.LString(entryKey))
+		entry.RawSetString("old", e.decodeStoredRow(namespace, entryKey, oldRow))
+		entry.RawSetString("new", e.decodeStoredRow(namespace, entryKey, newRow))
+		entry.RawSetString("script", lua.LString(script))
+		entry.RawSetString("user_id", lua.LString(callerID))
+		entry.RawSetString("time", lua.LNumber(changedAt/1000))
+		entries.Append(entry)
+	}
+	return entries, rows.Err()
+}
+
+// StoreRollback restores the value a key had before journal entry id: the
+// old value is written back with its expiry, or the key deleted if it was
+// unset or has expired since. Unless force is set it refuses when the key has
+// changed again since the entry, so a rollback can't silently undo later
+// writes; a value the entry wrote that has expired counts as unset. The
+// rollback is journaled and runs on_store_change hooks like any other write.
+func (e *Engine) StoreRollback(id int64, force bool) error {
+	var namespace, key string
+	var old, written storedRow
+	err := e.db.QueryRow(`SELECT namespace, key, old_value, old_type, old_expires_at, new_value, new_type, new_expires_at FROM kv_journal WHERE id = ?`, id).
+		Scan(&namespace, &key, &old.value, &old.typ, &old.expiresAt, &written.value, &written.typ, &written.expiresAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no journal entry %d", id)
+	} else if err != nil {
+		return err
+	}
+	if err := checkNamespace(namespace); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if written.expiredBy(now) {
+		written = storedRow{}
+	}
+	if old.expiredBy(now) {
+		old = storedRow{}
+	}
+
+	if !force {
+		current, err := readStoredRow(e.db, namespace, key)
+		if err != nil {
+			return err
+		}
+		if current != written {
+			return fmt.Errorf("%s/%s has changed since journal entry %d; pass force to roll back anyway", namespace, key, id)
+		}
+	}
+
+	if !old.value.Valid {
+		changed, err := e.storeWrite(namespace, key, `DELETE FROM kv_store WHERE namespace = ? AND key = ?`, namespace, key)
+		if err == nil && changed {
+			e.notifyStoreChange(namespace, key, lua.LNil)
+		}
+		return err
+	}
+	_, err = e.storeWrite(namespace, key, `INSERT INTO kv_store(namespace, key, value, type, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(namespace, key) DO UPDATE SET value=excluded.value, type=excluded.type, expires_at=excluded.expires_at`, namespace, key, old.value, old.typ, old.expiresAt)
+	if err == nil {
+		e.notifyStoreChange(namespace, key, e.decodeStoredRow(namespace, key, old))
+	}
+	return err
+}
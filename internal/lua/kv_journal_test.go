@@ -0,0 +1,136 @@
+package lua
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestStoreJournalAndRollback(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.JournalNamespaces = []string{"economy:*"}
+	engine.Initialize()
+
+	loadTestScript(t, engine, "journal.lua", `
+		store_set("economy:g1", "alice", 100)
+		store_set("economy:g1", "alice", 40)
+		store_set("economy:g1", "alice", 40)
+		store_set("other", "alice", 1)
+
+		local entries = store_journal("economy:g1", "alice")
+		bad_write = entries[1]
+		rolled_back = store_rollback(bad_write.id)
+		balance = store_get("economy:g1", "alice")
+		again_ok, again_err = store_rollback(bad_write.id)
+
+		store_delete("economy:g1", "alice")
+		entries = store_journal("economy:g1", "alice")
+		store_rollback(entries[1].id)
+		restored = store_get("economy:g1", "alice")
+
+		store_append("economy:g1", "log", "paid")
+		store_pop("economy:g1", "log")
+		store_pop("economy:g1", "log")
+
+		journal = store_journal("economy:g1")
+		other = store_journal("other")
+		page = store_journal("economy:g1", nil, { before = journal[2].id, limit = 2 })
+	`)
+
+	bad := scriptGlobal(engine, "bad_write").(*lua.LTable)
+	if bad.RawGetString("old") != lua.LNumber(100) || bad.RawGetString("new") != lua.LNumber(40) {
+		t.Errorf("newest entry = %v -> %v, want 100 -> 40", bad.RawGetString("old"), bad.RawGetString("new"))
+	}
+	if script := bad.RawGetString("script").String(); script != "journal.lua" {
+		t.Errorf("script = %q, want journal.lua", script)
+	}
+	if scriptGlobal(engine, "rolled_back") != lua.LTrue || scriptGlobal(engine, "balance") != lua.LNumber(100) {
+		t.Errorf("rollback: ok = %v, balance = %v, want true and 100", scriptGlobal(engine, "rolled_back"), scriptGlobal(engine, "balance"))
+	}
+	if err := scriptGlobal(engine, "again_err").String(); !strings.Contains(err, "has changed since") {
+		t.Errorf("rolling back a key changed since: err = %q", err)
+	}
+	if scriptGlobal(engine, "restored") != lua.LNumber(100) {
+		t.Errorf("rolling back a delete restored %v, want 100", scriptGlobal(engine, "restored"))
+	}
+
+	// alice: 2 sets (the repeated one changes nothing), the rollback, the
+	// delete and its rollback; log: the append and the pop of its only item
+	journal := scriptGlobal(engine, "journal").(*lua.LTable)
+	if journal.Len() != 7 {
+		t.Fatalf("journal has %d entries, want 7", journal.Len())
+	}
+	if newest := journal.RawGetInt(1).(*lua.LTable); newest.RawGetString("key").String() != "log" {
+		t.Errorf("newest entry is for %s, want log", newest.RawGetString("key"))
+	}
+	if other := scriptGlobal(engine, "other").(*lua.LTable); other.Len() != 0 {
+		t.Errorf("namespace without journaling has %d entries", other.Len())
+	}
+	page := scriptGlobal(engine, "page").(*lua.LTable)
+	if page.Len() != 2 || page.RawGetInt(1).(*lua.LTable).RawGetString("id") != journal.RawGetInt(3).(*lua.LTable).RawGetString("id") {
+		t.Errorf("paging back from the second entry returned %d entries", page.Len())
+	}
+}
+
+func TestStoreRollbackKeepsExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.JournalNamespaces = []string{"cache"}
+	engine.Initialize()
+
+	expiresAt := func(key string) sql.NullInt64 {
+		var at sql.NullInt64
+		db.QueryRow(`SELECT expires_at FROM kv_store WHERE namespace = 'cache' AND key = ?`, key).Scan(&at)
+		return at
+	}
+	newestEntry := func(key string) int64 {
+		var id int64
+		db.QueryRow(`SELECT MAX(id) FROM kv_journal WHERE namespace = 'cache' AND key = ?`, key).Scan(&id)
+		return id
+	}
+
+	// Rolling back a write puts the old value back with its expiry
+	if err := engine.StoreSetWithExpiry("cache", "token", lua.LString("old"), time.Hour); err != nil {
+		t.Fatalf("StoreSetWithExpiry failed: %v", err)
+	}
+	want := expiresAt("token")
+	if err := engine.StoreSet("cache", "token", lua.LString("new")); err != nil {
+		t.Fatalf("StoreSet failed: %v", err)
+	}
+	if err := engine.StoreRollback(newestEntry("token"), false); err != nil {
+		t.Fatalf("StoreRollback failed: %v", err)
+	}
+	if got := expiresAt("token"); !want.Valid || got != want {
+		t.Errorf("expires_at after rollback = %v, want %v", got, want)
+	}
+
+	// An expired value is unset: overwriting it journals nil as the old
+	// value, and an entry whose value has expired since can be rolled back
+	if err := engine.StoreSetWithExpiry("cache", "session", lua.LString("stale"), 10*time.Millisecond); err != nil {
+		t.Fatalf("StoreSetWithExpiry failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := engine.StoreSetWithExpiry("cache", "session", lua.LString("fresh"), 10*time.Millisecond); err != nil {
+		t.Fatalf("StoreSetWithExpiry failed: %v", err)
+	}
+	entries, err := engine.StoreJournal("cache", "session", 0, 1)
+	if err != nil {
+		t.Fatalf("StoreJournal failed: %v", err)
+	}
+	if old := entries.RawGetInt(1).(*lua.LTable).RawGetString("old"); old != lua.LNil {
+		t.Errorf("old value over an expired one = %v, want nil", old)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := engine.StoreRollback(newestEntry("session"), false); err != nil {
+		t.Errorf("rolling back a write that has expired since: %v", err)
+	}
+	if v, _ := engine.StoreGet("cache", "session"); v != lua.LNil {
+		t.Errorf("session after rollback = %v, want nil", v)
+	}
+}
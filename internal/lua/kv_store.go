@@ -3,88 +3,469 @@ package lua
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
+// Stored value types, recorded in the kv_store type column so that values
+// come back exactly as they were stored.
+const (
+	storeTypeString  = "string"
+	storeTypeNumber  = "number"
+	storeTypeBoolean = "boolean"
+	storeTypeTable   = "table"
+)
+
 // StoreSet stores a value in the key-value store
 func (e *Engine) StoreSet(namespace, key string, value lua.LValue) error {
-	var valStr string
+	return e.StoreSetWithExpiry(namespace, key, value, 0)
+}
+
+// StoreSetWithExpiry stores a value that expires after ttl: from then on it
+// reads as unset and is deleted the next time it is read. A ttl of zero or
+// less stores it without an expiry. Either way the value replaces the expiry
+// of the previous one.
+func (e *Engine) StoreSetWithExpiry(namespace, key string, value lua.LValue, ttl time.Duration) error {
+	var valStr, valType string
 
-	if tbl, ok := value.(*lua.LTable); ok {
-		goVal := luaTableToGo(tbl)
+	switch v := value.(type) {
+	case *lua.LTable:
+		goVal := luaTableToGo(v)
 		jsonBytes, err := json.Marshal(goVal)
 		if err != nil {
 			return err
 		}
-		valStr = string(jsonBytes)
-	} else {
-		valStr = value.String()
+		valStr, valType = string(jsonBytes), storeTypeTable
+	case lua.LNumber:
+		valStr, valType = v.String(), storeTypeNumber
+	case lua.LBool:
+		valStr, valType = v.String(), storeTypeBoolean
+	default:
+		valStr, valType = value.String(), storeTypeString
+	}
+
+	var expiresAt sql.NullInt64
+	if ttl > 0 {
+		expiresAt = sql.NullInt64{Int64: time.Now().Add(ttl).UnixMilli(), Valid: true}
 	}
 
-	_, err := e.db.Exec(`INSERT INTO kv_store(namespace, key, value) VALUES (?, ?, ?) 
-		ON CONFLICT(namespace, key) DO UPDATE SET value=excluded.value`, namespace, key, valStr)
+	_, err := e.storeWrite(namespace, key, `INSERT INTO kv_store(namespace, key, value, type, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(namespace, key) DO UPDATE SET value=excluded.value, type=excluded.type, expires_at=excluded.expires_at`, namespace, key, valStr, valType, expiresAt)
+	if err == nil {
+		e.notifyStoreChange(namespace, key, value)
+	}
 	return err
 }
 
 // StoreGet retrieves a value from the key-value store
 func (e *Engine) StoreGet(namespace, key string) (lua.LValue, error) {
-	row := e.db.QueryRow(`SELECT value FROM kv_store WHERE namespace = ? AND key = ?`, namespace, key)
+	row := e.db.QueryRow(`SELECT value, type, expires_at FROM kv_store WHERE namespace = ? AND key = ?`, namespace, key)
 	var valStr string
-	err := row.Scan(&valStr)
+	var valType sql.NullString
+	var expiresAt sql.NullInt64
+	err := row.Scan(&valStr, &valType, &expiresAt)
 	if err == sql.ErrNoRows {
 		return lua.LNil, nil
 	} else if err != nil {
 		return lua.LNil, err
 	}
 
-	// Try to decode as JSON object
-	var decoded any
-	if json.Unmarshal([]byte(valStr), &decoded) == nil {
-		return goValueToLua(e.state, decoded), nil
-	} else {
-		return lua.LString(valStr), nil
+	if now := time.Now(); expired(expiresAt, now) {
+		e.deleteExpired(namespace, key, now)
+		return lua.LNil, nil
+	}
+	return e.decodeStoredValue(namespace, key, valStr, valType), nil
+}
+
+// expired reports whether a value with the given expires_at has expired by now.
+func expired(expiresAt sql.NullInt64, now time.Time) bool {
+	return expiresAt.Valid && expiresAt.Int64 <= now.UnixMilli()
+}
+
+// deleteExpired deletes the expired values of namespace, or only key if it
+// isn't empty. Expiring isn't a write by a script, so it is neither journaled
+// nor passed to on_store_change hooks. A failure is only logged: the values
+// read as unset either way.
+func (e *Engine) deleteExpired(namespace, key string, now time.Time) {
+	query := `DELETE FROM kv_store WHERE namespace = ? AND expires_at <= ?`
+	args := []any{namespace, now.UnixMilli()}
+	if key != "" {
+		query += ` AND key = ?`
+		args = append(args, key)
+	}
+	if _, err := e.db.Exec(query, args...); err != nil {
+		log.Printf("kv_store: failed to delete expired values of %s: %v", namespace, err)
 	}
 }
 
+// pruneExpiredValues deletes the values of every namespace that have
+// expired by now, including those that are never read again, and returns
+// how many were removed.
+func (e *Engine) pruneExpiredValues(now time.Time) (int64, error) {
+	res, err := e.db.Exec(`DELETE FROM kv_store WHERE expires_at <= ?`, now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // StoreDelete removes a value from the key-value store
 func (e *Engine) StoreDelete(namespace, key string) error {
-	_, err := e.db.Exec(`DELETE FROM kv_store WHERE namespace = ? AND key = ?`, namespace, key)
+	changed, err := e.storeWrite(namespace, key, `DELETE FROM kv_store WHERE namespace = ? AND key = ?`, namespace, key)
+	if err == nil && changed {
+		e.notifyStoreChange(namespace, key, lua.LNil)
+	}
 	return err
 }
 
-// StoreGetAll retrieves all values from a namespace
+// StoreDeleteNamespace deletes every key of namespace and returns how many
+// were deleted, not counting expired ones. Each key is journaled and passed to
+// on_store_change hooks as if it were deleted with StoreDelete.
+func (e *Engine) StoreDeleteNamespace(namespace string) (int, error) {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM kv_store WHERE namespace = ? RETURNING key, value, type, expires_at`, namespace)
+	if err != nil {
+		return 0, err
+	}
+	type deletedRow struct {
+		key string
+		old storedRow
+	}
+	var deleted []deletedRow
+	now := time.Now()
+	for rows.Next() {
+		var row deletedRow
+		if err := rows.Scan(&row.key, &row.old.value, &row.old.typ, &row.old.expiresAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !row.old.expiredBy(now) {
+			deleted = append(deleted, row)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if e.journaled(namespace) {
+		for _, row := range deleted {
+			if err := e.journalChange(tx, namespace, row.key, row.old); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, row := range deleted {
+		e.notifyStoreChange(namespace, row.key, lua.LNil)
+	}
+	return len(deleted), nil
+}
+
+// StoreAppend appends value to the list stored under key, creating the list if
+// the key is unset. With max > 0 the oldest items are dropped so that at most
+// max remain. It returns the new length.
+func (e *Engine) StoreAppend(namespace, key string, value lua.LValue, max int) (int, error) {
+	list, err := e.updateList(namespace, key, func(list []any) ([]any, error) {
+		list = append(list, luaToGo(value))
+		if max > 0 && len(list) > max {
+			list = list[len(list)-max:]
+		}
+		return list, nil
+	})
+	return len(list), err
+}
+
+// StorePop removes and returns the last item of the list stored under key, or
+// the first if fromFront is set. It returns nil if the list is empty or unset.
+func (e *Engine) StorePop(namespace, key string, fromFront bool) (lua.LValue, error) {
+	var item lua.LValue = lua.LNil
+	_, err := e.updateList(namespace, key, func(list []any) ([]any, error) {
+		if len(list) == 0 {
+			return list, nil
+		}
+		if fromFront {
+			item, list = goValueToLua(e.state, list[0]), list[1:]
+		} else {
+			item, list = goValueToLua(e.state, list[len(list)-1]), list[:len(list)-1]
+		}
+		return list, nil
+	})
+	return item, err
+}
+
+// StoreIncrement adds delta to the integer stored under key and returns the
+// result. The read and the write are a single statement, so concurrent
+// increments can't be lost the way store_get followed by store_set can. An
+// unset or expired key, or one holding something other than a number, counts
+// as 0; a number with a fraction is truncated first.
+func (e *Engine) StoreIncrement(namespace, key string, delta int64) (int64, error) {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	journaled := e.journaled(namespace)
+	var old storedRow
+	if journaled {
+		if old, err = readStoredRow(tx, namespace, key); err != nil {
+			return 0, err
+		}
+	}
+
+	var value int64
+	now := time.Now().UnixMilli()
+	err = tx.QueryRow(`INSERT INTO kv_store(namespace, key, value, type) VALUES (?1, ?2, ?3, ?4)
+		ON CONFLICT(namespace, key) DO UPDATE SET
+			value = CASE WHEN kv_store.expires_at <= ?5 OR kv_store.type != ?4 THEN 0
+				ELSE CAST(kv_store.value AS INTEGER) END + ?3,
+			type = ?4,
+			expires_at = CASE WHEN kv_store.expires_at <= ?5 THEN NULL ELSE kv_store.expires_at END
+		RETURNING CAST(value AS INTEGER)`, namespace, key, delta, storeTypeNumber, now).Scan(&value)
+	if err != nil {
+		return 0, err
+	}
+	if journaled {
+		if err := e.journalChange(tx, namespace, key, old); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	e.notifyStoreChange(namespace, key, lua.LNumber(value))
+	return value, nil
+}
+
+// StoreListTrim drops the oldest items of the list stored under key so that at
+// most max remain, and returns the new length.
+func (e *Engine) StoreListTrim(namespace, key string, max int) (int, error) {
+	list, err := e.updateList(namespace, key, func(list []any) ([]any, error) {
+		if len(list) > max {
+			list = list[len(list)-max:]
+		}
+		return list, nil
+	})
+	return len(list), err
+}
+
+// updateList reads the list stored under key, applies update and writes the
+// result back in a single transaction, so concurrent writers can't lose items.
+// An unset or expired key is an empty list; a key holding anything but a
+// list (or an empty table) is an error. The list keeps its expiry.
+func (e *Engine) updateList(namespace, key string, update func([]any) ([]any, error)) ([]any, error) {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM kv_store WHERE namespace = ? AND key = ? AND expires_at <= ?`, namespace, key, time.Now().UnixMilli()); err != nil {
+		return nil, err
+	}
+
+	var list []any
+	old, err := readStoredRow(tx, namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	if old.value.Valid {
+		if list, err = decodeStoredList(old.value.String, old.typ); err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", namespace, key, err)
+		}
+	}
+
+	wasEmpty := len(list) == 0
+	if list, err = update(list); err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []any{}
+	}
+	if wasEmpty && len(list) == 0 {
+		// Popping or trimming an empty list changes nothing, and mustn't
+		// create the key
+		return list, nil
+	}
+	jsonBytes, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`INSERT INTO kv_store(namespace, key, value, type) VALUES (?, ?, ?, ?)
+		ON CONFLICT(namespace, key) DO UPDATE SET value=excluded.value, type=excluded.type`, namespace, key, string(jsonBytes), storeTypeTable); err != nil {
+		return nil, err
+	}
+	if e.journaled(namespace) {
+		if err := e.journalChange(tx, namespace, key, old); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	e.notifyStoreChange(namespace, key, goValueToLua(e.state, list))
+	return list, nil
+}
+
+// decodeStoredList decodes a stored value that should hold a list. Empty
+// tables are stored as {} and count as an empty list.
+func decodeStoredList(valStr string, valType sql.NullString) ([]any, error) {
+	if valType.Valid && valType.String != storeTypeTable {
+		return nil, fmt.Errorf("value is a %s, not a list", valType.String)
+	}
+	var decoded any
+	if err := json.Unmarshal([]byte(valStr), &decoded); err != nil {
+		return nil, fmt.Errorf("value is not a list")
+	}
+	switch v := decoded.(type) {
+	case []any:
+		return v, nil
+	case map[string]any:
+		if len(v) == 0 {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("value is not a list")
+}
+
+// maxStoreChangeDepth bounds chains of on_store_change handlers that write to
+// the store, e.g. a handler updating the key it watches.
+const maxStoreChangeDepth = 5
+
+// notifyStoreChange queues a StoreChangeEvent if any on_store_change hook
+// watches the namespace. Handlers run as a separate event, after the writing
+// script has returned.
+func (e *Engine) notifyStoreChange(namespace, key string, value lua.LValue) {
+	if isReservedNamespace(namespace) {
+		return
+	}
+
+	e.hookMutex.Lock()
+	watched := false
+	for _, hook := range e.hooks["on_store_change"] {
+		if hook.Namespace == namespace {
+			watched = true
+			break
+		}
+	}
+	e.hookMutex.Unlock()
+	if !watched {
+		return
+	}
+
+	depth := e.storeChangeDepth + 1
+	if depth > maxStoreChangeDepth {
+		log.Printf("Warning: dropping change of %s/%s, on_store_change handlers nested more than %d deep", namespace, key, maxStoreChangeDepth)
+		return
+	}
+	e.enqueueFollowUp(StoreChangeEvent{Namespace: namespace, Key: key, Value: value, Depth: depth}, "store")
+}
+
+// maxStoreGetAllValueSize is the size above which StoreGetAll leaves a value
+// out, so one huge value doesn't have to be decoded to read a namespace. Such
+// values can still be read one at a time with StoreGet.
+const maxStoreGetAllValueSize = 1 << 20
+
+// StoreGetAll retrieves all values from a namespace. Rows that can't be read,
+// such as a NULL value, and values over maxStoreGetAllValueSize are logged and
+// left out rather than failing the whole namespace. Expired values are left
+// out and deleted.
 func (e *Engine) StoreGetAll(namespace string) (lua.LValue, error) {
-	rows, err := e.db.Query(`SELECT key, value FROM kv_store WHERE namespace = ?`, namespace)
+	rows, err := e.db.Query(`SELECT key, value, type, expires_at FROM kv_store WHERE namespace = ?`, namespace)
 	if err != nil {
 		return lua.LNil, err
 	}
 	defer rows.Close()
 
 	result := e.state.NewTable()
+	now := time.Now()
+	foundExpired := false
 
 	for rows.Next() {
-		var key, valStr string
-		if err := rows.Scan(&key, &valStr); err != nil {
-			return lua.LNil, err
+		var key string
+		var valStr, valType sql.NullString
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&key, &valStr, &valType, &expiresAt); err != nil {
+			log.Printf("kv_store: skipping unreadable row in %s: %v", namespace, err)
+			continue
 		}
-
-		// Try to decode as JSON object
-		var decoded any
-		if json.Unmarshal([]byte(valStr), &decoded) == nil {
-			result.RawSetString(key, goValueToLua(e.state, decoded))
-		} else {
-			result.RawSetString(key, lua.LString(valStr))
+		switch {
+		case expired(expiresAt, now):
+			foundExpired = true
+		case !valStr.Valid:
+			log.Printf("kv_store: skipping %s/%s, it has no value", namespace, key)
+		case len(valStr.String) > maxStoreGetAllValueSize:
+			log.Printf("kv_store: skipping %s/%s, its value is %d bytes (limit %d); read it with store_get", namespace, key, len(valStr.String), maxStoreGetAllValueSize)
+		default:
+			result.RawSetString(key, e.decodeStoredValue(namespace, key, valStr.String, valType))
 		}
 	}
 
 	if err := rows.Err(); err != nil {
 		return lua.LNil, err
 	}
+	rows.Close()
 
+	if foundExpired {
+		e.deleteExpired(namespace, "", now)
+	}
 	return result, nil
 }
 
+// decodeStoredValue turns a stored value back into its Lua form according to
+// its recorded type:
+//
+//   - string values are returned verbatim, even if they look like JSON
+//   - number and boolean values are parsed back into their Lua types
+//   - table values are JSON decoded; if the JSON is corrupt the raw text is
+//     returned as a string (and logged) rather than dropped
+//
+// Rows written before types were recorded have no type. For those the old
+// behaviour is kept: anything that parses as JSON is decoded (so "42" becomes
+// a number and "true" a boolean) and everything else is returned as a string.
+// Re-saving such a value records its type.
+func (e *Engine) decodeStoredValue(namespace, key, valStr string, valType sql.NullString) lua.LValue {
+	switch valType.String {
+	case storeTypeString:
+		return lua.LString(valStr)
+	case storeTypeNumber:
+		if n, err := strconv.ParseFloat(valStr, 64); err == nil {
+			return lua.LNumber(n)
+		}
+	case storeTypeBoolean:
+		return lua.LBool(valStr == "true")
+	case storeTypeTable:
+		var decoded any
+		if err := json.Unmarshal([]byte(valStr), &decoded); err == nil {
+			return goValueToLua(e.state, decoded)
+		}
+	default:
+		var decoded any
+		if json.Unmarshal([]byte(valStr), &decoded) == nil {
+			return goValueToLua(e.state, decoded)
+		}
+		return lua.LString(valStr)
+	}
+
+	log.Printf("kv_store: %s/%s is not a valid %s, returning it as a string", namespace, key, valType.String)
+	return lua.LString(valStr)
+}
+
 // luaTableToMap is a backward-compatible wrapper returning map[string]any.
 // Prefer luaTableToGo when the table may be a sequence.
 func luaTableToMap(tbl *lua.LTable) map[string]any {
@@ -1,8 +1,12 @@
 package lua
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/leihog/discord-bot/internal/database"
 	lua "github.com/yuin/gopher-lua"
@@ -32,6 +36,7 @@ func setupTestDB(t *testing.T) *database.DB {
 func TestStoreSetAndGetString(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Test storing and retrieving a simple string
 	err := engine.StoreSet("test", "key1", lua.LString("hello world"))
@@ -52,6 +57,7 @@ func TestStoreSetAndGetString(t *testing.T) {
 func TestStoreSetAndGetTable(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create a Lua table
 	L := lua.NewState()
@@ -93,6 +99,7 @@ func TestStoreSetAndGetTable(t *testing.T) {
 func TestStoreSetAndGetNestedTable(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create a nested Lua table
 	L := lua.NewState()
@@ -143,6 +150,7 @@ func TestStoreSetAndGetNestedTable(t *testing.T) {
 func TestStoreDelete(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Store a value
 	err := engine.StoreSet("test", "delete_key", lua.LString("to_delete"))
@@ -178,6 +186,7 @@ func TestStoreDelete(t *testing.T) {
 func TestStoreGetNonExistent(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Try to get a non-existent key
 	value, err := engine.StoreGet("test", "non_existent")
@@ -192,6 +201,7 @@ func TestStoreGetNonExistent(t *testing.T) {
 func TestStoreGetAll(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Store multiple values in the same namespace
 	err := engine.StoreSet("test_all", "key1", lua.LString("value1"))
@@ -251,6 +261,7 @@ func TestStoreGetAll(t *testing.T) {
 func TestStoreGetAllEmpty(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Get all values from an empty namespace
 	result, err := engine.StoreGetAll("empty_namespace")
@@ -319,3 +330,560 @@ func TestLuaTableToMapPreservesNumbers(t *testing.T) {
 
 	t.Log("Number preservation test passed!")
 }
+
+func TestVacuumReclaimsSpace(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	payload := lua.LString(strings.Repeat("x", 4096))
+	for i := 0; i < 200; i++ {
+		if err := engine.StoreSet("bulk", fmt.Sprintf("key%d", i), payload); err != nil {
+			t.Fatalf("StoreSet failed: %v", err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if err := engine.StoreDelete("bulk", fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatalf("StoreDelete failed: %v", err)
+		}
+	}
+
+	before, after, err := engine.runMaintenance()
+	if err != nil {
+		t.Fatalf("runMaintenance failed: %v", err)
+	}
+	if after >= before {
+		t.Errorf("Expected vacuum to shrink the database, got %d -> %d bytes", before, after)
+	}
+}
+
+func TestGuildConfig(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		set_guild_config("g1", "prefix", "?")
+		set_guild_config("g1", "max_warnings", 3)
+		set_guild_config("g1", "welcome", true)
+		set_guild_config("g2", "prefix", "42")
+		result = table.concat({
+			get_guild_config("g1", "prefix", "!"),
+			type(get_guild_config("g2", "prefix")),
+			tostring(get_guild_config("g1", "max_warnings", 0) + 1),
+			tostring(get_guild_config("g1", "welcome", false)),
+			get_guild_config("g3", "prefix", "!"),
+			tostring(get_guild_config("g1", "prefix", 0)),
+		}, ",")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if want, out := "?,string,4,true,!,0", scriptGlobal(engine, "result").String(); out != want {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+
+	// The backing namespace is not reachable through store_*.
+	err = engine.state.DoString(`
+		local errors = {}
+		for _, call in ipairs({
+			function() return store_set("guild_config:g1", "prefix", "#") end,
+			function() return store_get("guild_config:g1", "prefix") end,
+			function() return store_delete("guild_config:g1", "prefix") end,
+			function() return store_get_all("guild_config:g1") end,
+		}) do
+			local ok, err = call()
+			table.insert(errors, tostring(ok) .. " " .. tostring(err))
+		end
+		result = table.concat(errors, ",")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	reserved := "nil namespace 'guild_config:g1' is reserved"
+	if want, out := strings.Repeat(reserved+",", 3)+reserved, scriptGlobal(engine, "result").String(); out != want {
+		t.Errorf("Expected reserved namespace errors %q, got %q", want, out)
+	}
+	var valType string
+	if err := db.QueryRow(`SELECT type FROM kv_store WHERE namespace = 'guild_config:g1' AND key = 'prefix'`).Scan(&valType); err != nil || valType != storeTypeString {
+		t.Errorf("Expected guild config to be stored with its type, got %q (%v)", valType, err)
+	}
+	value, _ := engine.GuildConfigGet("g1", "prefix", lua.LNil)
+	if value.String() != "?" {
+		t.Errorf("Expected store_set to leave guild config untouched, got %q", value.String())
+	}
+
+	// Setting nil removes the key.
+	if err := engine.GuildConfigSet("g1", "prefix", lua.LNil); err != nil {
+		t.Fatalf("GuildConfigSet failed: %v", err)
+	}
+	value, _ = engine.GuildConfigGet("g1", "prefix", lua.LString("!"))
+	if value.String() != "!" {
+		t.Errorf("Expected default after removal, got %q", value.String())
+	}
+}
+
+func TestStoreGetTypeFidelity(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	tests := []struct {
+		name     string
+		value    lua.LValue
+		wantType lua.LValueType
+		want     string
+	}{
+		{"plain string", lua.LString("hello"), lua.LTString, "hello"},
+		{"numeric string", lua.LString("42"), lua.LTString, "42"},
+		{"boolean string", lua.LString("true"), lua.LTString, "true"},
+		{"null string", lua.LString("null"), lua.LTString, "null"},
+		{"json object string", lua.LString(`{"a":1}`), lua.LTString, `{"a":1}`},
+		{"broken json string", lua.LString(`{not json`), lua.LTString, `{not json`},
+		{"quoted string", lua.LString(`"quoted"`), lua.LTString, `"quoted"`},
+		{"integer", lua.LNumber(42), lua.LTNumber, "42"},
+		{"float", lua.LNumber(1.5), lua.LTNumber, "1.5"},
+		{"true", lua.LTrue, lua.LTBool, "true"},
+		{"false", lua.LFalse, lua.LTBool, "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := engine.StoreSet("types", tt.name, tt.value); err != nil {
+				t.Fatalf("StoreSet failed: %v", err)
+			}
+			value, err := engine.StoreGet("types", tt.name)
+			if err != nil {
+				t.Fatalf("StoreGet failed: %v", err)
+			}
+			if value.Type() != tt.wantType || value.String() != tt.want {
+				t.Errorf("Expected %s %q, got %s %q", tt.wantType, tt.want, value.Type(), value.String())
+			}
+		})
+	}
+
+	all, err := engine.StoreGetAll("types")
+	if err != nil {
+		t.Fatalf("StoreGetAll failed: %v", err)
+	}
+	if v := all.(*lua.LTable).RawGetString("numeric string"); v.Type() != lua.LTString {
+		t.Errorf("Expected StoreGetAll to keep strings as strings, got %s", v.Type())
+	}
+}
+
+func TestStoreGetLegacyAndCorruptRows(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	rows := []struct {
+		key, value string
+		typ        any
+	}{
+		{"legacy number", "42", nil},
+		{"legacy text", "hello", nil},
+		{"legacy broken", "{not json", nil},
+		{"legacy table", `{"a":1}`, nil},
+		{"corrupt table", "{not json", "table"},
+		{"corrupt number", "abc", "number"},
+	}
+	for _, r := range rows {
+		if _, err := db.Exec(`INSERT INTO kv_store(namespace, key, value, type) VALUES ('legacy', ?, ?, ?)`, r.key, r.value, r.typ); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	expect := map[string]lua.LValueType{
+		"legacy number":  lua.LTNumber,
+		"legacy text":    lua.LTString,
+		"legacy broken":  lua.LTString,
+		"legacy table":   lua.LTTable,
+		"corrupt table":  lua.LTString,
+		"corrupt number": lua.LTString,
+	}
+	for key, wantType := range expect {
+		value, err := engine.StoreGet("legacy", key)
+		if err != nil {
+			t.Fatalf("StoreGet(%s) failed: %v", key, err)
+		}
+		if value.Type() != wantType {
+			t.Errorf("%s: expected %s, got %s (%s)", key, wantType, value.Type(), value.String())
+		}
+	}
+
+	// Corrupt values are handed back untouched rather than lost.
+	value, _ := engine.StoreGet("legacy", "corrupt table")
+	if value.String() != "{not json" {
+		t.Errorf("Expected raw text for corrupt table, got %q", value.String())
+	}
+}
+
+func TestStoreGetAllSkipsBadRows(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	rows := []struct {
+		key        string
+		value, typ any
+	}{
+		{"name", "alice", "string"},
+		{"score", "12", "number"},
+		{"prefs", `{"theme":"dark"}`, "table"},
+		{"corrupt", "{not json", "table"},
+		{"missing", nil, "table"},
+		{"huge", `["` + strings.Repeat("x", maxStoreGetAllValueSize) + `"]`, "table"},
+	}
+	for _, r := range rows {
+		if _, err := db.Exec(`INSERT INTO kv_store(namespace, key, value, type) VALUES ('mixed', ?, ?, ?)`, r.key, r.value, r.typ); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	result, err := engine.StoreGetAll("mixed")
+	if err != nil {
+		t.Fatalf("StoreGetAll failed: %v", err)
+	}
+	tbl := result.(*lua.LTable)
+	expect := map[string]lua.LValueType{
+		"name":    lua.LTString,
+		"score":   lua.LTNumber,
+		"prefs":   lua.LTTable,
+		"corrupt": lua.LTString,
+		"missing": lua.LTNil,
+		"huge":    lua.LTNil,
+	}
+	for key, wantType := range expect {
+		if got := tbl.RawGetString(key); got.Type() != wantType {
+			t.Errorf("%s: expected %s, got %s", key, wantType, got.Type())
+		}
+	}
+
+	// A skipped value can still be read on its own
+	if value, err := engine.StoreGet("mixed", "huge"); err != nil || value.Type() != lua.LTTable {
+		t.Errorf("Expected StoreGet to decode the huge value, got %s, %v", value.Type(), err)
+	}
+}
+
+func TestKvStoreTypeColumnMigration(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+	db, err := database.New(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE kv_store (namespace TEXT NOT NULL, key TEXT NOT NULL, value TEXT, PRIMARY KEY (namespace, key))`); err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO kv_store VALUES ('ns', 'count', '7')`); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := db.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	value, err := engine.StoreGet("ns", "count")
+	if err != nil {
+		t.Fatalf("StoreGet failed: %v", err)
+	}
+	if value != lua.LNumber(7) {
+		t.Errorf("Expected legacy row to decode as before, got %s %q", value.Type(), value.String())
+	}
+}
+
+// drainEvents dispatches queued events until the queue is empty.
+func drainEvents(engine *Engine) {
+	for len(engine.eventQueue) > 0 {
+		(<-engine.eventQueue).Dispatch(engine)
+	}
+}
+
+func TestStoreChangeHook(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "watcher.lua", `
+		changes = {}
+		register_hook("on_store_change", function(event)
+			table.insert(changes, event.key .. "=" .. tostring(event.value) .. (event.deleted and " (deleted)" or ""))
+		end, { namespace = "config" })
+
+		-- Writes to the key it watches; must not loop forever
+		bumps = 0
+		register_hook("on_store_change", function(event)
+			bumps = bumps + 1
+			store_set("counter", "n", bumps)
+		end, { namespace = "counter" })
+
+		register_hook("on_store_change", function() end)
+	`)
+
+	if err := engine.state.DoString(`
+		store_set("config", "mode", "fast")
+		store_set("other", "ignored", 1)
+		store_delete("config", "mode")
+		store_delete("config", "missing")
+		store_set("counter", "n", 0)
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	drainEvents(engine)
+
+	changes := scriptGlobal(engine, "changes").(*lua.LTable)
+	var got []string
+	for i := 1; i <= changes.Len(); i++ {
+		got = append(got, changes.RawGetInt(i).String())
+	}
+	if want := "mode=fast,mode=nil (deleted)"; strings.Join(got, ",") != want {
+		t.Errorf("Expected changes %q, got %q", want, strings.Join(got, ","))
+	}
+
+	if bumps := scriptGlobal(engine, "bumps"); bumps != lua.LNumber(maxStoreChangeDepth) {
+		t.Errorf("Expected the self-triggering handler to stop after %d runs, got %s", maxStoreChangeDepth, bumps)
+	}
+
+	if n := len(engine.hooks["on_store_change"]); n != 2 {
+		t.Errorf("Expected the hook without a namespace to be rejected, got %d hooks", n)
+	}
+}
+
+func TestStoreLists(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		for i = 1, 12 do
+			last_len = store_append("links", "recent", "link" .. i, 10)
+		end
+		local recent = store_get("links", "recent")
+		oldest = recent[1]
+		newest = recent[#recent]
+
+		store_append("jobs", "queue", { id = 1 })
+		store_append("jobs", "queue", { id = 2 })
+		first_job = store_pop("jobs", "queue", "first").id
+		last_job = store_pop("jobs", "queue").id
+		empty_pop = store_pop("jobs", "queue")
+		store_pop("jobs", "missing")
+		store_list_trim("jobs", "missing", 5)
+		missing = store_get("jobs", "missing")
+
+		trimmed = store_list_trim("links", "recent", 3)
+		after_trim = store_get("links", "recent")[1]
+
+		store_set("links", "name", "not a list")
+		not_list, not_list_err = store_append("links", "name", "x")
+		reserved, reserved_err = store_append("guild_config:g1", "k", "x")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	get := func(name string) string { return scriptGlobal(engine, name).String() }
+	if get("last_len") != "10" || get("oldest") != "link3" || get("newest") != "link12" {
+		t.Errorf("Expected a bounded list of link3..link12, got %s items from %s to %s", get("last_len"), get("oldest"), get("newest"))
+	}
+	if get("first_job") != "1" || get("last_job") != "2" || get("empty_pop") != "nil" {
+		t.Errorf("Unexpected pops: first %s, last %s, empty %s", get("first_job"), get("last_job"), get("empty_pop"))
+	}
+	if get("missing") != "nil" {
+		t.Errorf("Expected popping an unset key to leave it unset, got %s", get("missing"))
+	}
+	if get("trimmed") != "3" || get("after_trim") != "link10" {
+		t.Errorf("Expected trim to keep the newest 3, got %s starting at %s", get("trimmed"), get("after_trim"))
+	}
+	if get("not_list") != "nil" || get("not_list_err") == "nil" {
+		t.Error("Expected appending to a string value to fail")
+	}
+	if get("reserved") != "nil" || get("reserved_err") == "nil" {
+		t.Error("Expected appending to a reserved namespace to fail")
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		store_set("cache", "weather", { summary = "sunny" }, 0.05)
+		store_set("cache", "forever", "kept")
+		store_set("cache", "renewed", "old", 0.05)
+		store_set("cache", "renewed", "new")
+		store_append("cache", "recent", "a")
+		store_set("cache", "recent", store_get("cache", "recent"), 0.05)
+		before = store_get("cache", "weather").summary
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if got := scriptGlobal(engine, "before").String(); got != "sunny" {
+		t.Fatalf("Expected the value before it expires, got %s", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if value, err := engine.StoreGet("cache", "weather"); err != nil || value != lua.LNil {
+		t.Errorf("Expected an expired value to read as nil, got %v (err %v)", value, err)
+	}
+	var rows int
+	db.QueryRow(`SELECT COUNT(*) FROM kv_store WHERE namespace = 'cache' AND key = 'weather'`).Scan(&rows)
+	if rows != 0 {
+		t.Error("Expected the expired row to be deleted when read")
+	}
+
+	all, err := engine.StoreGetAll("cache")
+	if err != nil {
+		t.Fatalf("StoreGetAll failed: %v", err)
+	}
+	tbl := all.(*lua.LTable)
+	if tbl.RawGetString("forever").String() != "kept" || tbl.RawGetString("renewed").String() != "new" || tbl.RawGetString("recent") != lua.LNil {
+		t.Errorf("Expected only the values without an expiry, got forever=%v renewed=%v recent=%v",
+			tbl.RawGetString("forever"), tbl.RawGetString("renewed"), tbl.RawGetString("recent"))
+	}
+
+	// An expired list starts over instead of being appended to
+	if err := engine.state.DoString(`store_set("cache", "recent", { "a" }, 0.05)`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, err := engine.StoreAppend("cache", "recent", lua.LString("b"), 0); err != nil || n != 1 {
+		t.Errorf("Expected appending to an expired list to start a new one, got length %d (err %v)", n, err)
+	}
+
+	for _, expiry := range []string{"-1", "0", "0/0", "1/0", "-1/0"} {
+		if err := engine.state.DoString(`ok, err = store_set("cache", "bad", "x", ` + expiry + `)`); err != nil {
+			t.Fatalf("DoString failed: %v", err)
+		}
+		if value, _ := engine.StoreGet("cache", "bad"); value != lua.LNil || scriptGlobal(engine, "ok") != lua.LNil {
+			t.Errorf("Expected an expiry of %s to be rejected, got %v", expiry, value)
+		}
+		if err := scriptGlobal(engine, "err").String(); !strings.HasPrefix(err, "expiry must") {
+			t.Errorf("Expected an expiry error for %s, got %q", expiry, err)
+		}
+	}
+}
+
+func TestStoreIncrement(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.JournalNamespaces = []string{"stats"}
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		first = store_increment("stats", "messages")
+		second = store_increment("stats", "messages", 5)
+		down = store_increment("stats", "messages", -2)
+		read_back = store_get("stats", "messages")
+
+		store_set("stats", "name", "not a number")
+		from_string = store_increment("stats", "name", 3)
+		store_set("stats", "half", 2.5)
+		from_fraction = store_increment("stats", "half")
+		store_set("stats", "expired", 100, 0.01)
+
+		reserved, reserved_err = store_increment("guild_config:g1", "k")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := engine.state.DoString(`from_expired = store_increment("stats", "expired")`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	get := func(name string) lua.LValue { return scriptGlobal(engine, name) }
+	for name, want := range map[string]lua.LValue{
+		"first":         lua.LNumber(1),
+		"second":        lua.LNumber(6),
+		"down":          lua.LNumber(4),
+		"read_back":     lua.LNumber(4),
+		"from_string":   lua.LNumber(3),
+		"from_fraction": lua.LNumber(3),
+		"from_expired":  lua.LNumber(1),
+	} {
+		if got := get(name); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	if get("reserved") != lua.LNil || get("reserved_err") == lua.LNil {
+		t.Error("Expected incrementing in a reserved namespace to fail")
+	}
+
+	// The expired counter starts over without an expiry
+	time.Sleep(20 * time.Millisecond)
+	if value, _ := engine.StoreGet("stats", "expired"); value != lua.LNumber(1) {
+		t.Errorf("Expected the restarted counter to be kept, got %v", value)
+	}
+
+	journal, err := engine.StoreJournal("stats", "messages", 0, 0)
+	if err != nil {
+		t.Fatalf("StoreJournal failed: %v", err)
+	}
+	if journal.Len() != 3 {
+		t.Errorf("Expected each increment to be journaled, got %d entries", journal.Len())
+	}
+}
+
+func TestStoreClear(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.JournalNamespaces = []string{"guild:*"}
+	engine.Initialize()
+
+	loadTestScript(t, engine, "reset.lua", `
+		deleted = {}
+		register_hook("on_store_change", function(event)
+			if event.deleted then table.insert(deleted, event.key) end
+		end, { namespace = "guild:1" })
+
+		store_set("guild:1", "prefix", "?")
+		store_set("guild:1", "scores", { alice = 3 })
+		store_set("guild:1", "stale", 1, 0.01)
+		store_set("guild:2", "prefix", "!")
+	`)
+	time.Sleep(50 * time.Millisecond)
+	if err := engine.state.DoString(`
+		cleared = store_clear("guild:1")
+		cleared_again = store_clear("guild:1")
+		reserved, reserved_err = store_clear("guild_config:g1")
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	drainEvents(engine)
+
+	get := func(name string) lua.LValue { return scriptGlobal(engine, name) }
+	if get("cleared") != lua.LNumber(2) || get("cleared_again") != lua.LNumber(0) {
+		t.Errorf("Expected 2 keys cleared and then none, got %v and %v", get("cleared"), get("cleared_again"))
+	}
+	if get("reserved") != lua.LNil || get("reserved_err") == lua.LNil {
+		t.Error("Expected clearing a reserved namespace to fail")
+	}
+	if all, _ := engine.StoreGetAll("guild:1"); all.(*lua.LTable).Len() != 0 || all.(*lua.LTable).RawGetString("prefix") != lua.LNil {
+		t.Error("Expected guild:1 to be empty")
+	}
+	if value, _ := engine.StoreGet("guild:2", "prefix"); value.String() != "!" {
+		t.Errorf("Expected other namespaces to be kept, got %v", value)
+	}
+	if n := get("deleted").(*lua.LTable).Len(); n != 2 {
+		t.Errorf("Expected on_store_change for both deleted keys, got %d", n)
+	}
+
+	journal, err := engine.StoreJournal("guild:1", "prefix", 0, 0)
+	if err != nil {
+		t.Fatalf("StoreJournal failed: %v", err)
+	}
+	if journal.Len() != 2 || journal.RawGetInt(1).(*lua.LTable).RawGetString("new") != lua.LNil {
+		t.Errorf("Expected the clear to be journaled as a delete, got %d entries", journal.Len())
+	}
+}
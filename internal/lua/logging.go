@@ -0,0 +1,74 @@
+package lua
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+)
+
+// scriptLogPrefix marks a log line as belonging to a script, e.g.
+// "[greeter.lua] ". It is empty when there is no script.
+func scriptLogPrefix(script *LuaScript) string {
+	if script == nil {
+		return ""
+	}
+	return "[" + script.Name + "] "
+}
+
+// scriptLogf logs a line about script, prefixed with its name. Every log line
+// that can be attributed to a script goes through here or logf, so a script's
+// output can be picked out of a busy log with grep.
+func scriptLogf(script *LuaScript, format string, args ...any) {
+	log.Print(scriptLogPrefix(script) + fmt.Sprintf(format, args...))
+}
+
+// logf logs on behalf of the script running on the dispatcher, which is the
+// one calling the Lua function being implemented. Must be called on the
+// dispatcher goroutine.
+func (e *Engine) logf(format string, args ...any) {
+	e.tracef(e.currentScript, format, args...)
+}
+
+// Every queued event gets a short trace ID, and the lines logged while it is
+// dispatched carry it, e.g. "[greeter.lua] trace=3f9a1c Dispatching timer",
+// so everything one message set off can be found with grep even when the
+// log interleaves several scripts. Events queued while another is being
+// dispatched, such as on_store_change hooks or run_command, are queued with
+// tryEnqueueFollowUp: they keep the trace of the event that caused them, and
+// count one deeper: a chain of events
+// each queued by the handler of the previous one, say a store change running
+// a command that changes the store again, is cut off at MAX_EVENT_DEPTH.
+
+// newTraceID returns a random six digit hex trace ID.
+func newTraceID() string {
+	return fmt.Sprintf("%06x", rand.Uint32()&0xffffff)
+}
+
+// traceLogPrefix marks a log line with a trace ID, e.g. "trace=3f9a1c ". It
+// is empty when there is no trace.
+func traceLogPrefix(trace string) string {
+	if trace == "" {
+		return ""
+	}
+	return "trace=" + trace + " "
+}
+
+// tracef is scriptLogf with the trace ID of the event being dispatched. Must
+// be called on the dispatcher goroutine.
+func (e *Engine) tracef(script *LuaScript, format string, args ...any) {
+	log.Print(scriptLogPrefix(script) + traceLogPrefix(e.traceID) + fmt.Sprintf(format, args...))
+}
+
+// tracedEvent is a queued event with its trace ID and depth.
+type tracedEvent struct {
+	Event
+	trace string
+	depth int
+}
+
+func (te tracedEvent) Dispatch(e *Engine) {
+	prevTrace, prevDepth := e.traceID, e.eventDepth
+	e.traceID, e.eventDepth = te.trace, te.depth
+	defer func() { e.traceID, e.eventDepth = prevTrace, prevDepth }()
+	te.Event.Dispatch(e)
+}
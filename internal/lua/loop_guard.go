@@ -0,0 +1,89 @@
+package lua
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minEchoLength is the shortest sent message the loop guard tracks. Replies
+// like "ok" or "👍" are too common to tell an echo from a person typing them.
+const minEchoLength = 8
+
+// sentMessage is a message the bot sent recently and how often it has come
+// back since.
+type sentMessage struct {
+	content string
+	at      time.Time
+	echoes  int
+}
+
+// loopGuard stops relay loops. Messages from bots, including the bot's own,
+// never reach scripts, but a script relaying messages to a webhook or to a
+// bridge that posts as a user can still get its own output back as a new
+// message, relay that, and so on. The guard remembers what the bot sent
+// within LOOP_GUARD_WINDOW and drops incoming messages containing it once
+// it has come back more than LOOP_GUARD_MAX_ECHOES times.
+type loopGuard struct {
+	mu   sync.Mutex
+	sent []*sentMessage // oldest first
+	now  func() time.Time
+}
+
+// prune drops the messages sent before the window. Must hold mu.
+func (g *loopGuard) prune(now time.Time, window time.Duration) {
+	kept := g.sent[:0]
+	for _, s := range g.sent {
+		if now.Sub(s.at) < window {
+			kept = append(kept, s)
+		}
+	}
+	g.sent = kept
+}
+
+// recordSent notes content the bot sent.
+func (e *Engine) recordSent(content string) {
+	window := e.cfg.LoopGuardWindow
+	content = strings.TrimSpace(content)
+	if window <= 0 || len([]rune(content)) < minEchoLength {
+		return
+	}
+	g := &e.loops
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	g.prune(now, window)
+	g.sent = append(g.sent, &sentMessage{content: content, at: now})
+}
+
+// isEcho reports whether an incoming message repeats something the bot sent
+// recently often enough to be dropped as a loop. Every sent message it
+// contains counts an echo, so a relay that wraps each message in a prefix is
+// caught by the first message of the chain coming back again and again.
+func (e *Engine) isEcho(content string) bool {
+	window := e.cfg.LoopGuardWindow
+	if window <= 0 {
+		return false
+	}
+	g := &e.loops
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(g.now(), window)
+	echo := false
+	for _, s := range g.sent {
+		if !strings.Contains(content, s.content) {
+			continue
+		}
+		s.echoes++
+		if s.echoes <= e.cfg.LoopGuardMaxEchoes {
+			continue
+		}
+		if !echo && s.echoes == e.cfg.LoopGuardMaxEchoes+1 {
+			log.Printf("Loop guard: dropping incoming messages that repeat %q, which the bot sent less than %s ago",
+				s.content, window)
+		}
+		echo = true
+	}
+	return echo
+}
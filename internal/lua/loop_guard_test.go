@@ -0,0 +1,90 @@
+package lua
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestLoopGuardStopsRelayLoop(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	// Relays every message to another channel, where a bridge posts it back
+	loadTestScript(t, engine, "relay.lua", `
+		register_hook("on_channel_message", function(event)
+			send_message("c2", "[relay] " .. event.content)
+		end)
+	`)
+
+	receive := func(content string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			GuildID:   "g1",
+			WebhookID: "w1",
+			Author:    &discordgo.User{ID: "bridge", Username: "bridge"},
+		}})
+		drainEvents(engine)
+	}
+
+	receive("hello everyone")
+	for i := 0; i < 10 && len(session.sent) > 0; i++ {
+		receive(session.sent[len(session.sent)-1].Content)
+	}
+
+	// The first relay comes back with the second and third; the fourth
+	// contains it a third time and is dropped
+	if len(session.sent) != 3 {
+		t.Fatalf("Expected the loop to stop after 3 relays, got %d", len(session.sent))
+	}
+
+	// Unrelated messages still get through
+	receive("something else")
+	if len(session.sent) != 4 {
+		t.Errorf("Expected an unrelated message to be relayed, got %d messages", len(session.sent))
+	}
+}
+
+func TestLoopGuardForgetsAfterWindow(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	now := time.Now()
+	engine.loops.now = func() time.Time { return now }
+	engine.cfg.LoopGuardMaxEchoes = 0
+
+	engine.recordSent("short")
+	if engine.isEcho("short") {
+		t.Error("Expected short messages not to be tracked")
+	}
+
+	engine.recordSent("the weather today is sunny")
+	if !engine.isEcho("relayed: the weather today is sunny") {
+		t.Error("Expected a message containing a sent message to be an echo")
+	}
+
+	now = now.Add(engine.cfg.LoopGuardWindow)
+	if engine.isEcho("the weather today is sunny") {
+		t.Error("Expected sent messages to be forgotten after the window")
+	}
+}
+
+func TestLoopGuardRemembersEmbedContent(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, &fakeSession{}, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.LoopGuardMaxEchoes = 0
+	engine.Initialize()
+
+	loadTestScript(t, engine, "digest.lua", `
+		send_embed("c1", { title = "Digest" }, { content = "the weekly digest is out" })
+	`)
+	if !engine.isEcho("relayed: the weekly digest is out") {
+		t.Error("Expected the content of an embed message to be remembered")
+	}
+}
@@ -0,0 +1,44 @@
+package lua
+
+import (
+	"log"
+	"time"
+)
+
+// maintenanceLoop periodically enqueues database maintenance. Going through
+// the event queue keeps maintenance on the dispatcher goroutine, so it never
+// runs in the middle of a script's store call.
+func (e *Engine) maintenanceLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if e.IsShuttingDown() {
+				return
+			}
+			e.enqueueEvent(MaintenanceEvent{}, "maintenance")
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// runMaintenance deletes expired kv_store values and vacuums the database.
+// Must be called on the dispatcher goroutine.
+func (e *Engine) runMaintenance() (before, after int64, err error) {
+	start := time.Now()
+	if n, err := e.pruneExpiredValues(start); err != nil {
+		log.Println("Warning: failed to prune expired values:", err)
+	} else if n > 0 {
+		log.Printf("Pruned %d expired values", n)
+	}
+	before, after, err = e.db.Vacuum()
+	if err != nil {
+		log.Println("Database maintenance failed:", err)
+		return before, after, err
+	}
+	log.Printf("Database vacuumed in %s (%d -> %d bytes)", time.Since(start).Round(time.Millisecond), before, after)
+	return before, after, nil
+}
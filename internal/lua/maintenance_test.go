@@ -0,0 +1,53 @@
+package lua
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/leihog/discord-bot/internal/users"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestVacuumRequiresOwner(t *testing.T) {
+	db := setupTestDB(t)
+	store := users.New(db)
+	engine := New(db, &fakeSession{}, store)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	if err := store.EnsureUser("owner1", "boss"); err != nil {
+		t.Fatalf("EnsureUser failed: %v", err)
+	}
+	if err := store.AddRole("owner1", "owner"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+
+	loadTestScript(t, engine, "vacuum.lua", `
+		results = {}
+		register_command("vac", "Vacuum", function(event)
+			local before, err = db_vacuum()
+			results[event.author_id] = before and "ok" or err
+		end)
+		_, outside_err = db_vacuum()
+	`)
+	for _, id := range []string{"user1", "owner1"} {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   "!vac",
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: id, Username: id},
+		}})
+	}
+	drainEvents(engine)
+
+	denied := "db_vacuum requires a command run by an owner"
+	if got := scriptGlobal(engine, "outside_err").String(); got != denied {
+		t.Errorf("Expected db_vacuum outside a command to be refused, got %q", got)
+	}
+	results := scriptGlobal(engine, "results").(*lua.LTable)
+	if got := results.RawGetString("user1").String(); got != denied {
+		t.Errorf("Expected a non-owner to be refused, got %q", got)
+	}
+	if got := results.RawGetString("owner1").String(); got != "ok" {
+		t.Errorf("Expected the owner to vacuum the database, got %q", got)
+	}
+}
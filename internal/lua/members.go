@@ -0,0 +1,145 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Page sizes of get_members. Discord returns at most 1000 members per
+// request.
+const (
+	defaultMembersPerPage = 100
+	maxMembersPerPage     = 1000
+)
+
+// guildMembers returns up to limit members of a guild whose user IDs follow
+// after, in ID order. An empty after starts at the beginning. limit is capped
+// at maxMembersPerPage.
+func (e *Engine) guildMembers(guildID, after string, limit int) ([]*discordgo.Member, error) {
+	if !isSnowflake(guildID) {
+		return nil, fmt.Errorf("invalid guild ID '%s'", guildID)
+	}
+	if after != "" && !isSnowflake(after) {
+		return nil, fmt.Errorf("invalid user ID '%s' for after", after)
+	}
+	if limit < 1 {
+		return nil, fmt.Errorf("limit must be at least 1, got %d", limit)
+	}
+	limit = min(limit, maxMembersPerPage)
+
+	members, err := e.session.GuildMembers(guildID, after, limit)
+	if err != nil {
+		return nil, membersError(guildID, err)
+	}
+	return members, nil
+}
+
+// membersError explains the error Discord returns for member requests when
+// the bot lacks the Server Members Intent.
+func membersError(guildID string, err error) error {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeMissingAccess {
+		return fmt.Errorf("listing members of guild %s needs the Server Members Intent, enable it in the Developer Portal", guildID)
+	}
+	return err
+}
+
+// maxUserMatches is how many members find_user asks Discord for, and so the
+// most candidates it can return.
+const maxUserMatches = 25
+
+// userTagPattern matches a legacy "name#1234" tag.
+var userTagPattern = regexp.MustCompile(`^(.+)#(\d{4})$`)
+
+// findUser looks up the members of a guild going by name: their username,
+// global name or nickname, ignoring case and a leading @. A legacy tag like
+// "name#1234" must match the discriminator too. Members whose name is name
+// exactly are returned if there are any, otherwise those whose name starts
+// with it, so "john" finds "John" without also offering "johnny".
+func (e *Engine) findUser(guildID, name string) ([]*discordgo.Member, error) {
+	if !isSnowflake(guildID) {
+		return nil, fmt.Errorf("invalid guild ID '%s'", guildID)
+	}
+	name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+	var discriminator string
+	if m := userTagPattern.FindStringSubmatch(name); m != nil {
+		name, discriminator = m[1], m[2]
+	}
+	if name == "" {
+		return nil, errors.New("name must not be empty")
+	}
+
+	// Discord matches the start of usernames and nicknames
+	found, err := e.session.GuildMembersSearch(guildID, name, maxUserMatches)
+	if err != nil {
+		return nil, membersError(guildID, err)
+	}
+
+	var exact, prefix []*discordgo.Member
+	for _, member := range found {
+		if member.User == nil || (discriminator != "" && member.User.Discriminator != discriminator) {
+			continue
+		}
+		switch memberNameMatch(member, name) {
+		case nameExact:
+			exact = append(exact, member)
+		case namePrefix:
+			prefix = append(prefix, member)
+		}
+	}
+	if len(exact) > 0 {
+		return exact, nil
+	}
+	return prefix, nil
+}
+
+// How well a member's names match a search, best first.
+const (
+	nameExact = iota
+	namePrefix
+	nameNone
+)
+
+// memberNameMatch returns the best match of name against the member's
+// username, global name and nickname, ignoring case.
+func memberNameMatch(member *discordgo.Member, name string) int {
+	best := nameNone
+	for _, candidate := range []string{member.User.Username, member.User.GlobalName, member.Nick} {
+		switch {
+		case candidate == "":
+		case strings.EqualFold(candidate, name):
+			return nameExact
+		case strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(name)):
+			best = namePrefix
+		}
+	}
+	return best
+}
+
+// memberToLua converts a member into a {id, username, display_name, nick,
+// roles, joined_at, bot, pending} table. display_name is the nickname, the
+// global name or the username, whichever is set first; joined_at is a Unix
+// timestamp.
+func memberToLua(L *lua.LState, member *discordgo.Member) *lua.LTable {
+	tbl := L.NewTable()
+	roles := L.NewTable()
+	for _, role := range member.Roles {
+		roles.Append(lua.LString(role))
+	}
+	tbl.RawSetString("roles", roles)
+	tbl.RawSetString("nick", lua.LString(member.Nick))
+	tbl.RawSetString("joined_at", lua.LNumber(member.JoinedAt.Unix()))
+	tbl.RawSetString("pending", lua.LBool(member.Pending))
+	if member.User != nil {
+		tbl.RawSetString("id", lua.LString(member.User.ID))
+		tbl.RawSetString("username", lua.LString(member.User.Username))
+		tbl.RawSetString("display_name", lua.LString(member.DisplayName()))
+		tbl.RawSetString("bot", lua.LBool(member.User.Bot))
+	}
+	return tbl
+}
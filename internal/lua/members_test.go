@@ -0,0 +1,145 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestGetMembersPagination(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	for i := 1; i <= 5; i++ {
+		session.members = append(session.members, &discordgo.Member{
+			User:  &discordgo.User{ID: fmt.Sprintf("10%d", i), Username: fmt.Sprintf("user%d", i)},
+			Roles: []string{"7"},
+		})
+	}
+	session.members[1].Nick = "nick"
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		ids = {}
+		pages = 0
+		local after
+		repeat
+			local page, next_after = get_members("1", { limit = 2, after = after })
+			pages = pages + 1
+			for _, m in ipairs(page) do table.insert(ids, m.id) end
+			after = next_after
+		until not after
+		first = get_members("1")[2]
+		local ok, err = get_members("1", { limit = 0 })
+		bad_limit = err
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	if got := scriptGlobal(engine, "ids").(*lua.LTable).Len(); got != 5 {
+		t.Errorf("Expected all 5 members across the pages, got %d", got)
+	}
+	if got := scriptGlobal(engine, "pages").String(); got != "3" {
+		t.Errorf("Expected 3 pages of at most 2 members, got %s", got)
+	}
+	if err := engine.state.DoString(`display = first.display_name .. "/" .. first.username .. "/" .. first.roles[1]`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if got := scriptGlobal(engine, "display").String(); got != "nick/user2/7" {
+		t.Errorf("Expected the nickname as display name, got %q", got)
+	}
+	if err := scriptGlobal(engine, "bad_limit").String(); !strings.Contains(err, "limit must be at least 1") {
+		t.Errorf("Expected an invalid limit error, got %q", err)
+	}
+}
+
+func TestGuildMembersCapsLimit(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	for i := 0; i < maxMembersPerPage+5; i++ {
+		session.members = append(session.members, &discordgo.Member{User: &discordgo.User{ID: fmt.Sprintf("%d", 10000+i)}})
+	}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+
+	members, err := engine.guildMembers("1", "", 5000)
+	if err != nil {
+		t.Fatalf("guildMembers failed: %v", err)
+	}
+	if len(members) != maxMembersPerPage {
+		t.Errorf("Expected the page to be capped at %d, got %d", maxMembersPerPage, len(members))
+	}
+	if _, err := engine.guildMembers("1", "abc", 10); err == nil {
+		t.Error("Expected a non-numeric after to be rejected")
+	}
+}
+
+func TestFindUser(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{members: []*discordgo.Member{
+		{User: &discordgo.User{ID: "101", Username: "johndoe", Discriminator: "0"}},
+		{User: &discordgo.User{ID: "102", Username: "johnny", GlobalName: "Johnny B"}},
+		{User: &discordgo.User{ID: "103", Username: "jd_1990"}, Nick: "JohnDoe"},
+		{User: &discordgo.User{ID: "104", Username: "alice"}, Nick: "Al"},
+		{User: &discordgo.User{ID: "105", Username: "oldtimer", Discriminator: "4242"}},
+	}}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	find := func(name string) (string, []string) {
+		t.Helper()
+		engine.state.SetGlobal("query", lua.LString(name))
+		if err := engine.state.DoString(`id, matches = find_user("1", query)`); err != nil {
+			t.Fatalf("DoString failed: %v", err)
+		}
+		matches, ok := scriptGlobal(engine, "matches").(*lua.LTable)
+		if !ok {
+			t.Fatalf("find_user(%q) failed: %v", name, scriptGlobal(engine, "matches"))
+		}
+		var ids []string
+		for i := 1; i <= matches.Len(); i++ {
+			ids = append(ids, matches.RawGetInt(i).(*lua.LTable).RawGetString("id").String())
+		}
+		id := ""
+		if v := scriptGlobal(engine, "id"); v != lua.LNil {
+			id = v.String()
+		}
+		return id, ids
+	}
+
+	tests := []struct {
+		name    string
+		wantID  string
+		matches string
+	}{
+		{"alice", "104", "104"},
+		{"@ALICE", "104", "104"},
+		{"JohnDoe", "", "101,103"}, // username of one, nickname of the other
+		{"johnn", "102", "102"},    // prefix
+		{"john", "", "101,102,103"},
+		{"oldtimer#4242", "105", "105"},
+		{"oldtimer#0001", "", ""},
+		{"nobody", "", ""},
+		{"<@!104>", "104", ""},
+		{"104", "104", ""},
+	}
+	for _, tt := range tests {
+		id, matches := find(tt.name)
+		if id != tt.wantID || strings.Join(matches, ",") != tt.matches {
+			t.Errorf("find_user(%q) = %q, %v; want %q, %s", tt.name, id, matches, tt.wantID, tt.matches)
+		}
+	}
+
+	if err := engine.state.DoString(`bad_id, bad_err = find_user("1", "  ")`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if scriptGlobal(engine, "bad_id") != lua.LNil || scriptGlobal(engine, "bad_err").Type() != lua.LTString {
+		t.Error("an empty name should be an error")
+	}
+}
@@ -0,0 +1,104 @@
+package lua
+
+import (
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ProcessMessageEdit queues an edited message for the on_message_edit hooks.
+// The message as it was before comes from the state message cache and is nil
+// when it wasn't cached.
+func (e *Engine) ProcessMessageEdit(m *discordgo.MessageUpdate) {
+	if e.IsShuttingDown() || m == nil || m.Message == nil {
+		return
+	}
+	event := MessageChangeEvent{Message: *m.Message, Before: m.BeforeUpdate}
+	if event.ignored() {
+		return
+	}
+	// Discord also sends updates when it adds link previews; only changes
+	// to the text are edits.
+	if m.BeforeUpdate != nil && m.BeforeUpdate.Content == m.Content {
+		return
+	}
+	e.enqueueEvent(event, event.authorName())
+}
+
+// ProcessMessageDelete queues a deleted message for the on_message_delete
+// hooks. Discord only sends the IDs; everything else comes from the state
+// message cache.
+func (e *Engine) ProcessMessageDelete(m *discordgo.MessageDelete) {
+	if e.IsShuttingDown() || m == nil || m.Message == nil {
+		return
+	}
+	event := MessageChangeEvent{Message: *m.Message, Before: m.BeforeDelete, Deleted: true}
+	if event.ignored() {
+		return
+	}
+	e.enqueueEvent(event, event.authorName())
+}
+
+// MessageChangeEvent delivers an edited or deleted message to the
+// on_message_edit or on_message_delete hooks.
+type MessageChangeEvent struct {
+	Message discordgo.Message
+	Before  *discordgo.Message // nil if the message wasn't cached
+	Deleted bool
+}
+
+// author returns the message's author, which edits only sometimes carry and
+// deletes never do.
+func (mc MessageChangeEvent) author() *discordgo.User {
+	if mc.Message.Author != nil {
+		return mc.Message.Author
+	}
+	if mc.Before != nil {
+		return mc.Before.Author
+	}
+	return nil
+}
+
+// ignored reports whether the message is from a bot; like new messages,
+// those never reach scripts.
+func (mc MessageChangeEvent) ignored() bool {
+	author := mc.author()
+	return author != nil && author.Bot
+}
+
+func (mc MessageChangeEvent) authorName() string {
+	if author := mc.author(); author != nil {
+		return author.Username
+	}
+	return "unknown author"
+}
+
+func (mc MessageChangeEvent) Dispatch(e *Engine) {
+	data := e.state.NewTable()
+	data.RawSetString("message_id", lua.LString(mc.Message.ID))
+	data.RawSetString("channel_id", lua.LString(mc.Message.ChannelID))
+	data.RawSetString("guild_id", lua.LString(mc.Message.GuildID))
+	if author := mc.author(); author != nil {
+		data.RawSetString("author", lua.LString(author.Username))
+		data.RawSetString("author_id", lua.LString(author.ID))
+	}
+	if !mc.Deleted {
+		data.RawSetString("content", lua.LString(mc.Message.Content))
+	}
+	if mc.Before != nil {
+		data.RawSetString("old_content", lua.LString(mc.Before.Content))
+		if mc.Deleted {
+			data.RawSetString("attachments", attachmentsToLua(e.state, mc.Before.Attachments))
+		}
+	}
+	hooks := e.hooks[mc.Type()]
+	for i, hook := range hooks {
+		e.callLuaFunction(hook, hookData(e.state, data, i, len(hooks)))
+	}
+}
+
+func (mc MessageChangeEvent) Type() string {
+	if mc.Deleted {
+		return "on_message_delete"
+	}
+	return "on_message_edit"
+}
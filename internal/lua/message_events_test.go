@@ -0,0 +1,67 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestMessageEditAndDeleteHooks(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "audit.lua", `
+		edits = {}
+		deletes = {}
+		register_hook("on_message_edit", function(event)
+			table.insert(edits, (event.old_content or "unknown") .. " -> " .. event.content)
+		end)
+		register_hook("on_message_delete", function(event)
+			table.insert(deletes, (event.author or "?") .. ": " .. (event.old_content or "unknown"))
+		end)
+	`)
+
+	alice := &discordgo.User{ID: "u1", Username: "alice"}
+	bot := &discordgo.User{ID: "b1", Username: "helper", Bot: true}
+	cached := &discordgo.Message{ID: "m1", ChannelID: "c1", Author: alice, Content: "helo"}
+
+	engine.ProcessMessageEdit(&discordgo.MessageUpdate{
+		Message:      &discordgo.Message{ID: "m1", ChannelID: "c1", Author: alice, Content: "hello"},
+		BeforeUpdate: cached,
+	})
+	engine.ProcessMessageEdit(&discordgo.MessageUpdate{
+		Message: &discordgo.Message{ID: "m2", ChannelID: "c1", Author: alice, Content: "uncached"},
+	})
+	// A link preview being added leaves the content alone
+	engine.ProcessMessageEdit(&discordgo.MessageUpdate{
+		Message:      &discordgo.Message{ID: "m1", ChannelID: "c1", Author: alice, Content: "helo"},
+		BeforeUpdate: cached,
+	})
+	engine.ProcessMessageEdit(&discordgo.MessageUpdate{
+		Message:      &discordgo.Message{ID: "m3", ChannelID: "c1", Author: bot, Content: "new"},
+		BeforeUpdate: &discordgo.Message{ID: "m3", ChannelID: "c1", Author: bot, Content: "old"},
+	})
+	engine.ProcessMessageDelete(&discordgo.MessageDelete{
+		Message:      &discordgo.Message{ID: "m1", ChannelID: "c1"},
+		BeforeDelete: cached,
+	})
+	engine.ProcessMessageDelete(&discordgo.MessageDelete{
+		Message: &discordgo.Message{ID: "m2", ChannelID: "c1"},
+	})
+	drainEvents(engine)
+
+	out, err := execIn(engine, "audit.lua", `table.concat(edits, ","), table.concat(deletes, ",")`)
+	if err != nil {
+		t.Fatalf("execIn failed: %v", err)
+	}
+	editLog, deleteLog, _ := strings.Cut(out, "\t")
+	if got := editLog; got != "helo -> hello,unknown -> uncached" {
+		t.Errorf("Unexpected edits: %q", got)
+	}
+	if got := deleteLog; got != "alice: helo,?: unknown" {
+		t.Errorf("Unexpected deletes: %q", got)
+	}
+}
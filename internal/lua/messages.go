@@ -0,0 +1,305 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxMessageLength is Discord's limit on message content, counted in UTF-16
+// code units like JavaScript string lengths: emoji outside the Basic
+// Multilingual Plane count twice, while "é" counts once despite being two
+// bytes.
+const maxMessageLength = 2000
+
+// messageLength returns the length of s as Discord counts it.
+func messageLength(s string) int {
+	n := 0
+	for _, r := range s {
+		if size := utf16.RuneLen(r); size > 0 {
+			n += size
+		} else {
+			n++ // invalid UTF-8 is sent as U+FFFD
+		}
+	}
+	return n
+}
+
+// splitMessage splits text into chunks of at most limit UTF-16 code units,
+// breaking after the last newline, or failing that the last space, that fits.
+// Chunks never end inside a character, so surrogate pairs stay together. A
+// limit outside 1..maxMessageLength means maxMessageLength.
+func splitMessage(text string, limit int) []string {
+	if limit <= 0 || limit > maxMessageLength {
+		limit = maxMessageLength
+	}
+	var chunks []string
+	for messageLength(text) > limit {
+		end, units := len(text), 0
+		lastNewline, lastSpace := 0, 0
+		for i, r := range text {
+			size := max(utf16.RuneLen(r), 1)
+			if units+size > limit {
+				end = i
+				break
+			}
+			units += size
+			if r == '\n' {
+				lastNewline = i + 1
+			} else if unicode.IsSpace(r) {
+				lastSpace = i + 1
+			}
+		}
+		if end == 0 {
+			// limit is 1 and the next character needs a surrogate pair
+			_, end = utf8.DecodeRuneInString(text)
+		}
+
+		cut := end
+		if lastNewline > 0 {
+			cut = lastNewline
+		} else if lastSpace > 0 {
+			cut = lastSpace
+		}
+		chunk := strings.TrimRight(text[:cut], " \t\n")
+		if chunk == "" {
+			chunk = text[:end]
+			cut = end
+		}
+		chunks = append(chunks, chunk)
+		text = text[cut:]
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// mentionPresets maps the allowed_mentions shorthands to the mention types
+// Discord is allowed to parse. "none" is an empty (but non-nil) list.
+var mentionPresets = map[string][]discordgo.AllowedMentionType{
+	"none":     {},
+	"users":    {discordgo.AllowedMentionTypeUsers},
+	"roles":    {discordgo.AllowedMentionTypeRoles},
+	"everyone": {discordgo.AllowedMentionTypeEveryone},
+	"all": {
+		discordgo.AllowedMentionTypeUsers,
+		discordgo.AllowedMentionTypeRoles,
+		discordgo.AllowedMentionTypeEveryone,
+	},
+}
+
+// parseMentionPreset resolves a preset name such as "none" or "users".
+func parseMentionPreset(name string) (*discordgo.MessageAllowedMentions, error) {
+	parse, ok := mentionPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown allowed_mentions preset '%s'", name)
+	}
+	return &discordgo.MessageAllowedMentions{Parse: parse}, nil
+}
+
+// parseAllowedMentions converts the allowed_mentions option into its discordgo
+// form. It accepts a preset string or a table with the fields parse, users,
+// roles and replied_user.
+func parseAllowedMentions(value lua.LValue) (*discordgo.MessageAllowedMentions, error) {
+	switch v := value.(type) {
+	case lua.LString:
+		return parseMentionPreset(string(v))
+	case *lua.LTable:
+		mentions := &discordgo.MessageAllowedMentions{Parse: []discordgo.AllowedMentionType{}}
+		if parse, ok := v.RawGetString("parse").(*lua.LTable); ok {
+			for i := 1; i <= parse.Len(); i++ {
+				mentions.Parse = append(mentions.Parse, discordgo.AllowedMentionType(parse.RawGetInt(i).String()))
+			}
+		}
+		if users, ok := v.RawGetString("users").(*lua.LTable); ok {
+			for i := 1; i <= users.Len(); i++ {
+				mentions.Users = append(mentions.Users, users.RawGetInt(i).String())
+			}
+		}
+		if roles, ok := v.RawGetString("roles").(*lua.LTable); ok {
+			for i := 1; i <= roles.Len(); i++ {
+				mentions.Roles = append(mentions.Roles, roles.RawGetInt(i).String())
+			}
+		}
+		mentions.RepliedUser = lua.LVAsBool(v.RawGetString("replied_user"))
+		return mentions, nil
+	default:
+		return nil, fmt.Errorf("allowed_mentions must be a string or table, got %s", value.Type())
+	}
+}
+
+// defaultAllowedMentions returns the configured default, falling back to
+// "none" if the configuration holds an unknown preset.
+func (e *Engine) defaultAllowedMentions() *discordgo.MessageAllowedMentions {
+	mentions, err := parseMentionPreset(e.cfg.AllowedMentions)
+	if err != nil {
+		mentions, _ = parseMentionPreset("none")
+	}
+	return mentions
+}
+
+// sendNotice sends a message of the bot's own, such as an error reply to a
+// command, with the default allowed mentions, so user text quoted in it can't
+// ping anyone.
+func (e *Engine) sendNotice(channelID, content string) (*discordgo.Message, error) {
+	return e.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: e.defaultAllowedMentions(),
+	})
+}
+
+// applySendOptions fills msg from a send options table. Fields that are absent
+// keep their defaults.
+func (e *Engine) applySendOptions(msg *discordgo.MessageSend, options *lua.LTable) error {
+	msg.AllowedMentions = e.defaultAllowedMentions()
+	if n := messageLength(msg.Content); n > maxMessageLength {
+		return fmt.Errorf("message is %d characters long, Discord allows %d; use split_message to send it in parts", n, maxMessageLength)
+	}
+	if options == nil {
+		return nil
+	}
+
+	if value := options.RawGetString("allowed_mentions"); value != lua.LNil {
+		mentions, err := parseAllowedMentions(value)
+		if err != nil {
+			return err
+		}
+		msg.AllowedMentions = mentions
+	}
+
+	if components, ok := options.RawGetString("components").(*lua.LTable); ok {
+		rows, err := parseComponents(components)
+		if err != nil {
+			return err
+		}
+		msg.Components = rows
+	}
+
+	if stickers, ok := options.RawGetString("stickers").(*lua.LTable); ok {
+		ids, err := parseStickerIDs(stickers)
+		if err != nil {
+			return err
+		}
+		msg.StickerIDs = ids
+	}
+	return nil
+}
+
+// replyMessage sends content as a reply to a message, which Discord shows
+// with the original quoted above it, and returns the ID of the reply. If the
+// original is gone the reply is sent without the quote. options are those of
+// send_message; the original's author is pinged only if allowed_mentions sets
+// replied_user.
+func (e *Engine) replyMessage(channelID, messageID, content string, options *lua.LTable) (string, error) {
+	if !isSnowflake(messageID) {
+		return "", fmt.Errorf("invalid message ID '%s'", messageID)
+	}
+	failIfNotExists := false
+	msg := &discordgo.MessageSend{
+		Content: content,
+		Reference: &discordgo.MessageReference{
+			MessageID:       messageID,
+			ChannelID:       channelID,
+			FailIfNotExists: &failIfNotExists,
+		},
+	}
+	if err := e.filterOutboundMessage(channelID, "message", &msg.Content, nil); err != nil {
+		return "", err
+	}
+	if err := e.applySendOptions(msg, options); err != nil {
+		return "", err
+	}
+	sent, err := e.session.ChannelMessageSendComplex(channelID, msg)
+	if err != nil {
+		return "", err
+	}
+	e.recordSent(msg.Content)
+	return sent.ID, nil
+}
+
+// deleteMessage deletes a message. Deleting messages of other users needs the
+// Manage Messages permission in the channel.
+func (e *Engine) deleteMessage(channelID, messageID string) error {
+	if !isSnowflake(channelID) {
+		return fmt.Errorf("invalid channel ID '%s'", channelID)
+	}
+	if !isSnowflake(messageID) {
+		return fmt.Errorf("invalid message ID '%s'", messageID)
+	}
+	err := e.session.ChannelMessageDelete(channelID, messageID)
+	var restErr *discordgo.RESTError
+	if err == nil || !errors.As(err, &restErr) || restErr.Message == nil {
+		return err
+	}
+	switch restErr.Message.Code {
+	case discordgo.ErrCodeUnknownMessage:
+		return fmt.Errorf("message %s in channel %s does not exist or was already deleted", messageID, channelID)
+	case discordgo.ErrCodeUnknownChannel:
+		return fmt.Errorf("unknown channel %s", channelID)
+	case discordgo.ErrCodeMissingPermissions, discordgo.ErrCodeMissingAccess:
+		return fmt.Errorf("missing permission to delete message %s in channel %s (needs Manage Messages)", messageID, channelID)
+	}
+	return err
+}
+
+// maxDMChannels caps how many DM channels send_dm remembers. The DM channel
+// of a user doesn't change, so entries don't expire; a full cache is emptied.
+const maxDMChannels = 10000
+
+// dmChannel returns the ID of the DM channel with a user, opening it the
+// first time. Must be called on the dispatcher goroutine.
+func (e *Engine) dmChannel(userID string) (string, error) {
+	if channelID, ok := e.dmChannels[userID]; ok {
+		return channelID, nil
+	}
+	channel, err := e.session.UserChannelCreate(userID)
+	if err != nil {
+		return "", fmt.Errorf("opening a DM with user %s: %w", userID, err)
+	}
+	if len(e.dmChannels) >= maxDMChannels {
+		clear(e.dmChannels)
+	}
+	e.dmChannels[userID] = channel.ID
+	return channel.ID, nil
+}
+
+// sendDM sends content to a user as a direct message and returns the ID of
+// the message. options are those of send_message.
+func (e *Engine) sendDM(userID, content string, options *lua.LTable) (string, error) {
+	if !isSnowflake(userID) {
+		return "", fmt.Errorf("invalid user ID '%s'", userID)
+	}
+	channelID, err := e.dmChannel(userID)
+	if err != nil {
+		return "", err
+	}
+	msg := &discordgo.MessageSend{Content: content}
+	if err := e.filterOutboundMessage(channelID, "dm", &msg.Content, nil); err != nil {
+		return "", err
+	}
+	if err := e.applySendOptions(msg, options); err != nil {
+		return "", err
+	}
+	sent, err := e.session.ChannelMessageSendComplex(channelID, msg)
+	if err != nil {
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) && restErr.Message != nil {
+			switch restErr.Message.Code {
+			case discordgo.ErrCodeCannotSendMessagesToThisUser:
+				return "", fmt.Errorf("user %s does not accept direct messages from the bot", userID)
+			case discordgo.ErrCodeUnknownChannel:
+				delete(e.dmChannels, userID) // opened again by the next send_dm
+			}
+		}
+		return "", err
+	}
+	e.recordSent(msg.Content)
+	return sent.ID, nil
+}
@@ -0,0 +1,460 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestParseAllowedMentions(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	none, err := parseAllowedMentions(lua.LString("none"))
+	if err != nil {
+		t.Fatalf("parseAllowedMentions failed: %v", err)
+	}
+	if none.Parse == nil || len(none.Parse) != 0 {
+		t.Errorf("Expected an empty non-nil parse list for 'none', got %#v", none.Parse)
+	}
+
+	if _, err := parseAllowedMentions(lua.LString("bogus")); err == nil {
+		t.Error("Expected error for unknown preset")
+	}
+
+	tbl := L.NewTable()
+	users := L.NewTable()
+	users.Append(lua.LString("123"))
+	tbl.RawSetString("users", users)
+	tbl.RawSetString("replied_user", lua.LTrue)
+
+	custom, err := parseAllowedMentions(tbl)
+	if err != nil {
+		t.Fatalf("parseAllowedMentions failed: %v", err)
+	}
+	if len(custom.Users) != 1 || custom.Users[0] != "123" {
+		t.Errorf("Expected users [123], got %v", custom.Users)
+	}
+	if !custom.RepliedUser {
+		t.Error("Expected replied_user to be true")
+	}
+}
+
+func TestDefaultAllowedMentions(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	msg := &discordgo.MessageSend{Content: "@everyone hi"}
+	if err := engine.applySendOptions(msg, nil); err != nil {
+		t.Fatalf("applySendOptions failed: %v", err)
+	}
+	if msg.AllowedMentions == nil || len(msg.AllowedMentions.Parse) != 0 {
+		t.Errorf("Expected mentions to be suppressed by default, got %#v", msg.AllowedMentions)
+	}
+
+	engine.cfg.AllowedMentions = "all"
+	if err := engine.applySendOptions(msg, nil); err != nil {
+		t.Fatalf("applySendOptions failed: %v", err)
+	}
+	if len(msg.AllowedMentions.Parse) != 3 {
+		t.Errorf("Expected all mention types with 'all' default, got %v", msg.AllowedMentions.Parse)
+	}
+}
+
+func TestMessageLength(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"héllo", 5},  // é is two bytes but one code unit
+		{"日本語", 3},    // three bytes each, one code unit each
+		{"😀", 2},      // outside the BMP: a surrogate pair
+		{"👍🏽", 4},     // emoji plus skin tone modifier
+		{"a\xffb", 3}, // invalid UTF-8 becomes one replacement character
+	}
+	for _, tt := range tests {
+		if got := messageLength(tt.text); got != tt.want {
+			t.Errorf("messageLength(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	check := func(name string, chunks []string, limit int, want ...string) {
+		t.Helper()
+		for i, chunk := range chunks {
+			if n := messageLength(chunk); n > limit {
+				t.Errorf("%s: chunk %d is %d code units, over the limit of %d", name, i+1, n, limit)
+			}
+			if !utf8.ValidString(chunk) {
+				t.Errorf("%s: chunk %d splits a character", name, i+1)
+			}
+		}
+		if want != nil && strings.Join(chunks, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: got %q, want %q", name, chunks, want)
+		}
+	}
+
+	check("short", splitMessage("hello", 0), maxMessageLength, "hello")
+	check("words", splitMessage("one two three four", 9), 9, "one two", "three", "four")
+	check("newlines first", splitMessage("ab cd\nef gh ij", 12), 12, "ab cd", "ef gh ij")
+	check("no spaces", splitMessage("abcdefgh", 3), 3, "abc", "def", "gh")
+	check("surrogate pairs", splitMessage("😀😀😀", 3), 3, "😀", "😀", "😀")
+	check("surrogate pair at the limit", splitMessage("a😀b", 2), 2, "a", "😀", "b")
+
+	// 1000 emoji are exactly 2000 code units but 4000 bytes: one message
+	emoji := strings.Repeat("😀", 1000)
+	check("emoji at the limit", splitMessage(emoji, 0), maxMessageLength, emoji)
+
+	// One more and it no longer fits, although it is only 1001 runes
+	chunks := splitMessage(emoji+"😀", 0)
+	check("emoji over the limit", chunks, maxMessageLength, emoji, "😀")
+
+	// Accented text counts characters, not bytes
+	accents := strings.Repeat("é", maxMessageLength)
+	check("two-byte characters", splitMessage(accents, 0), maxMessageLength, accents)
+
+	long := strings.Repeat("word 🎉 ", 600)
+	chunks = splitMessage(long, 0)
+	check("mixed", chunks, maxMessageLength)
+	if got := strings.Join(chunks, " "); strings.TrimSpace(got) != strings.TrimSpace(long) {
+		t.Error("mixed: expected the chunks to add up to the original text")
+	}
+}
+
+func TestSendRejectsOverlongContent(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	msg := &discordgo.MessageSend{Content: strings.Repeat("😀", 1001)}
+	if err := engine.applySendOptions(msg, nil); err == nil || !strings.Contains(err.Error(), "2002") {
+		t.Errorf("Expected content over 2000 UTF-16 code units to be rejected, got %v", err)
+	}
+	msg.Content = strings.Repeat("😀", 1000)
+	if err := engine.applySendOptions(msg, nil); err != nil {
+		t.Errorf("Expected 2000 code units to be allowed, got %v", err)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	apiError := func(code int) error {
+		return &discordgo.RESTError{Message: &discordgo.APIErrorMessage{Code: code}}
+	}
+	db := setupTestDB(t)
+	session := &fakeSession{
+		deleted: make(chan string, 1),
+		deleteErrs: map[string]error{
+			"2": apiError(discordgo.ErrCodeUnknownMessage),
+			"3": apiError(discordgo.ErrCodeMissingPermissions),
+		},
+	}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "mod.lua", `
+		ok = delete_message("10", "1")
+		gone_ok, gone_err = delete_message("10", "2")
+		denied_ok, denied_err = delete_message("10", "3")
+		bad_ok, bad_err = delete_message("10", "latest")
+	`)
+
+	if scriptGlobal(engine, "ok") != lua.LTrue || <-session.deleted != "10/1" {
+		t.Error("Expected message 1 to be deleted")
+	}
+	tests := []struct{ ok, err, want string }{
+		{"gone_ok", "gone_err", "message 2 in channel 10 does not exist or was already deleted"},
+		{"denied_ok", "denied_err", "missing permission to delete message 3 in channel 10"},
+		{"bad_ok", "bad_err", "invalid message ID"},
+	}
+	for _, tt := range tests {
+		if scriptGlobal(engine, tt.ok) != lua.LFalse || !strings.Contains(scriptGlobal(engine, tt.err).String(), tt.want) {
+			t.Errorf("%s = %v, %v; want false and %q", tt.ok, scriptGlobal(engine, tt.ok), scriptGlobal(engine, tt.err), tt.want)
+		}
+	}
+}
+
+func TestSendDM(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "dm.lua", `
+		first = send_dm("42", "Welcome!")
+		second = send_dm("42", "Reminder: read the rules")
+		bad_id, bad_err = send_dm("<@42>", "hi")
+	`)
+
+	if id := scriptGlobal(engine, "first").String(); id != "mdm42" {
+		t.Errorf("send_dm returned %q, want the message ID", id)
+	}
+	if len(session.sent) != 2 || session.sentTo[0] != "dm42" || session.sentTo[1] != "dm42" {
+		t.Errorf("sent to %v, want the DM channel twice", session.sentTo)
+	}
+	if session.dmOpens != 1 {
+		t.Errorf("opened the DM channel %d times, want once", session.dmOpens)
+	}
+	if err := scriptGlobal(engine, "bad_err").String(); !strings.Contains(err, "invalid user ID") {
+		t.Errorf("bad_err = %q", err)
+	}
+
+	session.dmErr = &discordgo.RESTError{Message: &discordgo.APIErrorMessage{Code: discordgo.ErrCodeCannotSendMessagesToThisUser}}
+	if err := engine.state.DoString(`closed_id, closed_err = send_dm("42", "hi")`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if scriptGlobal(engine, "closed_id") != lua.LNil || !strings.Contains(scriptGlobal(engine, "closed_err").String(), "does not accept direct messages") {
+		t.Errorf("send_dm to a user with DMs closed = %v, %v", scriptGlobal(engine, "closed_id"), scriptGlobal(engine, "closed_err"))
+	}
+}
+
+func TestReplyMessage(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "reply.lua", `
+		register_command("ping", "Ping", function(event)
+			reply_id = reply_message(event.channel_id, event.message_id, "Pong!")
+		end)
+		register_hook("on_channel_message", function(event)
+			heard = event.message_id
+		end)
+		bad_id, bad_err = reply_message("10", "", "hi")
+	`)
+	for _, m := range []*discordgo.Message{
+		{ID: "555", Content: "!ping", ChannelID: "10", GuildID: "1"},
+		{ID: "556", Content: "hello", ChannelID: "10", GuildID: "1"},
+	} {
+		m.Author = &discordgo.User{ID: "u1", Username: "alice"}
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: m})
+	}
+	drainEvents(engine)
+
+	if len(session.sent) != 1 {
+		t.Fatalf("sent %d messages, want the reply", len(session.sent))
+	}
+	reply := session.sent[0]
+	if reply.Content != "Pong!" || reply.Reference == nil || reply.Reference.MessageID != "555" || reply.Reference.ChannelID != "10" {
+		t.Errorf("reply = %+v, want Pong! referencing message 555", reply)
+	}
+	if reply.Reference.FailIfNotExists == nil || *reply.Reference.FailIfNotExists {
+		t.Error("a reply to a deleted message should still be sent")
+	}
+	if scriptGlobal(engine, "reply_id").String() != "m10" {
+		t.Errorf("reply_message returned %v, want the reply's ID", scriptGlobal(engine, "reply_id"))
+	}
+	if scriptGlobal(engine, "heard").String() != "556" {
+		t.Errorf("on_channel_message got message_id %v", scriptGlobal(engine, "heard"))
+	}
+	if scriptGlobal(engine, "bad_id") != lua.LNil || !strings.Contains(scriptGlobal(engine, "bad_err").String(), "invalid message ID") {
+		t.Errorf("an empty message ID should be refused, got %v", scriptGlobal(engine, "bad_err"))
+	}
+}
+
+// fakeSession records sent messages and serves canned guild data.
+type fakeSession struct {
+	UnsupportedSession
+	sent         []*discordgo.MessageSend
+	sentTo       []string
+	channels     []*discordgo.Channel
+	channelLoads int
+	roles        []*discordgo.Role
+	members      []*discordgo.Member // in user ID order
+	events       []*discordgo.GuildScheduledEvent
+	users        map[string]*discordgo.User
+	userLoads    int
+	stickers     []*discordgo.Sticker
+	reactions    map[string][]*discordgo.MessageReactions // message ID -> reactions
+	reacted      []string                                 // "channel/message/emoji" added by the bot
+	reactors     map[string][]*discordgo.User             // "message/emoji" -> users, in ID order
+	edits        map[string][]*discordgo.ChannelEdit      // channel ID -> edits
+	editErr      error
+	messageEdits []string // "channel/message: content"
+	webhooks     []*discordgo.Webhook
+	deleted      chan string      // receives "channel/message" for each delete, if set
+	deleteErrs   map[string]error // message ID -> error of ChannelMessageDelete
+	dmOpens      int
+	dmErr        error // returned for messages sent to DM channels
+}
+
+func (f *fakeSession) ChannelMessageSend(channelID, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return f.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content})
+}
+
+func (f *fakeSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	if f.dmErr != nil && strings.HasPrefix(channelID, "dm") {
+		return nil, f.dmErr
+	}
+	f.sent = append(f.sent, data)
+	f.sentTo = append(f.sentTo, channelID)
+	return &discordgo.Message{ID: "m" + channelID, ChannelID: channelID, Content: data.Content}, nil
+}
+
+func (f *fakeSession) GuildChannels(guildID string, _ ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	f.channelLoads++
+	return f.channels, nil
+}
+
+func (f *fakeSession) GuildRoles(guildID string, _ ...discordgo.RequestOption) ([]*discordgo.Role, error) {
+	return f.roles, nil
+}
+
+func (f *fakeSession) GuildMembers(guildID, after string, limit int, _ ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	var page []*discordgo.Member
+	for _, member := range f.members {
+		if member.User.ID > after && len(page) < limit {
+			page = append(page, member)
+		}
+	}
+	return page, nil
+}
+
+// GuildMembersSearch matches the start of usernames and nicknames, ignoring
+// case, like Discord.
+func (f *fakeSession) GuildMembersSearch(guildID, query string, limit int, _ ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	query = strings.ToLower(query)
+	var found []*discordgo.Member
+	for _, member := range f.members {
+		if len(found) < limit && (strings.HasPrefix(strings.ToLower(member.User.Username), query) || strings.HasPrefix(strings.ToLower(member.Nick), query)) {
+			found = append(found, member)
+		}
+	}
+	return found, nil
+}
+
+func (f *fakeSession) User(userID string, _ ...discordgo.RequestOption) (*discordgo.User, error) {
+	f.userLoads++
+	if user, ok := f.users[userID]; ok {
+		return user, nil
+	}
+	return nil, fmt.Errorf("unknown user %s", userID)
+}
+
+func (f *fakeSession) Guild(guildID string, _ ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	return &discordgo.Guild{ID: guildID, Stickers: f.stickers}, nil
+}
+
+func (f *fakeSession) ChannelMessage(channelID, messageID string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return &discordgo.Message{ID: messageID, ChannelID: channelID, Reactions: f.reactions[messageID]}, nil
+}
+
+func (f *fakeSession) ChannelMessageEdit(channelID, messageID, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.messageEdits = append(f.messageEdits, channelID+"/"+messageID+": "+content)
+	return &discordgo.Message{ID: messageID, ChannelID: channelID, Content: content}, nil
+}
+
+func (f *fakeSession) UserChannelCreate(recipientID string, _ ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	f.dmOpens++
+	return &discordgo.Channel{ID: "dm" + recipientID, Type: discordgo.ChannelTypeDM}, nil
+}
+
+func (f *fakeSession) ChannelMessageDelete(channelID, messageID string, _ ...discordgo.RequestOption) error {
+	if err := f.deleteErrs[messageID]; err != nil {
+		return err
+	}
+	if f.deleted != nil {
+		f.deleted <- channelID + "/" + messageID
+	}
+	return nil
+}
+
+func (f *fakeSession) MessageReactionAdd(channelID, messageID, emojiID string, _ ...discordgo.RequestOption) error {
+	f.reacted = append(f.reacted, channelID+"/"+messageID+"/"+emojiID)
+	return nil
+}
+
+func (f *fakeSession) MessageReactions(channelID, messageID, emojiID string, limit int, _, afterID string, _ ...discordgo.RequestOption) ([]*discordgo.User, error) {
+	var page []*discordgo.User
+	for _, user := range f.reactors[messageID+"/"+emojiID] {
+		if user.ID > afterID && len(page) < limit {
+			page = append(page, user)
+		}
+	}
+	return page, nil
+}
+
+func (f *fakeSession) ChannelEdit(channelID string, data *discordgo.ChannelEdit, _ ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	if f.editErr != nil {
+		return nil, f.editErr
+	}
+	if f.edits == nil {
+		f.edits = make(map[string][]*discordgo.ChannelEdit)
+	}
+	f.edits[channelID] = append(f.edits[channelID], data)
+	return &discordgo.Channel{ID: channelID}, nil
+}
+
+func (f *fakeSession) WebhookCreate(channelID, name, avatar string, _ ...discordgo.RequestOption) (*discordgo.Webhook, error) {
+	webhook := &discordgo.Webhook{
+		ID:        fmt.Sprintf("%d", 100+len(f.webhooks)),
+		ChannelID: channelID,
+		Name:      name,
+		Token:     "secret-token",
+	}
+	f.webhooks = append(f.webhooks, webhook)
+	return webhook, nil
+}
+
+func (f *fakeSession) GuildScheduledEvents(guildID string, _ bool, _ ...discordgo.RequestOption) ([]*discordgo.GuildScheduledEvent, error) {
+	return f.events, nil
+}
+
+func (f *fakeSession) GuildScheduledEventCreate(guildID string, params *discordgo.GuildScheduledEventParams, _ ...discordgo.RequestOption) (*discordgo.GuildScheduledEvent, error) {
+	event := &discordgo.GuildScheduledEvent{
+		ID:                 fmt.Sprintf("e%d", len(f.events)+1),
+		GuildID:            guildID,
+		ChannelID:          params.ChannelID,
+		Name:               params.Name,
+		Description:        params.Description,
+		ScheduledStartTime: *params.ScheduledStartTime,
+		ScheduledEndTime:   params.ScheduledEndTime,
+		Status:             discordgo.GuildScheduledEventStatusScheduled,
+		EntityType:         params.EntityType,
+	}
+	if params.EntityMetadata != nil {
+		event.EntityMetadata = *params.EntityMetadata
+	}
+	f.events = append(f.events, event)
+	return event, nil
+}
+
+func TestResolveChannelCaching(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{channels: []*discordgo.Channel{
+		{ID: "1", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		{ID: "2", Name: "Announcements", Type: discordgo.ChannelTypeGuildNews},
+		{ID: "3", Name: "voice", Type: discordgo.ChannelTypeGuildVoice},
+	}}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+
+	if id, err := engine.resolveChannel("g1", "#announcements"); err != nil || id != "2" {
+		t.Fatalf("Expected channel 2, got %q (%v)", id, err)
+	}
+	if _, err := engine.resolveChannel("g1", "voice"); err == nil {
+		t.Error("Expected voice channels to be ignored")
+	}
+	if session.channelLoads != 1 {
+		t.Errorf("Expected channels to be loaded once, got %d loads", session.channelLoads)
+	}
+
+	// Recreating the channel gives it a new ID
+	session.channels[0] = &discordgo.Channel{ID: "4", Name: "general", Type: discordgo.ChannelTypeGuildText}
+	engine.InvalidateChannelCache("g1")
+
+	if id, err := engine.resolveChannel("g1", "general"); err != nil || id != "4" {
+		t.Errorf("Expected recreated channel 4 after invalidation, got %q (%v)", id, err)
+	}
+}
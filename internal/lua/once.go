@@ -0,0 +1,40 @@
+package lua
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// oncePruneInterval is how often expired once() keys are pruned.
+const oncePruneInterval = time.Hour
+
+// once reports whether this is the first call for key within ttl, e.g. to
+// handle each webhook delivery or reaction only once when Discord or a
+// webhook sender retries. Keys are scoped by the calling script and kept in
+// the database, so they survive reloads and restarts. Expired keys are
+// pruned at most once per oncePruneInterval. Must be called on the
+// dispatcher goroutine.
+func (e *Engine) once(key string, ttl time.Duration) (bool, error) {
+	script := e.currentScript
+	if script == nil {
+		return false, errors.New("once can only be called by a script")
+	}
+	if key == "" {
+		return false, errors.New("key is empty")
+	}
+	if ttl <= 0 {
+		return false, errors.New("ttl must be positive")
+	}
+
+	now := time.Now()
+	if now.Sub(e.oncePrunedAt) >= oncePruneInterval {
+		e.oncePrunedAt = now
+		if n, err := e.db.PruneOnceKeys(now); err != nil {
+			log.Println("Warning: failed to prune once keys:", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d expired once keys", n)
+		}
+	}
+	return e.db.ClaimOnceKey(script.Name, key, now, now.Add(ttl))
+}
@@ -0,0 +1,64 @@
+package lua
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnce(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "webhook.lua", `
+		first = once("delivery:1", 60)
+		again = once("delivery:1", 60)
+		other = once("delivery:2", 60)
+		bad, bad_err = once("delivery:3", 0)
+	`)
+	loadTestScript(t, engine, "other.lua", `
+		other_script = once("delivery:1", 60)
+	`)
+
+	expect := map[string]string{
+		"first":        "true",
+		"again":        "false",
+		"other":        "true",
+		"bad":          "nil",
+		"bad_err":      "ttl must be positive",
+		"other_script": "true", // keys are per script
+	}
+	for name, want := range expect {
+		if got := scriptGlobal(engine, name).String(); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestOnceKeyExpires(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Now()
+
+	claim := func(at time.Time) bool {
+		t.Helper()
+		claimed, err := db.ClaimOnceKey("s.lua", "k", at, at.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("ClaimOnceKey failed: %v", err)
+		}
+		return claimed
+	}
+	if !claim(now) {
+		t.Fatal("Expected the first claim to succeed")
+	}
+	if claim(now.Add(59 * time.Second)) {
+		t.Error("Expected a claim within the TTL to fail")
+	}
+	if !claim(now.Add(time.Minute)) {
+		t.Error("Expected the key to be claimable again once expired")
+	}
+
+	if n, err := db.PruneOnceKeys(now.Add(2 * time.Minute)); err != nil || n != 1 {
+		t.Errorf("PruneOnceKeys = %d, %v; want 1 row pruned", n, err)
+	}
+}
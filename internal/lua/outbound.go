@@ -0,0 +1,145 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Outbound filters are a deployment-wide policy layer over what the bot
+// posts: every message a script sends, edits or broadcasts has its text
+// passed through them before it goes to Discord, whichever script sent it.
+// A filter returns the text to send instead, nil to leave it as it is or
+// false to block the message. A filter that raises an error is skipped, or
+// blocks the message when OUTBOUND_FILTER_FAILURE is "closed".
+
+// outboundFilter is a function registered with register_outbound_filter.
+type outboundFilter struct {
+	script *LuaScript
+	fn     *lua.LFunction
+}
+
+// errOutboundBlocked is returned for messages a filter refused.
+var errOutboundBlocked = errors.New("message blocked by an outbound filter")
+
+// registerOutboundFilter adds fn, owned by the running script, after the
+// filters already registered.
+func (e *Engine) registerOutboundFilter(fn *lua.LFunction) error {
+	if e.currentScript == nil {
+		return errors.New("outbound filters can only be registered by a script")
+	}
+	e.outboundFilters = append(e.outboundFilters, outboundFilter{script: e.currentScript, fn: fn})
+	return nil
+}
+
+// removeOutboundFilters drops the filters of an unloaded script.
+func (e *Engine) removeOutboundFilters(script *LuaScript) {
+	filters := e.outboundFilters[:0]
+	for _, f := range e.outboundFilters {
+		if f.script != script {
+			filters = append(filters, f)
+		}
+	}
+	e.outboundFilters = filters
+}
+
+// filterOutboundMessage passes the content and the text of the embeds of a
+// message for channelID through the outbound filters, in place. kind names
+// the function sending it, e.g. "message" or "embed". Must be called on the
+// dispatcher goroutine.
+func (e *Engine) filterOutboundMessage(channelID, kind string, content *string, embeds []*discordgo.MessageEmbed) error {
+	filter := func(text *string, field string) error {
+		filtered, err := e.filterOutbound(*text, kind, channelID, field)
+		*text = filtered
+		return err
+	}
+
+	if err := filter(content, "content"); err != nil {
+		return err
+	}
+	for _, embed := range embeds {
+		if err := filter(&embed.Title, "title"); err != nil {
+			return err
+		}
+		if err := filter(&embed.Description, "description"); err != nil {
+			return err
+		}
+		for _, field := range embed.Fields {
+			if err := filter(&field.Name, "field_name"); err != nil {
+				return err
+			}
+			if err := filter(&field.Value, "field_value"); err != nil {
+				return err
+			}
+		}
+		if embed.Footer != nil {
+			if err := filter(&embed.Footer.Text, "footer"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterOutbound runs text through each outbound filter in turn. Empty text
+// is left alone, and so are messages sent by a filter itself, which would
+// otherwise be filtered without end.
+func (e *Engine) filterOutbound(text, kind, channelID, field string) (string, error) {
+	if text == "" || len(e.outboundFilters) == 0 || e.filteringOutbound {
+		return text, nil
+	}
+	e.filteringOutbound = true
+	sender := e.currentScript
+	defer func() {
+		e.filteringOutbound = false
+		e.currentScript = sender
+	}()
+
+	info := e.state.NewTable()
+	info.RawSetString("kind", lua.LString(kind))
+	info.RawSetString("channel_id", lua.LString(channelID))
+	info.RawSetString("field", lua.LString(field))
+	if sender != nil {
+		info.RawSetString("script", lua.LString(sender.Name))
+	}
+
+	for _, f := range e.outboundFilters {
+		e.currentScript = f.script
+		result, err := e.callOutboundFilter(f, text, info)
+		if err != nil {
+			e.logf("Outbound filter error: %v", err)
+			if e.cfg.OutboundFilterFailure == "closed" {
+				return "", fmt.Errorf("outbound filter of %s failed, not sending (OUTBOUND_FILTER_FAILURE=closed)", f.script.Name)
+			}
+			continue
+		}
+		switch {
+		case result == lua.LFalse:
+			e.logf("Outbound filter blocked a %s to channel %s", kind, channelID)
+			return "", errOutboundBlocked
+		case result.Type() == lua.LTString:
+			text = result.String()
+		}
+	}
+	return text, nil
+}
+
+// callOutboundFilter calls one filter and checks what it returned.
+func (e *Engine) callOutboundFilter(f outboundFilter, text string, info *lua.LTable) (lua.LValue, error) {
+	if err := e.state.CallByParam(lua.P{Fn: f.fn, NRet: 1, Protect: true}, lua.LString(text), info); err != nil {
+		return nil, err
+	}
+	result := e.state.Get(-1)
+	e.state.Pop(1)
+	switch result.Type() {
+	case lua.LTString, lua.LTNil:
+		return result, nil
+	case lua.LTBool:
+		if result == lua.LFalse {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("filter returned a %s, expected a string, nil or false", result.Type())
+}
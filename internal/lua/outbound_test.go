@@ -0,0 +1,95 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestOutboundFilters(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	policy := loadTestScript(t, engine, "policy.lua", `
+		register_outbound_filter(function(text, info)
+			if text:find("darn") then return false end
+			if info.field == "content" then
+				send_message("audit", info.kind .. " from " .. info.script)
+				return text .. " -- sent by Bot"
+			end
+		end)
+		register_outbound_filter(function(text)
+			return text:upper()
+		end)
+	`)
+	loadTestScript(t, engine, "chatty.lua", `
+		send_message("c1", "hello")
+		embed_ok = send_embed("c1", { title = "news", description = "all good" }, { content = "digest" })
+		blocked_ok, blocked_err = send_embed("c1", { description = "darn it" })
+	`)
+
+	var sent []string
+	for _, msg := range session.sent {
+		text := msg.Content
+		for _, embed := range msg.Embeds {
+			text += "|" + embed.Title + "|" + embed.Description
+		}
+		sent = append(sent, text)
+	}
+	want := []string{
+		"message from chatty.lua", // sent by the filter itself, so not filtered
+		"HELLO -- SENT BY BOT",
+		"embed from chatty.lua",
+		"DIGEST -- SENT BY BOT|NEWS|ALL GOOD",
+	}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("sent:\n%s\nwant:\n%s", strings.Join(sent, "\n"), strings.Join(want, "\n"))
+	}
+	if scriptGlobal(engine, "embed_ok") != lua.LTrue {
+		t.Error("send_embed should succeed")
+	}
+	if err := scriptGlobal(engine, "blocked_err").String(); !strings.Contains(err, "blocked by an outbound filter") {
+		t.Errorf("blocked message: err = %q", err)
+	}
+
+	// Filters go away with their script
+	engine.unloadScript(policy.Name)
+	session.sent = nil
+	if err := engine.state.DoString(`send_message("c1", "darn")`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if len(session.sent) != 1 || session.sent[0].Content != "darn" {
+		t.Errorf("after unloading the filters, sent %v", session.sent)
+	}
+}
+
+func TestOutboundFilterFailure(t *testing.T) {
+	for _, mode := range []string{"open", "closed"} {
+		t.Run(mode, func(t *testing.T) {
+			db := setupTestDB(t)
+			session := &fakeSession{channels: []*discordgo.Channel{{ID: "c9", Name: "general", Type: discordgo.ChannelTypeGuildText}}}
+			engine := New(db, session, nil)
+			t.Cleanup(engine.Close)
+			engine.cfg.OutboundFilterFailure = mode
+			engine.Initialize()
+
+			loadTestScript(t, engine, "broken.lua", `
+				register_outbound_filter(function(text) error("filter bug") end)
+				register_outbound_filter(function(text) return 42 end)
+				ok, err = send_to_channel("1", "general", "hello")
+			`)
+			if mode == "open" {
+				if len(session.sent) != 1 || session.sent[0].Content != "hello" {
+					t.Errorf("failing open: sent %v, want hello unchanged (err %v)", session.sent, scriptGlobal(engine, "err"))
+				}
+			} else if err := scriptGlobal(engine, "err").String(); !strings.Contains(err, "OUTBOUND_FILTER_FAILURE=closed") || len(session.sent) != 0 {
+				t.Errorf("failing closed: err = %q, sent %v", err, session.sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package lua
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// queueTypeName names the metatable of queue userdata in the registry.
+const queueTypeName = "queue"
+
+// scriptQueue is an in-memory FIFO queue returned by get_queue. Queues
+// belong to the script that created them and are emptied when it unloads.
+// Only the dispatcher touches them, so they need no locking.
+type scriptQueue struct {
+	items  []lua.LValue
+	max    int  // 0 means unbounded
+	closed bool // set when the owning script unloads
+}
+
+// registerQueues installs get_queue and the methods of queue userdata:
+//
+//	q:push(value)  → true, or false, error when the queue is full
+//	q:pop()        → the oldest value, or nil when empty
+//	q:peek()       → the oldest value without removing it, or nil
+//	q:len(), #q    → number of queued values
+//	q:clear()      → removes every value
+func (e *Engine) registerQueues() {
+	L := e.state
+	mt := L.NewTypeMetatable(queueTypeName)
+	methods := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"push": func(L *lua.LState) int {
+			q := checkQueue(L)
+			value := L.CheckAny(2)
+			if value == lua.LNil {
+				L.ArgError(2, "cannot push nil")
+			}
+			switch {
+			case q.closed:
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("the queue's script was unloaded"))
+				return 2
+			case q.max > 0 && len(q.items) >= q.max:
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("queue is full"))
+				return 2
+			}
+			q.items = append(q.items, value)
+			L.Push(lua.LTrue)
+			return 1
+		},
+		"pop": func(L *lua.LState) int {
+			q := checkQueue(L)
+			if len(q.items) == 0 {
+				L.Push(lua.LNil)
+				return 1
+			}
+			value := q.items[0]
+			q.items[0] = nil // let the value be collected
+			q.items = q.items[1:]
+			L.Push(value)
+			return 1
+		},
+		"peek": func(L *lua.LState) int {
+			q := checkQueue(L)
+			if len(q.items) == 0 {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(q.items[0])
+			}
+			return 1
+		},
+		"len": queueLen,
+		"clear": func(L *lua.LState) int {
+			checkQueue(L).items = nil
+			return 0
+		},
+	})
+	mt.RawSetString("__index", methods)
+	mt.RawSetString("__len", L.NewFunction(queueLen))
+
+	// get_queue(name[, options]) → the calling script's queue called name,
+	// created on first use, or nil, error
+	// Options (applied when the queue is created): max, the most values it
+	// holds before push fails.
+	L.SetGlobal("get_queue", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		options := L.OptTable(2, nil)
+
+		script := e.currentScript
+		if script == nil || script.unloaded {
+			L.Push(lua.LNil)
+			L.Push(lua.LString("get_queue can only be called by a loaded script"))
+			return 2
+		}
+		ud, ok := script.queues[name]
+		if !ok {
+			q := &scriptQueue{}
+			if options != nil {
+				q.max = max(int(lua.LVAsNumber(options.RawGetString("max"))), 0)
+			}
+			ud = L.NewUserData()
+			ud.Value = q
+			L.SetMetatable(ud, L.GetTypeMetatable(queueTypeName))
+			if script.queues == nil {
+				script.queues = make(map[string]*lua.LUserData)
+			}
+			script.queues[name] = ud
+		}
+		L.Push(ud)
+		return 1
+	}))
+}
+
+// closeScriptQueues empties the queues of an unloading script and refuses
+// further pushes, so values held by stale references can be collected.
+func closeScriptQueues(script *LuaScript) {
+	for _, ud := range script.queues {
+		q := ud.Value.(*scriptQueue)
+		q.items = nil
+		q.closed = true
+	}
+	script.queues = nil
+}
+
+func checkQueue(L *lua.LState) *scriptQueue {
+	ud := L.CheckUserData(1)
+	q, ok := ud.Value.(*scriptQueue)
+	if !ok {
+		L.ArgError(1, "queue expected")
+	}
+	return q
+}
+
+func queueLen(L *lua.LState) int {
+	L.Push(lua.LNumber(len(checkQueue(L).items)))
+	return 1
+}
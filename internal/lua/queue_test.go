@@ -0,0 +1,85 @@
+package lua
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestQueue(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "jobs.lua", `
+		local q = get_queue("jobs")
+		q:push("first")
+		q:push({id = 2})
+		q:push(3)
+		same = get_queue("jobs") == q
+		size, size_op = q:len(), #q
+		peeked = q:peek()
+		first = q:pop()
+		second = q:pop().id
+		third = q:pop()
+		empty = q:pop()
+
+		local small = get_queue("small", {max = 1})
+		small_ok = small:push("a")
+		full_ok, full_err = small:push("b")
+		small:clear()
+		cleared = small:len()
+		nil_ok = pcall(function() small:push(nil) end)
+	`)
+
+	expect := map[string]string{
+		"same":     "true",
+		"size":     "3",
+		"size_op":  "3",
+		"peeked":   "first",
+		"first":    "first",
+		"second":   "2",
+		"third":    "3",
+		"empty":    "nil",
+		"small_ok": "true",
+		"full_ok":  "false",
+		"full_err": "queue is full",
+		"cleared":  "0",
+		"nil_ok":   "false",
+	}
+	for name, want := range expect {
+		if got := scriptGlobal(engine, name).String(); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestQueuesArePerScriptAndClearedOnUnload(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "a.lua", `
+		a_queue = get_queue("work")
+		a_queue:push("from a")
+	`)
+	loadTestScript(t, engine, "b.lua", `b_len = get_queue("work"):len()`)
+	if got := scriptGlobal(engine, "b_len").String(); got != "0" {
+		t.Errorf("Expected b.lua to get its own queue, it holds %s values", got)
+	}
+
+	// Keep hold of a.lua's queue after its globals are gone
+	engine.state.SetGlobal("a_queue", scriptGlobal(engine, "a_queue"))
+	engine.unloadScript("a.lua")
+	if err := engine.state.DoString(`stale_len = #a_queue; stale_ok, stale_err = a_queue:push("late")`); err != nil {
+		t.Fatal(err)
+	}
+	if got := scriptGlobal(engine, "stale_len").String(); got != "0" {
+		t.Errorf("Expected the queue to be emptied on unload, it holds %s values", got)
+	}
+	if scriptGlobal(engine, "stale_ok") != lua.LFalse {
+		t.Error("Expected pushing to a queue of an unloaded script to fail")
+	}
+}
@@ -0,0 +1,107 @@
+package lua
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// cryptoSource is a rand.Source backed by crypto/rand.
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func newSeededRand(seed uint64) *rand.Rand {
+	return rand.New(rand.NewPCG(seed, seed))
+}
+
+// SeedRandom makes the rand table deterministic. Intended for tests; the
+// secure variant is never affected.
+func (e *Engine) SeedRandom(seed uint64) {
+	e.rng = newSeededRand(seed)
+}
+
+// registerRandom installs the rand table:
+//
+//	rand.int(min, max)   → integer in [min, max]
+//	rand.float()         → number in [0, 1)
+//	rand.choice(array)   → random element, or nil for an empty array
+//	rand.shuffle(array)  → shuffles array in place and returns it
+//	rand.seed(n)         → reseed for reproducible results
+//
+// rand.secure offers the same int/float/choice/shuffle backed by crypto/rand.
+func (e *Engine) registerRandom() {
+	if e.rng == nil {
+		e.rng = newSeededRand(uint64(time.Now().UnixNano()))
+	}
+	secure := rand.New(cryptoSource{})
+
+	tbl := e.state.NewTable()
+	e.setRandomFunctions(tbl, func() *rand.Rand { return e.rng })
+	tbl.RawSetString("seed", e.state.NewFunction(func(L *lua.LState) int {
+		e.SeedRandom(uint64(L.CheckInt64(1)))
+		return 0
+	}))
+
+	secureTbl := e.state.NewTable()
+	e.setRandomFunctions(secureTbl, func() *rand.Rand { return secure })
+	tbl.RawSetString("secure", secureTbl)
+
+	e.state.SetGlobal("rand", tbl)
+}
+
+// setRandomFunctions fills tbl with functions drawing from src. src is called
+// on every use so that reseeding takes effect immediately.
+func (e *Engine) setRandomFunctions(tbl *lua.LTable, src func() *rand.Rand) {
+	tbl.RawSetString("int", e.state.NewFunction(func(L *lua.LState) int {
+		lo := L.CheckInt64(1)
+		hi := L.CheckInt64(2)
+		if lo > hi {
+			L.ArgError(2, "max must not be less than min")
+		}
+		// The span of a wide range such as -9e18..9e18 doesn't fit in an
+		// int64, but always does in a uint64
+		span := uint64(hi) - uint64(lo)
+		if span == math.MaxUint64 {
+			L.Push(lua.LNumber(int64(src().Uint64())))
+			return 1
+		}
+		L.Push(lua.LNumber(lo + int64(src().Uint64N(span+1))))
+		return 1
+	}))
+
+	tbl.RawSetString("float", e.state.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(src().Float64()))
+		return 1
+	}))
+
+	tbl.RawSetString("choice", e.state.NewFunction(func(L *lua.LState) int {
+		arr := L.CheckTable(1)
+		n := arr.Len()
+		if n == 0 {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(arr.RawGetInt(src().IntN(n) + 1))
+		return 1
+	}))
+
+	tbl.RawSetString("shuffle", e.state.NewFunction(func(L *lua.LState) int {
+		arr := L.CheckTable(1)
+		src().Shuffle(arr.Len(), func(i, j int) {
+			a, b := arr.RawGetInt(i+1), arr.RawGetInt(j+1)
+			arr.RawSetInt(i+1, b)
+			arr.RawSetInt(j+1, a)
+		})
+		L.Push(arr)
+		return 1
+	}))
+}
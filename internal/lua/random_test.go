@@ -0,0 +1,65 @@
+package lua
+
+import "testing"
+
+func TestRandomSeeded(t *testing.T) {
+	db := setupTestDB(t)
+
+	run := func() string {
+		engine := New(db, nil, nil)
+		t.Cleanup(engine.Close)
+		engine.SeedRandom(42)
+		engine.Initialize()
+		err := engine.state.DoString(`
+			local parts = {}
+			for i = 1, 5 do parts[#parts + 1] = rand.int(1, 6) end
+			parts[#parts + 1] = rand.choice({ "a", "b", "c" })
+			parts[#parts + 1] = table.concat(rand.shuffle({ 1, 2, 3, 4, 5 }), "")
+			result = table.concat(parts, ",")
+		`)
+		if err != nil {
+			t.Fatalf("DoString failed: %v", err)
+		}
+		return scriptGlobal(engine, "result").String()
+	}
+
+	first, second := run(), run()
+	if first != second {
+		t.Errorf("Expected identical sequences for the same seed, got %q and %q", first, second)
+	}
+}
+
+func TestRandomBounds(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		ok = true
+		for _, r in ipairs({ rand, rand.secure }) do
+			for i = 1, 200 do
+				local n = r.int(-2, 2)
+				local f = r.float()
+				if n < -2 or n > 2 or n ~= math.floor(n) or f < 0 or f >= 1 then ok = false end
+			end
+			if r.choice({}) ~= nil then ok = false end
+			if r.int(7, 7) ~= 7 then ok = false end
+			local wide = r.int(-9e18, 9e18)
+			if wide < -9e18 or wide > 9e18 then ok = false end
+			local shuffled = r.shuffle({ 1, 2, 3 })
+			table.sort(shuffled)
+			if table.concat(shuffled) ~= "123" then ok = false end
+		end
+		bad = pcall(rand.int, 5, 1)
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if scriptGlobal(engine, "ok").String() != "true" {
+		t.Error("Expected all random values to be in range")
+	}
+	if scriptGlobal(engine, "bad").String() != "false" {
+		t.Error("Expected rand.int to reject min > max")
+	}
+}
@@ -0,0 +1,329 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// reactionThresholdPrefix marks the kv_store namespaces that remember which
+// messages an on_reaction_threshold callback has already fired for, one
+// namespace per script.
+const reactionThresholdPrefix = "reaction_threshold:"
+
+// reactionThresholdWindow is how long after a message is posted its
+// reactions are checked against on_reaction_threshold. The records of fired
+// callbacks expire after it too, so maintenance prunes them: by then the
+// message is too old to be checked again, and can't fire twice.
+const reactionThresholdWindow = 30 * 24 * time.Hour
+
+// checksReactionThresholds reports whether reactions to messageID are still
+// checked against the thresholds. IDs that aren't snowflakes are.
+func checksReactionThresholds(messageID string, now time.Time) bool {
+	posted, err := discordgo.SnowflakeTimestamp(messageID)
+	return err != nil || now.Sub(posted) < reactionThresholdWindow
+}
+
+// normalizeEmoji converts an emoji as scripts write it into the form Discord
+// reports in reaction events: unicode emoji as is, custom emoji as "name:id".
+// The message syntax "<:name:id>" (or "<a:name:id>" for animated emoji) is
+// accepted too.
+func normalizeEmoji(emoji string) string {
+	emoji = strings.TrimSpace(emoji)
+	if strings.HasPrefix(emoji, "<") && strings.HasSuffix(emoji, ">") {
+		emoji = strings.TrimSuffix(emoji[1:], ">")
+		emoji = strings.TrimPrefix(strings.TrimPrefix(emoji, "a"), ":")
+	}
+	return emoji
+}
+
+// customEmojiPattern matches a normalized custom emoji, "name:id", and
+// shortcodePattern the ":name:" shortcodes Discord clients turn into emoji.
+var (
+	customEmojiPattern = regexp.MustCompile(`^\w{2,32}:\d+$`)
+	shortcodePattern   = regexp.MustCompile(`^:\w+:$`)
+)
+
+// reactionEmoji normalizes an emoji to react with and checks it has a form
+// Discord accepts: a unicode emoji, or a custom one as "name:id",
+// "<:name:id>" or "<a:name:id>". Shortcodes like ":thumbsup:" are refused,
+// since the API doesn't know them.
+func reactionEmoji(emoji string) (string, error) {
+	normalized := normalizeEmoji(emoji)
+	switch {
+	case normalized == "":
+		return "", fmt.Errorf("emoji expected")
+	case shortcodePattern.MatchString(normalized):
+		return "", fmt.Errorf("'%s' is a shortcode, not an emoji; use the emoji character itself", emoji)
+	case strings.Contains(normalized, ":"):
+		if !customEmojiPattern.MatchString(normalized) {
+			return "", fmt.Errorf("invalid custom emoji '%s', use <:name:id>, <a:name:id> or name:id", emoji)
+		}
+	case !strings.ContainsFunc(normalized, func(r rune) bool { return r > unicode.MaxASCII }):
+		return "", fmt.Errorf("'%s' is not an emoji, use the emoji character itself or name:id for custom emoji", emoji)
+	}
+	return normalized, nil
+}
+
+// addReaction reacts to a message as the bot.
+func (e *Engine) addReaction(channelID, messageID, emoji string) error {
+	if !isSnowflake(channelID) || !isSnowflake(messageID) {
+		return fmt.Errorf("invalid channel or message ID '%s/%s'", channelID, messageID)
+	}
+	normalized, err := reactionEmoji(emoji)
+	if err != nil {
+		return err
+	}
+	err = e.session.MessageReactionAdd(channelID, messageID, normalized)
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownEmoji {
+		return fmt.Errorf("unknown emoji '%s'; custom emoji must be from a guild the bot is in", emoji)
+	}
+	return err
+}
+
+// ProcessReaction queues a reaction being added to or removed from a message.
+// If an on_reaction_threshold callback watches the emoji, the message's
+// reactions are counted here, before the event is queued, so the API call
+// doesn't hold up the dispatcher.
+func (e *Engine) ProcessReaction(reaction *discordgo.MessageReaction, added bool) {
+	if e.IsShuttingDown() || reaction == nil {
+		return
+	}
+	event := ReactionEvent{Reaction: *reaction, Added: added}
+	emoji := reaction.Emoji.APIName()
+	if e.hasReactionThreshold(emoji, added) && checksReactionThresholds(reaction.MessageID, time.Now()) {
+		count, err := e.reactionCount(reaction.ChannelID, reaction.MessageID, emoji)
+		if err != nil {
+			log.Printf("on_reaction_threshold: counting %s on message %s: %v", emoji, reaction.MessageID, err)
+		} else {
+			event.Count, event.Counted = count, true
+		}
+	}
+	e.enqueueEvent(event, reaction.UserID)
+}
+
+// ReactionEvent delivers a reaction to the on_reaction_add or
+// on_reaction_remove hooks and checks the reaction thresholds.
+type ReactionEvent struct {
+	Reaction discordgo.MessageReaction
+	Added    bool
+	Count    int  // reactions with the emoji, counted for on_reaction_threshold
+	Counted  bool // Count holds the count; false if it wasn't needed or failed
+}
+
+func (re ReactionEvent) Dispatch(e *Engine) {
+	data := reactionToLua(e.state, &re.Reaction)
+	data.RawSetString("added", lua.LBool(re.Added))
+	hooks := e.hooks[re.Type()]
+	for i, hook := range hooks {
+		e.callLuaFunction(hook, hookData(e.state, data, i, len(hooks)))
+	}
+	if re.Counted {
+		e.checkReactionThresholds(&re.Reaction, re.Count, re.Added)
+	}
+}
+
+func (re ReactionEvent) Type() string {
+	if re.Added {
+		return "on_reaction_add"
+	}
+	return "on_reaction_remove"
+}
+
+// reactionToLua converts a reaction into a {message_id, channel_id, guild_id,
+// user_id, emoji} table.
+func reactionToLua(L *lua.LState, reaction *discordgo.MessageReaction) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("message_id", lua.LString(reaction.MessageID))
+	tbl.RawSetString("channel_id", lua.LString(reaction.ChannelID))
+	tbl.RawSetString("guild_id", lua.LString(reaction.GuildID))
+	tbl.RawSetString("user_id", lua.LString(reaction.UserID))
+	tbl.RawSetString("emoji", lua.LString(reaction.Emoji.APIName()))
+	return tbl
+}
+
+// reactionCount returns how many users reacted to a message with emoji. The
+// state cache doesn't track reactions, so this asks the API.
+func (e *Engine) reactionCount(channelID, messageID, emoji string) (int, error) {
+	msg, err := e.session.ChannelMessage(channelID, messageID)
+	if err != nil {
+		return 0, err
+	}
+	emoji = normalizeEmoji(emoji)
+	for _, reaction := range msg.Reactions {
+		if reaction.Emoji != nil && reaction.Emoji.APIName() == emoji {
+			return reaction.Count, nil
+		}
+	}
+	return 0, nil
+}
+
+// maxReactionPages caps the API calls one sync_reactions makes to list who
+// reacted, across all emojis. Each call blocks the dispatcher until Discord
+// answers, so without a cap a message with many emojis and reactions would
+// hold up every other script; with it a call lists at most 1000 users.
+// reactionPageSize is the most the API returns at once.
+const (
+	maxReactionPages = 10
+	reactionPageSize = 100
+)
+
+// messageReactions is the state of one emoji's reactions on a message.
+type messageReactions struct {
+	Emoji     string
+	Count     int
+	Me        bool     // the bot reacted too
+	Users     []string // IDs of the users who reacted, see maxReactionPages
+	Truncated bool     // more users reacted than were listed
+}
+
+// syncReactions fetches the current reactions of a message and, with
+// withUsers, who reacted with each emoji. Scripts that track reactions call
+// it to catch up on reactions added or removed while the bot was down.
+func (e *Engine) syncReactions(channelID, messageID string, withUsers bool) ([]messageReactions, error) {
+	if !isSnowflake(channelID) || !isSnowflake(messageID) {
+		return nil, fmt.Errorf("invalid channel or message ID '%s/%s'", channelID, messageID)
+	}
+	msg, err := e.session.ChannelMessage(channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []messageReactions
+	pages := maxReactionPages
+	for _, reaction := range msg.Reactions {
+		if reaction.Emoji == nil {
+			continue
+		}
+		state := messageReactions{
+			Emoji: reaction.Emoji.APIName(),
+			Count: reaction.Count,
+			Me:    reaction.Me,
+		}
+		if withUsers {
+			if err := e.fetchReactors(channelID, messageID, &state, &pages); err != nil {
+				return nil, fmt.Errorf("listing %s reactions: %w", state.Emoji, err)
+			}
+		}
+		result = append(result, state)
+	}
+	return result, nil
+}
+
+// fetchReactors pages through the users who reacted with state's emoji,
+// using up to *pages API calls and taking the ones it made off *pages.
+func (e *Engine) fetchReactors(channelID, messageID string, state *messageReactions, pages *int) error {
+	state.Users = []string{}
+	after := ""
+	for len(state.Users) < state.Count && *pages > 0 {
+		*pages--
+		users, err := e.session.MessageReactions(channelID, messageID, state.Emoji, reactionPageSize, "", after)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			state.Users = append(state.Users, user.ID)
+		}
+		if len(users) < reactionPageSize {
+			break
+		}
+		after = users[len(users)-1].ID
+	}
+	state.Truncated = state.Count > len(state.Users)
+	return nil
+}
+
+// messageReactionsToLua converts synced reactions into an array of
+// {emoji, count, me, users, truncated} tables.
+func messageReactionsToLua(L *lua.LState, reactions []messageReactions) *lua.LTable {
+	arr := L.NewTable()
+	for _, r := range reactions {
+		tbl := L.NewTable()
+		tbl.RawSetString("emoji", lua.LString(r.Emoji))
+		tbl.RawSetString("count", lua.LNumber(r.Count))
+		tbl.RawSetString("me", lua.LBool(r.Me))
+		if r.Users != nil {
+			users := L.NewTable()
+			for _, id := range r.Users {
+				users.Append(lua.LString(id))
+			}
+			tbl.RawSetString("users", users)
+			tbl.RawSetString("truncated", lua.LBool(r.Truncated))
+		}
+		arr.Append(tbl)
+	}
+	return arr
+}
+
+// hasReactionThreshold reports whether an on_reaction_threshold callback
+// watches emoji: any callback for added reactions, one with on_drop for
+// removed ones. Safe to call from any goroutine.
+func (e *Engine) hasReactionThreshold(emoji string, added bool) bool {
+	e.hookMutex.Lock()
+	defer e.hookMutex.Unlock()
+	for _, hook := range e.hooks["on_reaction_threshold"] {
+		if hook.Emoji == emoji && (added || hook.OnDrop != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReactionThresholds runs the on_reaction_threshold callbacks for the
+// reaction's emoji whose count has been reached. Each callback fires at most
+// once per message: that is recorded in the store before it runs, so a
+// failing callback or a restart don't fire it again. When a reaction is
+// removed and the count of a message the callback fired for falls below the
+// threshold, the on_drop callback runs, if the script passed one, and the
+// record is deleted, so the message can reach the threshold again. Without
+// on_drop the record is kept. Only additions can reach a threshold, so a
+// message that was already past it isn't picked up when someone removes
+// their reaction.
+func (e *Engine) checkReactionThresholds(reaction *discordgo.MessageReaction, count int, added bool) {
+	emoji := reaction.Emoji.APIName()
+	for _, hook := range e.hooks["on_reaction_threshold"] {
+		if hook.Emoji != emoji || added != (count >= hook.Threshold) {
+			continue
+		}
+		if !added && hook.OnDrop == nil {
+			continue
+		}
+		namespace := reactionThresholdPrefix + hook.Script.Name
+		key := fmt.Sprintf("%s:%d:%s", emoji, hook.Threshold, reaction.MessageID)
+		fired, err := e.StoreGet(namespace, key)
+		if err != nil {
+			log.Printf("on_reaction_threshold: %v", err)
+			continue
+		}
+
+		callback := hook
+		if added {
+			if fired != lua.LNil {
+				continue
+			}
+			err = e.StoreSetWithExpiry(namespace, key, lua.LNumber(time.Now().Unix()), reactionThresholdWindow)
+		} else {
+			if fired == lua.LNil {
+				continue
+			}
+			err = e.StoreDelete(namespace, key)
+			callback.Function, callback.Name = hook.OnDrop, hook.Name+" on_drop"
+		}
+		if err != nil {
+			log.Printf("on_reaction_threshold: %v", err)
+			continue
+		}
+
+		data := reactionToLua(e.state, reaction)
+		data.RawSetString("count", lua.LNumber(count))
+		e.callLuaFunction(callback, data)
+	}
+}
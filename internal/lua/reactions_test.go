@@ -0,0 +1,279 @@
+package lua
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestNormalizeEmoji(t *testing.T) {
+	tests := map[string]string{
+		"⭐":              "⭐",
+		"star:123":       "star:123",
+		"<:star:123>":    "star:123",
+		"<a:party:456>":  "party:456",
+		" <:apple:789> ": "apple:789",
+	}
+	for in, want := range tests {
+		if got := normalizeEmoji(in); got != want {
+			t.Errorf("normalizeEmoji(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReactionThreshold(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{reactions: make(map[string][]*discordgo.MessageReactions)}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "starboard.lua", `
+		starred = {}
+		reactions = 0
+		on_reaction_threshold("⭐", 3, function(event)
+			table.insert(starred, event.message_id .. "=" .. event.count)
+		end)
+		register_hook("on_reaction_add", function(event) reactions = reactions + 1 end)
+	`)
+
+	react := func(messageID, emoji string, count int, added bool) {
+		session.reactions[messageID] = []*discordgo.MessageReactions{
+			{Count: count, Emoji: &discordgo.Emoji{Name: emoji}},
+		}
+		engine.ProcessReaction(&discordgo.MessageReaction{
+			MessageID: messageID,
+			ChannelID: "c1",
+			GuildID:   "g1",
+			UserID:    "u1",
+			Emoji:     discordgo.Emoji{Name: emoji},
+		}, added)
+		drainEvents(engine)
+	}
+
+	react("m1", "⭐", 2, true)
+	react("m1", "👍", 5, true)
+	react("m1", "⭐", 3, true)
+	react("m1", "⭐", 2, false) // dropping below the threshold...
+	react("m1", "⭐", 3, true)  // ...and back doesn't fire again
+	react("m2", "⭐", 4, false) // removals never fire
+	react("m3", "⭐", 4, true)
+
+	result, err := execIn(engine, "starboard.lua", `table.concat(starred, ",")`)
+	if err != nil {
+		t.Fatalf("execIn failed: %v", err)
+	}
+	if got := result; got != "m1=3,m3=4" {
+		t.Errorf("Expected each message to be starred once, got %q", got)
+	}
+	if got := scriptGlobal(engine, "reactions").String(); got != "5" {
+		t.Errorf("Expected on_reaction_add to see 5 additions, got %s", got)
+	}
+
+	// Reloading the script doesn't forget which messages were starred
+	engine.unloadScript("starboard.lua")
+	loadTestScript(t, engine, "starboard.lua", `
+		starred = {}
+		on_reaction_threshold("⭐", 3, function(event) table.insert(starred, event.message_id) end)
+	`)
+	react("m1", "⭐", 4, true)
+	if n := scriptGlobal(engine, "starred").(*lua.LTable).Len(); n != 0 {
+		t.Errorf("Expected m1 to stay starred across reloads, got %d callbacks", n)
+	}
+}
+
+func TestReactionThresholdDrop(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{reactions: make(map[string][]*discordgo.MessageReactions)}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "starboard.lua", `
+		events = {}
+		on_reaction_threshold("⭐", 3, function(event)
+			table.insert(events, "star " .. event.message_id .. "=" .. event.count)
+		end, function(event)
+			table.insert(events, "drop " .. event.message_id .. "=" .. event.count)
+		end)
+	`)
+
+	react := func(messageID string, count int, added bool) {
+		session.reactions[messageID] = []*discordgo.MessageReactions{
+			{Count: count, Emoji: &discordgo.Emoji{Name: "⭐"}},
+		}
+		engine.ProcessReaction(&discordgo.MessageReaction{
+			MessageID: messageID,
+			ChannelID: "c1",
+			UserID:    "u1",
+			Emoji:     discordgo.Emoji{Name: "⭐"},
+		}, added)
+		drainEvents(engine)
+	}
+	// A snowflake of a message posted when, in Discord's epoch
+	snowflake := func(posted time.Time) string {
+		return strconv.FormatInt((posted.UnixMilli()-1420070400000)<<22, 10)
+	}
+
+	recent, old := snowflake(time.Now().Add(-time.Hour)), snowflake(time.Now().Add(-reactionThresholdWindow-time.Hour))
+	react(recent, 3, true)
+	react(recent, 3, false) // still at the threshold
+	react(recent, 2, false)
+	react(recent, 1, false) // already dropped
+	react(recent, 3, true)  // reaching it again fires again
+	react("m2", 2, false)   // never reached
+	react(old, 5, true)     // too old to be checked
+
+	result, err := execIn(engine, "starboard.lua", `table.concat(events, ",")`)
+	if err != nil {
+		t.Fatalf("execIn failed: %v", err)
+	}
+	want := fmt.Sprintf("star %s=3,drop %s=2,star %s=3", recent, recent, recent)
+	if result != want {
+		t.Errorf("Expected events %q, got %q", want, result)
+	}
+
+	var expiresAt sql.NullInt64
+	if err := db.QueryRow(`SELECT expires_at FROM kv_store WHERE namespace = ?`, reactionThresholdPrefix+"starboard.lua").Scan(&expiresAt); err != nil || !expiresAt.Valid {
+		t.Errorf("Expected the threshold record to expire, got %v (%v)", expiresAt, err)
+	}
+}
+
+func TestReactionEmoji(t *testing.T) {
+	valid := map[string]string{
+		"👍":                  "👍",
+		"1️⃣":                "1️⃣",
+		"#⃣":                 "#⃣",
+		"©":                  "©",
+		"party_parrot:12345": "party_parrot:12345",
+		"<:blob:678>":        "blob:678",
+		"<a:dance:910>":      "dance:910",
+		" <:apple:789> ":     "apple:789",
+	}
+	for in, want := range valid {
+		if got, err := reactionEmoji(in); err != nil || got != want {
+			t.Errorf("reactionEmoji(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", ":thumbsup:", "thumbsup", "blob:abc", "<:blob>", "x:1"} {
+		if got, err := reactionEmoji(in); err == nil {
+			t.Errorf("Expected reactionEmoji(%q) to fail, got %q", in, got)
+		}
+	}
+}
+
+func TestAddReaction(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		ok_unicode = add_reaction("1", "2", "⭐")
+		ok_custom = add_reaction("1", "2", "<a:dance:910>")
+		local ok, err = add_reaction("1", "2", ":star:")
+		bad_ok, bad_err = ok, err
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if strings.Join(session.reacted, ",") != "1/2/⭐,1/2/dance:910" {
+		t.Errorf("Expected the reactions in API form, got %v", session.reacted)
+	}
+	if scriptGlobal(engine, "ok_custom") != lua.LTrue || scriptGlobal(engine, "bad_ok") != lua.LFalse {
+		t.Error("Expected add_reaction to return true, or false on a bad emoji")
+	}
+	if err := scriptGlobal(engine, "bad_err").String(); !strings.Contains(err, "shortcode") {
+		t.Errorf("Expected a shortcode to be refused, got %q", err)
+	}
+}
+
+func TestSyncReactions(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{
+		reactions: map[string][]*discordgo.MessageReactions{
+			"2": {
+				{Count: 150, Me: true, Emoji: &discordgo.Emoji{Name: "⭐"}},
+				{Count: 1, Emoji: &discordgo.Emoji{Name: "yes", ID: "910"}},
+			},
+		},
+		reactors: map[string][]*discordgo.User{"2/yes:910": {{ID: "42"}}},
+	}
+	for i := range 150 {
+		user := &discordgo.User{ID: fmt.Sprintf("%03d", i)}
+		session.reactors["2/⭐"] = append(session.reactors["2/⭐"], user)
+	}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		local reactions = sync_reactions("1", "2")
+		stars, custom = reactions[1], reactions[2]
+		star_users, last_star = #stars.users, stars.users[150]
+		counts_only = sync_reactions("1", "2", {users = false})
+		bad, bad_err = sync_reactions("1", "not-an-id")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	stars := scriptGlobal(engine, "stars").(*lua.LTable)
+	if stars.RawGetString("emoji").String() != "⭐" || stars.RawGetString("count").String() != "150" ||
+		stars.RawGetString("me") != lua.LTrue || stars.RawGetString("truncated") != lua.LFalse {
+		t.Errorf("Unexpected ⭐ reactions: emoji=%v count=%v me=%v truncated=%v", stars.RawGetString("emoji"),
+			stars.RawGetString("count"), stars.RawGetString("me"), stars.RawGetString("truncated"))
+	}
+	if got := scriptGlobal(engine, "star_users").String(); got != "150" {
+		t.Errorf("Expected all 150 reactors across pages, got %s", got)
+	}
+	if got := scriptGlobal(engine, "last_star").String(); got != "149" {
+		t.Errorf("Expected the last reactor to be 149, got %s", got)
+	}
+	custom := scriptGlobal(engine, "custom").(*lua.LTable)
+	if custom.RawGetString("emoji").String() != "yes:910" || custom.RawGetString("users").(*lua.LTable).RawGetInt(1).String() != "42" {
+		t.Error("Expected the custom emoji in name:id form with its reactor")
+	}
+	countsOnly := scriptGlobal(engine, "counts_only").(*lua.LTable).RawGetInt(1).(*lua.LTable)
+	if countsOnly.RawGetString("users") != lua.LNil || countsOnly.RawGetString("count").String() != "150" {
+		t.Error("Expected {users = false} to return counts without users")
+	}
+	if scriptGlobal(engine, "bad") != lua.LNil || !strings.Contains(scriptGlobal(engine, "bad_err").String(), "invalid") {
+		t.Error("Expected an invalid message ID to be refused")
+	}
+}
+
+func TestSyncReactionsCapsPagesPerCall(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{
+		reactions: map[string][]*discordgo.MessageReactions{},
+		reactors:  map[string][]*discordgo.User{},
+	}
+	for i := range maxReactionPages + 2 {
+		emoji := fmt.Sprintf("e%d:%d", i, 900+i)
+		session.reactions["2"] = append(session.reactions["2"],
+			&discordgo.MessageReactions{Count: 1, Emoji: &discordgo.Emoji{Name: fmt.Sprintf("e%d", i), ID: fmt.Sprint(900 + i)}})
+		session.reactors["2/"+emoji] = []*discordgo.User{{ID: "42"}}
+	}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	reactions, err := engine.syncReactions("1", "2", true)
+	if err != nil {
+		t.Fatalf("syncReactions failed: %v", err)
+	}
+	for i, r := range reactions {
+		listed := i < maxReactionPages
+		if (len(r.Users) == 1) != listed || r.Truncated == listed {
+			t.Errorf("%s: expected listed=%v, got users=%v truncated=%v", r.Emoji, listed, r.Users, r.Truncated)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// A Go panic in a host function, say a failed type assertion on odd Lua input
+// or a panicking database driver, must not take the bot down. Host functions
+// are wrapped so the panic becomes an ordinary Lua error the script can
+// pcall, and the dispatcher recovers from panics in the Go side of events.
+// Loading a script is guarded the same way, with a deadline on its top-level
+// code, so one bad script is skipped rather than stalling startup.
+
+// protectHostFunctions wraps the Go functions the engine added to the Lua
+// state, including those in tables such as rand, so a panic in one of them
+// is raised as a Lua error naming the function. The standard library is left
+// alone. Called once by Initialize, after everything is registered.
+func (e *Engine) protectHostFunctions() {
+	std := lua.NewState()
+	defer std.Close()
+	builtin := make(map[string]bool)
+	std.G.Global.ForEach(func(k, _ lua.LValue) {
+		builtin[k.String()] = true
+	})
+
+	seen := make(map[*lua.LTable]bool)
+	e.state.G.Global.ForEach(func(k, v lua.LValue) {
+		if !builtin[k.String()] {
+			protectValue(k.String(), v, seen)
+		}
+	})
+	if mt, ok := e.state.GetTypeMetatable(queueTypeName).(*lua.LTable); ok {
+		protectValue("queue", mt, seen)
+	}
+}
+
+// protectValue wraps fn if it is a Go function, or the Go functions in it if
+// it is a table.
+func protectValue(name string, v lua.LValue, seen map[*lua.LTable]bool) {
+	switch v := v.(type) {
+	case *lua.LFunction:
+		if v.IsG {
+			v.GFunction = protectHost(name, v.GFunction)
+		}
+	case *lua.LTable:
+		if seen[v] {
+			return
+		}
+		seen[v] = true
+		v.ForEach(func(k, field lua.LValue) {
+			protectValue(name+"."+k.String(), field, seen)
+		})
+	}
+}
+
+// protectHost returns fn with Go panics turned into Lua errors. Lua errors
+// raised by fn, or by Lua code it calls, are panics too and pass through
+// untouched.
+func protectHost(name string, fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if _, ok := r.(*lua.ApiError); ok {
+				panic(r)
+			}
+			log.Printf("PANIC in host function %s: %v\n%s", name, r, stack())
+			L.RaiseError("%s: internal error: %v", name, r)
+		}()
+		return fn(L)
+	}
+}
+
+// dispatch runs one event. A panic is logged and the event dropped, so the
+// dispatcher carries on with the next one.
+func (e *Engine) dispatch(event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			var trace string
+			if te, ok := event.(tracedEvent); ok {
+				trace = te.trace
+			}
+			log.Printf("PANIC dispatching %s event: %s%v\n%s", event.Type(), traceLogPrefix(trace), r, stack())
+			e.currentScript = nil
+		}
+	}()
+	event.Dispatch(e)
+}
+
+// protectLoad guards the load of a script for loadScript: the script's
+// top-level code is aborted once it runs past SCRIPT_LOAD_TIMEOUT, and a
+// panic fails the load rather than the caller, e.g. startup. It returns the
+// function loadScript defers, which sets *err in either case.
+func (e *Engine) protectLoad(name string, err *error) func() {
+	// The load may run inside a command with its own deadline, e.g.
+	// add_script_dir; that deadline still applies and is restored after
+	parent := e.state.Context()
+	timeout := e.cfg.ScriptLoadTimeout
+	var ctx context.Context
+	cancel := func() {}
+	if timeout > 0 {
+		base := parent
+		if base == nil {
+			base = context.Background()
+		}
+		ctx, cancel = context.WithTimeout(base, timeout)
+		e.state.SetContext(ctx)
+	}
+
+	return func() {
+		if r := recover(); r != nil {
+			log.Printf("PANIC loading %s: %v\n%s", name, r, stack())
+			*err = fmt.Errorf("panic while loading: %v", r)
+		}
+		if ctx == nil {
+			return
+		}
+		if *err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && (parent == nil || parent.Err() == nil) {
+			*err = fmt.Errorf("top-level code did not finish within %s (SCRIPT_LOAD_TIMEOUT)", timeout)
+		}
+		cancel()
+		if parent != nil {
+			e.state.SetContext(parent)
+		} else {
+			e.state.RemoveContext()
+		}
+	}
+}
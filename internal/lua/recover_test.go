@@ -0,0 +1,176 @@
+package lua
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestHostFunctionPanicBecomesLuaError(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	// Registered before Initialize, like the engine's own host functions
+	engine.state.SetGlobal("explode", engine.state.NewFunction(func(L *lua.LState) int {
+		var m map[string]int
+		m["boom"] = 1 // panics: assignment to entry in nil map
+		return 0
+	}))
+	engine.Initialize()
+
+	script := loadTestScript(t, engine, "panics.lua", `
+		ok, err = pcall(explode)
+		nested_ok = pcall(function() return rand.int(1, 2) end)
+		lua_ok, lua_err = pcall(error, "plain", 0)
+		function handler() explode() end
+	`)
+	if ok := scriptGlobal(engine, "ok"); ok != lua.LFalse {
+		t.Errorf("pcall(explode) = %v, want false", ok)
+	}
+	if err := scriptGlobal(engine, "err").String(); !strings.Contains(err, "explode: internal error") {
+		t.Errorf("err = %q, want it to name the function", err)
+	}
+	if scriptGlobal(engine, "nested_ok") != lua.LTrue {
+		t.Error("wrapped functions in tables should still work")
+	}
+	if err := scriptGlobal(engine, "lua_err").String(); err != "plain" {
+		t.Errorf("Lua errors should pass through untouched, got %q", err)
+	}
+
+	// An unprotected call from a hook is logged, not fatal
+	handler := scriptGlobal(engine, "handler").(*lua.LFunction)
+	engine.callLuaFunction(HookInfo{Function: handler, Script: script, Name: "handler"}, lua.LNil)
+}
+
+type panicEvent struct{}
+
+func (panicEvent) Dispatch(e *Engine) { panic("event exploded") }
+func (panicEvent) Type() string       { return "panic" }
+
+func TestDispatcherSurvivesPanickingEvent(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+
+	engine.enqueueEvent(panicEvent{}, "test")
+	out, err := engine.Exec("1 + 1")
+	if err != nil {
+		t.Fatalf("Exec after a panicking event failed: %v", err)
+	}
+	if out != "2" {
+		t.Errorf("Exec = %q, want 2", out)
+	}
+}
+
+type exitEvent struct{}
+
+func (exitEvent) Dispatch(e *Engine) { runtime.Goexit() }
+func (exitEvent) Type() string       { return "exit" }
+
+func TestDispatcherIsRestarted(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+
+	for i := 0; i < maxDispatcherRestarts; i++ {
+		engine.enqueueEvent(exitEvent{}, "test")
+		if out, err := engine.Exec("1 + 1"); err != nil || out != "2" {
+			t.Fatalf("Exec after the dispatcher exited %d time(s) = %q, %v", i+1, out, err)
+		}
+	}
+	select {
+	case err := <-engine.Failed():
+		t.Fatalf("engine failed after %d restarts: %v", maxDispatcherRestarts, err)
+	default:
+	}
+
+	engine.enqueueEvent(exitEvent{}, "test")
+	select {
+	case err := <-engine.Failed():
+		if !strings.Contains(err.Error(), "no longer handled") {
+			t.Errorf("err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a dispatcher that keeps exiting should fail the engine")
+	}
+}
+
+type blockingEvent chan struct{}
+
+func (b blockingEvent) Dispatch(e *Engine) { <-b }
+func (blockingEvent) Type() string         { return "blocking" }
+
+func TestStuckDispatcherFailsEngine(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.DispatcherStallTimeout = 50 * time.Millisecond
+	engine.Initialize()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+
+	release := make(blockingEvent)
+	defer close(release)
+	engine.enqueueEvent(release, "test")
+
+	select {
+	case err := <-engine.Failed():
+		if !strings.Contains(err.Error(), "stuck on a blocking event") {
+			t.Errorf("err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a stuck dispatcher was not reported")
+	}
+}
+
+func TestLoadScriptsSkipsHangingScript(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.cfg.ScriptLoadTimeout = 50 * time.Millisecond
+	engine.Initialize()
+
+	dir := writeScripts(t, map[string]string{
+		"hang.lua": `
+			register_command("hang", "Never registered", function() end)
+			register_hook("on_channel_message", function() end)
+			while true do end
+		`,
+		"fine.lua": `fine = true`,
+	})
+	result := engine.LoadScripts(dir)
+	if result.Loaded != 1 || len(result.Failed) != 1 || result.Failed[0].Name != "hang.lua" {
+		t.Fatalf("LoadScripts = %+v, want fine.lua loaded and hang.lua failed", result)
+	}
+	if err := result.Failed[0].Err.Error(); !strings.Contains(err, "SCRIPT_LOAD_TIMEOUT") {
+		t.Errorf("error = %q, want it to mention the load timeout", err)
+	}
+	if _, ok := engine.commands["hang"]; ok {
+		t.Error("the command registered by the failed script should be removed")
+	}
+	if hooks := engine.hooks["on_channel_message"]; len(hooks) != 0 {
+		t.Errorf("the failed script left %d hooks behind", len(hooks))
+	}
+	if engine.state.Context() != nil {
+		t.Error("the load deadline should be cleared after loading")
+	}
+	if scriptGlobal(engine, "fine") != lua.LTrue {
+		t.Error("fine.lua should have loaded")
+	}
+}
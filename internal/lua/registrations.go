@@ -0,0 +1,72 @@
+package lua
+
+import (
+	"sort"
+	"strings"
+)
+
+// registration is one command, command pattern or hook found by
+// whoRegistered.
+type registration struct {
+	Kind      string // "command", "pattern" or "hook"
+	Name      string // the qualified name for commands, the pattern for patterns
+	Script    string
+	Active    bool   // for commands and patterns: this one handles the name
+	Namespace string // kv namespace of an on_store_change hook
+}
+
+// whoRegistered lists what handles name: a command, with or without the
+// command prefix or qualified, or a hook such as "on_tick". Every command registered under
+// the plain name is listed, the one that handles it first, followed by the
+// patterns matching the name and the hooks, in the order they were
+// registered. Must be called on the dispatcher goroutine.
+func (e *Engine) whoRegistered(name string) []registration {
+	var found []registration
+
+	commandName := strings.TrimPrefix(name, e.cfg.CommandPrefix)
+	e.cmdMutex.Lock()
+	handler, _ := e.findCommand(commandName)
+	var commands []*Command
+	for _, cmd := range e.qualifiedCommands {
+		if cmd.Name == commandName || cmd.QualifiedName() == commandName {
+			commands = append(commands, cmd)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if (commands[i] == handler) != (commands[j] == handler) {
+			return commands[i] == handler
+		}
+		return commands[i].seq < commands[j].seq
+	})
+	for _, cmd := range commands {
+		found = append(found, registration{Kind: "command", Name: cmd.QualifiedName(), Script: cmd.Callback.Script.Name, Active: cmd == handler})
+	}
+	for _, cmd := range e.commandPatterns {
+		if cmd.Pattern.MatchString(commandName) {
+			found = append(found, registration{Kind: "pattern", Name: cmd.Name, Script: cmd.Callback.Script.Name, Active: cmd == handler})
+		}
+	}
+	e.cmdMutex.Unlock()
+
+	e.hookMutex.Lock()
+	for _, hook := range e.hooks[name] {
+		found = append(found, registration{Kind: "hook", Name: name, Script: hook.Script.Name, Namespace: hook.Namespace})
+	}
+	e.hookMutex.Unlock()
+
+	// on_load and on_unload hooks are kept with their script, so list them
+	// by script name
+	if name == "on_load" || name == "on_unload" {
+		for _, script := range e.scripts {
+			fn := script.OnUnload
+			if name == "on_load" {
+				fn = script.OnLoad
+			}
+			if fn != nil {
+				found = append(found, registration{Kind: "hook", Name: name, Script: script.Name})
+			}
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].Script < found[j].Script })
+	}
+	return found
+}
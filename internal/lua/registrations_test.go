@@ -0,0 +1,68 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestWhoRegistered(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "pack_a.lua", `
+		register_command("ping", "Ping", function() end)
+		register_hook("on_tick", function() end)
+	`)
+	loadTestScript(t, engine, "pack_b.lua", `
+		register_command("ping", "Ping too", function() end)
+		register_command_pattern("^pi", "Everything pi", function() end)
+		register_hook("on_store_change", function() end, { namespace = "scores" })
+		register_hook("on_tick", function() end)
+	`)
+
+	describe := func(global string) string {
+		var lines []string
+		tbl := scriptGlobal(engine, global).(*lua.LTable)
+		tbl.ForEach(func(_, v lua.LValue) {
+			r := v.(*lua.LTable)
+			line := r.RawGetString("kind").String() + " " + r.RawGetString("name").String() + " " + r.RawGetString("script").String()
+			if r.RawGetString("active") == lua.LTrue {
+				line += " active"
+			}
+			if ns := r.RawGetString("namespace"); ns != lua.LNil {
+				line += " " + ns.String()
+			}
+			lines = append(lines, line)
+		})
+		return strings.Join(lines, "\n")
+	}
+
+	if err := engine.state.DoString(`
+		ping = who_registered("!ping")
+		pie = who_registered("pie")
+		qualified = who_registered("pack_b:ping")
+		tick = who_registered("on_tick")
+		store = who_registered("on_store_change")
+		nothing = who_registered("nope")
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	tests := []struct{ global, want string }{
+		{"ping", "command pack_a:ping pack_a.lua active\ncommand pack_b:ping pack_b.lua\npattern ^pi pack_b.lua"},
+		{"pie", "pattern ^pi pack_b.lua active"},
+		{"qualified", "command pack_b:ping pack_b.lua active"},
+		{"tick", "hook on_tick pack_a.lua\nhook on_tick pack_b.lua"},
+		{"store", "hook on_store_change pack_b.lua scores"},
+		{"nothing", ""},
+	}
+	for _, tt := range tests {
+		if got := describe(tt.global); got != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.global, got, tt.want)
+		}
+	}
+}
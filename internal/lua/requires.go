@@ -0,0 +1,65 @@
+package lua
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// requireScript makes sure the named script is loaded before the script that
+// is loading now carries on. Dependencies are looked up next to the requiring
+// script and loaded on the spot, so LoadScripts ends up loading them in
+// dependency order whatever the file names. Must be called while a script
+// loads.
+func (e *Engine) requireScript(name string) error {
+	requirer := e.currentScript
+	if !strings.HasSuffix(name, ".lua") {
+		name += ".lua"
+	}
+	if name != filepath.Base(name) {
+		return fmt.Errorf("requires takes a script name, not a path: '%s'", name)
+	}
+	requirer.Requires = append(requirer.Requires, name)
+	if len(requirer.Requires) == 1 {
+		e.shareRequiredGlobals(requirer)
+	}
+
+	if _, loaded := e.scripts[name]; loaded {
+		return nil
+	}
+	for i, loading := range e.loading {
+		if loading == name {
+			cycle := append(append([]string(nil), e.loading[i:]...), name)
+			return fmt.Errorf("circular dependency: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	path := filepath.Join(filepath.Dir(requirer.Path), name)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("missing dependency '%s' required by '%s'", name, requirer.Name)
+	}
+	if err := e.loadScript(path); err != nil {
+		return fmt.Errorf("dependency '%s' of '%s' failed to load: %w", name, requirer.Name, err)
+	}
+	return nil
+}
+
+// registerRequires adds requires(script_name) to the Lua state.
+func (e *Engine) registerRequires() {
+	e.state.SetGlobal("requires", e.state.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		if e.currentScript == nil || len(e.loading) == 0 {
+			L.RaiseError("requires can only be used at the top level of a script")
+			return 0
+		}
+		if err := e.requireScript(name); err != nil {
+			L.RaiseError("%s", err.Error())
+			return 0
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+}
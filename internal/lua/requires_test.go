@@ -0,0 +1,64 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequiresLoadsDependenciesFirst(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	dir := t.TempDir()
+	scripts := map[string]string{
+		// a.lua sorts first but needs the library at load time
+		"a.lua":    `requires("zlib") greeting = zlib_greet("a")`,
+		"zlib.lua": `function zlib_greet(name) return "hello " .. name end`,
+		"b.lua":    `requires("missing.lua") b_loaded = true`,
+		"c.lua":    `requires("d.lua")`,
+		"d.lua":    `requires("c.lua")`,
+	}
+	for name, code := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(code), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	result := engine.LoadScripts(dir)
+
+	if result.Loaded != 2 || result.Queued != 0 {
+		t.Errorf("Expected 2 scripts loaded and none queued, got %+v", result)
+	}
+	var failed []string
+	for _, f := range result.Failed {
+		failed = append(failed, f.Name)
+	}
+	if strings.Join(failed, ",") != "b.lua,c.lua,d.lua" {
+		t.Errorf("Expected b.lua, c.lua and d.lua to be reported as failed, got %v", failed)
+	}
+	if got := scriptGlobal(engine, "greeting").String(); got != "hello a" {
+		t.Errorf("Expected the dependency to be loaded first, got greeting %q", got)
+	}
+	if requires := engine.scripts["a.lua"].Requires; len(requires) != 1 || requires[0] != "zlib.lua" {
+		t.Errorf("Expected a.lua to record its dependency, got %v", requires)
+	}
+	if _, ok := engine.scripts["zlib.lua"]; !ok {
+		t.Error("Expected zlib.lua to be loaded once as a dependency")
+	}
+	for _, name := range []string{"b.lua", "c.lua", "d.lua"} {
+		if _, ok := engine.scripts[name]; ok {
+			t.Errorf("Expected %s to fail to load", name)
+		}
+	}
+	if len(engine.loading) != 0 {
+		t.Errorf("Expected the loading stack to be empty, got %v", engine.loading)
+	}
+
+	if err := engine.state.DoString(`requires("zlib")`); err == nil {
+		t.Error("Expected requires outside a script load to fail")
+	}
+}
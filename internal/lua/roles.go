@@ -0,0 +1,64 @@
+package lua
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// guildRoles returns the roles of a guild, highest position first. The state
+// cache is used when it has the guild (it is kept current by gateway events),
+// otherwise the roles are fetched from the API.
+func (e *Engine) guildRoles(guildID string) ([]*discordgo.Role, error) {
+	var roles []*discordgo.Role
+	if state := e.messageState(); state != nil {
+		if guild, err := state.Guild(guildID); err == nil {
+			state.RLock()
+			roles = append(roles, guild.Roles...)
+			state.RUnlock()
+		}
+	}
+	if roles == nil {
+		var err error
+		if roles, err = e.session.GuildRoles(guildID); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(roles, func(i, j int) bool {
+		return roles[i].Position > roles[j].Position
+	})
+	return roles, nil
+}
+
+// findRole looks a role up by ID or by case-insensitive name.
+func (e *Engine) findRole(guildID, nameOrID string) (*discordgo.Role, error) {
+	roles, err := e.guildRoles(guildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if role.ID == nameOrID || strings.EqualFold(role.Name, nameOrID) {
+			return role, nil
+		}
+	}
+	return nil, fmt.Errorf("no role named '%s' in guild %s", nameOrID, guildID)
+}
+
+// roleToLua converts a role into a {id, name, color, position, permissions,
+// mentionable, managed} table. Permissions is the decimal bit set as a string
+// since it doesn't fit in a Lua number.
+func roleToLua(L *lua.LState, role *discordgo.Role) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LString(role.ID))
+	tbl.RawSetString("name", lua.LString(role.Name))
+	tbl.RawSetString("color", lua.LNumber(role.Color))
+	tbl.RawSetString("position", lua.LNumber(role.Position))
+	tbl.RawSetString("permissions", lua.LString(fmt.Sprintf("%d", role.Permissions)))
+	tbl.RawSetString("mentionable", lua.LBool(role.Mentionable))
+	tbl.RawSetString("managed", lua.LBool(role.Managed))
+	return tbl
+}
@@ -0,0 +1,50 @@
+package lua
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRoleLookup(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{roles: []*discordgo.Role{
+		{ID: "1", Name: "@everyone", Position: 0},
+		{ID: "2", Name: "Moderator", Position: 5, Color: 0xff0000, Permissions: discordgo.PermissionKickMembers},
+		{ID: "3", Name: "Member", Position: 1},
+	}}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		local roles = get_roles("g1")
+		first = roles[1].name
+		count = #roles
+
+		local mod = find_role("g1", "moderator")
+		mod_id = mod.id
+		mod_color = mod.color
+		mod_perms = mod.permissions
+		by_id = find_role("g1", "3").name
+
+		missing, missing_err = find_role("g1", "Admin")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	get := func(name string) string { return scriptGlobal(engine, name).String() }
+	if get("first") != "Moderator" || get("count") != "3" {
+		t.Errorf("Expected 3 roles sorted by position, got first %s of %s", get("first"), get("count"))
+	}
+	if get("mod_id") != "2" || get("mod_color") != "16711680" || get("mod_perms") != "2" {
+		t.Errorf("Unexpected moderator role: id %s color %s permissions %s", get("mod_id"), get("mod_color"), get("mod_perms"))
+	}
+	if get("by_id") != "Member" {
+		t.Errorf("Expected lookup by ID to work, got %s", get("by_id"))
+	}
+	if get("missing") != "nil" || get("missing_err") == "nil" {
+		t.Error("Expected nil and an error for an unknown role")
+	}
+}
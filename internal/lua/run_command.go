@@ -0,0 +1,102 @@
+package lua
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxCommandDepth bounds chains of commands started with run_command, e.g. a
+// macro that runs itself.
+const maxCommandDepth = 5
+
+// runCommand queues the command name as if it had been typed with args by
+// the user whose command is running. origin may set channel_id, guild_id and
+// author. The command's cooldown and required role apply, and declared
+// arguments are validated as for typed commands. Only a command run by an
+// owner may set author_id to run it as someone else or bypass_checks to skip
+// the cooldown and role check; otherwise any script could act as an owner.
+func (e *Engine) runCommand(name string, args []string, origin *lua.LTable) error {
+	depth := e.commandDepth + 1
+	if depth > maxCommandDepth {
+		return fmt.Errorf("commands nested more than %d deep", maxCommandDepth)
+	}
+
+	e.cmdMutex.Lock()
+	cmd, name := e.findCommand(name)
+	e.cmdMutex.Unlock()
+	if cmd == nil {
+		return fmt.Errorf("unknown command '%s'", name)
+	}
+
+	channelID := lua.LVAsString(origin.RawGetString("channel_id"))
+	guildID := lua.LVAsString(origin.RawGetString("guild_id"))
+	author := lua.LVAsString(origin.RawGetString("author"))
+	authorID := e.currentCaller
+	bypass := lua.LVAsBool(origin.RawGetString("bypass_checks"))
+	if id := lua.LVAsString(origin.RawGetString("author_id")); id != "" && id != authorID {
+		if err := e.requireOwner("run_command with author_id"); err != nil {
+			return err
+		}
+		authorID = id
+	}
+	if bypass {
+		if err := e.requireOwner("run_command with bypass_checks"); err != nil {
+			return err
+		}
+	}
+
+	if !bypass {
+		if cmd.cooldownRemaining(authorID) > 0 {
+			return fmt.Errorf("command '%s' is on cooldown", name)
+		}
+		if cmd.RequiredRole != "" && e.users != nil {
+			if ok, err := e.users.HasRole(authorID, cmd.RequiredRole); err != nil || !ok {
+				return fmt.Errorf("permission denied for command '%s'", name)
+			}
+		}
+	}
+
+	var params *lua.LTable
+	if cmd.Args != nil {
+		var err error
+		if params, err = parseArgs(e.state, cmd.Args, args); err != nil {
+			return fmt.Errorf("invalid arguments: %v. Usage: %s", err, commandUsage(e.cfg.CommandPrefix, name, cmd.Args))
+		}
+	}
+
+	if !bypass {
+		cmd.markUsed(authorID)
+	}
+
+	argsTable := e.state.NewTable()
+	argsTable.Append(lua.LString(name))
+	for _, arg := range args {
+		argsTable.Append(lua.LString(arg))
+	}
+	data := e.state.NewTable()
+	data.RawSetString("args", argsTable)
+	data.RawSetString("command", lua.LString(name))
+	data.RawSetString("channel_id", lua.LString(channelID))
+	data.RawSetString("guild_id", lua.LString(guildID))
+	data.RawSetString("author", lua.LString(author))
+	data.RawSetString("author_id", lua.LString(authorID))
+	data.RawSetString("attachments", e.state.NewTable())
+	data.RawSetString("programmatic", lua.LTrue)
+	if params != nil {
+		data.RawSetString("params", params)
+	}
+	if cmd.History > 0 {
+		recent := recentMessages(e.messageState(), channelID, "", cmd.History)
+		data.RawSetString("recent", messagesToLua(e.state, recent))
+	}
+
+	return e.tryEnqueueFollowUp(CommandEvent{
+		CommandName: name,
+		CommandData: data,
+		Callback:    cmd.Callback,
+		AuthorID:    authorID,
+		GuildID:     guildID,
+		Depth:       depth,
+	})
+}
@@ -0,0 +1,140 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/leihog/discord-bot/internal/users"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestRunCommand(t *testing.T) {
+	db := setupTestDB(t)
+	store := users.New(db)
+	engine := New(db, &fakeSession{}, store)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	// bypass_checks is only honoured for owners
+	if err := store.EnsureUser("u1", "alice"); err != nil {
+		t.Fatalf("EnsureUser failed: %v", err)
+	}
+	if err := store.AddRole("u1", "owner"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+
+	loadTestScript(t, engine, "greeter.lua", `
+		greeted = {}
+		register_command("greet", "Greets someone", function(event)
+			table.insert(greeted, event.params.name .. "@" .. event.channel_id .. " by " .. event.author_id)
+		end, { cooldown = 60, args = { { name = "name" } } })
+	`)
+	loadTestScript(t, engine, "macro.lua", `
+		errors = {}
+		register_command("macro", "Greets twice", function(event)
+			run_command("greet", { "alice" }, { channel_id = event.channel_id })
+			local ok, err = run_command("greet", { "bob" }, { channel_id = event.channel_id })
+			table.insert(errors, err)
+			run_command("greet", { "carol" }, { channel_id = event.channel_id, bypass_checks = true })
+			ok, err = run_command("greet", {}, { bypass_checks = true })
+			table.insert(errors, err)
+			ok, err = run_command("nope")
+			table.insert(errors, err)
+		end)
+		loops = 0
+		register_command("loop", "Runs itself", function(event)
+			loops = loops + 1
+			local ok, err = run_command("loop")
+			if not ok then loop_error = err end
+		end)
+	`)
+
+	send := func(content string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		drainEvents(engine)
+	}
+
+	send("!macro")
+	greeted := scriptGlobal(engine, "greeted").(*lua.LTable)
+	var got []string
+	for i := 1; i <= greeted.Len(); i++ {
+		got = append(got, greeted.RawGetInt(i).String())
+	}
+	if want := "alice@c1 by u1,carol@c1 by u1"; strings.Join(got, ",") != want {
+		t.Errorf("Expected greetings %q, got %q", want, strings.Join(got, ","))
+	}
+
+	errors := scriptGlobal(engine, "errors").(*lua.LTable)
+	for i, want := range []string{"on cooldown", "missing name", "unknown command"} {
+		if err := errors.RawGetInt(i + 1).String(); !strings.Contains(err, want) {
+			t.Errorf("Expected error %d to mention %q, got %q", i+1, want, err)
+		}
+	}
+
+	send("!loop")
+	if loops := scriptGlobal(engine, "loops"); loops != lua.LNumber(maxCommandDepth+1) {
+		t.Errorf("Expected the typed command and %d nested runs, got %v", maxCommandDepth, loops)
+	}
+	if err := scriptGlobal(engine, "loop_error").String(); !strings.Contains(err, "nested more than") {
+		t.Errorf("Expected a depth error, got %q", err)
+	}
+}
+
+func TestRunCommandCantImpersonate(t *testing.T) {
+	db := setupTestDB(t)
+	store := users.New(db)
+	engine := New(db, &fakeSession{}, store)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	for _, id := range []string{"owner1", "user1"} {
+		if err := store.EnsureUser(id, id); err != nil {
+			t.Fatalf("EnsureUser failed: %v", err)
+		}
+	}
+	if err := store.AddRole("owner1", "owner"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+
+	loadTestScript(t, engine, "sneak.lua", `
+		ran_as = {}
+		register_command("secret", "Owners only", function(event)
+			table.insert(ran_as, event.author_id)
+		end, 0, "owner")
+		results = {}
+		register_command("sneak", "Runs secret", function(event)
+			local _, as_err = run_command("secret", {}, { author_id = "owner1" })
+			local _, bypass_err = run_command("secret", {}, { bypass_checks = true })
+			results[event.author_id] = { as_err = as_err, bypass_err = bypass_err }
+		end)
+	`)
+	for _, id := range []string{"user1", "owner1"} {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   "!sneak",
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: id, Username: id},
+		}})
+	}
+	drainEvents(engine)
+
+	results := scriptGlobal(engine, "results").(*lua.LTable)
+	user := results.RawGetString("user1").(*lua.LTable)
+	for _, field := range []string{"as_err", "bypass_err"} {
+		if err := user.RawGetString(field).String(); !strings.Contains(err, "requires a command run by an owner") {
+			t.Errorf("Expected a non-owner's %s to be refused, got %q", field, err)
+		}
+	}
+	owner := results.RawGetString("owner1").(*lua.LTable)
+	if owner.RawGetString("as_err") != lua.LNil || owner.RawGetString("bypass_err") != lua.LNil {
+		t.Errorf("Expected an owner to use both options, got %v and %v", owner.RawGetString("as_err"), owner.RawGetString("bypass_err"))
+	}
+	ran := scriptGlobal(engine, "ran_as").(*lua.LTable)
+	if ran.Len() != 2 || ran.RawGetInt(1).String() != "owner1" || ran.RawGetInt(2).String() != "owner1" {
+		t.Errorf("Expected secret to run twice, only for the owner, got %d runs", ran.Len())
+	}
+}
@@ -0,0 +1,107 @@
+package lua
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scheduledEventTypes maps the type option of create_scheduled_event to
+// Discord's entity types.
+var scheduledEventTypes = map[string]discordgo.GuildScheduledEventEntityType{
+	"external": discordgo.GuildScheduledEventEntityTypeExternal,
+	"voice":    discordgo.GuildScheduledEventEntityTypeVoice,
+	"stage":    discordgo.GuildScheduledEventEntityTypeStageInstance,
+}
+
+// scheduledEventStatuses names Discord's event statuses for scripts.
+var scheduledEventStatuses = map[discordgo.GuildScheduledEventStatus]string{
+	discordgo.GuildScheduledEventStatusScheduled: "scheduled",
+	discordgo.GuildScheduledEventStatusActive:    "active",
+	discordgo.GuildScheduledEventStatusCompleted: "completed",
+	discordgo.GuildScheduledEventStatusCanceled:  "canceled",
+}
+
+// parseScheduledEvent converts the options of create_scheduled_event into
+// their discordgo form. Times are unix seconds. The type defaults to "voice"
+// when a channel_id is given and to "external" otherwise; external events need
+// a location and an end_time.
+func parseScheduledEvent(tbl *lua.LTable) (*discordgo.GuildScheduledEventParams, error) {
+	params := &discordgo.GuildScheduledEventParams{
+		Name:         lua.LVAsString(tbl.RawGetString("name")),
+		Description:  lua.LVAsString(tbl.RawGetString("description")),
+		ChannelID:    lua.LVAsString(tbl.RawGetString("channel_id")),
+		PrivacyLevel: discordgo.GuildScheduledEventPrivacyLevelGuildOnly,
+	}
+	if params.Name == "" {
+		return nil, fmt.Errorf("scheduled event needs a name")
+	}
+
+	start, ok := tbl.RawGetString("start_time").(lua.LNumber)
+	if !ok {
+		return nil, fmt.Errorf("scheduled event needs a start_time (unix seconds)")
+	}
+	startTime := time.Unix(int64(start), 0).UTC()
+	params.ScheduledStartTime = &startTime
+	if end, ok := tbl.RawGetString("end_time").(lua.LNumber); ok {
+		endTime := time.Unix(int64(end), 0).UTC()
+		if !endTime.After(startTime) {
+			return nil, fmt.Errorf("end_time must be after start_time")
+		}
+		params.ScheduledEndTime = &endTime
+	}
+
+	kind := lua.LVAsString(tbl.RawGetString("type"))
+	if kind == "" {
+		kind = "external"
+		if params.ChannelID != "" {
+			kind = "voice"
+		}
+	}
+	entityType, ok := scheduledEventTypes[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduled event type '%s'", kind)
+	}
+	params.EntityType = entityType
+
+	if entityType == discordgo.GuildScheduledEventEntityTypeExternal {
+		location := lua.LVAsString(tbl.RawGetString("location"))
+		if location == "" {
+			return nil, fmt.Errorf("external events need a location")
+		}
+		if params.ScheduledEndTime == nil {
+			return nil, fmt.Errorf("external events need an end_time")
+		}
+		params.ChannelID = ""
+		params.EntityMetadata = &discordgo.GuildScheduledEventEntityMetadata{Location: location}
+	} else if params.ChannelID == "" {
+		return nil, fmt.Errorf("%s events need a channel_id", kind)
+	}
+	return params, nil
+}
+
+// scheduledEventToLua converts an event into a {id, name, description,
+// channel_id, location, type, status, start_time, end_time, user_count} table.
+// Times are unix seconds; end_time is absent when the event has none.
+func scheduledEventToLua(L *lua.LState, event *discordgo.GuildScheduledEvent) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LString(event.ID))
+	tbl.RawSetString("name", lua.LString(event.Name))
+	tbl.RawSetString("description", lua.LString(event.Description))
+	tbl.RawSetString("channel_id", lua.LString(event.ChannelID))
+	tbl.RawSetString("location", lua.LString(event.EntityMetadata.Location))
+	for name, entityType := range scheduledEventTypes {
+		if entityType == event.EntityType {
+			tbl.RawSetString("type", lua.LString(name))
+		}
+	}
+	tbl.RawSetString("status", lua.LString(scheduledEventStatuses[event.Status]))
+	tbl.RawSetString("start_time", lua.LNumber(event.ScheduledStartTime.Unix()))
+	if event.ScheduledEndTime != nil {
+		tbl.RawSetString("end_time", lua.LNumber(event.ScheduledEndTime.Unix()))
+	}
+	tbl.RawSetString("user_count", lua.LNumber(event.UserCount))
+	return tbl
+}
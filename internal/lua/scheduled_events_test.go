@@ -0,0 +1,59 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestScheduledEvents(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		local later = create_scheduled_event("g1", {
+			name = "Game night", start_time = 2000000000, channel_id = "v1",
+		})
+		later_type = later.type
+		later_status = later.status
+
+		local meetup = create_scheduled_event("g1", {
+			name = "Meetup", location = "Town hall",
+			start_time = 1900000000, end_time = 1900003600,
+		})
+		meetup_type = meetup.type
+		meetup_location = meetup.location
+		meetup_end = meetup.end_time
+
+		local events = get_scheduled_events("g1")
+		count = #events
+		first = events[1].name
+
+		no_location, no_location_err = create_scheduled_event("g1", { name = "x", start_time = 1, end_time = 2 })
+		no_start, no_start_err = create_scheduled_event("g1", { name = "x", location = "here" })
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	get := func(name string) string { return scriptGlobal(engine, name).String() }
+	if get("later_type") != "voice" || get("later_status") != "scheduled" {
+		t.Errorf("Expected a scheduled voice event, got %s/%s", get("later_type"), get("later_status"))
+	}
+	if get("meetup_type") != "external" || get("meetup_location") != "Town hall" || get("meetup_end") != "1900003600" {
+		t.Errorf("Unexpected external event: %s at %s until %s", get("meetup_type"), get("meetup_location"), get("meetup_end"))
+	}
+	if get("count") != "2" || get("first") != "Meetup" {
+		t.Errorf("Expected 2 events soonest first, got %s starting with %s", get("count"), get("first"))
+	}
+	if get("no_location") != "nil" || get("no_location_err") == "nil" {
+		t.Error("Expected an external event without location to be rejected")
+	}
+	if get("no_start") != "nil" || get("no_start_err") == "nil" {
+		t.Error("Expected an event without start_time to be rejected")
+	}
+	if len(session.events) != 2 {
+		t.Errorf("Expected invalid events not to reach Discord, got %d created", len(session.events))
+	}
+}
@@ -0,0 +1,101 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scriptConfigKeyPattern matches the keys of a script config file, which
+// become fields of the script's config table.
+var scriptConfigKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// scriptConfigPath returns the config file of a script: greeter.lua is
+// configured by greeter.conf next to it.
+func scriptConfigPath(scriptPath string) string {
+	return strings.TrimSuffix(scriptPath, ".lua") + ".conf"
+}
+
+// readScriptConfig reads the config file of a script, or returns nil if it
+// has none.
+func readScriptConfig(scriptPath string) ([]byte, error) {
+	data, err := os.ReadFile(scriptConfigPath(scriptPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// parseScriptConfig parses a script config file: "key = value" lines, with
+// blank lines and lines starting with # or ; ignored. Values are strings;
+// double quotes keep leading or trailing spaces and allow Go escapes.
+// Numbers are left as strings too, since Discord IDs don't fit a Lua number.
+func parseScriptConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		case !scriptConfigKeyPattern.MatchString(key):
+			return nil, fmt.Errorf("line %d: invalid key '%s'", n, key)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %d: '%s' is set twice", n, key)
+		}
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value for '%s'", n, key)
+			}
+			value = unquoted
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// scriptConfigProxy returns the table behind the config global. Indexing it
+// reads the config of the running script; assigning to it is an error.
+func (e *Engine) scriptConfigProxy() *lua.LTable {
+	L := e.state
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		if e.currentScript == nil || e.currentScript.Config == nil {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(e.currentScript.Config.RawGet(L.Get(2)))
+		return 1
+	}))
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("config is read-only, edit the script's .conf file instead")
+		return 0
+	}))
+	proxy := L.NewTable()
+	L.SetMetatable(proxy, mt)
+	return proxy
+}
+
+// scriptConfigToLua converts parsed config values into the config table.
+func scriptConfigToLua(L *lua.LState, values map[string]string) *lua.LTable {
+	tbl := L.NewTable()
+	for key, value := range values {
+		tbl.RawSetString(key, lua.LString(value))
+	}
+	return tbl
+}
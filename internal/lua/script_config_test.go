@@ -0,0 +1,145 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseScriptConfig(t *testing.T) {
+	conf := "# deployment settings\n\nchannel_id = 123456789012345678\n; old = value\ngreeting = \"  hi there  \"\nempty =\nurl = https://example.com/?a=b\n"
+	got, err := parseScriptConfig([]byte(conf))
+	if err != nil {
+		t.Fatalf("parseScriptConfig failed: %v", err)
+	}
+	want := map[string]string{
+		"channel_id": "123456789012345678",
+		"greeting":   "  hi there  ",
+		"empty":      "",
+		"url":        "https://example.com/?a=b",
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d values, got %v", len(want), got)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("Expected %s = %q, got %q", key, value, got[key])
+		}
+	}
+
+	for conf, wantErr := range map[string]string{
+		"a = 1\nnot a pair":  "line 2: expected key = value",
+		"1st = x":            "line 1: invalid key '1st'",
+		"a = 1\na = 2":       "line 2: 'a' is set twice",
+		"a = \"unterminated": "line 1: invalid quoted value for 'a'",
+	} {
+		if _, err := parseScriptConfig([]byte(conf)); err == nil || err.Error() != wantErr {
+			t.Errorf("parseScriptConfig(%q) error = %v, want %q", conf, err, wantErr)
+		}
+	}
+}
+
+func TestScriptConfigTable(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "welcome.lua")
+	confPath := filepath.Join(dir, "welcome.conf")
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	// Each load runs in a new environment, so count in a shared table
+	loads := engine.state.NewTable()
+	engine.state.SetGlobal("loads", loads)
+	writeFile(path, "loads.n = (loads.n or 0) + 1\nchannel = config.channel_id")
+	writeFile(confPath, "channel_id = 123456789012345678")
+	if err := engine.loadScript(path); err != nil {
+		t.Fatalf("loadScript failed: %v", err)
+	}
+	if got := scriptGlobal(engine, "channel").String(); got != "123456789012345678" {
+		t.Errorf("Expected config.channel_id to be the configured ID, got %s", got)
+	}
+
+	// A changed config reloads the script even though its code is unchanged
+	writeFile(confPath, "channel_id = 876543210987654321")
+	if err := engine.reloadScript(path, false); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if got := scriptGlobal(engine, "channel").String(); got != "876543210987654321" {
+		t.Errorf("Expected the reload to pick up the new config, got %s", got)
+	}
+	if err := engine.reloadScript(path, false); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if got := loads.RawGetString("n").String(); got != "2" {
+		t.Errorf("Expected an unchanged script and config not to reload, got %s loads", got)
+	}
+
+	// Without a config file the table is empty
+	if err := os.Remove(confPath); err != nil {
+		t.Fatalf("Failed to remove config: %v", err)
+	}
+	if err := engine.reloadScript(path, false); err != nil {
+		t.Fatalf("reloadScript failed: %v", err)
+	}
+	if got := engine.scripts["welcome.lua"].Env.RawGetString("channel").String(); got != "nil" {
+		t.Errorf("Expected config.channel_id to be nil without a config file, got %s", got)
+	}
+
+	writeFile(confPath, "channel_id")
+	err := engine.reloadScript(path, false)
+	if err == nil || !strings.Contains(err.Error(), "config error in welcome.conf: line 1") {
+		t.Errorf("Expected a malformed config to fail the load, got %v", err)
+	}
+}
+
+func TestScriptConfigIsPerScript(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	dir := t.TempDir()
+	for name, greeting := range map[string]string{"english": "hello", "swedish": "hej"} {
+		conf := "greeting = " + greeting
+		code := `register_hook("on_channel_message", function(event)
+			greetings = (greetings or "") .. config.greeting .. ";"
+		end)`
+		if err := os.WriteFile(filepath.Join(dir, name+".conf"), []byte(conf), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".lua"), []byte(code), 0o644); err != nil {
+			t.Fatalf("Failed to write script: %v", err)
+		}
+		if err := engine.loadScript(filepath.Join(dir, name+".lua")); err != nil {
+			t.Fatalf("loadScript failed: %v", err)
+		}
+	}
+
+	engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+		Content:   "hi",
+		ChannelID: "c1",
+		GuildID:   "g1",
+		Author:    &discordgo.User{ID: "u1", Username: "alice"},
+	}})
+	drainEvents(engine)
+	for name, want := range map[string]string{"english.lua": "hello;", "swedish.lua": "hej;"} {
+		if got, err := execIn(engine, name, "greetings"); err != nil || got != want {
+			t.Errorf("Expected the hook of %s to see its own script's config, got %q (%v)", name, got, err)
+		}
+	}
+
+	if err := engine.state.DoString(`config.greeting = "hi"`); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("Expected assigning to config to fail, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package lua
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// addScriptDir records dir as a script directory and reports whether it is
+// new.
+func (e *Engine) addScriptDir(dir string) bool {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if slices.Contains(e.scriptDirs, dir) {
+		return false
+	}
+	e.scriptDirs = append(e.scriptDirs, dir)
+	return true
+}
+
+// AddScriptDir loads the scripts of another directory into the running bot
+// and, when scripts are watched, watches it for changes too. Unlike
+// LoadScripts it loads them right away rather than queueing them, so it must
+// run on the dispatcher, e.g. from an owner command. A script with the name
+// of one already loaded from another directory fails to load, as scripts are
+// known by their file name. Adding a directory twice is an error.
+func (e *Engine) AddScriptDir(dir string) (LoadResult, error) {
+	var result LoadResult
+	if err := e.checkLuaAccess("AddScriptDir"); err != nil {
+		return result, err
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return result, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return result, err
+	}
+	if !info.IsDir() {
+		return result, fmt.Errorf("%s is not a directory", dir)
+	}
+	files, err := os.ReadDir(abs)
+	if err != nil {
+		return result, err
+	}
+	if !e.addScriptDir(abs) {
+		return result, fmt.Errorf("%s is already a script directory", dir)
+	}
+
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".lua" {
+			continue
+		}
+		if script, loaded := e.scripts[f.Name()]; loaded {
+			if filepath.Dir(script.Path) == abs {
+				continue // already loaded as a dependency
+			}
+			err := fmt.Errorf("a script named %s is already loaded from %s", f.Name(), filepath.Dir(script.Path))
+			result.Failed = append(result.Failed, ScriptError{Name: f.Name(), Err: err})
+			continue
+		}
+		before := len(e.scripts)
+		if err := e.loadScript(filepath.Join(abs, f.Name())); err != nil {
+			log.Println("Failed to load script", f.Name(), ":", err)
+			result.Failed = append(result.Failed, ScriptError{Name: f.Name(), Err: err})
+		}
+		result.Loaded += len(e.scripts) - before
+	}
+	log.Printf("Added script directory %s: %d scripts loaded, %d failed", abs, result.Loaded, len(result.Failed))
+
+	if w := e.watcher.Load(); w != nil {
+		if err := w.AddDir(abs); err != nil {
+			log.Printf("Warning: scripts in %s won't be reloaded on change: %v", abs, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,116 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/leihog/discord-bot/internal/users"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func writeScripts(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, code := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(code), 0o644); err != nil {
+			t.Fatalf("Failed to write script: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestAddScriptDir(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	main := writeScripts(t, map[string]string{"hello.lua": `hello = "main"`})
+	if result := engine.LoadScripts(main); result.Loaded != 1 {
+		t.Fatalf("LoadScripts loaded %d scripts, want 1", result.Loaded)
+	}
+
+	extra := writeScripts(t, map[string]string{
+		"hello.lua":  `hello = "extra"`,
+		"extra.lua":  `requires("common")`,
+		"common.lua": `common = true`,
+		"broken.lua": `error("boom")`,
+		"notes.txt":  `not a script`,
+	})
+	result, err := engine.AddScriptDir(extra)
+	if err != nil {
+		t.Fatalf("AddScriptDir: %v", err)
+	}
+	if result.Loaded != 2 {
+		t.Errorf("Loaded = %d, want 2 (extra.lua and common.lua)", result.Loaded)
+	}
+	failed := make(map[string]string)
+	for _, f := range result.Failed {
+		failed[f.Name] = f.Err.Error()
+	}
+	if len(failed) != 2 || !strings.Contains(failed["hello.lua"], "already loaded from") || failed["broken.lua"] == "" {
+		t.Errorf("Failed = %v, want hello.lua (name taken) and broken.lua", failed)
+	}
+	if got := scriptGlobal(engine, "hello").String(); got != "main" {
+		t.Errorf("hello = %s, the script of the first directory should stay loaded", got)
+	}
+
+	if _, err := engine.AddScriptDir(extra); err == nil || !strings.Contains(err.Error(), "already a script directory") {
+		t.Errorf("adding the directory again: err = %v", err)
+	}
+	if _, err := engine.AddScriptDir(main); err == nil {
+		t.Error("adding the directory loaded by LoadScripts should fail")
+	}
+	if _, err := engine.AddScriptDir(filepath.Join(main, "hello.lua")); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("adding a file: err = %v", err)
+	}
+}
+
+func TestAddScriptDirRequiresOwner(t *testing.T) {
+	db := setupTestDB(t)
+	store := users.New(db)
+	engine := New(db, &fakeSession{}, store)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	if err := store.EnsureUser("owner1", "boss"); err != nil {
+		t.Fatalf("EnsureUser failed: %v", err)
+	}
+	if err := store.AddRole("owner1", "owner"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+
+	extra := writeScripts(t, map[string]string{"extra.lua": `extra = true`})
+	loadTestScript(t, engine, "adddir.lua", `
+		results = {}
+		register_command("adddir", "Add a script directory", function(event)
+			local loaded, err = add_script_dir(event.args[2])
+			results[event.author_id] = loaded or err
+		end)
+		_, outside_err = add_script_dir(`+strconv.Quote(extra)+`)
+	`)
+	for _, id := range []string{"user1", "owner1"} {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   "!adddir " + extra,
+			ChannelID: "c1",
+			Author:    &discordgo.User{ID: id, Username: id},
+		}})
+	}
+	drainEvents(engine)
+
+	denied := "add_script_dir requires a command run by an owner"
+	if got := scriptGlobal(engine, "outside_err").String(); got != denied {
+		t.Errorf("Expected add_script_dir outside a command to be refused, got %q", got)
+	}
+	results := scriptGlobal(engine, "results").(*lua.LTable)
+	if got := results.RawGetString("user1").String(); got != denied {
+		t.Errorf("Expected a non-owner to be refused, got %q", got)
+	}
+	if got := results.RawGetString("owner1"); got != lua.LNumber(1) {
+		t.Errorf("Expected the owner to load the directory's script, got %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package lua
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Every script runs in its own global environment, its Env: globals the
+// script sets land there rather than in the shared globals, so scripts can't
+// overwrite each other's variables and functions, and the globals of an
+// unloaded script go with it. A global the script hasn't set is looked up in
+// the scripts it requires, then in the shared globals, which hold the bot's
+// functions. Library tables such as string, math and rand are copied into
+// each Env, so string.format = nil in one script doesn't break the others.
+
+// newScriptEnv returns an environment with its own copies of the library
+// tables that falls back to the shared globals for everything else. _G is the
+// environment itself, so _G.name = value stays private too.
+func (e *Engine) newScriptEnv() *lua.LTable {
+	env := e.state.NewTable()
+	e.copyLibraries(env)
+	env.RawSetString("_G", env)
+	mt := e.state.NewTable()
+	mt.RawSetString("__index", e.state.Get(lua.GlobalsIndex))
+	e.state.SetMetatable(env, mt)
+	return env
+}
+
+// libraryTables are the globals holding library functions that every script
+// gets its own copy of: the standard libraries and the bot's own, like rand.
+var libraryTables = []string{"string", "table", "math", "os", "io", "coroutine", "debug", "channel", "rand"}
+
+// copyLibraries copies the library tables into env. The copies guard against
+// a script changing a library by accident; the originals are still
+// reachable, e.g. through getmetatable("").__index.
+func (e *Engine) copyLibraries(env *lua.LTable) {
+	copies := make(map[*lua.LTable]*lua.LTable)
+	for _, name := range libraryTables {
+		if tbl, ok := e.state.GetGlobal(name).(*lua.LTable); ok {
+			env.RawSetString(name, e.copyTable(tbl, copies))
+		}
+	}
+}
+
+// copyTable returns a deep copy of tbl, reusing the copies already made so a
+// table referenced twice is copied once. Tables with a metatable get their
+// behavior from it and are kept as they are.
+func (e *Engine) copyTable(tbl *lua.LTable, copies map[*lua.LTable]*lua.LTable) lua.LValue {
+	if c, ok := copies[tbl]; ok {
+		return c
+	}
+	if e.state.GetMetatable(tbl) != lua.LNil {
+		return tbl
+	}
+	c := e.state.NewTable()
+	copies[tbl] = c
+	tbl.ForEach(func(key, value lua.LValue) {
+		if nested, ok := value.(*lua.LTable); ok {
+			value = e.copyTable(nested, copies)
+		}
+		c.RawSet(key, value)
+	})
+	return c
+}
+
+// shareRequiredGlobals makes the globals of the scripts that script requires
+// visible to it, so it can call a library script's functions by name. The
+// dependencies are looked up by name on every access, which picks up a
+// library that was reloaded. Scripts without dependencies read the shared
+// globals directly, which is faster.
+func (e *Engine) shareRequiredGlobals(script *LuaScript) {
+	globals := e.state.Get(lua.GlobalsIndex).(*lua.LTable)
+	index := e.state.NewFunction(func(L *lua.LState) int {
+		key := L.Get(2)
+		for _, name := range script.Requires {
+			if dep, ok := e.scripts[name]; ok && dep.Env != nil {
+				if value := dep.Env.RawGet(key); value != lua.LNil {
+					L.Push(value)
+					return 1
+				}
+			}
+		}
+		L.Push(globals.RawGet(key))
+		return 1
+	})
+	e.state.GetMetatable(script.Env).(*lua.LTable).RawSetString("__index", index)
+}
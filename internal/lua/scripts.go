@@ -1,18 +1,25 @@
 package lua
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 
 	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
 )
 
 var hookNames = []string{
 	"on_channel_message",
 	"on_direct_message",
+	"on_select",
 	"on_shutdown",
+	"on_store_change",
+	"on_tick",
 	"on_unload",
 }
 
@@ -20,43 +27,107 @@ type LuaScript struct {
 	Name     string
 	Path     string
 	Env      *lua.LTable
+	OnLoad   *lua.LFunction
 	OnUnload *lua.LFunction
 	Commands []string
+	Requires []string // scripts named with requires()
+
+	// Checksum is the SHA-256 of the source and config file the script was
+	// loaded from, so a reload of an unchanged script can be skipped.
+	Checksum string
+
+	// APIVersion is the host API version declared with a "-- api: N" header,
+	// or 0 if the script declares none.
+	APIVersion int
+
+	// State is the script's in-memory table returned by get_state. It lives
+	// as long as the script is loaded and is dropped on unload (and so on
+	// reload).
+	State *lua.LTable
+
+	// queues holds the script's get_queue queues by name. They are emptied
+	// when the script unloads.
+	queues map[string]*lua.LUserData
+
+	// Config holds the values of the script's .conf file, read through the
+	// config global.
+	Config *lua.LTable
+
+	// unloaded is set once the script has been unloaded, so callbacks of
+	// this instance still queued can be told from the ones of a reload.
+	unloaded bool
 }
 
-func (e *Engine) loadScript(path string) error {
+func (e *Engine) loadScript(path string) (err error) {
 	name := filepath.Base(path)
+	if err := e.checkLuaAccess("loading " + name); err != nil {
+		return err
+	}
+	// Scripts loaded by requires run under the deadline of the script
+	// requiring them
+	if len(e.loading) == 0 {
+		defer e.protectLoad(name, &err)()
+	}
 
 	code, err := os.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("read error: %w", err)
 	}
 
-	L := e.state
-	env := L.NewTable()
+	conf, err := readScriptConfig(path)
+	if err != nil {
+		return fmt.Errorf("config read error: %w", err)
+	}
+	configValues, err := parseScriptConfig(conf)
+	if err != nil {
+		return fmt.Errorf("config error in %s: %w", filepath.Base(scriptConfigPath(path)), err)
+	}
 
-	mt := L.NewTable()
-	mt.RawSetString("__index", L.Get(lua.GlobalsIndex))
-	L.SetMetatable(env, mt)
+	apiVersion, err := scriptAPIVersion(code)
+	if err != nil {
+		return err
+	}
+	apiWarning, err := checkAPIVersion(apiVersion)
+	if err != nil {
+		return err
+	}
 
-	fn, err := L.LoadString(string(code))
+	L := e.state
+	fn, err := e.compileScript(name, code)
 	if err != nil {
 		return fmt.Errorf("compile error: %w", err)
 	}
 
 	script := &LuaScript{
-		Name: name,
-		Path: path,
-		Env:  env,
+		Name:       name,
+		Path:       path,
+		Env:        e.newScriptEnv(),
+		State:      L.NewTable(),
+		Config:     scriptConfigToLua(L, configValues),
+		Checksum:   scriptChecksum(code, conf),
+		APIVersion: apiVersion,
+	}
+	if apiWarning != "" {
+		scriptLogf(script, "Warning: %s", apiWarning)
 	}
 
+	// Restore the previous script afterwards: dependencies are loaded while
+	// the script requiring them is itself still loading.
+	prev := e.currentScript
 	e.currentScript = script
+	e.loading = append(e.loading, name)
+	defer func() {
+		e.currentScript = prev
+		e.loading = e.loading[:len(e.loading)-1]
+	}()
+	fn.Env = script.Env
 	L.Push(fn)
-	L.Push(env)
-	if err := L.PCall(1, lua.MultRet, nil); err != nil {
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		// Drop whatever the script registered before it failed, so a failed
+		// load or reload doesn't leave hooks and commands behind
+		e.releaseScript(script)
 		return fmt.Errorf("runtime error: %w", err)
 	}
-	e.currentScript = nil
 
 	// might switch to this model for hooks later. Haven't decided yet.
 	// for _, hookName := range hookNames {
@@ -67,31 +138,67 @@ func (e *Engine) loadScript(path string) error {
 	// }
 
 	e.scripts[name] = script
+	if script.OnLoad != nil {
+		e.enqueueFollowUp(LoadEvent{Script: script}, name)
+	}
 
-	log.Printf("Script '%s' loaded", name)
+	scriptLogf(script, "Script loaded")
 	// todo: print out how many commands and hooks the script registered
 	return nil
 }
 
-// LoadScripts loads all Lua scripts from the given directory
-func (e *Engine) LoadScripts(dir string) {
+// LoadResult summarises a LoadScripts run.
+type LoadResult struct {
+	Loaded int // scripts loaded, including dependencies loaded by requires
+	Queued int // scripts queued for the dispatcher, which reports their errors
+	Failed []ScriptError
+}
+
+// ScriptError is a script that failed to load.
+type ScriptError struct {
+	Name string
+	Err  error
+}
+
+// LoadScripts loads all Lua scripts from the given directory. A script that
+// fails to load is logged and skipped; the result lists them. Once the engine
+// has started they are queued for the dispatcher instead of loaded directly.
+func (e *Engine) LoadScripts(dir string) LoadResult {
+	var result LoadResult
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		log.Println("Failed to read script directory:", err)
-		return
+		return result
 	}
+	e.addScriptDir(dir)
 
 	for _, f := range files {
 		if filepath.Ext(f.Name()) != ".lua" {
 			continue
 		}
 
+		if _, loaded := e.scripts[f.Name()]; loaded {
+			continue // already loaded as a dependency
+		}
+
 		scriptPath := filepath.Join(dir, f.Name())
+		if e.started {
+			e.enqueueEvent(ScriptEvent{Action: "load", ScriptName: scriptPath}, "LoadScripts")
+			result.Queued++
+			continue
+		}
+		before := len(e.scripts)
 		if err := e.loadScript(scriptPath); err != nil {
 			log.Println("Failed to load script", f.Name(), ":", err)
-			continue
+			result.Failed = append(result.Failed, ScriptError{Name: f.Name(), Err: err})
 		}
+		// Dependencies may have loaded even if the script itself failed
+		result.Loaded += len(e.scripts) - before
+	}
+	if !e.started {
+		e.reportUnscheduledCronJobs()
 	}
+	return result
 }
 
 func (e *Engine) unloadScript(name string) {
@@ -102,29 +209,113 @@ func (e *Engine) unloadScript(name string) {
 	}
 
 	if script.OnUnload != nil {
-		log.Printf("Dispatching on_unload for script '%s'", name)
+		scriptLogf(script, "Dispatching on_unload")
 		e.callLuaFunction(HookInfo{
 			Function: script.OnUnload,
 			Script:   script,
+			Name:     "on_unload",
 		}, lua.LNil)
 	}
 
+	e.releaseScript(script)
+	delete(e.scripts, script.Name)
+	scriptLogf(script, "Script fully unloaded")
+}
+
+// releaseScript removes the hooks, timers, commands and other registrations
+// of script and marks it unloaded.
+func (e *Engine) releaseScript(script *LuaScript) {
 	e.removeHooks(script)
-	e.timer.UnregisterScriptTimers(name)
-	for _, cmd := range script.Commands {
-		delete(e.commands, cmd)
+	e.timer.UnregisterScriptTimers(script)
+	e.crons.removeScript(script)
+	closeScriptQueues(script)
+	e.cancelAwaits(script)
+	e.removeScriptCommands(script)
+	e.removeCommandPatterns(script)
+	e.removeOutboundFilters(script)
+	script.State = nil
+	script.unloaded = true
+}
+
+// scriptChecksum returns the hex SHA-256 of a script's source and config
+// file.
+func scriptChecksum(code, conf []byte) string {
+	h := sha256.New()
+	h.Write(code)
+	h.Write([]byte{0})
+	h.Write(conf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// compiledScript is a script's compiled chunk and the SHA-256 of the source
+// it was compiled from.
+type compiledScript struct {
+	hash  string
+	proto *lua.FunctionProto
+}
+
+// compileScript returns the main chunk of script name with source code. The
+// compiled proto is kept, so a reload that doesn't change the source, like a
+// forced reload or a change to the script's .conf file, only creates a new
+// closure. The cache is in memory only: gopher-lua can't restore a proto
+// from disk through its public API.
+func (e *Engine) compileScript(name string, code []byte) (*lua.LFunction, error) {
+	sum := sha256.Sum256(code)
+	hash := hex.EncodeToString(sum[:])
+	if c, ok := e.compiled[name]; ok && c.hash == hash {
+		return e.state.NewFunctionFromProto(c.proto), nil
 	}
 
-	delete(e.scripts, script.Name)
-	log.Printf("Script '%s' fully unloaded", name)
+	// Same chunk name as LState.LoadString, so error messages don't change
+	chunk, err := parse.Parse(bytes.NewReader(code), "<string>")
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, "<string>")
+	if err != nil {
+		return nil, err
+	}
+	e.compiled[name] = compiledScript{hash: hash, proto: proto}
+	return e.state.NewFunctionFromProto(proto), nil
 }
 
-func (e *Engine) reloadScript(path string) error {
+// reloadScript unloads and loads a script again. Unless force is set, a
+// script whose source hasn't changed since it was loaded is left alone: the
+// watcher sees writes that don't change the content (touch, some editors'
+// saves), and a reload runs on_unload, drops timers and re-runs the script.
+func (e *Engine) reloadScript(path string, force bool) error {
 	name := filepath.Base(path)
+	if script, ok := e.scripts[name]; ok && !force {
+		code, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read error: %w", err)
+		}
+		conf, err := readScriptConfig(path)
+		if err != nil {
+			return fmt.Errorf("config read error: %w", err)
+		}
+		if scriptChecksum(code, conf) == script.Checksum {
+			scriptLogf(script, "Unchanged, not reloading")
+			return nil
+		}
+	}
 	e.unloadScript(name)
 	return e.loadScript(path)
 }
 
+func (e *Engine) removeCommandPatterns(script *LuaScript) {
+	e.cmdMutex.Lock()
+	defer e.cmdMutex.Unlock()
+
+	patterns := e.commandPatterns[:0]
+	for _, cmd := range e.commandPatterns {
+		if cmd.Callback.Script != script {
+			patterns = append(patterns, cmd)
+		}
+	}
+	e.commandPatterns = patterns
+}
+
 func (e *Engine) removeHooks(script *LuaScript) {
 	for name, hooks := range e.hooks {
 		newHooks := hooks[:0] // reuse existing slice storage
@@ -0,0 +1,114 @@
+package lua
+
+import (
+	"errors"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MessageSender is satisfied by *discordgo.Session and by the dev shell mock.
+type MessageSender interface {
+	ChannelMessageSend(channelID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error)
+	GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error)
+	GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+	GuildMembersSearch(guildID, query string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+	GuildScheduledEvents(guildID string, userCount bool, options ...discordgo.RequestOption) ([]*discordgo.GuildScheduledEvent, error)
+	GuildScheduledEventCreate(guildID string, event *discordgo.GuildScheduledEventParams, options ...discordgo.RequestOption) (*discordgo.GuildScheduledEvent, error)
+	User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error)
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error)
+	ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageEdit(channelID, messageID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error
+	MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error
+	MessageReactions(channelID, messageID, emojiID string, limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.User, error)
+	ChannelEdit(channelID string, data *discordgo.ChannelEdit, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error)
+}
+
+// ErrUnsupported is returned by UnsupportedSession for every call.
+var ErrUnsupported = errors.New("not supported by this session")
+
+// UnsupportedSession implements MessageSender by failing every call with
+// ErrUnsupported. Mocks embed it and override only what they can emulate, so
+// they keep compiling as MessageSender grows.
+type UnsupportedSession struct{}
+
+func (UnsupportedSession) ChannelMessageSend(channelID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) GuildMembersSearch(guildID, query string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	return ErrUnsupported
+}
+
+func (UnsupportedSession) GuildScheduledEvents(guildID string, userCount bool, options ...discordgo.RequestOption) ([]*discordgo.GuildScheduledEvent, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) GuildScheduledEventCreate(guildID string, event *discordgo.GuildScheduledEventParams, options ...discordgo.RequestOption) (*discordgo.GuildScheduledEvent, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) ChannelMessageEdit(channelID, messageID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	return ErrUnsupported
+}
+
+func (UnsupportedSession) MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error {
+	return ErrUnsupported
+}
+
+func (UnsupportedSession) MessageReactions(channelID, messageID, emojiID string, limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.User, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) ChannelEdit(channelID string, data *discordgo.ChannelEdit, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	return nil, ErrUnsupported
+}
+
+func (UnsupportedSession) WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,65 @@
+package lua
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxStickersPerMessage is Discord's limit on stickers attached to a message.
+const maxStickersPerMessage = 3
+
+var stickerFormats = map[discordgo.StickerFormat]string{
+	discordgo.StickerFormatTypePNG:    "png",
+	discordgo.StickerFormatTypeAPNG:   "apng",
+	discordgo.StickerFormatTypeLottie: "lottie",
+	discordgo.StickerFormatTypeGIF:    "gif",
+}
+
+// parseStickerIDs reads the stickers send option, an array of sticker IDs.
+func parseStickerIDs(tbl *lua.LTable) ([]string, error) {
+	n := tbl.Len()
+	if n > maxStickersPerMessage {
+		return nil, fmt.Errorf("a message can hold at most %d stickers, got %d", maxStickersPerMessage, n)
+	}
+	ids := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		id := lua.LVAsString(tbl.RawGetInt(i))
+		if !isSnowflake(id) {
+			return nil, fmt.Errorf("sticker %d: '%s' is not a sticker ID", i, tbl.RawGetInt(i).String())
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// guildStickers returns the custom stickers of a guild, from the state cache
+// when it has the guild and from the API otherwise.
+func (e *Engine) guildStickers(guildID string) ([]*discordgo.Sticker, error) {
+	if state := e.messageState(); state != nil {
+		if guild, err := state.Guild(guildID); err == nil {
+			state.RLock()
+			defer state.RUnlock()
+			return append([]*discordgo.Sticker(nil), guild.Stickers...), nil
+		}
+	}
+	guild, err := e.session.Guild(guildID)
+	if err != nil {
+		return nil, err
+	}
+	return guild.Stickers, nil
+}
+
+// stickerToLua converts a sticker into a {id, name, description, tags, format,
+// available} table.
+func stickerToLua(L *lua.LState, sticker *discordgo.Sticker) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LString(sticker.ID))
+	tbl.RawSetString("name", lua.LString(sticker.Name))
+	tbl.RawSetString("description", lua.LString(sticker.Description))
+	tbl.RawSetString("tags", lua.LString(sticker.Tags))
+	tbl.RawSetString("format", lua.LString(stickerFormats[sticker.FormatType]))
+	tbl.RawSetString("available", lua.LBool(sticker.Available))
+	return tbl
+}
@@ -0,0 +1,42 @@
+package lua
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestStickers(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{stickers: []*discordgo.Sticker{
+		{ID: "749054660769218631", Name: "wave", Tags: "wave", FormatType: discordgo.StickerFormatTypeAPNG, Available: true},
+	}}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		local stickers = get_guild_stickers("g1")
+		count = #stickers
+		name = stickers[1].name
+		format = stickers[1].format
+
+		send_message("c1", "", { stickers = { stickers[1].id } })
+		send_message("c1", "too many", { stickers = { "1", "2", "3", "4" } })
+		send_message("c1", "not an id", { stickers = { "wave" } })
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	get := func(name string) string { return scriptGlobal(engine, name).String() }
+	if get("count") != "1" || get("name") != "wave" || get("format") != "apng" {
+		t.Errorf("Unexpected stickers: %s, first %s (%s)", get("count"), get("name"), get("format"))
+	}
+	if len(session.sent) != 1 {
+		t.Fatalf("Expected only the valid sticker message to be sent, got %d", len(session.sent))
+	}
+	if ids := session.sent[0].StickerIDs; len(ids) != 1 || ids[0] != "749054660769218631" {
+		t.Errorf("Expected the sticker to be attached, got %v", ids)
+	}
+}
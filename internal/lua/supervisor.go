@@ -0,0 +1,92 @@
+package lua
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// The dispatcher is the only goroutine running Lua, so if it dies or hangs
+// the bot still takes Discord events but nothing handles them. A dispatcher
+// that exits before the queue is closed is restarted, up to
+// maxDispatcherRestarts times. One that spends longer than
+// DISPATCHER_STALL_TIMEOUT on a single event can't be: the stuck goroutine
+// still owns the Lua state. Either failure is reported through Failed, and
+// the bot shuts down instead of looking alive while doing nothing.
+
+// maxDispatcherRestarts is how often a dispatcher that died is restarted
+// before the engine gives up.
+const maxDispatcherRestarts = 3
+
+// activeDispatch is the event the dispatcher is working on, its heartbeat.
+type activeDispatch struct {
+	event string
+	trace string
+	since time.Time
+}
+
+// startDispatcher runs the dispatcher on a new goroutine, which owns the Lua
+// state from then on.
+func (e *Engine) startDispatcher() {
+	e.dispatcherWg.Add(1)
+	e.dispatcherRunning.Store(true)
+	go e.dispatcher()
+}
+
+// dispatcherExited handles a dispatcher that stopped before the queue was
+// closed; r is what it panicked with, if anything.
+func (e *Engine) dispatcherExited(r any) {
+	cause := "exited"
+	if r != nil {
+		cause = fmt.Sprintf("panicked: %v", r)
+	}
+	log.Printf("Event dispatcher %s\n%s", cause, stack())
+	e.dispatching.Store(nil)
+	e.currentScript = nil
+
+	restarts := e.dispatcherRestarts.Add(1)
+	if !e.started || restarts > maxDispatcherRestarts {
+		e.fail(fmt.Errorf("event dispatcher %s after %d restart(s); events are no longer handled", cause, restarts-1))
+		return
+	}
+	log.Printf("Restarting event dispatcher (restart %d of %d)", restarts, maxDispatcherRestarts)
+	e.startDispatcher()
+}
+
+// watchDispatcher reports the dispatcher stuck once it has spent longer than
+// timeout on one event.
+func (e *Engine) watchDispatcher(timeout time.Duration) {
+	ticker := time.NewTicker(max(timeout/10, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			active := e.dispatching.Load()
+			if active == nil || time.Since(active.since) < timeout {
+				continue
+			}
+			e.stalled.Store(true)
+			e.fail(fmt.Errorf("%sevent dispatcher stuck on a %s event for over %s (DISPATCHER_STALL_TIMEOUT); events are no longer handled",
+				traceLogPrefix(active.trace), active.event, timeout))
+			return
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// fail reports an error the engine can't recover from. Only the first one is
+// kept.
+func (e *Engine) fail(err error) {
+	log.Printf("ERROR: %v", err)
+	select {
+	case e.failed <- err:
+	default:
+	}
+}
+
+// Failed reports a dispatcher failure the engine could not recover from.
+func (e *Engine) Failed() <-chan error {
+	return e.failed
+}
@@ -0,0 +1,65 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// threadAutoArchiveDurations are the auto-archive durations, in minutes,
+// Discord accepts: an hour, a day, three days and a week.
+var threadAutoArchiveDurations = map[int]bool{60: true, 1440: true, 4320: true, 10080: true}
+
+// editThread applies edit to a thread. Channels the state cache knows are
+// checked to be threads first, so a typo can't rename or lock a regular
+// channel.
+func (e *Engine) editThread(threadID string, edit *discordgo.ChannelEdit) error {
+	if !isSnowflake(threadID) {
+		return fmt.Errorf("invalid thread ID '%s'", threadID)
+	}
+	if state := e.messageState(); state != nil {
+		if channel, err := state.Channel(threadID); err == nil && !channel.IsThread() {
+			return fmt.Errorf("channel %s is not a thread", threadID)
+		}
+	}
+	if _, err := e.session.ChannelEdit(threadID, edit); err != nil {
+		return threadError(threadID, err)
+	}
+	return nil
+}
+
+// threadError explains the API errors a script can act on.
+func threadError(threadID string, err error) error {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Message == nil {
+		return err
+	}
+	switch restErr.Message.Code {
+	case discordgo.ErrCodeMissingPermissions, discordgo.ErrCodeMissingAccess:
+		return fmt.Errorf("missing permission to manage thread %s (needs Manage Threads)", threadID)
+	case discordgo.ErrCodeUnknownChannel:
+		return fmt.Errorf("unknown thread %s", threadID)
+	}
+	return err
+}
+
+// setThreadArchived archives or unarchives a thread.
+func (e *Engine) setThreadArchived(threadID string, archived bool) error {
+	return e.editThread(threadID, &discordgo.ChannelEdit{Archived: &archived})
+}
+
+// setThreadLocked locks or unlocks a thread. Only members with Manage
+// Threads can unarchive a locked thread.
+func (e *Engine) setThreadLocked(threadID string, locked bool) error {
+	return e.editThread(threadID, &discordgo.ChannelEdit{Locked: &locked})
+}
+
+// setThreadAutoArchive sets after how many minutes of inactivity a thread is
+// archived.
+func (e *Engine) setThreadAutoArchive(threadID string, minutes int) error {
+	if !threadAutoArchiveDurations[minutes] {
+		return fmt.Errorf("auto-archive duration must be 60, 1440, 4320 or 10080 minutes, got %d", minutes)
+	}
+	return e.editThread(threadID, &discordgo.ChannelEdit{AutoArchiveDuration: minutes})
+}
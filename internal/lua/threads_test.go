@@ -0,0 +1,68 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestThreadLifecycle(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	err := engine.state.DoString(`
+		results = {}
+		table.insert(results, tostring(lock_thread("42")))
+		table.insert(results, tostring(archive_thread("42")))
+		table.insert(results, tostring(archive_thread("42", false)))
+		table.insert(results, tostring(set_thread_auto_archive("42", 1440)))
+		local ok, err = set_thread_auto_archive("42", 30)
+		bad_duration = err
+		ok, err = lock_thread("general")
+		bad_id = err
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	edits := session.edits["42"]
+	if len(edits) != 4 {
+		t.Fatalf("Expected 4 edits, got %d", len(edits))
+	}
+	if edits[0].Locked == nil || !*edits[0].Locked || edits[0].Archived != nil {
+		t.Errorf("Expected the first edit to only lock, got %+v", edits[0])
+	}
+	if edits[1].Archived == nil || !*edits[1].Archived {
+		t.Errorf("Expected the second edit to archive, got %+v", edits[1])
+	}
+	if edits[2].Archived == nil || *edits[2].Archived {
+		t.Errorf("Expected the third edit to unarchive, got %+v", edits[2])
+	}
+	if edits[3].AutoArchiveDuration != 1440 {
+		t.Errorf("Expected an auto-archive duration of 1440, got %d", edits[3].AutoArchiveDuration)
+	}
+	if err := scriptGlobal(engine, "bad_duration").String(); !strings.Contains(err, "must be 60, 1440") {
+		t.Errorf("Expected an invalid duration error, got %q", err)
+	}
+	if err := scriptGlobal(engine, "bad_id").String(); !strings.Contains(err, "invalid thread ID") {
+		t.Errorf("Expected an invalid ID error, got %q", err)
+	}
+}
+
+func TestThreadPermissionError(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{editErr: &discordgo.RESTError{
+		Message: &discordgo.APIErrorMessage{Code: discordgo.ErrCodeMissingPermissions, Message: "Missing Permissions"},
+	}}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+
+	err := engine.setThreadLocked("42", true)
+	if err == nil || !strings.Contains(err.Error(), "missing permission to manage thread 42") {
+		t.Errorf("Expected a permission error, got %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package lua
 
 import (
-	"log"
+	"fmt"
+	"math/rand/v2"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lua "github.com/yuin/gopher-lua"
@@ -14,10 +17,34 @@ type TimerEntry struct {
 	Duration  time.Duration
 	Callback  lua.LValue
 	Data      lua.LValue
-	Script    *LuaScript
+	Script    *LuaScript // nil for timers registered outside a script, e.g. from the dev shell
 	Timer     *time.Timer
 	Active    bool
 	Repeating bool
+	FireAt    time.Time // when the timer is next due
+
+	// Jitter delays each firing of a repeating timer by a random amount in
+	// [0, Jitter). Offsets are applied to a fixed schedule (nextBase) so the
+	// timer doesn't drift.
+	Jitter   time.Duration
+	nextBase time.Time
+}
+
+// scriptName returns the name of the script that registered the timer, or
+// "" if none did.
+func (entry *TimerEntry) scriptName() string {
+	if entry.Script == nil {
+		return ""
+	}
+	return entry.Script.Name
+}
+
+// TimerInfo is a snapshot of a pending timer.
+type TimerInfo struct {
+	ID        string
+	Script    string // "" for timers registered outside a script
+	Repeating bool
+	Remaining time.Duration
 }
 
 // Timer manages Lua script timers
@@ -37,22 +64,33 @@ func NewTimer(engine *Engine) *Timer {
 
 // RegisterTimer registers a new timer
 func (t *Timer) RegisterTimer(seconds float64, callback lua.LValue, data lua.LValue, script *LuaScript) string {
-	return t.registerTimer(seconds, callback, data, script, false)
+	return t.registerTimer(seconds, callback, data, script, false, 0)
 }
 
 // RegisterRepeatingTimer registers a new repeating timer
 func (t *Timer) RegisterRepeatingTimer(seconds float64, callback lua.LValue, data lua.LValue, script *LuaScript) string {
-	return t.registerTimer(seconds, callback, data, script, true)
+	return t.registerTimer(seconds, callback, data, script, true, 0)
+}
+
+// RegisterJitteredTimer registers a repeating timer whose every firing is
+// delayed by a random amount of up to jitter seconds, which spreads out timers
+// that would otherwise fire at the same moment. Jitter is capped at the
+// interval.
+func (t *Timer) RegisterJitteredTimer(seconds, jitter float64, callback lua.LValue, data lua.LValue, script *LuaScript) string {
+	return t.registerTimer(seconds, callback, data, script, true, jitter)
 }
 
 // registerTimer registers a new timer (internal function)
-func (t *Timer) registerTimer(seconds float64, callback lua.LValue, data lua.LValue, script *LuaScript, repeating bool) string {
+func (t *Timer) registerTimer(seconds float64, callback lua.LValue, data lua.LValue, script *LuaScript, repeating bool, jitter float64) string {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	// Generate unique timer ID
 	timerID := generateTimerID()
 	duration := time.Duration(seconds * float64(time.Second))
+	jitterDuration := min(max(time.Duration(jitter*float64(time.Second)), 0), duration)
+	nextBase := time.Now().Add(duration)
+	delay := duration + randomOffset(jitterDuration)
 
 	// Create timer entry
 	entry := &TimerEntry{
@@ -63,10 +101,13 @@ func (t *Timer) registerTimer(seconds float64, callback lua.LValue, data lua.LVa
 		Script:    script,
 		Active:    true,
 		Repeating: repeating,
+		FireAt:    time.Now().Add(delay),
+		Jitter:    jitterDuration,
+		nextBase:  nextBase,
 	}
 
 	// Create the actual timer
-	entry.Timer = time.AfterFunc(duration, func() {
+	entry.Timer = time.AfterFunc(delay, func() {
 		t.executeTimer(timerID)
 	})
 
@@ -77,7 +118,7 @@ func (t *Timer) registerTimer(seconds float64, callback lua.LValue, data lua.LVa
 	if repeating {
 		timerType = "repeating"
 	}
-	log.Printf("Registered %s timer '%s' for script '%s' (%.2f seconds)", timerType, timerID, script.Name, seconds)
+	scriptLogf(script, "Registered %s timer '%s' (%.2f seconds)", timerType, timerID, seconds)
 	return timerID
 }
 
@@ -100,17 +141,21 @@ func (t *Timer) UnregisterTimer(timerID string) bool {
 	// Remove from map
 	delete(t.timers, timerID)
 
-	log.Printf("Unregistered timer '%s' from script '%s'", timerID, entry.Script.Name)
+	scriptLogf(entry.Script, "Unregistered timer '%s'", timerID)
 	return true
 }
 
-// Removes any pending timers registered by a script
-func (t *Timer) UnregisterScriptTimers(scriptName string) {
+// Removes any pending timers registered by a script. Timers registered
+// outside a script belong to none, so a nil script removes nothing.
+func (t *Timer) UnregisterScriptTimers(script *LuaScript) {
+	if script == nil {
+		return
+	}
 	// it's necessary to fetch the timers in a separate lock to avoid deadlocks
 	t.mu.Lock()
 	var targetTimers []string
 	for timerID, entry := range t.timers {
-		if entry.Script.Name == scriptName {
+		if entry.Script == script {
 			targetTimers = append(targetTimers, timerID)
 		}
 	}
@@ -142,28 +187,40 @@ func (t *Timer) executeTimer(timerID string) {
 		Callback: HookInfo{
 			Function: entry.Callback,
 			Script:   entry.Script,
+			Name:     "timer " + timerID,
 		},
 		TimerData: entry.Data,
 	}
 
-	// Enqueue the timer event
-	select {
-	case t.engine.eventQueue <- event:
-		log.Printf("Timer '%s' from script '%s' executed", timerID, entry.Script.Name)
-	default:
-		log.Printf("Warning: Could not enqueue timer '%s' from script '%s' - queue full", timerID, entry.Script.Name)
+	// Enqueue the timer event. This fails rather than panics if Close has
+	// shut the queue since the timer fired.
+	if err := t.engine.tryEnqueue(event); err != nil {
+		scriptLogf(entry.Script, "Warning: Could not enqueue timer '%s' - %v", timerID, err)
+	} else {
+		scriptLogf(entry.Script, "Timer '%s' executed", timerID)
 	}
 
 	// Handle repeating timers
 	if entry.Repeating {
 		t.mu.Lock()
+		if t.timers[timerID] != entry {
+			// Stopped or unregistered while firing; don't bring it back
+			t.mu.Unlock()
+			return
+		}
 		// Re-register the timer for the next execution
-		entry.Timer = time.AfterFunc(entry.Duration, func() {
+		delay := entry.Duration
+		if entry.Jitter > 0 {
+			entry.nextBase = entry.nextBase.Add(entry.Duration)
+			delay = max(time.Until(entry.nextBase)+randomOffset(entry.Jitter), 0)
+		}
+		entry.Timer = time.AfterFunc(delay, func() {
 			t.executeTimer(timerID)
 		})
+		entry.FireAt = time.Now().Add(delay)
 		entry.Active = true
 		t.mu.Unlock()
-		log.Printf("Re-registered repeating timer '%s' from script '%s'", timerID, entry.Script.Name)
+		scriptLogf(entry.Script, "Re-registered repeating timer '%s'", timerID)
 	} else {
 		// Remove the timer from the map since it's completed (one-shot)
 		t.mu.Lock()
@@ -186,6 +243,31 @@ func (t *Timer) GetActiveTimers() []string {
 	return activeTimers
 }
 
+// ListTimers returns the active timers, soonest first. If scriptName is not
+// empty only that script's timers are included.
+func (t *Timer) ListTimers(scriptName string) []TimerInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now()
+	var timers []TimerInfo
+	for timerID, entry := range t.timers {
+		if !entry.Active || (scriptName != "" && entry.scriptName() != scriptName) {
+			continue
+		}
+		timers = append(timers, TimerInfo{
+			ID:        timerID,
+			Script:    entry.scriptName(),
+			Repeating: entry.Repeating,
+			Remaining: max(entry.FireAt.Sub(now), 0),
+		})
+	}
+	sort.Slice(timers, func(i, j int) bool {
+		return timers[i].Remaining < timers[j].Remaining
+	})
+	return timers
+}
+
 // GetTimerCount returns the number of active timers
 func (t *Timer) GetTimerCount() int {
 	t.mu.RLock()
@@ -209,14 +291,27 @@ func (t *Timer) StopAll() {
 		if entry.Active && entry.Timer != nil {
 			entry.Timer.Stop()
 			entry.Active = false
-			log.Printf("Stopped timer '%s' from script '%s'", timerID, entry.Script.Name)
+			scriptLogf(entry.Script, "Stopped timer '%s'", timerID)
 		}
 		// Remove from map
 		delete(t.timers, timerID)
 	}
 }
 
+// randomOffset returns a random duration in [0, window).
+func randomOffset(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return rand.N(window)
+}
+
+// timerSeq makes timer IDs unique: clocks can be too coarse for timers
+// registered in a tight loop to get different times, and a reused ID would
+// replace a pending timer that then can't be stopped.
+var timerSeq atomic.Uint64
+
 // generateTimerID generates a unique timer ID
 func generateTimerID() string {
-	return "timer_" + time.Now().Format("20060102150405.000000000")
+	return fmt.Sprintf("timer_%s_%d", time.Now().Format("20060102150405.000000000"), timerSeq.Add(1))
 }
@@ -2,6 +2,9 @@ package lua
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -259,3 +262,210 @@ func TestRepeatingTimer(t *testing.T) {
 		t.Errorf("Expected 0 active timers after cancellation, got %d", engine.timer.GetTimerCount())
 	}
 }
+
+func TestListTimers(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	timer := NewTimer(engine)
+	defer timer.StopAll()
+
+	L := lua.NewState()
+	defer L.Close()
+	callback := L.NewFunction(func(L *lua.LState) int {
+		return 0
+	})
+
+	a := &LuaScript{Name: "a.lua"}
+	b := &LuaScript{Name: "b.lua"}
+	later := timer.RegisterTimer(60, callback, lua.LNil, a)
+	time.Sleep(time.Millisecond) // timer IDs are timestamp based
+	sooner := timer.RegisterRepeatingTimer(30, callback, lua.LNil, b)
+
+	all := timer.ListTimers("")
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 timers, got %d", len(all))
+	}
+	if all[0].ID != sooner || all[1].ID != later {
+		t.Errorf("Expected timers ordered soonest first, got %s, %s", all[0].ID, all[1].ID)
+	}
+	if !all[0].Repeating || all[0].Script != "b.lua" {
+		t.Errorf("Unexpected timer info: %+v", all[0])
+	}
+	if all[1].Remaining <= 59*time.Second || all[1].Remaining > 60*time.Second {
+		t.Errorf("Expected about 60s remaining, got %s", all[1].Remaining)
+	}
+
+	onlyA := timer.ListTimers("a.lua")
+	if len(onlyA) != 1 || onlyA[0].ID != later {
+		t.Errorf("Expected only a.lua's timer, got %+v", onlyA)
+	}
+}
+
+func TestTimerWithoutScript(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	// Timers registered outside a script, as from the dev shell, have no
+	// script
+	if err := engine.state.DoString(`
+		fired = false
+		shell_timer = register_timer(0.01, function() fired = true end)
+		later_timer = call_later(60, function() end)
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	script := &LuaScript{Name: "a.lua"}
+	owned := engine.timer.RegisterTimer(60, scriptGlobal(engine, "print"), lua.LNil, script)
+
+	timers := engine.timer.ListTimers("")
+	if len(timers) != 3 {
+		t.Fatalf("Expected 3 timers, got %+v", timers)
+	}
+	for _, info := range timers {
+		if info.ID != owned && info.Script != "" {
+			t.Errorf("Expected no script for %s, got %q", info.ID, info.Script)
+		}
+	}
+	if onlyA := engine.timer.ListTimers("a.lua"); len(onlyA) != 1 || onlyA[0].ID != owned {
+		t.Errorf("Expected only a.lua's timer, got %+v", onlyA)
+	}
+
+	engine.timer.UnregisterScriptTimers(nil)
+	if n := engine.timer.GetTimerCount(); n != 3 {
+		t.Errorf("Expected a nil script to remove no timers, %d left", n)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	drainEvents(engine)
+	if scriptGlobal(engine, "fired") != lua.LTrue {
+		t.Error("Expected the shell timer to fire")
+	}
+
+	engine.timer.StopAll()
+	if n := engine.timer.GetTimerCount(); n != 0 {
+		t.Errorf("Expected StopAll to stop every timer, %d left", n)
+	}
+}
+
+func TestJitteredTimer(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	engine.Initialize()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine.Start(ctx)
+	defer engine.timer.StopAll()
+
+	L := lua.NewState()
+	defer L.Close()
+	var executions atomic.Int32
+	callback := L.NewFunction(func(L *lua.LState) int {
+		executions.Add(1)
+		return 0
+	})
+	script := setupTestScript(t)
+
+	// Jitter never exceeds the interval
+	capped := engine.timer.RegisterJitteredTimer(60, 600, callback, lua.LNil, script)
+	engine.timer.mu.RLock()
+	jitter := engine.timer.timers[capped].Jitter
+	engine.timer.mu.RUnlock()
+	if jitter != time.Minute {
+		t.Errorf("Expected jitter to be capped at the interval, got %s", jitter)
+	}
+	for _, info := range engine.timer.ListTimers("") {
+		if info.Remaining < 59*time.Second || info.Remaining > 120*time.Second {
+			t.Errorf("Expected first firing within the jitter window, got %s", info.Remaining)
+		}
+	}
+	engine.timer.UnregisterTimer(capped)
+
+	// Offsets are taken from a fixed schedule, so the timer fires once per
+	// interval instead of drifting by the accumulated jitter.
+	time.Sleep(time.Millisecond) // timer IDs are timestamp based
+	engine.timer.RegisterJitteredTimer(0.05, 0.04, callback, lua.LNil, script)
+	time.Sleep(520 * time.Millisecond)
+	if n := executions.Load(); n < 8 || n > 11 {
+		t.Errorf("Expected about 10 executions in 0.5s, got %d", n)
+	}
+}
+
+func TestCloseWhileTimersFire(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		db := setupTestDB(t)
+		engine := New(db, nil, nil)
+		engine.Initialize()
+		loadTestScript(t, engine, "busy.lua", `
+			for i = 1, 3 do
+				register_timer(0.001, function() end)
+			end
+		`)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		engine.Start(ctx)
+		time.Sleep(5 * time.Millisecond)
+		engine.Close() // must not panic with a send on the closed queue
+		cancel()
+
+		if _, err := engine.Exec("1"); err == nil {
+			t.Fatal("Expected Exec to fail once the queue is closed")
+		}
+		if n := engine.timer.GetTimerCount(); n != 0 {
+			t.Fatalf("Expected no timers to be re-armed after Close, got %d", n)
+		}
+	}
+}
+
+func TestReloadDoesNotLeakTimers(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	path := filepath.Join(t.TempDir(), "ticker.lua")
+	code := `
+		for i = 1, 3 do
+			register_timer(60, function() end)
+		end
+		call_later(0.001, function() _G.fired = (_G.fired or 0) + 1 end)
+	`
+	if err := os.WriteFile(path, []byte(code), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	if err := engine.loadScript(path); err != nil {
+		t.Fatalf("loadScript failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		// Let the one-shot fire and be queued before the reload
+		time.Sleep(5 * time.Millisecond)
+		if err := engine.reloadScript(path, true); err != nil {
+			t.Fatalf("reloadScript failed: %v", err)
+		}
+		if n := len(engine.timer.ListTimers("ticker.lua")); n > 4 {
+			t.Fatalf("Expected at most 4 timers after reload %d, got %d", i+1, n)
+		}
+	}
+	drainEvents(engine)
+
+	if fired := scriptGlobal(engine, "fired"); fired != lua.LNil {
+		t.Errorf("Expected one-shots fired before a reload to be dropped, got %v runs", fired)
+	}
+	if n := engine.timer.GetTimerCount(); n != 3 && n != 4 {
+		t.Errorf("Expected only the current instance's timers, got %d", n)
+	}
+}
+
+func TestTimerIDsAreUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := generateTimerID()
+		if seen[id] {
+			t.Fatalf("Duplicate timer ID %s", id)
+		}
+		seen[id] = true
+	}
+}
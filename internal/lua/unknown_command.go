@@ -0,0 +1,130 @@
+package lua
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// isCommandName reports whether name could be a command someone meant to
+// type, as opposed to "!!!" or "!?" in ordinary chat.
+func isCommandName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// maxSuggestionDistance is how many edits a typo may be from the command it
+// is suggested for. Short names get less slack so "!hi" doesn't suggest "!ai".
+func maxSuggestionDistance(name string) int {
+	if len([]rune(name)) <= 4 {
+		return 1
+	}
+	return 2
+}
+
+// suggestCommand returns the registered command closest to name, or "" if
+// none is close enough. Commands the user lacks the role for are skipped.
+// Ties go to the alphabetically first command.
+func (e *Engine) suggestCommand(name, userID string) string {
+	e.cmdMutex.Lock()
+	candidates := make([]*Command, 0, len(e.commands))
+	for _, cmd := range e.commands {
+		candidates = append(candidates, cmd)
+	}
+	e.cmdMutex.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	name = strings.ToLower(name)
+	best, bestDistance := "", maxSuggestionDistance(name)+1
+	var roles map[string]bool // looked up once, when a close match needs a role
+	for _, cmd := range candidates {
+		distance := levenshtein(name, strings.ToLower(cmd.Name))
+		if distance >= bestDistance {
+			continue
+		}
+		if cmd.RequiredRole != "" && e.users != nil {
+			if roles == nil {
+				roles = e.userRoles(userID)
+			}
+			if !roles[cmd.RequiredRole] {
+				continue
+			}
+		}
+		best, bestDistance = cmd.Name, distance
+	}
+	return best
+}
+
+// userRoles returns the roles of a user as a set. It is empty for unknown
+// users and when the lookup fails.
+func (e *Engine) userRoles(userID string) map[string]bool {
+	roles := make(map[string]bool)
+	user, err := e.users.GetUser(userID)
+	if err != nil {
+		log.Printf("Failed to look up the roles of user %s: %v", userID, err)
+		return roles
+	}
+	if user != nil {
+		for _, role := range user.Roles {
+			roles[role] = true
+		}
+	}
+	return roles
+}
+
+// handleUnknownCommand answers a !command that matched nothing, as configured
+// by UNKNOWN_COMMAND, and queues the on_unknown_command hooks. The message
+// still goes on to the message hooks afterwards.
+func (e *Engine) handleUnknownCommand(content string, m *discordgo.MessageCreate) {
+	parts := strings.Fields(content)
+	prefix := e.cfg.CommandPrefix
+	name := strings.TrimPrefix(parts[0], prefix)
+	if !isCommandName(name) {
+		return
+	}
+	suggestion := e.suggestCommand(name, m.Author.ID)
+
+	var reply string
+	mode := e.cfg.UnknownCommand
+	if suggestion != "" && (mode == "suggest" || mode == "reply") {
+		reply = fmt.Sprintf("Unknown command `%s%s`. Did you mean `%s%s`?", prefix, name, prefix, suggestion)
+	} else if mode == "reply" {
+		reply = fmt.Sprintf("Unknown command `%s%s`.", prefix, name)
+	}
+	if reply != "" {
+		if _, err := e.sendNotice(m.ChannelID, reply); err != nil {
+			log.Printf("Failed to answer unknown command '%s': %v", name, err)
+		}
+	}
+
+	args := e.state.NewTable()
+	for _, arg := range parts {
+		args.Append(lua.LString(arg))
+	}
+	data := e.state.NewTable()
+	data.RawSetString("command", lua.LString(name))
+	data.RawSetString("args", args)
+	if suggestion != "" {
+		data.RawSetString("suggestion", lua.LString(suggestion))
+	}
+	data.RawSetString("channel_id", lua.LString(m.ChannelID))
+	data.RawSetString("guild_id", lua.LString(m.GuildID))
+	data.RawSetString("author", lua.LString(m.Author.Username))
+	data.RawSetString("author_id", lua.LString(m.Author.ID))
+
+	e.enqueueEvent(BotEvent{Data: data, EventType: "on_unknown_command"}, m.Author.Username)
+}
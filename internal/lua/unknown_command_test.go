@@ -0,0 +1,104 @@
+package lua
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/leihog/discord-bot/internal/users"
+)
+
+func TestUnknownCommand(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "cmds.lua", `
+		unknown = {}
+		register_command("weather", "Shows the weather", function() end)
+		register_command("ping", "Pong", function() end)
+		register_hook("on_unknown_command", function(event)
+			table.insert(unknown, event.command .. ">" .. (event.suggestion or "") .. ":" .. event.args[2])
+		end)
+	`)
+
+	send := func(content string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			GuildID:   "g1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		drainEvents(engine)
+	}
+
+	// Silent by default, but the hook still hears about it
+	send("!wether today")
+	if len(session.sent) != 0 {
+		t.Errorf("Expected no reply by default, got %q", session.sent[0].Content)
+	}
+
+	engine.cfg.UnknownCommand = "suggest"
+	send("!pnig x")
+	send("!pong x")
+	send("!!! x") // not a command
+	if len(session.sent) != 1 || session.sent[0].Content != "Unknown command `!pong`. Did you mean `!ping`?" {
+		t.Errorf("Expected a single suggestion for !pong, got %d replies", len(session.sent))
+	}
+
+	engine.cfg.UnknownCommand = "reply"
+	send("!nonsense x")
+	if n := len(session.sent); n != 2 || session.sent[1].Content != "Unknown command `!nonsense`." {
+		t.Errorf("Expected a plain unknown command reply, got %d replies", n)
+	}
+
+	got, err := execIn(engine, "cmds.lua", `table.concat(unknown, ",")`)
+	if err != nil {
+		t.Fatalf("execIn failed: %v", err)
+	}
+	want := "wether>weather:today,pnig>:x,pong>ping:x,nonsense>:x"
+	if got != want {
+		t.Errorf("Expected hook calls %q, got %q", want, got)
+	}
+}
+
+func TestUnknownCommandSuggestsOnlyAllowedCommands(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	store := users.New(db)
+	engine := New(db, session, store)
+	t.Cleanup(engine.Close)
+	engine.cfg.UnknownCommand = "suggest"
+	engine.Initialize()
+
+	if err := store.EnsureUser("u1", "alice"); err != nil {
+		t.Fatalf("EnsureUser failed: %v", err)
+	}
+	loadTestScript(t, engine, "cmds.lua", `
+		register_command("deploy", "Deploys", function() end, 0, "admin")
+	`)
+
+	send := func() {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   "!deplyo",
+			ChannelID: "c1",
+			GuildID:   "g1",
+			Author:    &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		drainEvents(engine)
+	}
+
+	send()
+	if len(session.sent) != 0 {
+		t.Errorf("Expected no suggestion of a command the user can't run, got %q", session.sent[0].Content)
+	}
+
+	if err := store.AddRole("u1", "admin"); err != nil {
+		t.Fatalf("AddRole failed: %v", err)
+	}
+	send()
+	if len(session.sent) != 1 || session.sent[0].Content != "Unknown command `!deplyo`. Did you mean `!deploy`?" {
+		t.Errorf("Expected !deploy to be suggested to an admin, got %d replies", len(session.sent))
+	}
+}
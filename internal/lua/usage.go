@@ -0,0 +1,34 @@
+package lua
+
+import (
+	"log"
+	"time"
+)
+
+// usagePruneInterval is how often command usage past its retention is pruned.
+const usagePruneInterval = time.Hour
+
+// recordCommandUsage logs a dispatched command when COMMAND_USAGE_LOG is
+// enabled, pruning records older than COMMAND_USAGE_RETENTION at most once per
+// usagePruneInterval. Must be called on the dispatcher goroutine.
+func (e *Engine) recordCommandUsage(command, userID, guildID string) {
+	if !e.cfg.CommandUsageLog {
+		return
+	}
+
+	now := time.Now()
+	if err := e.db.RecordCommandUsage(command, userID, guildID, now); err != nil {
+		log.Printf("Warning: failed to record usage of command '%s': %v", command, err)
+	}
+
+	retention := e.cfg.CommandUsageRetention
+	if retention <= 0 || now.Sub(e.usagePrunedAt) < usagePruneInterval {
+		return
+	}
+	e.usagePrunedAt = now
+	if n, err := e.db.PruneCommandUsage(now.Add(-retention)); err != nil {
+		log.Println("Warning: failed to prune command usage:", err)
+	} else if n > 0 {
+		log.Printf("Pruned %d command usage records older than %s", n, retention)
+	}
+}
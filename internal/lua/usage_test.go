@@ -0,0 +1,64 @@
+package lua
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestCommandUsageLog(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "cmds.lua", `
+		register_command("ping", "Ping", function() end)
+		register_command("roll", "Roll", function() end)
+		register_command("broken", "Fails", function() error("oops") end)
+	`)
+	run := func(content, userID string) {
+		engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+			Content:   content,
+			ChannelID: "c1",
+			GuildID:   "g1",
+			Author:    &discordgo.User{ID: userID, Username: userID},
+		}})
+		drainEvents(engine)
+	}
+
+	// Disabled by default
+	run("!ping", "u1")
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM command_usage`).Scan(&rows); err != nil || rows != 0 {
+		t.Fatalf("Expected no usage to be recorded while disabled, got %d (%v)", rows, err)
+	}
+
+	engine.cfg.CommandUsageLog = true
+	// A stale record that the first logged command prunes
+	if err := db.RecordCommandUsage("old", "u9", "g1", time.Now().Add(-60*24*time.Hour)); err != nil {
+		t.Fatalf("RecordCommandUsage failed: %v", err)
+	}
+	run("!ping", "u1")
+	run("!ping", "u2")
+	run("!ping", "u1")
+	run("!roll", "u1")
+	run("!broken", "u1") // failed commands aren't counted
+
+	err := engine.state.DoString(`
+		local top = get_top_commands(5)
+		count = #top
+		first = top[1].command
+		first_uses = top[1].uses
+		first_users = top[1].users
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	get := func(name string) string { return scriptGlobal(engine, name).String() }
+	if get("count") != "2" || get("first") != "ping" || get("first_uses") != "3" || get("first_users") != "2" {
+		t.Errorf("Expected ping used 3 times by 2 users out of 2 commands, got %s: %s %s/%s",
+			get("count"), get("first"), get("first_uses"), get("first_users"))
+	}
+}
@@ -0,0 +1,113 @@
+package lua
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// userCacheTTL is how long a looked up user is reused before it is fetched
+// again, so renamed users and new avatars show up eventually.
+const userCacheTTL = time.Hour
+
+// userCacheSize is how many users the cache holds before stale ones are
+// dropped, and then the oldest, so a busy bot's memory use stays bounded.
+const userCacheSize = 10000
+
+// userCache holds Discord users by ID. It is filled by get_user lookups and by
+// the authors of incoming messages, which carry the full user object.
+type userCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedUser
+	size    int
+}
+
+type cachedUser struct {
+	user    *discordgo.User
+	fetched time.Time
+}
+
+func newUserCache(size int) *userCache {
+	return &userCache{entries: make(map[string]cachedUser), size: size}
+}
+
+func (c *userCache) get(id string) (*discordgo.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok || time.Since(entry.fetched) > userCacheTTL {
+		return nil, false
+	}
+	return entry.user, true
+}
+
+func (c *userCache) put(user *discordgo.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if _, ok := c.entries[user.ID]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[user.ID] = cachedUser{user: user, fetched: now}
+}
+
+// evict makes room for a new entry: it drops the expired entries or, if there
+// are none, the oldest one. Must be called with mu held.
+func (c *userCache) evict(now time.Time) {
+	var oldestID string
+	var oldest time.Time
+	for id, entry := range c.entries {
+		if now.Sub(entry.fetched) > userCacheTTL {
+			delete(c.entries, id)
+		} else if oldestID == "" || entry.fetched.Before(oldest) {
+			oldestID, oldest = id, entry.fetched
+		}
+	}
+	if len(c.entries) >= c.size {
+		delete(c.entries, oldestID)
+	}
+}
+
+// lookupUser returns a Discord user, from the cache if it is fresh and from
+// the API otherwise.
+func (e *Engine) lookupUser(id string) (*discordgo.User, error) {
+	if user, ok := e.userCache.get(id); ok {
+		return user, nil
+	}
+	user, err := e.session.User(id)
+	if err != nil {
+		return nil, err
+	}
+	e.userCache.put(user)
+	return user, nil
+}
+
+// avatarURL returns the CDN URL of a user's avatar, or of the default avatar
+// if they have none. size must be a power of two between 16 and 4096, or 0
+// for Discord's default size.
+func avatarURL(user *discordgo.User, size int) (string, error) {
+	if size != 0 && (size < 16 || size > 4096 || size&(size-1) != 0) {
+		return "", fmt.Errorf("avatar size must be a power of two between 16 and 4096, got %d", size)
+	}
+	if size == 0 {
+		return user.AvatarURL(""), nil
+	}
+	return user.AvatarURL(strconv.Itoa(size)), nil
+}
+
+// userToLua converts a user into a {id, username, display_name, discriminator,
+// avatar_url, bot} table.
+func userToLua(L *lua.LState, user *discordgo.User, avatar string) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LString(user.ID))
+	tbl.RawSetString("username", lua.LString(user.Username))
+	tbl.RawSetString("display_name", lua.LString(user.DisplayName()))
+	tbl.RawSetString("discriminator", lua.LString(user.Discriminator))
+	tbl.RawSetString("avatar_url", lua.LString(avatar))
+	tbl.RawSetString("bot", lua.LBool(user.Bot))
+	return tbl
+}
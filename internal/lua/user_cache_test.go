@@ -0,0 +1,87 @@
+package lua
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestGetUser(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{users: map[string]*discordgo.User{
+		"80351110224678912": {ID: "80351110224678912", Username: "nelly", GlobalName: "Nelly", Discriminator: "0", Avatar: "8342729096ea3675442027381ff50dfe"},
+	}}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	// Message authors are cached without an API call
+	engine.ProcessMessage(&discordgo.MessageCreate{Message: &discordgo.Message{
+		Content:   "hi",
+		ChannelID: "c1",
+		Author:    &discordgo.User{ID: "42", Username: "alice", Discriminator: "0"},
+	}})
+	drainEvents(engine)
+
+	err := engine.state.DoString(`
+		local user = get_user("80351110224678912", 128)
+		name = user.username
+		display = user.display_name
+		avatar = user.avatar_url
+		again = get_user("80351110224678912").username
+
+		author = get_user("42")
+		author_name = author.username
+		default_avatar = author.avatar_url
+
+		bad_size, bad_size_err = get_user("42", 100)
+		missing, missing_err = get_user("7")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	get := func(name string) string { return scriptGlobal(engine, name).String() }
+	if get("name") != "nelly" || get("display") != "Nelly" || get("again") != "nelly" {
+		t.Errorf("Unexpected user: %s (%s), again %s", get("name"), get("display"), get("again"))
+	}
+	if want := discordgo.EndpointUserAvatar("80351110224678912", "8342729096ea3675442027381ff50dfe") + "?size=128"; get("avatar") != want {
+		t.Errorf("Expected avatar %s, got %s", want, get("avatar"))
+	}
+	if get("author_name") != "alice" || get("default_avatar") == "" {
+		t.Errorf("Expected the cached author with a default avatar, got %s / %s", get("author_name"), get("default_avatar"))
+	}
+	if get("bad_size") != "nil" || get("bad_size_err") == "nil" {
+		t.Error("Expected an invalid avatar size to be rejected")
+	}
+	if get("missing") != "nil" || get("missing_err") == "nil" {
+		t.Error("Expected nil and an error for an unknown user")
+	}
+	if session.userLoads != 2 {
+		t.Errorf("Expected 2 API lookups (nelly once, the unknown user), got %d", session.userLoads)
+	}
+}
+
+func TestUserCacheIsBounded(t *testing.T) {
+	cache := newUserCache(2)
+	cache.put(&discordgo.User{ID: "1"})
+	cache.put(&discordgo.User{ID: "2"})
+	cache.entries["1"] = cachedUser{user: cache.entries["1"].user, fetched: time.Now().Add(-2 * userCacheTTL)}
+
+	// An expired entry makes room first...
+	cache.put(&discordgo.User{ID: "3"})
+	if _, ok := cache.entries["1"]; ok || len(cache.entries) != 2 {
+		t.Errorf("Expected the expired user to be evicted, cache holds %d users", len(cache.entries))
+	}
+
+	// ...and otherwise the oldest one goes
+	cache.entries["2"] = cachedUser{user: cache.entries["2"].user, fetched: time.Now().Add(-time.Minute)}
+	cache.put(&discordgo.User{ID: "4"})
+	if _, ok := cache.entries["2"]; ok || len(cache.entries) != 2 {
+		t.Errorf("Expected the oldest user to be evicted, cache holds %d users", len(cache.entries))
+	}
+	if _, ok := cache.get("3"); !ok {
+		t.Error("Expected the newer users to stay cached")
+	}
+}
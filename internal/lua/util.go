@@ -2,6 +2,9 @@ package lua
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -23,3 +26,55 @@ func (e *Engine) jsonDecode(jsonStr string) (lua.LValue, error) {
 	}
 	return goValueToLua(e.state, v), nil
 }
+
+// formatDuration renders a duration as a compact human readable string such
+// as "2d 3h" or "45s". Only the two most significant non-zero units are shown.
+func formatDuration(d time.Duration) string {
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+
+	var parts []string
+	for _, unit := range units {
+		if n := d / unit.size; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", n, unit.suffix))
+			d -= n * unit.size
+		}
+		if len(parts) == 2 {
+			break
+		}
+	}
+	if len(parts) == 0 {
+		return "0s"
+	}
+	return strings.Join(parts, " ")
+}
+
+// levenshtein returns the edit distance between a and b: the number of single
+// character insertions, deletions and substitutions turning one into the other.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -2,6 +2,7 @@ package lua
 
 import (
 	"testing"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -9,6 +10,7 @@ import (
 func TestJsonEncodeBasic(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create a simple Lua table
 	L := lua.NewState()
@@ -41,6 +43,7 @@ func TestJsonEncodeBasic(t *testing.T) {
 func TestJsonEncodeComplex(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create a complex Lua table with nested structure
 	L := lua.NewState()
@@ -55,6 +58,11 @@ func TestJsonEncodeComplex(t *testing.T) {
 	outerTable.RawSetString("level1", lua.LString("test"))
 	outerTable.RawSetString("level2", innerTable)
 	outerTable.RawSetString("number", lua.LNumber(123))
+	list := L.NewTable()
+	list.Append(lua.LNumber(1))
+	list.Append(lua.LNumber(2.5))
+	list.Append(lua.LFalse)
+	outerTable.RawSetString("list", list)
 
 	// Test JSON encoding
 	result, err := engine.jsonEncode(outerTable)
@@ -69,16 +77,10 @@ func TestJsonEncodeComplex(t *testing.T) {
 	if jsonStr, ok := result.(lua.LString); !ok {
 		t.Errorf("Expected string, got %T", result)
 	} else {
-		// Check that it contains expected fields
-		jsonString := jsonStr.String()
-		if !contains(jsonString, "level1") {
-			t.Errorf("Expected to contain 'level1', got %s", jsonString)
-		}
-		if !contains(jsonString, "level2") {
-			t.Errorf("Expected to contain 'level2', got %s", jsonString)
-		}
-		if !contains(jsonString, "nested") {
-			t.Errorf("Expected to contain 'nested', got %s", jsonString)
+		// Numbers and booleans stay JSON numbers and booleans at every level
+		expected := `{"level1":"test","level2":{"nested":"value"},"list":[1,2.5,false],"number":123}`
+		if jsonStr.String() != expected {
+			t.Errorf("Expected %s, got %s", expected, jsonStr.String())
 		}
 	}
 }
@@ -86,6 +88,7 @@ func TestJsonEncodeComplex(t *testing.T) {
 func TestJsonDecodeBasic(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Test JSON decoding
 	jsonString := `{"name":"test","value":42,"active":true}`
@@ -117,6 +120,7 @@ func TestJsonDecodeBasic(t *testing.T) {
 func TestJsonDecodeComplex(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Test JSON decoding with nested structure
 	jsonString := `{"level1":"test","level2":{"nested":"value"},"number":123}`
@@ -158,6 +162,7 @@ func TestJsonDecodeComplex(t *testing.T) {
 func TestJsonRoundtrip(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Create a complex Lua table
 	L := lua.NewState()
@@ -199,6 +204,7 @@ func TestJsonRoundtrip(t *testing.T) {
 func TestJsonDecodeInvalid(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Test invalid JSON
 	invalidJson := `{"name":"test",invalid}`
@@ -215,6 +221,7 @@ func TestJsonDecodeInvalid(t *testing.T) {
 func TestJsonDecodeWithArrays(t *testing.T) {
 	db := setupTestDB(t)
 	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
 
 	// Test JSON with arrays
 	jsonString := `{"name":"Bob","age":25,"skills":["python","javascript"],"numbers":[1,2,3]}`
@@ -275,17 +282,77 @@ func TestJsonDecodeWithArrays(t *testing.T) {
 	}
 }
 
-// Helper function to check if a string contains a substring
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr ||
-		(len(s) > len(substr) && (s[:len(substr)] == substr ||
-			s[len(s)-len(substr):] == substr ||
-			func() bool {
-				for i := 1; i <= len(s)-len(substr); i++ {
-					if s[i:i+len(substr)] == substr {
-						return true
-					}
-				}
-				return false
-			}())))
+func TestJsonDecodeTopLevelValues(t *testing.T) {
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+
+	// A bare array becomes a sequence
+	result, err := engine.jsonDecode(`[1,"two",true]`)
+	if err != nil {
+		t.Fatalf("jsonDecode of an array failed: %v", err)
+	}
+	tbl, ok := result.(*lua.LTable)
+	if !ok {
+		t.Fatalf("Expected table, got %T", result)
+	}
+	if tbl.Len() != 3 || tbl.RawGetInt(1) != lua.LNumber(1) || tbl.RawGetInt(2) != lua.LString("two") || tbl.RawGetInt(3) != lua.LTrue {
+		t.Errorf("Expected {1, \"two\", true}, got %v %v %v (len %d)", tbl.RawGetInt(1), tbl.RawGetInt(2), tbl.RawGetInt(3), tbl.Len())
+	}
+
+	// Bare scalars decode to the matching Lua value
+	for input, want := range map[string]lua.LValue{
+		`"hello"`: lua.LString("hello"),
+		`42`:      lua.LNumber(42),
+		`2.5`:     lua.LNumber(2.5),
+		`false`:   lua.LFalse,
+		`null`:    lua.LNil,
+	} {
+		result, err := engine.jsonDecode(input)
+		if err != nil {
+			t.Errorf("jsonDecode(%s) failed: %v", input, err)
+		} else if result != want {
+			t.Errorf("jsonDecode(%s) = %v, want %v", input, result, want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{500 * time.Millisecond, "0s"},
+		{45 * time.Second, "45s"},
+		{90 * time.Second, "1m 30s"},
+		{3*time.Hour + 5*time.Second, "3h 5s"},
+		{26*time.Hour + 30*time.Minute + 10*time.Second, "1d 2h"},
+	}
+	for _, tt := range tests {
+		if got := formatDuration(tt.d); got != tt.want {
+			t.Errorf("formatDuration(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "ping", 4},
+		{"ping", "ping", 0},
+		{"pnig", "ping", 2},
+		{"pin", "ping", 1},
+		{"weather", "wether", 1},
+		{"kitten", "sitting", 3},
+		{"häst", "hast", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
 }
@@ -2,9 +2,12 @@ package lua
 
 import (
 	"context"
+	"errors"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -13,6 +16,9 @@ import (
 type Watcher struct {
 	engine *Engine
 	dir    string
+
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher // nil until Start, and again once stopped
 }
 
 // NewWatcher creates a new file watcher
@@ -31,8 +37,19 @@ func (w *Watcher) Start(ctx context.Context) {
 		return
 	}
 
+	w.mu.Lock()
+	w.watcher = watcher
+	w.mu.Unlock()
+	w.engine.watcher.Store(w)
+
 	go func() {
-		defer watcher.Close()
+		defer func() {
+			w.engine.watcher.CompareAndSwap(w, nil)
+			w.mu.Lock()
+			w.watcher = nil
+			w.mu.Unlock()
+			watcher.Close()
+		}()
 
 		for {
 			select {
@@ -42,11 +59,17 @@ func (w *Watcher) Start(ctx context.Context) {
 					return
 				}
 
-				// Only process .lua files and ignore files starting with '.'
+				// Only process .lua and .conf files and ignore files starting with '.'
 				if !w.shouldProcessFile(event.Name) {
 					continue
 				}
 
+				// A changed, added or removed config file reloads its script
+				if filepath.Ext(event.Name) == ".conf" {
+					w.reloadConfiguredScript(event)
+					continue
+				}
+
 				// todo: handle removed/deleted files
 
 				log.Println("File watcher event:", event)
@@ -82,12 +105,41 @@ func (w *Watcher) Start(ctx context.Context) {
 	}
 }
 
+// AddDir watches another script directory, see Engine.AddScriptDir.
+func (w *Watcher) AddDir(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watcher == nil {
+		return errors.New("the script watcher is not running")
+	}
+	return w.watcher.Add(dir)
+}
+
+// reloadConfiguredScript reloads the script a config file event belongs to,
+// if that script exists.
+func (w *Watcher) reloadConfiguredScript(event fsnotify.Event) {
+	if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) &&
+		!event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+		return
+	}
+	scriptPath := strings.TrimSuffix(event.Name, ".conf") + ".lua"
+	if _, err := os.Stat(scriptPath); err != nil {
+		return
+	}
+	log.Println("Reloading script due to config change:", scriptPath)
+	w.engine.enqueueEvent(ScriptEvent{
+		ScriptName: scriptPath,
+		Action:     "reload",
+	}, "watcher")
+}
+
 // shouldProcessFile checks if a file should be processed by the watcher
 func (w *Watcher) shouldProcessFile(filename string) bool {
 	base := filepath.Base(filename)
-	if !strings.HasPrefix(base, ".") && filepath.Ext(base) == ".lua" {
-		// it's a non-hidden .lua file
-		return true
+	if strings.HasPrefix(base, ".") {
+		return false
 	}
-	return false
+	// it's a non-hidden script or script config file
+	ext := filepath.Ext(base)
+	return ext == ".lua" || ext == ".conf"
 }
@@ -0,0 +1,162 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// webhookURLPattern matches the webhook URLs Discord hands out, capturing the
+// webhook ID and token. The client variants (ptb, canary) and the old
+// discordapp.com domain are accepted too.
+var webhookURLPattern = regexp.MustCompile(`^https://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/api(?:/v\d+)?/webhooks/(\d+)/([\w-]+)/?$`)
+
+// webhookAPI is the Discord API base webhook messages are posted to, whatever
+// the form of the URL a script passed. Tests point it at a local server.
+var webhookAPI = "https://discord.com/api/v10"
+
+// webhookURL returns the URL scripts use for a webhook.
+func webhookURL(id, token string) string {
+	return "https://discord.com/api/webhooks/" + id + "/" + token
+}
+
+// webhookPayload is the JSON body of Discord's execute webhook endpoint.
+type webhookPayload struct {
+	Content         string                            `json:"content,omitempty"`
+	Username        string                            `json:"username,omitempty"`
+	AvatarURL       string                            `json:"avatar_url,omitempty"`
+	Embeds          []*discordgo.MessageEmbed         `json:"embeds,omitempty"`
+	AllowedMentions *discordgo.MessageAllowedMentions `json:"allowed_mentions,omitempty"`
+}
+
+// webhookExecuteURL checks that rawURL is a Discord webhook URL and returns
+// the endpoint to post to. With wait set Discord answers with the message,
+// so a rejected message is an error rather than silently dropped.
+func webhookExecuteURL(rawURL string) (string, error) {
+	m := webhookURLPattern.FindStringSubmatch(strings.TrimSpace(rawURL))
+	if m == nil {
+		return "", errors.New("not a Discord webhook URL, expected https://discord.com/api/webhooks/<id>/<token>")
+	}
+	return webhookAPI + "/webhooks/" + m[1] + "/" + m[2] + "?wait=true", nil
+}
+
+// webhookSend posts a message through a webhook and returns its ID. The
+// request goes through the HTTP path of http_post, so the timeout and circuit
+// breaker settings apply. Errors never include the URL, as its token is all it
+// takes to post to the channel.
+func (e *Engine) webhookSend(rawURL string, payload webhookPayload) (string, error) {
+	endpoint, err := webhookExecuteURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if payload.Content == "" && len(payload.Embeds) == 0 {
+		return "", errors.New("webhook message needs content or embeds")
+	}
+	if n := messageLength(payload.Content); n > maxMessageLength {
+		return "", fmt.Errorf("message is %d characters long, Discord allows %d; use split_message to send it in parts", n, maxMessageLength)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	opts := e.requestOptions(nil)
+	opts.Headers["Content-Type"] = "application/json"
+	result := e.breaker.do(endpoint, func() HTTPResult {
+		ctx, cancel := e.requestContext()
+		defer cancel()
+		return doHTTPRequest(ctx, "POST", endpoint, string(body), opts)
+	})
+	if result.Err != nil {
+		var urlErr *url.Error
+		if errors.As(result.Err, &urlErr) {
+			return "", fmt.Errorf("webhook request failed: %w", urlErr.Err)
+		}
+		return "", result.Err
+	}
+	if result.StatusCode < 200 || result.StatusCode > 299 {
+		return "", webhookError(result)
+	}
+
+	var msg struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(result.Body), &msg); err != nil {
+		return "", fmt.Errorf("decoding webhook response: %w", err)
+	}
+	return msg.ID, nil
+}
+
+// webhookError turns a failed webhook response into an error, using the
+// message Discord sends along when there is one.
+func webhookError(result HTTPResult) error {
+	var apiErr struct {
+		Message    string  `json:"message"`
+		RetryAfter float64 `json:"retry_after"`
+	}
+	json.Unmarshal([]byte(result.Body), &apiErr)
+	switch {
+	case result.StatusCode == 429:
+		return fmt.Errorf("webhook rate limited, retry in %.1fs", apiErr.RetryAfter)
+	case apiErr.Message != "":
+		return fmt.Errorf("webhook returned %d: %s", result.StatusCode, apiErr.Message)
+	default:
+		return fmt.Errorf("webhook returned %d", result.StatusCode)
+	}
+}
+
+// parseWebhookMessage builds a webhook payload from a webhook_send message
+// table: content, username, avatar_url, embeds (one or an array, themed unless
+// theme = false) and allowed_mentions, which defaults to ALLOWED_MENTIONS.
+func (e *Engine) parseWebhookMessage(tbl *lua.LTable) (webhookPayload, error) {
+	payload := webhookPayload{
+		Content:         lua.LVAsString(tbl.RawGetString("content")),
+		Username:        lua.LVAsString(tbl.RawGetString("username")),
+		AvatarURL:       lua.LVAsString(tbl.RawGetString("avatar_url")),
+		AllowedMentions: e.defaultAllowedMentions(),
+	}
+	if embeds, ok := tbl.RawGetString("embeds").(*lua.LTable); ok {
+		parsed, err := parseEmbeds(embeds)
+		if err != nil {
+			return payload, err
+		}
+		if tbl.RawGetString("theme") != lua.LFalse {
+			if err := e.applyEmbedTheme(parsed); err != nil {
+				return payload, err
+			}
+		}
+		payload.Embeds = parsed
+	}
+	if value := tbl.RawGetString("allowed_mentions"); value != lua.LNil {
+		mentions, err := parseAllowedMentions(value)
+		if err != nil {
+			return payload, err
+		}
+		payload.AllowedMentions = mentions
+	}
+	return payload, nil
+}
+
+// createWebhook creates a webhook in a channel and returns its ID and URL.
+// The bot needs the Manage Webhooks permission there.
+func (e *Engine) createWebhook(channelID, name string) (*lua.LTable, error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return nil, errors.New("webhook name must not be empty")
+	}
+	webhook, err := e.session.WebhookCreate(channelID, name, "")
+	if err != nil {
+		return nil, err
+	}
+	tbl := e.state.NewTable()
+	tbl.RawSetString("id", lua.LString(webhook.ID))
+	tbl.RawSetString("channel_id", lua.LString(webhook.ChannelID))
+	tbl.RawSetString("name", lua.LString(webhook.Name))
+	tbl.RawSetString("url", lua.LString(webhookURL(webhook.ID, webhook.Token)))
+	return tbl, nil
+}
@@ -0,0 +1,117 @@
+package lua
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestWebhookSend(t *testing.T) {
+	var paths []string
+	var payloads []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]any
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("payload is not JSON: %v", err)
+		}
+		payloads = append(payloads, payload)
+		if payload["username"] == "clyde" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "Invalid Form Body", "code": 50035}`))
+			return
+		}
+		w.Write([]byte(`{"id": "555", "content": "hi"}`))
+	}))
+	defer server.Close()
+	defer func(api string) { webhookAPI = api }(webhookAPI)
+	webhookAPI = server.URL
+
+	db := setupTestDB(t)
+	engine := New(db, nil, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "webhook.lua", `
+		url = "https://discordapp.com/api/webhooks/123/abc-DEF_9"
+		id, err = webhook_send(url, {
+			content = "Hello <@1>",
+			username = "Narrator",
+			avatar_url = "https://example.com/a.png",
+			embeds = { title = "Chapter 1" },
+		})
+		rejected_id, rejected_err = webhook_send(url, { content = "hi", username = "clyde" })
+		bad_id, bad_err = webhook_send("https://example.com/api/webhooks/123/abc", { content = "hi" })
+		empty_id, empty_err = webhook_send(url, { username = "Narrator" })
+	`)
+
+	if id := scriptGlobal(engine, "id"); id.String() != "555" {
+		t.Fatalf("webhook_send = %v, %v", id, scriptGlobal(engine, "err"))
+	}
+	if len(paths) != 2 || paths[0] != "/webhooks/123/abc-DEF_9?wait=true" {
+		t.Fatalf("requests = %v, want two to /webhooks/123/abc-DEF_9?wait=true", paths)
+	}
+	payload := payloads[0]
+	if payload["content"] != "Hello <@1>" || payload["username"] != "Narrator" || payload["avatar_url"] != "https://example.com/a.png" {
+		t.Errorf("payload = %v", payload)
+	}
+	if embeds, _ := payload["embeds"].([]any); len(embeds) != 1 {
+		t.Errorf("embeds = %v, want the single embed as an array", payload["embeds"])
+	}
+	if mentions, _ := payload["allowed_mentions"].(map[string]any); mentions == nil {
+		t.Error("allowed_mentions should default to ALLOWED_MENTIONS")
+	}
+	engine.cfg.LoopGuardMaxEchoes = 0
+	if !engine.isEcho("relayed: Hello <@1>") {
+		t.Error("Expected webhook messages to be remembered by the loop guard")
+	}
+
+	if scriptGlobal(engine, "rejected_id") != lua.LNil || !strings.Contains(scriptGlobal(engine, "rejected_err").String(), "Invalid Form Body") {
+		t.Errorf("rejected message: err = %v, want Discord's message", scriptGlobal(engine, "rejected_err"))
+	}
+	if scriptGlobal(engine, "bad_id") != lua.LNil || !strings.Contains(scriptGlobal(engine, "bad_err").String(), "not a Discord webhook URL") {
+		t.Errorf("non-Discord URL: err = %v", scriptGlobal(engine, "bad_err"))
+	}
+	if scriptGlobal(engine, "empty_id") != lua.LNil {
+		t.Error("a message without content or embeds should be refused")
+	}
+}
+
+func TestCreateWebhook(t *testing.T) {
+	db := setupTestDB(t)
+	session := &fakeSession{}
+	engine := New(db, session, nil)
+	t.Cleanup(engine.Close)
+	engine.Initialize()
+
+	loadTestScript(t, engine, "webhook.lua", `
+		hook = create_webhook("c1", "Narrator")
+		blank, blank_err = create_webhook("c1", "  ")
+	`)
+
+	hook, ok := scriptGlobal(engine, "hook").(*lua.LTable)
+	if !ok {
+		t.Fatalf("create_webhook returned %v", scriptGlobal(engine, "hook"))
+	}
+	if url := hook.RawGetString("url").String(); url != "https://discord.com/api/webhooks/100/secret-token" {
+		t.Errorf("url = %s", url)
+	}
+	if _, err := webhookExecuteURL(hook.RawGetString("url").String()); err != nil {
+		t.Errorf("the returned URL should be accepted by webhook_send: %v", err)
+	}
+	if len(session.webhooks) != 1 || session.webhooks[0].ChannelID != "c1" {
+		t.Errorf("webhooks = %v", session.webhooks)
+	}
+	if scriptGlobal(engine, "blank") != lua.LNil {
+		t.Error("a blank name should be refused")
+	}
+}
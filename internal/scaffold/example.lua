@@ -0,0 +1,32 @@
+-- example.lua: a starter script written by `bot --init`.
+--
+-- Every .lua file in the scripts directory is loaded at startup and reloaded
+-- when it changes, so edit this file while the bot is running and watch the
+-- log. See the README for the full list of functions and hooks.
+
+-- Commands are messages starting with "!". This one answers "!ping".
+-- The last argument is a cooldown in seconds.
+register_command("ping", "Replies with Pong!", function(event)
+    -- event.args[1] is the command name, the words after it follow
+    send_message(event.channel_id, "Pong!")
+end, 5)
+
+-- Hooks run for every matching event. on_channel_message receives all
+-- non-command messages posted in servers the bot is in.
+register_hook("on_channel_message", function(event)
+    if event.content:lower() == "hello bot" then
+        send_message(event.channel_id, "Hello, " .. event.author .. "!")
+    end
+end)
+
+-- Data saved with store_set survives restarts.
+register_hook("on_channel_message", function(event)
+    local count = store_get("example", "messages_seen") or 0
+    store_set("example", "messages_seen", count + 1)
+end)
+
+-- Timers call a function later; register_timer repeats until cancelled.
+-- Here we log how many messages we've seen once an hour.
+register_timer(3600, function()
+    log("Messages seen so far: " .. tostring(store_get("example", "messages_seen") or 0))
+end)
@@ -0,0 +1,39 @@
+// Package scaffold writes starter files for new installations.
+package scaffold
+
+import (
+	_ "embed"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExampleScriptName is the file name used for the starter script.
+const ExampleScriptName = "example.lua"
+
+//go:embed example.lua
+var exampleScript []byte
+
+// WriteExampleScript writes a commented example script into dir, creating the
+// directory if needed. Nothing is written if dir already contains a Lua
+// script. It returns the path written, or "" if it was skipped.
+func WriteExampleScript(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".lua") {
+			return "", nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, ExampleScriptName)
+	if err := os.WriteFile(path, exampleScript, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
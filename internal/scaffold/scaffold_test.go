@@ -0,0 +1,37 @@
+package scaffold
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteExampleScript(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "scripts")
+
+	path, err := WriteExampleScript(dir)
+	if err != nil {
+		t.Fatalf("WriteExampleScript failed: %v", err)
+	}
+	if path != filepath.Join(dir, ExampleScriptName) {
+		t.Fatalf("Expected example to be written to %s, got %q", dir, path)
+	}
+	if data, err := os.ReadFile(path); err != nil || len(data) == 0 {
+		t.Fatalf("Expected example script contents, got %d bytes (%v)", len(data), err)
+	}
+
+	// A directory that already holds scripts is left alone.
+	if err := os.WriteFile(path, []byte("-- mine"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path, err = WriteExampleScript(dir)
+	if err != nil {
+		t.Fatalf("WriteExampleScript failed: %v", err)
+	}
+	if path != "" {
+		t.Errorf("Expected non-empty directory to be skipped, wrote %s", path)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, ExampleScriptName)); string(data) != "-- mine" {
+		t.Error("Expected existing script to be untouched")
+	}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+)
+
+// minRedactLength skips very short secrets, which would mangle unrelated log
+// text without protecting much.
+const minRedactLength = 4
+
+// RedactingWriter masks secret values in everything written through it. It is
+// meant for log output, where each Write is one complete log line.
+type RedactingWriter struct {
+	out     io.Writer
+	secrets [][]byte
+}
+
+// NewRedactingWriter returns a writer that replaces every occurrence of the
+// given secrets with "***" before passing the data to out.
+func NewRedactingWriter(out io.Writer, secrets []string) *RedactingWriter {
+	w := &RedactingWriter{out: out}
+	for _, secret := range secrets {
+		if len(secret) >= minRedactLength {
+			w.secrets = append(w.secrets, []byte(secret))
+		}
+	}
+	return w
+}
+
+func (w *RedactingWriter) Write(p []byte) (int, error) {
+	redacted := p
+	for _, secret := range w.secrets {
+		if bytes.Contains(redacted, secret) {
+			redacted = bytes.ReplaceAll(redacted, secret, []byte("***"))
+		}
+	}
+	if _, err := w.out.Write(redacted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
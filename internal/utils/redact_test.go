@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewRedactingWriter(&buf, []string{"hunter22", "abc", "s3cr3t-token"})
+
+	line := "calling api with key=hunter22 and token s3cr3t-token (abc stays)\n"
+	n, err := w.Write([]byte(line))
+	if err != nil || n != len(line) {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if want := "calling api with key=*** and token *** (abc stays)\n"; buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
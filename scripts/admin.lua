@@ -0,0 +1,218 @@
+-- Owner-only maintenance commands
+
+local PREFIX = command_prefix()
+
+register_command("vacuum", "Compact the database", function(event)
+    local before, after = db_vacuum()
+    if not before then
+        send_message(event.channel_id, "Vacuum failed: " .. after)
+        return
+    end
+    send_message(event.channel_id, string.format("Database vacuumed: %.1f KB -> %.1f KB", before / 1024, after / 1024))
+end, 0, "owner")
+
+local MAX_LISTED_TIMERS = 20
+
+register_command("timers", "List pending timers: " .. PREFIX .. "timers [script]", function(event)
+    local script = event.args[2]
+    local timers = get_timers(script)
+    if #timers == 0 then
+        send_message(event.channel_id, "No pending timers" .. (script and (" for " .. script) or ""))
+        return
+    end
+
+    local lines = { string.format("%d pending timer(s):", #timers) }
+    for i, t in ipairs(timers) do
+        if i > MAX_LISTED_TIMERS then
+            table.insert(lines, string.format("... and %d more", #timers - MAX_LISTED_TIMERS))
+            break
+        end
+        table.insert(lines, string.format("`%s` %s%s in %.1fs", t.id, t.script, t.repeating and " (repeating)" or "", t.remaining))
+    end
+    send_message(event.channel_id, table.concat(lines, "\n"))
+end, 0, "owner")
+
+register_command("canceltimer", "Cancel a timer: " .. PREFIX .. "canceltimer <id>", function(event)
+    local id = event.args[2]
+    if not id then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "canceltimer <id>")
+        return
+    end
+    if unregister_timer(id) then
+        send_message(event.channel_id, "Cancelled " .. id)
+    else
+        send_message(event.channel_id, "No timer with id " .. id)
+    end
+end, 0, "owner")
+
+register_command("config", "Show the effective configuration", function(event)
+    local lines = { "Effective configuration:", "```" }
+    for _, setting in ipairs(get_config()) do
+        table.insert(lines, setting.name .. "=" .. setting.value)
+    end
+    table.insert(lines, "```")
+    send_message(event.channel_id, table.concat(lines, "\n"))
+end, 0, "owner")
+
+register_command("broadcast", "Send a notice to every guild: " .. PREFIX .. "broadcast <message>", function(event)
+    local message = table.concat(event.args, " ", 2)
+    if message == "" then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "broadcast <message>")
+        return
+    end
+    local count, err = broadcast(message, function(result)
+        local failed = {}
+        for guild_id, reason in pairs(result.failed) do
+            table.insert(failed, guild_id .. ": " .. reason)
+        end
+        local summary = string.format("Broadcast sent to %d guild(s)", #result.sent)
+        if #failed > 0 then
+            summary = summary .. string.format(", %d failed:\n", #failed) .. table.concat(failed, "\n")
+        end
+        send_message(event.channel_id, summary)
+    end)
+    if not count then
+        send_message(event.channel_id, "Broadcast failed: " .. err)
+        return
+    end
+    send_message(event.channel_id, string.format("Broadcasting to %d guild(s)...", count))
+end, 0, "owner")
+
+register_command("topcommands", "Most used commands: " .. PREFIX .. "topcommands [days]", function(event)
+    local days = tonumber(event.args[2]) or 30
+    local top, err = get_top_commands(10, days)
+    if not top then
+        send_message(event.channel_id, "Can't show command usage: " .. err)
+        return
+    end
+    if #top == 0 then
+        send_message(event.channel_id, string.format("No commands used in the last %d day(s)", days))
+        return
+    end
+
+    local lines = { string.format("Top commands, last %d day(s):", days) }
+    for i, c in ipairs(top) do
+        table.insert(lines, string.format("%d. %s%s - %d use(s) by %d user(s)", i, PREFIX, c.command, c.uses, c.users))
+    end
+    send_message(event.channel_id, table.concat(lines, "\n"))
+end, 0, "owner")
+
+register_command("exportdata", "Export stored data to a JSON file in the export directory: " .. PREFIX .. "exportdata <file>", function(event)
+    local path = event.args[2]
+    if not path then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "exportdata <file>")
+        return
+    end
+    local count, err = export_data(path)
+    if not count then
+        send_message(event.channel_id, "Export failed: " .. err)
+        return
+    end
+    send_message(event.channel_id, string.format("Exported %d entries to %s", count, path))
+end, 0, "owner")
+
+register_command("importdata", "Import stored data from a JSON file in the export directory: " .. PREFIX .. "importdata <file> [skip|overwrite|replace]", function(event)
+    local path, strategy = event.args[2], event.args[3] or "skip"
+    if not path then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "importdata <file> [skip|overwrite|replace]")
+        return
+    end
+    local imported, skipped = import_data(path, strategy)
+    if not imported then
+        send_message(event.channel_id, "Import failed: " .. skipped)
+        return
+    end
+    send_message(event.channel_id, string.format("Imported %d entries from %s (%s), %d existing kept", imported, path, strategy, skipped))
+end, 0, "owner")
+
+register_command("whoregistered", "Show which scripts registered a command or hook: " .. PREFIX .. "whoregistered <name>", function(event)
+    local name = event.args[2]
+    if not name then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "whoregistered <command or hook>")
+        return
+    end
+    local found = who_registered(name)
+    if #found == 0 then
+        send_message(event.channel_id, "Nothing is registered as " .. name)
+        return
+    end
+
+    local lines = {}
+    for _, r in ipairs(found) do
+        local line = string.format("%s `%s` from %s", r.kind, r.name, r.script)
+        if r.namespace then
+            line = line .. " watching " .. r.namespace
+        end
+        if r.active then
+            line = line .. " (handles it)"
+        end
+        table.insert(lines, line)
+    end
+    send_message(event.channel_id, table.concat(lines, "\n"))
+end, 0, "owner")
+
+register_command("adddir", "Load and watch another script directory: " .. PREFIX .. "adddir <path>", function(event)
+    local path = event.args[2]
+    if not path then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "adddir <path>")
+        return
+    end
+    local loaded, failed = add_script_dir(path)
+    if not loaded then
+        send_message(event.channel_id, "Adding directory failed: " .. failed)
+        return
+    end
+    local lines = { string.format("Loaded %d script(s) from %s", loaded, path) }
+    for _, f in ipairs(failed) do
+        table.insert(lines, string.format("Failed: %s: %s", f.name, f.error))
+    end
+    send_message(event.channel_id, table.concat(lines, "\n"))
+end, 0, "owner")
+
+local MAX_LISTED_CHANGES = 10
+
+local function show_value(value)
+    if type(value) == "table" then
+        return json_encode(value)
+    end
+    return tostring(value)
+end
+
+register_command("journal", "Show recent changes to stored data: " .. PREFIX .. "journal <namespace> [key]", function(event)
+    local namespace, key = event.args[2], event.args[3]
+    if not namespace then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "journal <namespace> [key]")
+        return
+    end
+    local entries, err = store_journal(namespace, key, { limit = MAX_LISTED_CHANGES })
+    if not entries then
+        send_message(event.channel_id, "Reading the journal failed: " .. err)
+        return
+    end
+    if #entries == 0 then
+        send_message(event.channel_id, "No journaled changes to " .. namespace .. (key and ("/" .. key) or "") .. "; is it in JOURNAL_NAMESPACES?")
+        return
+    end
+
+    local lines = {}
+    for _, entry in ipairs(entries) do
+        table.insert(lines, string.format("`%d` %s %s: %s -> %s by %s%s", entry.id, os.date("!%Y-%m-%d %H:%M", entry.time), entry.key,
+            show_value(entry.old), show_value(entry.new), entry.script ~= "" and entry.script or "?",
+            entry.user_id ~= "" and (" for <@" .. entry.user_id .. ">") or ""))
+    end
+    send_message(event.channel_id, table.concat(lines, "\n"))
+end, 0, "owner")
+
+register_command("rollback", "Undo a journaled change: " .. PREFIX .. "rollback <id> [force]", function(event)
+    local id = tonumber(event.args[2] or "")
+    if not id then
+        send_message(event.channel_id, "Usage: " .. PREFIX .. "rollback <id> [force]")
+        return
+    end
+    local ok, err = store_rollback(id, { force = event.args[3] == "force" })
+    if not ok then
+        send_message(event.channel_id, "Rollback failed: " .. err)
+        return
+    end
+    send_message(event.channel_id, "Rolled back change " .. id)
+end, 0, "owner")
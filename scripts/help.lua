@@ -7,7 +7,7 @@ function handle_help(event)
         if cmd.cooldown > 0 then
             cooldownText = " (cooldown: " .. cmd.cooldown .. "s)"
         end
-        helpText = helpText .. "• `!" .. name .. "` - " .. cmd.description .. cooldownText .. "\n"
+        helpText = helpText .. "• `" .. cmd.usage .. "` - " .. cmd.description .. cooldownText .. "\n"
     end
     
     send_message(event.channel_id, helpText)
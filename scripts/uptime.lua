@@ -0,0 +1,4 @@
+register_command("uptime", "Shows how long the bot has been running", function(event)
+    local _, formatted = get_uptime()
+    send_message(event.channel_id, "Up for " .. formatted)
+end, 10)